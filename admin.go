@@ -0,0 +1,150 @@
+// admin.go
+package lancaster
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"time"
+)
+
+// How long either end of an admin socket waits on the other:
+const adminTimeout = 5 * time.Second
+
+// What an admin socket adjusts and reports on; a Server or a MultiServer:
+type AdminTarget interface {
+	SetRate(bytesPerSecond float64)
+	SetRateRange(min float64, max float64) error
+	Transfers() ([]ServerStatus, error)
+}
+
+// Sent over an admin socket, one per connection. Rates are as ParseRate reads them and each is left
+// as it is when empty.
+type AdminRequest struct {
+	SetRate string `json:"setRate,omitempty"`
+	// Range congestion control keeps the rate within:
+	MinRate string `json:"minRate,omitempty"`
+	MaxRate string `json:"maxRate,omitempty"`
+}
+
+// The reply to an AdminRequest, once any changes it asked for are applied:
+type AdminResponse struct {
+	Transfers []ServerStatus `json:"transfers"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// A served transfer as an admin socket reports it. Rates are in bytes per second.
+type ServerStatus struct {
+	HashId string `json:"hashId"`
+	Name   string `json:"name,omitempty"`
+	// Of the transfer's stream, and sent so far including retransmissions:
+	Size  int64 `json:"size"`
+	Bytes int64 `json:"bytes"`
+	// Over the last refresh:
+	Rate float64 `json:"rate"`
+	// What the send rate is held to now; 0 when unlimited:
+	RateLimit float64 `json:"rateLimit"`
+	// Range congestion control works within; 0 without it:
+	MinRate float64 `json:"minRate,omitempty"`
+	MaxRate float64 `json:"maxRate,omitempty"`
+
+	Clients          int  `json:"clients"`
+	ClientsCompleted int  `json:"clientsCompleted"`
+	Paused           bool `json:"paused"`
+}
+
+// Answers AdminRequests accepted on `l`, e.g. a Unix socket, until it is closed. Returns the error
+// that stopped it accepting.
+func ServeAdmin(l net.Listener, target AdminTarget, log *Logger) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveAdminConn(conn, target, log)
+	}
+}
+
+func serveAdminConn(conn net.Conn, target AdminTarget, log *Logger) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	req := AdminRequest{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Warnf("Admin socket: %s", err)
+		return
+	}
+	resp := AdminResponse{}
+	if err := applyAdminRequest(target, req, log); err != nil {
+		resp.Error = err.Error()
+	}
+	transfers, err := target.Transfers()
+	if err != nil && resp.Error == "" {
+		resp.Error = err.Error()
+	}
+	resp.Transfers = transfers
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Warnf("Admin socket: %s", err)
+	}
+}
+
+// Checks every rate before changing any of them:
+func applyAdminRequest(target AdminTarget, req AdminRequest, log *Logger) error {
+	rates := [3]float64{}
+	for i, s := range []string{req.SetRate, req.MinRate, req.MaxRate} {
+		if s == "" {
+			continue
+		}
+		r, err := ParseRate(s)
+		if err != nil {
+			return err
+		}
+		if i > 0 && math.IsInf(r, 1) {
+			// Congestion control needs a range to work within:
+			return ErrBadRate
+		}
+		rates[i] = r
+	}
+
+	if rates[1] != 0 || rates[2] != 0 {
+		if err := target.SetRateRange(rates[1], rates[2]); err != nil {
+			return err
+		}
+		log.Infof("Admin socket set the congestion control range to min %s, max %s", adminRate(req.MinRate), adminRate(req.MaxRate))
+	}
+	if rates[0] != 0 {
+		target.SetRate(rates[0])
+		log.Infof("Admin socket set the rate to %s", req.SetRate)
+	}
+	return nil
+}
+
+func adminRate(s string) string {
+	if s == "" {
+		return "unchanged"
+	}
+	return s
+}
+
+// Sends `req` to the admin socket at `path` and returns what the server made of it:
+func QueryAdmin(path string, req AdminRequest) (AdminResponse, error) {
+	resp := AdminResponse{}
+	conn, err := net.DialTimeout("unix", path, adminTimeout)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, err
+	}
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
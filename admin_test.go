@@ -0,0 +1,62 @@
+package lancaster
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeAdminTarget struct {
+	rate     float64
+	min, max float64
+}
+
+func (f *fakeAdminTarget) SetRate(bytesPerSecond float64) {
+	f.rate = bytesPerSecond
+}
+
+func (f *fakeAdminTarget) SetRateRange(min float64, max float64) error {
+	f.min, f.max = min, max
+	return nil
+}
+
+func (f *fakeAdminTarget) Transfers() ([]ServerStatus, error) {
+	return []ServerStatus{{HashId: "0102", RateLimit: f.rate}}, nil
+}
+
+func TestAdminSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("no Unix sockets: %s", err)
+	}
+	defer l.Close()
+	target := &fakeAdminTarget{}
+	go ServeAdmin(l, target, defaultLogger())
+
+	resp, err := QueryAdmin(path, AdminRequest{SetRate: "5MB", MaxRate: "40Mbps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.rate != 5000000 || target.min != 0 || target.max != 5000000 {
+		t.Fatalf("unexpected rates %+v", target)
+	}
+	if len(resp.Transfers) != 1 || resp.Transfers[0].RateLimit != 5000000 {
+		t.Fatalf("expected status after the change got %+v", resp.Transfers)
+	}
+
+	// Nothing changes unless every rate is good:
+	if _, err = QueryAdmin(path, AdminRequest{SetRate: "1MB", MinRate: "unlimited"}); err == nil || err.Error() != ErrBadRate.Error() {
+		t.Fatalf("expected ErrBadRate got %v", err)
+	}
+	if target.rate != 5000000 {
+		t.Fatalf("expected the rate to stay put got %v", target.rate)
+	}
+}
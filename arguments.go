@@ -0,0 +1,284 @@
+// arguments.go
+package lancaster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Entries of every tar archive in `args`, e.g. to serve with --from-tar:
+func BuildTarArchives(args []string, compat bool) ([]*TarballFile, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Require tar archives to serve")
+	}
+
+	files := []*TarballFile(nil)
+	for _, arg := range args {
+		entries, err := tarArchiveFiles(arg, compat)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, entries...)
+	}
+	return files, nil
+}
+
+// Lists the files to serve for command line style arguments; see below for their syntax.
+// Directory walks skip entries whose name matches one of `excludes`; explicitly named paths are always kept.
+// With `includeDirs` recursive walks also list directories as entries so their modes are transferred.
+// With `emptyDirs` empty directories are always listed so they are recreated even without any contents.
+// With `strip` that many leading components are dropped from paths, as tar's --strip-components.
+// `hidden` selects whether walks skip or only keep dot-prefixed entries, after `excludes` are applied.
+func BuildTarball(args []string, excludes []string, includeDirs bool, emptyDirs bool, strip int, hidden HiddenMode) ([]*TarballFile, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Require arguments to specify which files to serve")
+	}
+
+	// directory name ending with ":::subdir" means to add recursively into subdir (or root).
+	// directory name ending with "::subdir" means to add non-recursively into subdir (or root).
+	// file name ending with "::alias" means to rename file.
+	//
+	// for directories:
+	// "../asdf" -> "/*"
+	// "../asdf::asdf" -> "/asdf/*"
+	// "../asdf:::asdf" -> "/asdf/**" (recursively)
+	// "/abs/path" => "/*"
+	// "/abs/path::" => "/*"
+	// "/abs/path:::" => "/**" (recursively)
+	//
+	// for files:
+	// "hjkl" -> "/hjkl"
+	// "hjkl::" -> "/hjkl"
+	// "hjkl::asdf" -> "/asdf"
+	// "/abs/path/hjkl" -> "/hjkl"
+	//
+	// for standard input:
+	// "-" -> "/stdin"
+	// "-::asdf" -> "/asdf"
+	//
+	// stripping components applies to paths found walking a directory, before prepending any subdir, and
+	// to files not renamed; entries left with nothing are skipped though walks still descend into them:
+	// "build:::" with 1 stripped: "build/out/a/b" -> "/a/b" and "build/out/c" -> "/c"
+	// "build:::dist" with 1 stripped: "build/out/c" -> "/dist/c"
+	// "build/out/c" with 1 stripped -> "/out/c", keeping the components not stripped rather than only the name
+	// "build/out/c::c" -> "/c" whatever is stripped
+
+	files := make([]*TarballFile, 0, len(args))
+	readStdin := false
+	for _, a := range args {
+		localPath, subdir, isRecursive := SplitArgument(a)
+
+		if localPath == StdinArg && !isRecursive {
+			if readStdin {
+				RemoveSpooled(files)
+				return nil, ErrStdinTwice
+			}
+			readStdin = true
+
+			tf, err := spoolStdin(os.Stdin, subdir)
+			if err != nil {
+				RemoveSpooled(files)
+				return nil, err
+			}
+			files = append(files, tf)
+			continue
+		}
+
+		stat, err := os.Lstat(localPath)
+		if err != nil {
+			fmt.Printf("%s\n", err)
+			// Skip file due to error:
+			continue
+		}
+
+		if stat.IsDir() {
+			localPath, err := filepath.Abs(localPath)
+			if err != nil {
+				fmt.Printf("%s\n", err)
+				continue
+			}
+
+			// Walk directory tree:
+			filepath.Walk(localPath, func(fullPath string, info os.FileInfo, err error) error {
+				// Skip starting directory entry:
+				if fullPath == localPath {
+					return nil
+				}
+
+				// Translate to relative path with '/'s:
+				relPath := filepath.ToSlash(fullPath[len(localPath)+1:])
+
+				// Prepend subdir:
+				tarPath := relPath
+				if subdir != "" {
+					tarPath = subdir + "/" + tarPath
+				}
+
+				// Skip excluded entries and anything beneath them:
+				if isExcluded(tarPath, info.IsDir(), excludes) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				// Skip hidden entries and anything beneath them:
+				if hidden == SkipHidden && strings.HasPrefix(info.Name(), ".") {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				// Allow/prevent recursion accordingly:
+				if info.IsDir() {
+					if !isRecursive {
+						return filepath.SkipDir
+					}
+					if !includeDirs && !(emptyDirs && isEmptyDir(fullPath)) {
+						return nil
+					}
+				}
+
+				// Only hidden entries are listed, though walks still descend into other directories to find them:
+				if hidden == OnlyHidden && !isHidden(relPath) {
+					return nil
+				}
+
+				// Only what is left after stripping is served, under subdir:
+				if strip > 0 {
+					stripped, ok := stripComponents(relPath, strip)
+					if !ok {
+						return nil
+					}
+					tarPath = stripped
+					if subdir != "" {
+						tarPath = subdir + "/" + tarPath
+					}
+				}
+
+				// Add file to virtual tarball list (directories carry no contents):
+				size := info.Size()
+				if info.IsDir() {
+					size = 0
+				}
+				tf := &TarballFile{
+					Path:      tarPath,
+					LocalPath: fullPath,
+					Size:      size,
+					Mode:      recordedMode(info),
+					ModTime:   info.ModTime(),
+				}
+				tf.Uid, tf.Gid, tf.HasOwner = fileOwner(info)
+				files = append(files, tf)
+				return nil
+			})
+		} else {
+			tarPath := filepath.Base(localPath)
+			if subdir != "" {
+				// Rename file:
+				tarPath = subdir
+			} else if strip > 0 {
+				stripped, ok := stripComponents(filepath.ToSlash(localPath), strip)
+				if !ok {
+					fmt.Printf("%s: nothing left after stripping %d components\n", localPath, strip)
+					continue
+				}
+				tarPath = stripped
+			}
+
+			// Add file to virtual tarball list:
+			tf := &TarballFile{
+				Path:      tarPath,
+				LocalPath: localPath,
+				Size:      stat.Size(),
+				Mode:      recordedMode(stat),
+				ModTime:   stat.ModTime(),
+			}
+			tf.Uid, tf.Gid, tf.HasOwner = fileOwner(stat)
+			files = append(files, tf)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files to serve")
+	}
+
+	// Stripping can bring directories from different places together; they only carry a mode so the first wins:
+	if strip > 0 {
+		files = dedupeDirs(files)
+	}
+
+	// Send the contents of hard linked files once:
+	linkHardlinks(files)
+
+	return files, nil
+}
+
+// Drops the first `n` components of a slash separated path; false when nothing is left:
+func stripComponents(p string, n int) (string, bool) {
+	for ; n > 0; n-- {
+		i := strings.IndexByte(p, '/')
+		if i < 0 {
+			return "", false
+		}
+		p = p[i+1:]
+	}
+	return p, p != ""
+}
+
+// Keeps the first directory entry for each path. Files colliding are left for the reader to refuse:
+func dedupeDirs(files []*TarballFile) []*TarballFile {
+	seen := make(map[string]bool)
+	o := files[:0]
+	for _, tf := range files {
+		if tf.Mode.IsDir() {
+			if seen[tf.Path] {
+				continue
+			}
+			seen[tf.Path] = true
+		}
+		o = append(o, tf)
+	}
+	return o
+}
+
+// Splits a serve argument into its local path and the subdir or name it is served under:
+func SplitArgument(a string) (localPath string, subdir string, isRecursive bool) {
+	// let "a::b" specify path 'a' with subdir 'b':
+	// e.g. "../hello::hello"
+	if sep := strings.LastIndex(a, ":::"); sep > 0 {
+		return a[:sep], a[sep+3:], true
+	}
+	if sep := strings.LastIndex(a, "::"); sep > 0 {
+		return a[:sep], a[sep+2:], false
+	}
+	return a, "", false
+}
+
+// Names a transfer served on its own after its argument, e.g. "../photos:::" -> "photos":
+func ArgumentName(arg string) string {
+	if sep := strings.LastIndex(arg, "::"); sep > 0 {
+		if name := strings.TrimPrefix(arg[sep+2:], ":"); name != "" {
+			return name
+		}
+		arg = strings.TrimRight(arg[:sep], ":")
+	}
+	if arg == StdinArg {
+		return DefaultStdinName
+	}
+	return filepath.Base(arg)
+}
+
+func isEmptyDir(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
@@ -0,0 +1,133 @@
+package lancaster
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStripComponents(t *testing.T) {
+	cases := []struct {
+		path     string
+		n        int
+		expected string
+		ok       bool
+	}{
+		{"a/b/c", 0, "a/b/c", true},
+		{"a/b/c", 1, "b/c", true},
+		{"a/b/c", 2, "c", true},
+		{"a/b/c", 3, "", false},
+		{"a", 1, "", false},
+		{"a/", 1, "", false},
+	}
+	for _, c := range cases {
+		actual, ok := stripComponents(c.path, c.n)
+		if actual != c.expected || ok != c.ok {
+			t.Fatalf("%q stripping %d: expected %q %v got %q %v", c.path, c.n, c.expected, c.ok, actual, ok)
+		}
+	}
+}
+
+func TestBuildTarball_StripComponents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"out/a/b.txt", "out/c.txt", "top.txt", "x/sub/d.txt", "y/sub/e.txt", "x/sub/f.txt", "y/sub/f.txt"} {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := filepath.Join(dir, "out")
+
+	cases := []struct {
+		args        []string
+		includeDirs bool
+		strip       int
+		expected    []string
+	}{
+		{[]string{out + ":::"}, false, 0, []string{"a/b.txt", "c.txt"}},
+		// Entries with nothing left are skipped but walked into:
+		{[]string{out + ":::"}, false, 1, []string{"b.txt"}},
+		// Stripping comes before the subdir is prepended:
+		{[]string{out + ":::dist"}, false, 1, []string{"dist/b.txt"}},
+		// Renamed files keep their name:
+		{[]string{filepath.Join(out, "c.txt") + "::c.txt"}, false, 5, []string{"c.txt"}},
+		// Directories brought together by stripping are listed once:
+		{[]string{dir + ":::"}, true, 2, []string{"b.txt", "d.txt", "e.txt", "f.txt", "f.txt"}},
+		{[]string{dir + ":::"}, true, 1, []string{"a", "a/b.txt", "c.txt", "sub", "sub/d.txt", "sub/e.txt", "sub/f.txt", "sub/f.txt"}},
+	}
+	for i, c := range cases {
+		files, err := BuildTarball(c.args, nil, c.includeDirs, false, c.strip, IncludeHidden)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		if actual := tarballPaths(files); !reflect.DeepEqual(actual, c.expected) {
+			t.Fatalf("%d: expected %v got %v", i, c.expected, actual)
+		}
+	}
+
+	// Files brought together by stripping are refused rather than one silently winning:
+	files, err := BuildTarball([]string{dir + ":::"}, nil, false, false, 2, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewVirtualTarballReader(files, getOptions()); !errors.Is(err, ErrDuplicatePaths) {
+		t.Fatalf("expected ErrDuplicatePaths got %v", err)
+	}
+}
+
+func TestBuildTarball_BareFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-bare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	abs := filepath.Join(dir, "a", "b", "foo.bin")
+	if err = os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(abs, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	rel := filepath.Join("a", "b", "foo.bin")
+
+	cases := []struct {
+		arg      string
+		strip    int
+		expected string
+	}{
+		// Served under its name wherever it is:
+		{abs, 0, "foo.bin"},
+		{rel, 0, "foo.bin"},
+		{abs + "::", 0, "foo.bin"},
+		{abs + "::bar.bin", 0, "bar.bin"},
+		// Stripping keeps the components left over:
+		{rel, 1, "b/foo.bin"},
+	}
+	for _, c := range cases {
+		files, err := BuildTarball([]string{c.arg}, nil, false, false, c.strip, IncludeHidden)
+		if err != nil {
+			t.Fatalf("%s: %s", c.arg, err)
+		}
+		if len(files) != 1 || files[0].Path != c.expected {
+			t.Fatalf("%s: expected '%s' got %v", c.arg, c.expected, tarballPaths(files))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// bandwidth.go
+package lancaster
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+import "github.com/dustin/go-humanize"
+
+var ErrBadRate = errors.New("bad rate; expected e.g. 500KB, 5MB/s, 40Mbps or unlimited")
+
+var bitRateSuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"Gbps", 1000 * 1000 * 1000},
+	{"Mbps", 1000 * 1000},
+	{"kbps", 1000},
+	{"Kbps", 1000},
+	{"bps", 1},
+}
+
+// Parses a bandwidth into bytes per second. Bit rates end in "bps" (e.g. "40Mbps"), anything else is
+// parsed as a byte size per second (e.g. "5MB", "5MB/s", "512KiB"). Zero or "unlimited" returns +Inf.
+func ParseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "unlimited" {
+		return math.Inf(1), nil
+	}
+
+	bytesPerSecond := float64(0)
+	isBits := false
+	for _, b := range bitRateSuffixes {
+		if strings.HasSuffix(s, b.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, b.suffix)), 64)
+			if err != nil {
+				return 0, ErrBadRate
+			}
+			bytesPerSecond = n * b.multiplier / 8
+			isBits = true
+			break
+		}
+	}
+	if !isBits {
+		n, err := humanize.ParseBytes(strings.TrimSuffix(s, "/s"))
+		if err != nil {
+			return 0, ErrBadRate
+		}
+		bytesPerSecond = float64(n)
+	}
+
+	if bytesPerSecond < 0 {
+		return 0, ErrBadRate
+	}
+	if bytesPerSecond == 0 {
+		return math.Inf(1), nil
+	}
+	return bytesPerSecond, nil
+}
@@ -0,0 +1,40 @@
+package lancaster
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected float64
+	}{
+		{"5MB", 5 * 1000 * 1000},
+		{"5MB/s", 5 * 1000 * 1000},
+		{"512KiB", 512 * 1024},
+		{"40Mbps", 5 * 1000 * 1000},
+		{"800kbps", 100 * 1000},
+		{"1Gbps", 125 * 1000 * 1000},
+		{"1000", 1000},
+		{"unlimited", math.Inf(1)},
+		{"0", math.Inf(1)},
+	}
+	for _, tt := range tests {
+		actual, err := ParseRate(tt.in)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.in, err)
+		}
+		if actual != tt.expected {
+			t.Fatalf("%s: expected %v got %v", tt.in, tt.expected, actual)
+		}
+	}
+}
+
+func TestParseRate_Bad(t *testing.T) {
+	for _, in := range []string{"fast", "MBps", "-5Mbps"} {
+		if _, err := ParseRate(in); err != ErrBadRate {
+			t.Fatalf("%s: expected ErrBadRate got %v", in, err)
+		}
+	}
+}
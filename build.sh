@@ -1,3 +1,3 @@
 #!/bin/bash
-GOOS=darwin go build -o lancaster
-GOOS=windows GOARCH=amd64 go build -o lancaster.exe
+GOOS=darwin go build -o lancaster ./cmd/lancaster
+GOOS=windows GOARCH=amd64 go build -o lancaster.exe ./cmd/lancaster
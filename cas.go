@@ -0,0 +1,96 @@
+// cas.go
+package lancaster
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrBadDescriptor = errors.New("bad descriptor")
+	ErrCorruptBlob   = errors.New("blob does not match its hash")
+)
+
+// Descriptor describes a tarball's layout independent of where its content lives:
+//
+//	{"files": [{"path": "a/b.txt", "size": 5, "mode": 420, "hash": "<hex sha256>"}, ...]}
+type Descriptor struct {
+	Files []DescriptorFile `json:"files"`
+}
+
+type DescriptorFile struct {
+	Path string      `json:"path"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+	Hash string      `json:"hash"`
+}
+
+func LoadDescriptor(path string) (*Descriptor, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Descriptor{}
+	if err = json.Unmarshal(b, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Maps each file in the descriptor to its blob in a content-addressed store laid out as `store/<hash>`.
+// Identical files across versions share a blob so any version described can be served cheaply. Every
+// blob is hashed once up front so a corrupted store is never served.
+func CASTarballFiles(store string, d *Descriptor) ([]*TarballFile, error) {
+	files := make([]*TarballFile, 0, len(d.Files))
+	verified := make(map[string]bool)
+	for _, df := range d.Files {
+		if df.Mode&os.ModeType != 0 {
+			return nil, fmt.Errorf("%w: '%s' is not a regular file", ErrBadDescriptor, df.Path)
+		}
+		hash, err := hex.DecodeString(df.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%w: '%s' has bad hash '%s'", ErrBadDescriptor, df.Path, df.Hash)
+		}
+
+		// Blob must exist and agree with the descriptor:
+		blob := filepath.Join(store, df.Hash)
+		stat, err := os.Stat(blob)
+		if err != nil {
+			return nil, err
+		}
+		if stat.Size() != df.Size {
+			return nil, fmt.Errorf("%w: blob %s for '%s' is %d bytes; expected %d", ErrBadDescriptor, df.Hash, df.Path, stat.Size(), df.Size)
+		}
+		if !verified[blob] {
+			h, err := hashFile(blob, HashSHA256)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(h, hash) {
+				return nil, fmt.Errorf("%w: %s", ErrCorruptBlob, df.Hash)
+			}
+			verified[blob] = true
+		}
+
+		files = append(files, &TarballFile{
+			Path:      df.Path,
+			LocalPath: blob,
+			Size:      df.Size,
+			Mode:      df.Mode,
+			Hash:      hash,
+		})
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no files to serve")
+	}
+
+	return files, nil
+}
@@ -0,0 +1,91 @@
+package lancaster
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testBlobHash = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+func newTestStore(t *testing.T) string {
+	store, err := ioutil.TempDir("", "lancaster-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(store, testBlobHash), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestCASTarballFiles(t *testing.T) {
+	store := newTestStore(t)
+	defer os.RemoveAll(store)
+
+	// Same blob backs two versions of a file:
+	d := &Descriptor{Files: []DescriptorFile{
+		{Path: "v1/hello.txt", Size: 6, Mode: 0644, Hash: testBlobHash},
+		{Path: "v2/hello.txt", Size: 6, Mode: 0644, Hash: testBlobHash},
+	}}
+	files, err := CASTarballFiles(store, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tb := newTarballReader(t, files)
+	defer tb.Close()
+
+	buf := make([]byte, tb.size)
+	n, err := tb.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello\n\x00hello\n\x00" {
+		t.Fatalf("unexpected contents %q", buf[:n])
+	}
+}
+
+func TestCASTarballFiles_SizeMismatch(t *testing.T) {
+	store := newTestStore(t)
+	defer os.RemoveAll(store)
+
+	d := &Descriptor{Files: []DescriptorFile{
+		{Path: "hello.txt", Size: 7, Mode: 0644, Hash: testBlobHash},
+	}}
+	if _, err := CASTarballFiles(store, d); !errors.Is(err, ErrBadDescriptor) {
+		t.Fatalf("expected %v got %v", ErrBadDescriptor, err)
+	}
+}
+
+func TestCASTarballFiles_MissingBlob(t *testing.T) {
+	store := newTestStore(t)
+	defer os.RemoveAll(store)
+
+	d := &Descriptor{Files: []DescriptorFile{
+		{Path: "hello.txt", Size: 6, Mode: 0644, Hash: strings.Repeat("00", sha256.Size)},
+	}}
+	if _, err := CASTarballFiles(store, d); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist error got %v", err)
+	}
+}
+
+func TestCASTarballFiles_CorruptBlob(t *testing.T) {
+	store := newTestStore(t)
+	defer os.RemoveAll(store)
+
+	// Same size, different contents:
+	if err := ioutil.WriteFile(filepath.Join(store, testBlobHash), []byte("HELLO\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := &Descriptor{Files: []DescriptorFile{
+		{Path: "hello.txt", Size: 6, Mode: 0644, Hash: testBlobHash},
+	}}
+	if _, err := CASTarballFiles(store, d); !errors.Is(err, ErrCorruptBlob) {
+		t.Fatalf("expected %v got %v", ErrCorruptBlob, err)
+	}
+}
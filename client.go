@@ -1,13 +1,21 @@
 // client.go
-package main
+package lancaster
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 import "github.com/dustin/go-humanize"
@@ -19,55 +27,240 @@ const (
 	ExpectMetadataHeader
 	ExpectMetadataSections
 	ExpectDataSections
+	// Fetching hashes of the blocks of each file's contents, with ClientOptions.BlockHashes:
+	ExpectBlockHashes
 	Done
+	// Metadata couldn't be used; Run returns the error:
+	Failed
 )
 
+var clientStateNames = []string{"ExpectAnnouncement", "ExpectMetadataHeader", "ExpectMetadataSections", "ExpectDataSections", "ExpectBlockHashes", "Done", "Failed"}
+
+func (s ClientState) String() string {
+	if s < ExpectAnnouncement || s > Failed {
+		return fmt.Sprintf("ClientState(%d)", int(s))
+	}
+	return clientStateNames[s]
+}
+
 type Client struct {
 	m  *Multicast
 	tb *VirtualTarballWriter
 
 	options ClientOptions
+	log     *Logger
 
 	state       ClientState
 	resendTimer <-chan time.Time
 
 	hashId               []byte
+	lastDiscover         time.Time
+	discoveries          int
+	announcedSections    uint16
 	metadataSectionCount uint16
 	metadataSections     [][]byte
 	nextSectionIndex     uint16
+	// What the metadata sections must hash to, from headers carrying it:
+	metadataDigest []byte
+	// Hashes of each file's blocks by index into tb.files, and the file they are being fetched for:
+	blockHashes [][]byte
+	hashFile    int
+
+	// Server address joined source-specifically; messages from others are ignored:
+	source net.IP
+	// Group our transfer's data is announced on when not the shared one:
+	dataGroup net.IP
 
 	nakRegions *NakRegions
-	lastAck    Region
+	// Writes regions off the receive path when enabled; nakRegions then tracks what has been received
+	// and the pool what has been written:
+	writes  *writePool
+	lastAck Region
+	// Server accepts RequestDataRegions rather than only AckDataSection:
+	listsRegions bool
+
+	// Data regions arrive compressed into a spool file that is decompressed once complete:
+	compression Compression
+	streamSize  int64
+	spool       *os.File
+	// Data messages trail a checksum to verify before accepting them:
+	checksummed bool
+
+	// Rebuilds lost regions from parity when the server sends FEC:
+	fec       FEC
+	shardSize int64
+	decoder   *fecDecoder
+
+	// Backs off requests when our own consumption appears to cause loss:
+	polite *politeWindow
+
+	metrics *Metrics
+	events  *EventLog
+
+	// Requests for data asked for within minAskInterval of the last wait for this to fire:
+	lastAsk  time.Time
+	askTimer <-chan time.Time
+
+	// Round-trip measurement from requesting a region to its data arriving:
+	rtt         rttEstimator
+	sendTimes   *regionSendTimes
+	controlSent controlSendTime
+
+	// Transfers seen while listing:
+	announced      []AnnouncementEntry
+	listChunksSeen map[uint16]bool
 
 	bytesReceived     int64
+	bytesRecovered    int64
 	lastBytesReceived int64
 	lastTime          time.Time
+	// When bytesReceived last grew or the state moved on; StallTimeout counts from here:
+	stallBytes   int64
+	lastProgress time.Time
+	// Receive rate smoothed across refreshes for the ETA:
+	smoothedRate float64
+	// Fastest a full refresh interval received at:
+	peakRate float64
+
+	retransmitRequests int64
+	duplicatePackets   int64
+	ignoredPackets     int64
 
 	startTime time.Time
 	endTime   time.Time
+
+	// Closed by Stop to make Run clean up and return:
+	quit     chan empty
+	quitOnce sync.Once
+
+	// Each refresh's progress goes to every subscriber in turn; printing the bandwidth line is the first:
+	subscribers []func(ProgressEvent)
+	progress    progressEvents
+	// Files already reported complete, by index into tb.files:
+	reported []bool
+	// What had arrived of each file before following the transfer to a new hashId, kept once the new
+	// metadata shows which files are unchanged:
+	carried map[string]carriedFile
 }
 
+var ErrStalled = errors.New("no progress within the stall timeout")
+var ErrNoTransfer = errors.New("no transfer found")
+
+// Missing ranges a client tracks before merging the closest together, so heavy loss can't grow the
+// list and the memory it takes without bound:
+const DefaultMaxNakRegions = 4096
+
+// Past this many times MaxNakRegions ranges are merged as data arrives rather than at the next refresh,
+// and the loss is bad enough to warn about:
+const nakRegionsHardFactor = 4
+
 type ClientOptions struct {
 	TarballOptions VirtualTarballOptions
 	HashId         []byte
 	StorePath      string
 	RefreshRate    time.Duration
+	// Stop once metadata is received without downloading any data:
+	MetadataOnly bool
+	// Back off when loss suggests we are congesting a shared link at the cost of transfer speed:
+	BePolite bool
+	// Only collect announced transfers and stop without downloading:
+	ListOnly bool
+	// Only trust announcements and metadata headers signed by this key:
+	PublicKey ed25519.PublicKey
+	// Where messages go; info level text on stdout when nil:
+	Logger *Logger
+	// Don't print the bandwidth line:
+	Quiet bool
+	// Counters to expose for scraping; nil when disabled:
+	Metrics *Metrics
+	// How the bandwidth line is rendered:
+	Progress ProgressMode
+	// Goroutines writing received data to disk; 0 writes on the receive path itself:
+	WriteWorkers int
+	// Received regions waiting to be written before receiving blocks; 0 picks a default per worker:
+	WriteQueue int
+	// Give up with ErrStalled once nothing has arrived for this long, as when the server went away;
+	// unlike the resend timeout this spans however many requests go unanswered. 0 waits forever:
+	StallTimeout time.Duration
+	// Request missing regions starting from a random one rather than the first so clients missing the
+	// same holes don't all ask for the same region at once. Only has an effect when the request can't
+	// list every hole: with BePolite's window, or more holes than fit in a control message:
+	RandomNaks bool
+	// Only receive from the server at this address, joining source-specifically where supported and
+	// ignoring anyone else on the group otherwise:
+	Source net.IP
+	// Learn Source from the server's source announcement, signed by PublicKey when set:
+	DiscoverSource bool
+	// Missing ranges tracked before the closest are merged, asking again for what arrived between them;
+	// DefaultMaxNakRegions when 0:
+	MaxNakRegions int
+	// Hash files already on disk before asking for data and keep those matching the metadata, so only
+	// what changed since an earlier version comes over the wire:
+	Delta bool
+	// Give up with ErrNoTransfer when no server has announced the transfer for this long, as when none
+	// was started. 0 waits forever:
+	DiscoverWait time.Duration
+	// Give up with ErrNoTransfer once this many discovery requests, sent again each announce interval,
+	// have gone unanswered. 0 keeps asking:
+	DiscoverRetries int
+	// Where state changes, control messages, acked regions and errors are recorded; nil when disabled:
+	Events *EventLog
+	// With MetadataOnly, also fetch hashes of the blocks of every regular file's contents for VerifyTree
+	// to find which parts of files on disk differ:
+	BlockHashes bool
 }
 
+// How long a listing client waits for announcements before giving up on a complete combined list:
+const listWait = 3 * DefaultAnnounceInterval
+
 func NewClient(m *Multicast, options ClientOptions) *Client {
 	if options.RefreshRate <= time.Duration(0) {
 		options.RefreshRate = time.Second
 	}
+	if options.Logger == nil {
+		options.Logger = defaultLogger()
+	}
+	if options.MaxNakRegions <= 0 {
+		options.MaxNakRegions = DefaultMaxNakRegions
+	}
 
-	return &Client{
-		m:       m,
-		options: options,
-		state:   ExpectAnnouncement,
-		hashId:  options.HashId,
+	c := &Client{
+		m:         m,
+		options:   options,
+		log:       options.Logger,
+		metrics:   options.Metrics,
+		events:    options.Events,
+		state:     ExpectAnnouncement,
+		hashId:    options.HashId,
+		sendTimes: newRegionSendTimes(),
+		quit:      make(chan empty),
+		progress:  make(progressEvents, progressBacklog),
 	}
+	c.subscribers = []func(ProgressEvent){c.printBandwidth, c.progress.publish}
+	if options.BePolite {
+		c.polite = newPoliteWindow()
+	}
+	return c
+}
+
+// Progress of a download, closed once Run has returned. Nothing is published while only listing or
+// fetching metadata besides the final event.
+func (c *Client) Progress() <-chan ProgressEvent {
+	return c.progress
 }
 
 func (c *Client) Run() error {
+	err := c.run()
+
+	// Everything not yet reported is complete once the download is:
+	e := c.progressEvent(0, c.downloads() && c.state == Done && err == nil)
+	e.Done, e.Err = true, err
+	c.progress.publish(e)
+	close(c.progress)
+	return err
+}
+
+func (c *Client) run() error {
 	err := error(nil)
 
 	err = c.m.SendsControlToServer()
@@ -82,27 +275,50 @@ func (c *Client) Run() error {
 	if err != nil {
 		return err
 	}
+	if c.options.Source != nil {
+		if err = c.joinSource(c.options.Source); err != nil {
+			return err
+		}
+	}
+	if r, _, err := c.m.DataBufferSizes(); err == nil {
+		logBufferSize(c.log, "Receive", r, c.m.bufferSize(c.m.readBufferSize, c.m.recvDataCount), "net.core.rmem_max")
+	}
 
 	logError := func(err error) {
 		if err == nil {
 			return
 		}
-		fmt.Fprintf(os.Stderr, "%s\n", err)
+		c.log.Errorf("%s", err)
+		c.events.error(err)
 	}
 
 	// Start by expecting an announcment message:
 	c.state = ExpectAnnouncement
+	c.events.state(c.state)
+
+	// Ask servers to announce now instead of waiting for their next interval:
+	logError(c.discover())
 
 	// Start ticking every second to measure bandwidth:
 	refreshTimer := time.Tick(c.options.RefreshRate)
 	c.lastTime = time.Now()
 	c.startTime = c.lastTime
 	c.lastBytesReceived = 0
+	c.lastProgress = c.lastTime
 
 	// Send NAKs at a regular rate:
 	c.resendTimer = time.Tick(resendTimeout)
 
+	// Listing stops after a while even if no combined announcement arrives:
+	listTimer := (<-chan time.Time)(nil)
+	if c.options.ListOnly {
+		listTimer = time.After(listWait)
+	}
+
 	// Main message loop:
+	stalled, notFound := false, false
+	// Set once received data couldn't be written, which ends the download:
+	writeErr := error(nil)
 loop:
 	for {
 		select {
@@ -110,8 +326,22 @@ loop:
 			if msg.Error != nil {
 				return msg.Error
 			}
+			if msg, err = c.m.OpenControl(msg); err != nil || !c.fromSource(msg) {
+				// Not from a server holding our key, or not from our server:
+				msg.Release()
+				continue
+			}
 
 			err = c.processControl(msg)
+			msg.Release()
+			if errors.Is(err, ErrWriteFailed) {
+				writeErr = err
+				break loop
+			}
+			if c.fatal(err) {
+				c.events.error(err)
+				return err
+			}
 			logError(err)
 			if c.state == Done {
 				break loop
@@ -121,8 +351,18 @@ loop:
 			if msg.Error != nil {
 				return msg.Error
 			}
+			if msg, err = c.m.OpenData(msg); err != nil || !c.fromSource(msg) {
+				c.ignoredPackets++
+				msg.Release()
+				continue
+			}
 
 			err = c.processData(msg)
+			if errors.Is(err, ErrWriteFailed) {
+				// Keep what did reach the disk and its progress to resume from:
+				writeErr = err
+				break loop
+			}
 			logError(err)
 			if c.state == Done {
 				break loop
@@ -136,34 +376,342 @@ loop:
 				break loop
 			}
 
+		case <-c.askTimer:
+			// Send the requests coalesced since the last:
+			c.askTimer = nil
+			logError(c.ask())
+			if c.state == Done {
+				break loop
+			}
+
+		case <-listTimer:
+			c.setState(Done)
+			break loop
+
+		case <-c.quit:
+			// Leave what was written and its progress to resume from:
+			break loop
+
 		case <-refreshTimer:
 			// Measure and report receive-bandwidth:
-			c.reportBandwidth()
+			if c.downloads() {
+				c.boundNaks()
+				c.reportBandwidth()
+			}
+			logError(c.saveProgress())
 
 			if c.state == Done {
 				break loop
 			}
+			if c.notFound(time.Now()) {
+				notFound = true
+				break loop
+			}
+			if c.stalled(time.Now()) {
+				// Keep what was written and its progress to resume from once the server is back:
+				stalled = true
+				break loop
+			}
 		}
 	}
 
-	// Final report:
-	c.reportBandwidth()
-	fmt.Println()
+	if c.downloads() {
+		// Final report:
+		c.reportBandwidth()
+		printProgress(c.options.Quiet, "\n")
 
-	// Elapsed time:
-	c.endTime = time.Now()
-	diff := c.endTime.Sub(c.startTime)
-	fmt.Printf("%v elapsed %15s/s avg\n", diff, humanize.IBytes(uint64(float64(c.bytesReceived)/diff.Seconds())))
+		c.endTime = time.Now()
+		c.Stats().report(c.log)
+	}
+
+	// Let queued writes finish before anything is closed:
+	if c.writes != nil {
+		logError(c.writes.wait())
+	}
+
+	// Drop a partially received compressed stream:
+	c.closeSpool()
+
+	// Remember what we have for next time:
+	logError(c.saveProgress())
 
 	// Close virtual tarball writer:
 	if c.tb != nil {
 		if err := c.tb.Close(); err != nil {
+			// Leave the group before reporting files that failed verification:
+			logError(c.m.Close())
 			return err
 		}
+		if c.tb.OwnersSkipped() {
+			c.log.Warnf("Not running as root; downloaded files keep your ownership (use --no-owner to silence)")
+		}
 	}
 
 	// Close multicast sockets:
-	return c.m.Close()
+	if err := c.m.Close(); err != nil {
+		return err
+	}
+	if writeErr != nil {
+		c.events.error(writeErr)
+		return writeErr
+	}
+	if stalled {
+		return ErrStalled
+	}
+	if notFound {
+		return ErrNoTransfer
+	}
+	return nil
+}
+
+// Whether Run should give up on an error processing a control message rather than log it and carry on.
+// Waiting won't fix any of these; a server sending unsafe paths or garbage is not one to keep talking to,
+// a full disk stays full and metadata that can't be used leaves nothing to download against:
+func (c *Client) fatal(err error) bool {
+	if err == nil {
+		return false
+	}
+	return c.state == Failed || err == ErrEncrypted || errors.Is(err, ErrBadPath) || errors.Is(err, ErrBadMetadata) || errors.Is(err, ErrInsufficientSpace)
+}
+
+// Whether nothing has arrived for StallTimeout. A slow transfer keeps going as long as it moves at all:
+func (c *Client) stalled(now time.Time) bool {
+	if c.bytesReceived != c.stallBytes {
+		c.stallBytes, c.lastProgress = c.bytesReceived, now
+	}
+	return c.options.StallTimeout > 0 && now.Sub(c.lastProgress) >= c.options.StallTimeout
+}
+
+// Whether discovery has waited DiscoverWait or run out of DiscoverRetries without hearing of our transfer:
+func (c *Client) notFound(now time.Time) bool {
+	if c.state != ExpectAnnouncement || c.options.ListOnly {
+		return false
+	}
+	if c.options.DiscoverWait > 0 && now.Sub(c.lastProgress) >= c.options.DiscoverWait {
+		return true
+	}
+	// The last request gets an interval to be answered too:
+	return c.retriedDiscovery() && now.Sub(c.lastDiscover) >= DefaultAnnounceInterval
+}
+
+// Whether the first discovery request and DiscoverRetries more have been sent:
+func (c *Client) retriedDiscovery() bool {
+	return c.options.DiscoverRetries > 0 && c.discoveries > c.options.DiscoverRetries
+}
+
+// Joins the group for `source` only, or makes do with ignoring other senders where that's unsupported:
+func (c *Client) joinSource(source net.IP) error {
+	c.source = source
+	err := c.m.JoinSource(source)
+	if errors.Is(err, ErrSourceSpecificUnsupported) {
+		c.log.Warnf("%s; receiving from any source but ignoring all except %s", err, source)
+		return nil
+	}
+	if err == nil {
+		c.log.Infof("Receiving only from %s", source)
+	}
+	return err
+}
+
+// Latches onto the first source announced for our transfer when discovering it:
+func (c *Client) processSource(hashId []byte, data []byte) error {
+	if !c.options.DiscoverSource || c.source != nil || c.hashId == nil || compareHashes(c.hashId, hashId) != 0 {
+		return nil
+	}
+	source, ok := decodeSource(c.options.PublicKey, hashId, data)
+	if !ok {
+		return nil
+	}
+	return c.joinSource(source)
+}
+
+// Moves over to the group our transfer's data is sent to:
+func (c *Client) processDataGroup(hashId []byte, data []byte) error {
+	if c.hashId == nil || compareHashes(c.hashId, hashId) != 0 {
+		return nil
+	}
+	group, ok := decodeDataGroup(c.options.PublicKey, hashId, data)
+	if !ok || group.Equal(c.dataGroup) {
+		return nil
+	}
+	if err := c.m.JoinDataGroup(group); err != nil {
+		return err
+	}
+	c.dataGroup = group
+	c.log.Infof("Receiving data on %s", group)
+	return nil
+}
+
+// Follows our transfer to the hashId the server moved it to when files were added:
+func (c *Client) processReplaced(hashId []byte, data []byte) error {
+	if c.options.ListOnly || c.hashId == nil || compareHashes(c.hashId, hashId) != 0 || c.state == Done || c.state == Failed {
+		return nil
+	}
+	newId, ok := decodeReplaced(c.options.PublicKey, hashId, data)
+	if !ok {
+		return nil
+	}
+	return c.follow(newId)
+}
+
+// Drops everything learned about the current hashId and starts over on `newId`, noting what already
+// arrived so files that didn't change aren't sent again:
+func (c *Client) follow(newId []byte) error {
+	c.log.Infof("Files were added to %s; following it to %s", hex.EncodeToString(c.hashId), hex.EncodeToString(newId))
+
+	naks := c.nakRegions
+	if c.writes != nil {
+		err := c.writes.wait()
+		naks = c.writes.progress()
+		c.writes = nil
+		if err != nil {
+			return err
+		}
+	}
+	c.carried = nil
+	if c.tb != nil {
+		if c.resumes() && naks != nil {
+			c.carried = carryOver(c.tb.files, naks)
+		}
+		if err := c.tb.Close(); err != nil {
+			return err
+		}
+		c.tb = nil
+		if c.resumes() {
+			if err := os.Remove(c.progressPath()); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	c.closeSpool()
+
+	c.hashId = append([]byte(nil), newId...)
+	c.announcedSections, c.metadataSectionCount, c.metadataSections, c.nextSectionIndex = 0, 0, nil, 0
+	c.nakRegions, c.decoder, c.reported, c.lastAck = nil, nil, nil, Region{}
+	c.sendTimes = newRegionSendTimes()
+	c.bytesReceived, c.lastBytesReceived = 0, 0
+	c.discoveries = 0
+	c.setState(ExpectAnnouncement)
+	return c.discover()
+}
+
+// Whether a message came from the source joined, if any:
+func (c *Client) fromSource(msg UDPMessage) bool {
+	return c.source == nil || msg.SourceAddress == nil || msg.SourceAddress.IP.Equal(c.source)
+}
+
+// Makes Run stop downloading, finish queued writes, save progress and close everything before returning:
+func (c *Client) Stop() {
+	c.quitOnce.Do(func() {
+		close(c.quit)
+	})
+}
+
+// Sparse extents go untransferred only when regions map directly onto files and aren't needed to
+// rebuild others from parity:
+func (c *Client) skipsSparse() bool {
+	return c.compression == CompressNone && !c.fec.Enabled()
+}
+
+// Whether this client downloads data as opposed to only querying servers:
+func (c *Client) downloads() bool {
+	return !c.options.MetadataOnly && !c.options.ListOnly
+}
+
+func (c *Client) processListing(hashId []byte, op ControlToClientOp, data []byte) error {
+	// Combined announcements are unsigned so only signed plain ones count when verifying:
+	if c.options.PublicKey != nil {
+		if _, ok := verifyAnnouncement(c.options.PublicKey, hashId, data); op != AnnounceTarball || !ok {
+			return nil
+		}
+	}
+
+	switch op {
+	case AnnounceTarball:
+		// Plain announcements don't tell us the size:
+		c.addAnnounced(AnnouncementEntry{HashId: append([]byte(nil), hashId...), Size: -1})
+	case AnnounceTarballList:
+		chunkIndex, chunkCount, entries, err := decodeAnnouncementList(data)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			c.addAnnounced(e)
+		}
+
+		// Stop once every chunk of the combined list has been seen:
+		if c.listChunksSeen == nil {
+			c.listChunksSeen = make(map[uint16]bool)
+		}
+		c.listChunksSeen[chunkIndex] = true
+		if len(c.listChunksSeen) >= int(chunkCount) {
+			c.setState(Done)
+		}
+	}
+	return nil
+}
+
+func (c *Client) addAnnounced(e AnnouncementEntry) {
+	for i := range c.announced {
+		if compareHashes(c.announced[i].HashId, e.HashId) == 0 {
+			if e.Size >= 0 {
+				c.announced[i] = e
+			}
+			return
+		}
+	}
+
+	// Message buffers are not ours to keep:
+	e.HashId = append([]byte(nil), e.HashId[:HashSize]...)
+	c.announced = append(c.announced, e)
+}
+
+// Transfers seen while listing:
+func (c *Client) Announced() []AnnouncementEntry {
+	return c.announced
+}
+
+// ID of the transfer joined; nil until one is chosen:
+func (c *Client) HashId() []byte {
+	return c.hashId
+}
+
+// How far the download got; Done once everything arrived. Files were verified if Run then returned nil:
+func (c *Client) State() ClientState {
+	return c.state
+}
+
+// Counters for the download so far, or all of it once Run has returned:
+func (c *Client) Stats() ClientStats {
+	end := c.endTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s := ClientStats{
+		Bytes:              c.bytesReceived,
+		Duration:           end.Sub(c.startTime),
+		PeakRate:           c.peakRate,
+		RetransmitRequests: c.retransmitRequests,
+		DuplicatePackets:   c.duplicatePackets,
+		IgnoredPackets:     c.ignoredPackets,
+		BytesRecovered:     c.bytesRecovered,
+	}
+	if s.Duration > 0 {
+		s.AverageRate = float64(s.Bytes) / s.Duration.Seconds()
+	}
+	// Downloads shorter than a refresh never measure a full interval:
+	if s.PeakRate < s.AverageRate {
+		s.PeakRate = s.AverageRate
+	}
+	return s
+}
+
+// Files described by the received metadata; nil until metadata is decoded:
+func (c *Client) Files() []*TarballFile {
+	if c.tb == nil {
+		return nil
+	}
+	return c.tb.files
 }
 
 func (c *Client) reportBandwidth() {
@@ -171,34 +719,114 @@ func (c *Client) reportBandwidth() {
 	rightMeow := time.Now()
 	sec := rightMeow.Sub(c.lastTime).Seconds()
 
-	pct := float64(0.0)
-	if c.nakRegions != nil {
-		pct = float64(c.bytesReceived) * 100.0 / float64(c.nakRegions.size)
+	rate := float64(byteCount) / sec
+	c.smoothedRate = smoothRate(c.smoothedRate, rate)
+	// The final report's partial interval would overstate a burst:
+	if sec >= c.options.RefreshRate.Seconds() && rate > c.peakRate {
+		c.peakRate = rate
 	}
-	nakMeter := ""
+	e := c.progressEvent(rate, false)
+	c.metrics.setReceiveRate(rate)
+	c.metrics.setPercentComplete(e.Percent)
 	if c.nakRegions != nil {
-		nakMeter = c.nakRegions.ASCIIMeter(48)
+		c.metrics.setNakRegions(c.nakRegions.Len())
+	}
+	for _, subscriber := range c.subscribers {
+		subscriber(e)
 	}
-	fmt.Printf("\b%9s/s %6.2f%% [%s]\r", humanize.IBytes(uint64(float64(byteCount)/sec)), pct, nakMeter)
 
 	c.lastBytesReceived = c.bytesReceived
 	c.lastTime = rightMeow
 }
 
+// Progress so far, marking newly complete files as reported. With `all` every remaining file is
+// complete, which is also the only way files of a compressed stream complete since its regions
+// don't map onto them.
+func (c *Client) progressEvent(rate float64, all bool) ProgressEvent {
+	e := ProgressEvent{Bytes: c.bytesReceived, Rate: rate}
+	if c.nakRegions == nil {
+		return e
+	}
+	e.Size = c.nakRegions.size
+	if e.Size > 0 {
+		e.Percent = float64(c.bytesReceived) * 100.0 / float64(e.Size)
+	} else if c.nakRegions.IsAllAcked() {
+		// Nothing to receive in an empty transfer:
+		e.Percent = 100
+	}
+	if c.tb == nil || (!all && c.compression != CompressNone) {
+		return e
+	}
+
+	// Only what is known to be on disk:
+	naks := c.nakRegions
+	if c.writes != nil {
+		naks = c.writes.progress()
+	}
+	if c.reported == nil {
+		c.reported = make([]bool, len(c.tb.files))
+	}
+	for i, f := range c.tb.files {
+		if c.reported[i] || !(all || naks.IsAcked(f.offset, f.offset+f.Size+1)) {
+			continue
+		}
+		c.reported[i] = true
+		e.Completed = append(e.Completed, f.Path)
+	}
+	return e
+}
+
+// The default subscriber rewrites a bandwidth line in place:
+func (c *Client) printBandwidth(e ProgressEvent) {
+	if c.options.Progress == ProgressDetailed && c.nakRegions != nil && c.tb != nil {
+		printProgress(c.options.Quiet, "%s", c.formatDetailedProgress(e.Rate))
+		return
+	}
+	nakMeter := ""
+	if c.nakRegions != nil {
+		nakMeter = c.nakRegions.ASCIIMeter(48)
+	}
+	printProgress(c.options.Quiet, "\b%9s/s %6.2f%% [%s] rtt %v\r", humanize.IBytes(uint64(e.Rate)), e.Percent, nakMeter, c.rtt.RTT().Round(time.Millisecond))
+}
+
 func (c *Client) processControl(msg UDPMessage) error {
 	hashId, op, data, err := extractClientMessage(msg)
 	if err != nil {
 		return err
 	}
+	c.metrics.controlReceived()
+	c.events.controlReceived(op, msg.SourceAddress)
+
+	if op == AnnounceSource {
+		return c.processSource(hashId, data)
+	}
+	if op == AnnounceDataGroup {
+		return c.processDataGroup(hashId, data)
+	}
+	if op == AnnounceReplaced {
+		return c.processReplaced(hashId, data)
+	}
 
 	switch c.state {
 	case ExpectAnnouncement:
+		if c.options.ListOnly {
+			return c.processListing(hashId, op, data)
+		}
+
 		switch op {
 		case AnnounceTarball:
-			//fmt.Printf("announce %s\n", hex.EncodeToString(hashId))
+			c.log.Debugf("announce %s", hex.EncodeToString(hashId))
+			if c.options.PublicKey != nil {
+				// Don't even latch onto announcements we can't trust:
+				count, ok := verifyAnnouncement(c.options.PublicKey, hashId, data)
+				if !ok {
+					return nil
+				}
+				c.announcedSections = count
+			}
 			if c.hashId == nil {
 				// If client has not specified a hashId to listen for, accept the first one that's announced:
-				c.hashId = hashId
+				c.hashId = append([]byte(nil), hashId...)
 			} else if compareHashes(c.hashId, hashId) != 0 {
 				// These are not the droids we're looking for.
 				//fmt.Printf("\rIgnore announcement for %s; only interested in %s\n", hex.EncodeToString(hashId), hex.EncodeToString(c.hashId))
@@ -206,7 +834,7 @@ func (c *Client) processControl(msg UDPMessage) error {
 			}
 
 			// Request metadata header:
-			c.state = ExpectMetadataHeader
+			c.setState(ExpectMetadataHeader)
 			if err = c.ask(); err != nil {
 				return err
 			}
@@ -223,13 +851,61 @@ func (c *Client) processControl(msg UDPMessage) error {
 
 		switch op {
 		case RespondMetadataHeader:
-			//fmt.Printf("metaheader %s\n", hex.EncodeToString(hashId))
+			c.log.Debugf("metaheader %s", hex.EncodeToString(hashId))
+			if c.options.PublicKey != nil {
+				// Wait for the genuine header; a forged one will be followed by a re-ask:
+				header, ok := verifyMetadataHeader(c.options.PublicKey, hashId, data)
+				if !ok || len(header) < 2 || byteOrder.Uint16(header[0:2]) != c.announcedSections {
+					return nil
+				}
+				data = header
+			}
+			if len(data) < 2 {
+				return ErrMessageTooShort
+			}
+			c.sampleControlRTT()
 			// Read count of sections:
 			c.metadataSectionCount = byteOrder.Uint16(data[0:2])
 			c.metadataSections = make([][]byte, c.metadataSectionCount)
 
+			// Older servers send uncompressed streams and only the section count:
+			c.compression, c.streamSize, c.checksummed = CompressNone, -1, false
+			if len(data) >= 11 {
+				c.compression = Compression(data[2] &^ checksumFlag)
+				c.checksummed = data[2]&checksumFlag != 0
+				c.streamSize = int64(byteOrder.Uint64(data[3:11]))
+				if c.compression > CompressZstd {
+					return ErrBadCompression
+				}
+			}
+			// ...and those predating FEC send no parity and only understand AckDataSection:
+			c.fec, c.shardSize, c.listsRegions = FEC{}, 0, false
+			if len(data) >= 15 {
+				c.listsRegions = true
+				c.fec = FEC{DataShards: int(data[11]), ParityShards: int(data[12])}
+				c.shardSize = int64(byteOrder.Uint16(data[13:15]))
+				if c.fec.Enabled() && c.shardSize == 0 {
+					return ErrBadFEC
+				}
+			}
+			// Data regions are sealed with nonces salted by the server:
+			if c.m != nil && c.m.cipher != nil {
+				if len(data) < metadataDigestOffset {
+					return ErrMissingSalt
+				}
+				copy(c.m.cipher.salt[:], data[15:15+saltSize])
+			}
+			// Older servers don't vouch for the sections; signed metadata has to:
+			c.metadataDigest = nil
+			if len(data) >= metadataHeaderMsgSize {
+				c.metadataDigest = append([]byte(nil), data[metadataDigestOffset:metadataHeaderMsgSize]...)
+			} else if c.options.PublicKey != nil {
+				c.setState(Failed)
+				return fmt.Errorf("%w: signed header carries no digest of the metadata", ErrBadMetadata)
+			}
+
 			// Request metadata sections:
-			c.state = ExpectMetadataSections
+			c.setState(ExpectMetadataSections)
 			c.nextSectionIndex = 0
 			if err = c.ask(); err != nil {
 				return err
@@ -247,22 +923,48 @@ func (c *Client) processControl(msg UDPMessage) error {
 
 		switch op {
 		case RespondMetadataSection:
-			//fmt.Printf("metasection %s\n", hex.EncodeToString(hashId))
-
+			c.log.Debugf("metasection %s", hex.EncodeToString(hashId))
+			if len(data) < 2 {
+				return ErrMessageTooShort
+			}
 			sectionIndex := byteOrder.Uint16(data[0:2])
 			if sectionIndex == c.nextSectionIndex {
+				c.sampleControlRTT()
 				c.metadataSections[sectionIndex] = make([]byte, len(data[2:]))
 				copy(c.metadataSections[sectionIndex], data[2:])
 
 				c.nextSectionIndex++
 				if c.nextSectionIndex >= c.metadataSectionCount {
 					// Done receiving all metadata sections; decode:
-					if err = c.decodeMetadata(); err != nil {
+					err = c.decodeMetadata()
+					if errors.Is(err, ErrMetadataMismatch) {
+						// Forged or mixed up sections; ask for all of them again:
+						c.nextSectionIndex = 0
+						if aerr := c.ask(); aerr != nil {
+							return aerr
+						}
+						return err
+					}
+					if err != nil {
+						c.setState(Failed)
 						return err
 					}
+					if c.options.MetadataOnly && c.options.BlockHashes {
+						c.blockHashes, c.hashFile = make([][]byte, len(c.tb.files)), 0
+						return c.nextBlockHashes()
+					}
+					if c.options.MetadataOnly {
+						c.setState(Done)
+						return nil
+					}
+
+					// Everything may already be on disk from an earlier run:
+					if c.nakRegions.IsAllAcked() {
+						return c.complete()
+					}
 
 					// Start expecting data sections:
-					c.state = ExpectDataSections
+					c.setState(ExpectDataSections)
 					if err = c.ask(); err != nil {
 						return err
 					}
@@ -271,7 +973,7 @@ func (c *Client) processControl(msg UDPMessage) error {
 			}
 
 			// Request next metadata sections:
-			c.state = ExpectMetadataSections
+			c.setState(ExpectMetadataSections)
 			if err = c.ask(); err != nil {
 				return err
 			}
@@ -281,55 +983,162 @@ func (c *Client) processControl(msg UDPMessage) error {
 
 	case ExpectDataSections:
 		// Not interested in control messages really at this time. Maybe introduce server death messages?
+
+	case ExpectBlockHashes:
+		if compareHashes(c.hashId, hashId) != 0 || op != RespondBlockHashes {
+			return nil
+		}
+		if len(data) < blockHashesMsgSize {
+			return ErrMessageTooShort
+		}
+		fileIndex, first := byteOrder.Uint32(data[0:4]), int64(byteOrder.Uint64(data[4:12]))
+		hashes := c.blockHashes[c.hashFile]
+		if fileIndex != uint32(c.hashFile) || first != int64(len(hashes)/blockHashSize) {
+			// An answer to a request already answered:
+			return nil
+		}
+		received := data[blockHashesMsgSize:]
+		if len(received) == 0 || len(received)%blockHashSize != 0 || int64(len(hashes)+len(received)) > blockCount(c.tb.files[c.hashFile].Size)*blockHashSize {
+			return fmt.Errorf("%w: block hashes don't fit the file", ErrBadMetadata)
+		}
+		c.sampleControlRTT()
+		c.blockHashes[c.hashFile] = append(hashes, received...)
+		c.lastProgress = time.Now()
+		return c.nextBlockHashes()
 	}
 
 	return nil
 }
 
+// Requests an announcement from servers of our transfer, or of any transfer when we have no ID yet.
+// Servers predating discovery ignore it and are found at their next periodic announcement.
+func (c *Client) discover() error {
+	hashId := c.hashId
+	if hashId == nil {
+		hashId = anyHashId
+	}
+	c.lastDiscover = time.Now()
+	c.discoveries++
+	_, err := c.m.SendControlToServer(controlToServerMessage(hashId, RequestAnnouncement, nil))
+	c.events.controlSent(RequestAnnouncement, nil)
+	return err
+}
+
+// Asks for the next block hashes still missing, finishing once every regular file has them all:
+func (c *Client) nextBlockHashes() error {
+	for ; c.hashFile < len(c.tb.files); c.hashFile++ {
+		f := c.tb.files[c.hashFile]
+		if f.Mode.IsRegular() && int64(len(c.blockHashes[c.hashFile])) < blockCount(f.Size)*blockHashSize {
+			if c.state != ExpectBlockHashes {
+				c.setState(ExpectBlockHashes)
+			}
+			return c.ask()
+		}
+	}
+	c.setState(Done)
+	return nil
+}
+
+// Hashes of the blocks of each file's contents by index into Files, fetched with BlockHashes, for
+// VerifyTree; only safe once Run has returned:
+func (c *Client) BlockHashes() [][]byte {
+	return c.blockHashes
+}
+
 func (c *Client) ask() error {
 	err := (error)(nil)
 
 	switch c.state {
+	case ExpectAnnouncement:
+		// Ask again in case the first request was lost or no server was up yet, until out of retries:
+		if time.Since(c.lastDiscover) >= DefaultAnnounceInterval && !c.retriedDiscovery() {
+			err = c.discover()
+		}
 	case ExpectMetadataHeader:
+		c.controlSent.requested(time.Now())
 		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestMetadataHeader, nil))
+		c.events.controlSent(RequestMetadataHeader, nil)
 	case ExpectMetadataSections:
 		// Request next metadata section:
 		req := make([]byte, 2)
 		byteOrder.PutUint16(req[0:2], uint16(c.nextSectionIndex))
+		c.controlSent.requested(time.Now())
 		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestMetadataSection, req))
+		c.events.controlSent(RequestMetadataSection, nil)
+	case ExpectBlockHashes:
+		req := make([]byte, blockHashesMsgSize)
+		byteOrder.PutUint32(req[0:4], uint32(c.hashFile))
+		byteOrder.PutUint64(req[4:12], uint64(len(c.blockHashes[c.hashFile])/blockHashSize))
+		c.controlSent.requested(time.Now())
+		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestBlockHashes, req))
+		c.events.controlSent(RequestBlockHashes, nil)
 	case ExpectDataSections:
+		if wait := minAskInterval - time.Since(c.lastAsk); wait > 0 {
+			if c.askTimer == nil {
+				c.askTimer = time.After(wait)
+			}
+			return nil
+		}
+		c.lastAsk, c.askTimer = time.Now(), nil
+
+		max := c.m.MaxMessageSize() - (protocolControlPrefixSize)
+		naks := c.nakRegions.Naks()
+		if c.options.RandomNaks {
+			naks = scatterNaks(naks, rand.Intn)
+		}
+		if c.polite != nil {
+			c.polite.adjust()
+			// Only ask for as many holes as our window allows when being polite:
+			if len(naks) > c.polite.window {
+				naks = naks[:c.polite.window]
+			}
+		}
+		now := time.Now()
+		c.sendTimes.prune(c.nakRegions)
+
+		if c.listsRegions {
+			// List as many NAK'd regions as fit so the server can service several holes from one round trip:
+			req, n := encodeRegionList(naks, max)
+			for _, k := range naks[:n] {
+				c.sendTimes.requested(k.start, now)
+			}
+			c.metrics.retransmitsRequested(n)
+			c.retransmitRequests += int64(n)
+			_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestDataRegions, req))
+			c.events.controlSent(RequestDataRegions, nil)
+			break
+		}
+
 		// Send a message to get a new region:
 		//fmt.Printf("ack: [%v %v]\n", c.lastAck.start, c.lastAck.endEx)
-		max := c.m.MaxMessageSize() - (protocolControlPrefixSize)
 		bytes := make([]byte, max)
 		// Send last ACK:
 		i := 0
 		i += binary.PutUvarint(bytes[i:], uint64(c.lastAck.start))
 		i += binary.PutUvarint(bytes[i:], uint64(c.lastAck.endEx))
 		// Send as many NAK'd regions as we can fit in a message so the server doesnt waste time sending already-ACKed sections:
-		{
-			naks := c.nakRegions.Naks()
-			n := 0
-			for _, k := range naks {
-				if i >= max-2*binary.MaxVarintLen64 {
-					break
-				}
-				i += binary.PutUvarint(bytes[i:], uint64(k.start))
-				i += binary.PutUvarint(bytes[i:], uint64(k.endEx))
-				n++
+		for _, k := range naks {
+			if i >= max-2*binary.MaxVarintLen64 {
+				break
 			}
-			//if n < len(naks) {
-			//	fmt.Printf("%s", hex.Dump(bytes[:i]))
-			//}
+			i += binary.PutUvarint(bytes[i:], uint64(k.start))
+			i += binary.PutUvarint(bytes[i:], uint64(k.endEx))
+			c.sendTimes.requested(k.start, now)
+			c.metrics.retransmitsRequested(1)
+			c.retransmitRequests++
 		}
 		_, err = c.m.SendControlToServer(controlToServerMessage(c.hashId, AckDataSection, bytes[:i]))
+		c.events.controlSent(AckDataSection, nil)
 	case Done:
 	default:
 		return nil
 	}
+	if c.state != Done {
+		c.metrics.controlSent()
+	}
 
 	if isENOBUFS(err) {
-		fmt.Print("\r!")
+		printProgress(c.options.Quiet, "\r!")
 		err = nil
 	}
 	if err != nil {
@@ -337,45 +1146,73 @@ func (c *Client) ask() error {
 	}
 
 	// Start a timer for next ask in case this one got lost:
-	c.resendTimer = time.After(resendTimeout)
+	timeout := c.rtt.timeout()
+	if c.polite != nil && c.state == ExpectDataSections && c.polite.interval > timeout {
+		timeout = c.polite.interval
+	}
+	c.resendTimer = time.After(timeout)
 	return nil
 }
 
+// Rotates all but the first NAK so the list starts at a randomly chosen hole. The first stays in front
+// as the server takes it as how far we have received. Which holes are asked for only changes once the
+// list is cut short, so this merely reorders a request listing every hole:
+func scatterNaks(naks []Region, intn func(int) int) []Region {
+	if len(naks) <= 2 {
+		return naks
+	}
+	rest := naks[1:]
+	i := intn(len(rest))
+	o := make([]Region, 0, len(naks))
+	o = append(o, naks[0])
+	o = append(o, rest[i:]...)
+	return append(o, rest[:i]...)
+}
+
+// Current smoothed round-trip estimate; 0 until measured:
+func (c *Client) RTT() time.Duration {
+	return c.rtt.RTT()
+}
+
+// Measures the round trip of the metadata request just answered:
+func (c *Client) sampleControlRTT() {
+	if d, ok := c.controlSent.answered(time.Now()); ok {
+		c.rtt.sample(d)
+	}
+}
+
 func (c *Client) decodeMetadata() error {
 	// Decode all metadata sections and create a VirtualTarballWriter to download against:
 	md := bytes.Join(c.metadataSections, nil)
+	if c.metadataDigest != nil {
+		if digest := sha256.Sum256(md); !bytes.Equal(digest[:], c.metadataDigest) {
+			return ErrMetadataMismatch
+		}
+	}
 	mdBuf := bytes.NewBuffer(md)
 
 	err := error(nil)
 	readPrimitive := func(data interface{}) {
-		if err == nil {
-			err = binary.Read(mdBuf, byteOrder, data)
+		if err == nil && binary.Read(mdBuf, byteOrder, data) != nil {
+			err = fmt.Errorf("%w: truncated", ErrBadMetadata)
 		}
 	}
-	readString := func(s *string) {
-		if err != nil {
-			return
-		}
-
+	readString := func(s *string, max int) {
 		strlen := uint16(0)
 		readPrimitive(&strlen)
 		if err != nil {
 			return
 		}
-
-		strbuf := make([]byte, strlen)
-		n := 0
-		n, err = mdBuf.Read(strbuf)
-		if err != nil {
+		if int(strlen) > max {
+			err = fmt.Errorf("%w: %d byte string exceeds %d", ErrBadMetadata, strlen, max)
 			return
 		}
-
-		if uint16(n) != strlen {
-			err = errors.New("unable to read string from message")
+		if int(strlen) > mdBuf.Len() {
+			err = fmt.Errorf("%w: truncated", ErrBadMetadata)
 			return
 		}
 
-		*s = string(strbuf)
+		*s = string(mdBuf.Next(int(strlen)))
 	}
 
 	// Deserialize tarball metadata:
@@ -386,37 +1223,183 @@ func (c *Client) decodeMetadata() error {
 	if err != nil {
 		return err
 	}
+	// Every file takes at least its path and name lengths, size and mode:
+	if fileCount > maxMetadataFiles || int64(fileCount)*(2+8+4+2) > int64(mdBuf.Len()) {
+		return fmt.Errorf("%w: %d files don't fit", ErrBadMetadata, fileCount)
+	}
 
 	files := make([]*TarballFile, 0, fileCount)
+	total := int64(0)
 	for n := uint32(0); n < fileCount; n++ {
 		f := &TarballFile{}
-		readString(&f.Path)
+		readString(&f.Path, maxMetadataPath)
 		readPrimitive(&f.Size)
 		readPrimitive(&f.Mode)
-		readString(&f.SymlinkDestination)
+		readString(&f.SymlinkDestination, maxMetadataPath)
 		if err != nil {
 			return err
 		}
+		// Sizes must add up to the tarball's without overflowing on the way:
+		if f.Size < 0 || f.Size >= size-total {
+			return fmt.Errorf("%w: '%s' is %d bytes", ErrBadMetadata, f.Path, f.Size)
+		}
+		total += f.Size + 1
+		if f.Path, err = sanitizePath(f.Path); err != nil {
+			return err
+		}
 
 		files = append(files, f)
 	}
 
-	// Create a writer:
-	c.tb, err = NewVirtualTarballWriter(files, c.options.TarballOptions)
+	// Servers predating modification times end here:
+	if mdBuf.Len() > 0 {
+		for _, f := range files {
+			nanos := int64(0)
+			readPrimitive(&nanos)
+			f.ModTime = fromUnixNanos(nanos)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// ...and those predating content hashes here:
+	if mdBuf.Len() > 0 {
+		for _, f := range files {
+			hash := ""
+			readString(&hash, maxMetadataHash)
+			if hash != "" {
+				f.Hash = []byte(hash)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// ...and those predating ownership here:
+	if mdBuf.Len() > 0 {
+		for _, f := range files {
+			uid, gid := int32(0), int32(0)
+			readPrimitive(&uid)
+			readPrimitive(&gid)
+			f.Uid, f.Gid = int(uid), int(gid)
+			f.HasOwner = uid >= 0 || gid >= 0
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// ...and those predating sparse files here:
+	if mdBuf.Len() > 0 {
+		for _, f := range files {
+			count := uint32(0)
+			readPrimitive(&count)
+			if err != nil {
+				return err
+			}
+			if int64(count)*16 > int64(mdBuf.Len()) {
+				return fmt.Errorf("%w: '%s'", ErrBadSparseExtent, f.Path)
+			}
+			f.Sparse = make([]Region, count)
+			for i := range f.Sparse {
+				length := int64(0)
+				readPrimitive(&f.Sparse[i].start)
+				readPrimitive(&length)
+				f.Sparse[i].endEx = f.Sparse[i].start + length
+			}
+			if err != nil {
+				return err
+			}
+			if (len(f.Sparse) > 0 && f.Mode&os.ModeType != 0) || !validSparse(f) {
+				return fmt.Errorf("%w: '%s'", ErrBadSparseExtent, f.Path)
+			}
+		}
+	}
+	// ...and those predating hard links here:
+	if mdBuf.Len() > 0 {
+		for _, f := range files {
+			readString(&f.LinkTarget, maxMetadataPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// ...and those predating a choice of hash algorithm here:
+	if mdBuf.Len() > 0 {
+		algorithm := HashSHA256
+		readPrimitive(&algorithm)
+		if err != nil {
+			return err
+		}
+		if algorithm.String() == "unknown" {
+			return ErrBadHashAlgorithm
+		}
+		if algorithm != HashSHA256 {
+			for _, f := range files {
+				hash := ""
+				readString(&hash, maxMetadataHash)
+				if hash != "" {
+					f.Hash, f.hashAlgorithm = []byte(hash), algorithm
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Create a writer; only looking at what is served needs no room:
+	options := c.options.TarballOptions
+	if !c.downloads() {
+		options.SkipSpaceCheck = true
+	}
+	c.tb, err = NewVirtualTarballWriter(files, options)
 	if err != nil {
 		return err
 	}
 	if c.tb.size != size {
-		return errors.New("calculated tarball size does not match specified")
+		return fmt.Errorf("%w: calculated tarball size does not match specified", ErrBadMetadata)
+	}
+	if c.compression == CompressNone {
+		c.nakRegions = NewNakRegions(c.tb.size)
+		if c.resumes() {
+			if err = c.loadProgress(); err != nil {
+				return err
+			}
+			c.reuseCarried()
+			if c.options.Delta {
+				if err = c.ackMatching(); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		c.nakRegions = NewNakRegions(c.streamSize)
+	}
+	if c.skipsSparse() {
+		// The server won't send what we'd only leave as holes:
+		ackSparse(c.nakRegions, c.tb.files)
+	}
+	if c.options.WriteWorkers > 0 && c.downloads() {
+		c.writes = newWritePool(c.options.WriteWorkers, c.options.WriteQueue, c.nakRegions.clone())
+	}
+	if c.fec.Enabled() {
+		if c.decoder, err = newFECDecoder(c.fec, c.shardSize, c.nakRegions.size); err != nil {
+			return err
+		}
 	}
-	c.nakRegions = NewNakRegions(c.tb.size)
 
-	fmt.Print("\bReceiving files:\n")
+	c.log.Infof("Receiving files:")
 	for _, f := range c.tb.files {
-		fmt.Printf("  %v %15s '%s'\n", f.Mode, humanize.Comma(f.Size), f.Path)
+		c.log.Infof("  %v %15s '%s'", f.Mode, humanize.Comma(f.Size), f.Path)
 	}
 
-	fmt.Printf("%15s  ID: %s\n", humanize.Comma(c.tb.size), hex.EncodeToString(c.hashId))
+	c.log.Infof("%15s  ID: %s", humanize.Comma(c.tb.size), hex.EncodeToString(c.hashId))
+	if c.compression != CompressNone {
+		c.log.Infof("%15s  %s compressed", humanize.Comma(c.streamSize), c.compression)
+	}
+	if c.decoder != nil {
+		c.log.Infof("%15s  FEC %s", "", c.fec)
+	}
 
 	// Start elapsed timer:
 	c.startTime = time.Now()
@@ -425,57 +1408,388 @@ func (c *Client) decodeMetadata() error {
 }
 
 func (c *Client) processData(msg UDPMessage) error {
+	// The received buffer goes back to the pool once done with unless handed on to be written:
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			msg.Release()
+		}
+	}()
+
 	// Not ready for data yet:
 	if c.tb == nil {
 		//fmt.Print("not ready for data\n")
+		c.ignoredPackets++
 		return nil
 	}
 
 	// Decode data message:
 	hashId, region, data, err := extractDataMessage(msg)
 	if err != nil {
+		c.ignoredPackets++
 		return err
 	}
 
 	if compareHashes(c.hashId, hashId) != 0 {
 		// Ignore message not for us:
 		//fmt.Print("data msg ignored\n")
+		c.ignoredPackets++
 		return nil
 	}
+	// Drop corrupted messages; the region stays NAKed and gets asked for again:
+	if c.checksummed {
+		if _, err = verifyChecksum(msg.Data); err != nil {
+			c.ignoredPackets++
+			return err
+		}
+		data = data[:len(data)-dataChecksumSize]
+	}
+	c.metrics.dataReceived(len(data))
+
+	// Parity regions lie past the end of the stream and only feed the decoder:
+	if c.decoder != nil && c.decoder.isParity(region) {
+		return c.recoverGroup(c.decoder.addParity(region, data, c.nakRegions))
+	}
+
+	if c.polite != nil {
+		c.observeLoss(region, len(data))
+	}
 
 	c.lastAck = Region{start: region, endEx: region + int64(len(data))}
 
 	if c.nakRegions.IsAcked(c.lastAck.start, c.lastAck.endEx) {
 		// Already ACKed:
+		c.duplicatePackets++
 		allDone := c.nakRegions.IsAllAcked()
 		if allDone {
-			c.state = Done
+			return c.complete()
 		}
 
 		return nil
 	}
 
-	// ACK the region:
-	err = c.nakRegions.Ack(c.lastAck.start, c.lastAck.endEx)
+	// Measure round trip for regions we asked for:
+	if d, ok := c.sendTimes.arrived(region, time.Now()); ok {
+		c.rtt.sample(d)
+	}
+
+	if c.decoder != nil {
+		c.decoder.addData(region, data, c.nakRegions)
+	}
+	handedOff = true
+	if err = c.accept(region, data, msg.Release); err != nil {
+		return err
+	}
+	if c.decoder != nil {
+		first, last := c.decoder.dataGroups(region, len(data))
+		for g := first; g <= last; g++ {
+			if err = c.recoverGroup(g); err != nil {
+				return err
+			}
+		}
+	}
+
+	allDone := c.nakRegions.IsAllAcked()
+	if allDone {
+		return c.complete()
+	}
+	if c.nakRegions.Len() > c.options.MaxNakRegions*nakRegionsHardFactor {
+		c.boundNaks()
+	}
+
+	return nil
+}
+
+// Counts what was lost on the way since the last region seen for the polite window. Only gaps over
+// regions still NAKed count; the server skips what we already have or serves other clients' NAKs:
+func (c *Client) observeLoss(region int64, n int) {
+	lost := 0
+	if region > c.lastAck.endEx && n > 0 {
+		missed := c.nakRegions.NakedBytes(c.lastAck.endEx, region)
+		lost = int((missed + int64(n) - 1) / int64(n))
+	}
+	c.polite.observe(lost)
+}
+
+// Merges the closest missing ranges down to half of MaxNakRegions once there are more, giving the next
+// ones room to arrive. FEC groups are tracked by what has been received so are left alone.
+func (c *Client) boundNaks() {
+	if c.nakRegions == nil || c.decoder != nil {
+		return
+	}
+	n := c.nakRegions.Len()
+	if n <= c.options.MaxNakRegions {
+		return
+	}
+	forgotten := c.nakRegions.Squeeze(c.options.MaxNakRegions / 2)
+	if n > c.options.MaxNakRegions*nakRegionsHardFactor {
+		c.log.Warnf("Severe loss: %d ranges missing; asking again for %s bytes received between them", n, humanize.Comma(forgotten))
+		return
+	}
+	c.log.Debugf("%d ranges missing; asking again for %s bytes received between them", n, humanize.Comma(forgotten))
+}
+
+// Rebuilds whatever a group is missing once enough of its shards have arrived:
+func (c *Client) recoverGroup(g int64) error {
+	regions, contents, err := c.decoder.recover(g, c.nakRegions)
 	if err != nil {
 		return err
 	}
+	for i, r := range regions {
+		if err = c.accept(r.start, contents[i], nil); err != nil {
+			return err
+		}
+		c.bytesRecovered += r.endEx - r.start
+	}
+	if len(regions) > 0 && c.nakRegions.IsAllAcked() {
+		return c.complete()
+	}
+	return nil
+}
+
+// ACKs a region and writes its data:
+func (c *Client) accept(region int64, data []byte, release func()) error {
+	// `release` is called once `data` has been written, by the write pool when queued there:
+	queued := false
+	defer func() {
+		if !queued && release != nil {
+			release()
+		}
+	}()
+
+	err := c.nakRegions.Ack(region, region+int64(len(data)))
+	if err != nil {
+		return err
+	}
+	c.events.acked(region, region+int64(len(data)))
 	// Write the data:
+	w := io.WriterAt(c.tb)
+	if c.compression != CompressNone {
+		if c.spool == nil {
+			if c.spool, err = ioutil.TempFile("", "lancaster-spool"); err != nil {
+				return err
+			}
+		}
+		w = c.spool
+	}
+	if c.writes != nil {
+		if err = c.writes.write(w, region, data, release); err != nil {
+			return c.writeFailed(err)
+		}
+		queued = true
+		c.bytesReceived += int64(len(data))
+		return nil
+	}
 	n := 0
-	n, err = c.tb.WriteAt(data, region)
+	n, err = w.WriteAt(data, region)
 	if err != nil {
 		return err
 	}
 	if n < len(data) {
-		fmt.Print("\bNot enough data written! %d < %d\n", n, len(data))
+		c.log.Errorf("Not enough data written! %d < %d", n, len(data))
 	}
 
 	c.bytesReceived += int64(len(data))
+	return nil
+}
 
-	allDone := c.nakRegions.IsAllAcked()
-	if allDone {
-		c.state = Done
+// Takes back the ACKs of regions the write pool didn't get onto disk once one of its writes has failed,
+// so nothing is counted as received that isn't there. The pool writes nothing more after a failure:
+func (c *Client) writeFailed(err error) error {
+	c.writes.wait()
+	c.nakRegions = c.writes.progress()
+	return fmt.Errorf("%w: %s", ErrWriteFailed, err)
+}
+
+func (c *Client) setState(state ClientState) {
+	c.log.Debugf("%s -> %s", c.state, state)
+	c.state = state
+	c.lastProgress = time.Now()
+	c.events.state(state)
+}
+
+// Finishes a transfer once all data regions are in, decompressing the stream into files if needed:
+func (c *Client) complete() error {
+	if c.state == Done {
+		return nil
+	}
+
+	// Everything has arrived but may not all be on disk yet:
+	if c.writes != nil {
+		if err := c.writes.wait(); err != nil {
+			return c.writeFailed(err)
+		}
+	}
+	c.setState(Done)
+
+	if c.listsRegions {
+		// An empty request tells the server we have everything so it can count us as complete; best effort:
+		_, _ = c.m.SendControlToServer(controlToServerMessage(c.hashId, RequestDataRegions, []byte{0}))
+		c.events.controlSent(RequestDataRegions, nil)
+	}
+
+	if c.spool != nil {
+		defer c.closeSpool()
+
+		if _, err := c.spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		w := &offsetWriter{w: c.tb}
+		if err := decompressStream(c.compression, w, c.spool); err != nil {
+			return err
+		}
+		if w.offset != c.tb.size {
+			return ErrDecompressedSize
+		}
 	}
 
+	c.tb.markComplete()
+	if c.resumes() {
+		if err := os.Remove(c.progressPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether progress is kept on disk so an interrupted download can pick up where it left off:
+func (c *Client) resumes() bool {
+	return c.downloads() && c.compression == CompressNone && c.options.TarballOptions.DevicePath == "" && c.options.TarballOptions.TarPath == ""
+}
+
+func (c *Client) loadProgress() error {
+	path := c.progressPath()
+	naks, err := loadProgress(path, c.hashId, c.tb.size)
+	if err == nil && naks != nil && !progressMatchesFiles(c.tb.files, naks) {
+		err = ErrStaleProgress
+	}
+	if err != nil {
+		// Start over rather than trust bytes we can't account for:
+		c.log.Warnf("Ignoring %s: %s", path, err)
+		return os.Remove(path)
+	}
+	if naks == nil {
+		return nil
+	}
+
+	c.nakRegions = naks
+	c.bytesReceived = ackedBytes(naks)
+	c.lastBytesReceived = c.bytesReceived
+	c.log.Infof("Resuming with %s bytes already received", humanize.Comma(c.bytesReceived))
+	return nil
+}
+
+// Keeps what arrived before following the transfer of files that are unchanged under the new hashId:
+func (c *Client) reuseCarried() {
+	if c.carried == nil {
+		return
+	}
+	n := reuseCarried(c.tb.files, c.nakRegions, c.carried)
+	c.carried = nil
+	if n == 0 {
+		return
+	}
+	c.bytesReceived = ackedBytes(c.nakRegions)
+	c.lastBytesReceived = c.bytesReceived
+	c.log.Infof("Keeping %s bytes already received", humanize.Comma(n))
+}
+
+// Keeps files already on disk that match the metadata:
+func (c *Client) ackMatching() error {
+	n, err := ackMatching(c.tb.files, c.nakRegions)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	c.bytesReceived = ackedBytes(c.nakRegions)
+	c.lastBytesReceived = c.bytesReceived
+	c.log.Infof("Keeping %s bytes of files already on disk", humanize.Comma(n))
 	return nil
 }
+
+func (c *Client) saveProgress() error {
+	if c.state != ExpectDataSections || !c.resumes() {
+		return nil
+	}
+	naks := c.nakRegions
+	if c.writes != nil {
+		// Only what is known to be on disk:
+		naks = c.writes.progress()
+	}
+	return saveProgress(c.progressPath(), c.hashId, naks)
+}
+
+// Progress is kept alongside the files it describes:
+func (c *Client) progressPath() string {
+	return filepath.Join(c.options.TarballOptions.OutputDir, progressPath(c.hashId))
+}
+
+func (c *Client) closeSpool() {
+	if c.spool == nil {
+		return
+	}
+	c.spool.Close()
+	os.Remove(c.spool.Name())
+	c.spool = nil
+}
+
+const politeLossThreshold = 0.02
+const politeMaxInterval = 4 * time.Second
+const politeMaxWindow = 1024
+
+// Client-side AIMD window: halves the NAK regions requested per ask and doubles the ask interval when
+// observed loss crosses a threshold, and recovers additively while delivery is clean. Yielding like
+// this leaves room for other flows on a shared link but slows the transfer when the link is lossy for
+// reasons we don't cause.
+type politeWindow struct {
+	interval time.Duration
+	window   int
+
+	received int
+	lost     int
+}
+
+func newPoliteWindow() *politeWindow {
+	return &politeWindow{
+		interval: resendTimeout,
+		window:   politeMaxWindow,
+	}
+}
+
+func (p *politeWindow) observe(lost int) {
+	p.received++
+	p.lost += lost
+}
+
+func (p *politeWindow) adjust() {
+	total := p.received + p.lost
+	if total == 0 {
+		return
+	}
+
+	if float64(p.lost)/float64(total) > politeLossThreshold {
+		// Multiplicative decrease:
+		p.window /= 2
+		if p.window < 1 {
+			p.window = 1
+		}
+		p.interval *= 2
+		if p.interval > politeMaxInterval {
+			p.interval = politeMaxInterval
+		}
+	} else {
+		// Additive increase:
+		if p.window < politeMaxWindow {
+			p.window++
+		}
+		p.interval -= resendTimeout / 10
+		if p.interval < resendTimeout {
+			p.interval = resendTimeout
+		}
+	}
+
+	p.received = 0
+	p.lost = 0
+}
@@ -0,0 +1,1112 @@
+package lancaster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoliteWindow_BacksOffOnLoss(t *testing.T) {
+	p := newPoliteWindow()
+	window := p.window
+	interval := p.interval
+
+	// 50% loss:
+	for i := 0; i < 10; i++ {
+		p.observe(1)
+	}
+	p.adjust()
+	if p.window != window/2 {
+		t.Fatalf("expected window %d got %d", window/2, p.window)
+	}
+	if p.interval != interval*2 {
+		t.Fatalf("expected interval %v got %v", interval*2, p.interval)
+	}
+}
+
+func TestPoliteWindow_RecoversWhenClean(t *testing.T) {
+	p := newPoliteWindow()
+	for i := 0; i < 20; i++ {
+		p.observe(5)
+		p.adjust()
+	}
+	if p.window != 1 {
+		t.Fatalf("expected window to bottom out at 1 got %d", p.window)
+	}
+	if p.interval != politeMaxInterval {
+		t.Fatalf("expected interval to cap at %v got %v", politeMaxInterval, p.interval)
+	}
+
+	for i := 0; i < 200; i++ {
+		p.observe(0)
+		p.adjust()
+	}
+	if p.window != 201 {
+		t.Fatalf("expected window 201 got %d", p.window)
+	}
+	if p.interval != resendTimeout {
+		t.Fatalf("expected interval back at %v got %v", resendTimeout, p.interval)
+	}
+}
+
+func TestClient_Listing(t *testing.T) {
+	c := NewClient(nil, ClientOptions{ListOnly: true})
+
+	plain := []byte{9, 9, 9, 9, 9, 9, 9, 9}
+	listed := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(plain, AnnounceTarball, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectAnnouncement {
+		t.Fatal("expected to keep listening after a plain announcement")
+	}
+
+	chunk := encodeAnnouncementList([]AnnouncementEntry{{HashId: listed, Size: 42, Name: "build"}})[0]
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(make([]byte, HashSize), AnnounceTarballList, chunk)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != Done {
+		t.Fatal("expected Done after complete list")
+	}
+
+	announced := c.Announced()
+	if len(announced) != 2 {
+		t.Fatalf("expected 2 transfers got %d", len(announced))
+	}
+	if announced[0].Size != -1 || announced[1].Size != 42 || announced[1].Name != "build" {
+		t.Fatalf("unexpected listing %v", announced)
+	}
+}
+
+// Multicast whose control-to-server messages go to a plain UDP socket on loopback so tests can read them:
+func newTestClientMulticast(t *testing.T) (*Multicast, *net.UDPConn) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Multicast{
+		datagramSize:         DefaultDatagramSize,
+		controlToServerConns: []*net.UDPConn{conn},
+		controlToServerAddr:  conn.LocalAddr().(*net.UDPAddr),
+	}
+	return m, conn
+}
+
+func TestClient_SelectsRequestedHashId(t *testing.T) {
+	m, conn := newTestClientMulticast(t)
+	defer conn.Close()
+
+	wanted := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	other := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	c := NewClient(m, ClientOptions{HashId: wanted})
+
+	// Another transfer's announcement is ignored:
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(other, AnnounceTarball, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectAnnouncement {
+		t.Fatalf("expected ExpectAnnouncement after other announcement got %v", c.state)
+	}
+
+	// The requested one advances to fetching metadata:
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(wanted, AnnounceTarball, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectMetadataHeader {
+		t.Fatalf("expected ExpectMetadataHeader got %v", c.state)
+	}
+
+	buf := make([]byte, DefaultDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashId, op, _, err := extractServerMessage(UDPMessage{Data: buf[:n]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != RequestMetadataHeader || compareHashes(hashId, wanted) != 0 {
+		t.Fatalf("expected metadata header request for wanted transfer got op %v", op)
+	}
+}
+
+func TestClient_LatchesFirstAnnouncement(t *testing.T) {
+	m, conn := newTestClientMulticast(t)
+	defer conn.Close()
+
+	first := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	c := NewClient(m, ClientOptions{})
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(first, AnnounceTarball, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectMetadataHeader || compareHashes(c.hashId, first) != 0 {
+		t.Fatalf("expected to latch onto first announcement; state %v", c.state)
+	}
+}
+
+// Serves `contents` as a single file to a client over loopback multicast and checks it arrives intact.
+// Both ends seal messages with `key` when it is set.
+func runLoopbackTransfer(t *testing.T, port int, serverOptions ServerOptions, contents []byte, key []byte) *Client {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), port)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), port)
+	if key != nil {
+		for _, m := range []*Multicast{sm, cm} {
+			p, err := NewPacketCipher(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.SetCipher(p)
+		}
+	}
+	return runTransfer(t, sm, cm, serverOptions, ClientOptions{}, contents)
+}
+
+// Serves a single file over `sm` and downloads it over `cm`:
+func runTransfer(t *testing.T, sm *Multicast, cm *Multicast, serverOptions ServerOptions, clientOptions ClientOptions, contents []byte) *Client {
+	src, err := ioutil.TempDir("", "lancaster-run-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "lancaster-run-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	srcPath := filepath.Join(src, "tiny.txt")
+	if err = ioutil.WriteFile(srcPath, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	tb, err := NewVirtualTarballReader([]*TarballFile{{Path: "tiny.txt", LocalPath: srcPath, Size: int64(len(contents)), Mode: 0644, ModTime: modTime}}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	s := NewServer(sm, tb, serverOptions)
+	go s.Run()
+	defer sm.Close()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dst); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	clientOptions.HashId = tb.HashId()
+	clientOptions.TarballOptions = getOptions()
+	c := NewClient(cm, clientOptions)
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("client did not return after transfer")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dst, "tiny.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, contents) {
+		t.Fatalf("unexpected contents %q", b)
+	}
+	stat, err := os.Stat(filepath.Join(dst, "tiny.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Equal(modTime) {
+		t.Fatalf("expected modification time %v got %v", modTime, stat.ModTime())
+	}
+	return c
+}
+
+func TestClient_RunCompletes(t *testing.T) {
+	c := runLoopbackTransfer(t, 13600, ServerOptions{}, []byte("hello world\n"), nil)
+	if s := c.Stats(); s.Bytes < 12 || s.Duration <= 0 || s.PeakRate < s.AverageRate || s.AverageRate <= 0 {
+		t.Fatalf("expected stats for the 12 bytes got %+v", s)
+	}
+}
+
+func TestClient_RunRecordsEvents(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13930)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13930)
+	b := &bytes.Buffer{}
+	events := NewEventLog(b)
+	runTransfer(t, sm, cm, ServerOptions{}, ClientOptions{Events: events}, []byte("hello events\n"))
+	if err := events.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`"event":"state","state":"ExpectAnnouncement"`,
+		`"event":"control-sent","op":"RequestAnnouncement"`,
+		`"event":"control-received","op":"AnnounceTarball"`,
+		`"event":"acked","region":[0,`,
+		`"event":"state","state":"Done"`,
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Fatalf("expected %s in events:\n%s", expected, b)
+		}
+	}
+}
+
+func TestClient_RunCompletesUnicast(t *testing.T) {
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 13680}
+	sm := NewUnicast(server, []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 13680}})
+	cm := NewUnicast(server, nil)
+	runTransfer(t, sm, cm, ServerOptions{}, ClientOptions{}, []byte("hello unicast\n"))
+}
+
+func TestClient_RunCompletesWithWriteWorkers(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13690)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13690)
+	runTransfer(t, sm, cm, ServerOptions{}, ClientOptions{WriteWorkers: 4, WriteQueue: 8}, bytes.Repeat([]byte("0123456789abcdef"), 64*1024))
+}
+
+func TestClient_RunCompletesRandomized(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13790)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13790)
+	runTransfer(t, sm, cm, ServerOptions{Selector: RandomSelector{}}, ClientOptions{RandomNaks: true}, bytes.Repeat([]byte("0123456789abcdef"), 64*1024))
+}
+
+func TestClient_CoalescesAsks(t *testing.T) {
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13880)
+	defer cm.Close()
+	if err := cm.SendsControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics()
+	c := NewClient(cm, ClientOptions{Metrics: metrics, Quiet: true})
+	c.hashId = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	c.nakRegions = NewNakRegions(1000)
+	c.listsRegions = true
+	c.state = ExpectDataSections
+
+	// 1. A burst of asks sends one request and holds the rest back:
+	for i := 0; i < 100; i++ {
+		if err := c.ask(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := metrics.controlPacketsSent; n != 1 {
+		t.Fatalf("expected 1 control message sent got %d", n)
+	}
+	if c.askTimer == nil {
+		t.Fatal("expected a coalesced ask to be pending")
+	}
+
+	// 2. ...which are sent together once the interval has passed:
+	<-c.askTimer
+	c.askTimer = nil
+	if err := c.ask(); err != nil {
+		t.Fatal(err)
+	}
+	if n := metrics.controlPacketsSent; n != 2 {
+		t.Fatalf("expected 2 control messages sent got %d", n)
+	}
+}
+
+func TestClient_Stalled(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := &Client{options: ClientOptions{StallTimeout: 10 * time.Second}, lastProgress: start}
+
+	if c.stalled(start.Add(9 * time.Second)) {
+		t.Fatal("expected to keep waiting within the timeout")
+	}
+	// A trickle of data keeps a slow transfer alive:
+	c.bytesReceived = 100
+	if c.stalled(start.Add(15 * time.Second)) {
+		t.Fatal("expected progress to reset the timeout")
+	}
+	if c.stalled(start.Add(24 * time.Second)) {
+		t.Fatal("expected to count from the last progress")
+	}
+	if !c.stalled(start.Add(25 * time.Second)) {
+		t.Fatal("expected to give up once nothing arrived for the timeout")
+	}
+
+	c.options.StallTimeout = 0
+	if c.stalled(start.Add(time.Hour)) {
+		t.Fatal("expected to wait forever without a timeout")
+	}
+}
+
+func TestClient_RunStalls(t *testing.T) {
+	// No server is on this port:
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13820)
+	c := NewClient(cm, ClientOptions{StallTimeout: 500 * time.Millisecond, RefreshRate: 100 * time.Millisecond, Quiet: true})
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	select {
+	case err := <-done:
+		if err != ErrStalled {
+			t.Fatalf("expected %v got %v", ErrStalled, err)
+		}
+	case <-time.After(10 * time.Second):
+		c.Stop()
+		t.Fatal("client did not give up")
+	}
+}
+
+func TestClient_NotFound(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := &Client{options: ClientOptions{DiscoverWait: 10 * time.Second}, lastProgress: start, lastDiscover: start, discoveries: 1}
+
+	// 1. Waits out DiscoverWait:
+	if c.notFound(start.Add(9 * time.Second)) {
+		t.Fatal("expected to keep waiting within the wait")
+	}
+	if !c.notFound(start.Add(10 * time.Second)) {
+		t.Fatal("expected to give up once nothing was announced within the wait")
+	}
+
+	// 2. Or gives the last of DiscoverRetries an interval to be answered:
+	c.options = ClientOptions{DiscoverRetries: 2}
+	c.discoveries, c.lastDiscover = 3, start.Add(time.Hour)
+	if c.notFound(c.lastDiscover.Add(DefaultAnnounceInterval / 2)) {
+		t.Fatal("expected to wait for an answer to the last retry")
+	}
+	if !c.notFound(c.lastDiscover.Add(DefaultAnnounceInterval)) {
+		t.Fatal("expected to give up once the retries went unanswered")
+	}
+
+	// 3. Never once the transfer was found, or without either:
+	c.state = ExpectMetadataHeader
+	if c.notFound(start.Add(time.Hour)) {
+		t.Fatal("expected to keep going once announced")
+	}
+	c.state, c.options = ExpectAnnouncement, ClientOptions{}
+	if c.notFound(start.Add(time.Hour)) {
+		t.Fatal("expected to wait forever by default")
+	}
+}
+
+func TestClient_RunFindsNoTransfer(t *testing.T) {
+	// No server is on this port:
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13920)
+	c := NewClient(cm, ClientOptions{DiscoverRetries: 1, RefreshRate: 100 * time.Millisecond, Quiet: true})
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	select {
+	case err := <-done:
+		if err != ErrNoTransfer {
+			t.Fatalf("expected %v got %v", ErrNoTransfer, err)
+		}
+	case <-time.After(10 * time.Second):
+		c.Stop()
+		t.Fatal("client did not give up")
+	}
+}
+
+func TestClient_RunCompletesSourceSpecific(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13840)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13840)
+	runTransfer(t, sm, cm, ServerOptions{Source: multicastSource(t, net.IPv4(239, 0, 0, 100))}, ClientOptions{DiscoverSource: true}, []byte("hello source\n"))
+}
+
+func TestClient_RunCompletesOnDataGroup(t *testing.T) {
+	group := net.IPv4(239, 0, 0, 101)
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13860)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13860)
+	c := runTransfer(t, sm, cm, ServerOptions{DataGroup: group}, ClientOptions{}, bytes.Repeat([]byte("own group\n"), 4096))
+	if !c.dataGroup.Equal(group) {
+		t.Fatalf("expected to receive data on %s got %s", group, c.dataGroup)
+	}
+}
+
+func TestClient_RunCompletesOnDataGroupSourceSpecific(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13870)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13870)
+	serverOptions := ServerOptions{DataGroup: net.IPv4(239, 0, 0, 102), Source: multicastSource(t, net.IPv4(239, 0, 0, 100))}
+	runTransfer(t, sm, cm, serverOptions, ClientOptions{DiscoverSource: true}, []byte("own group and source\n"))
+}
+
+func TestClient_FollowsAddedFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "lancaster-added-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "lancaster-added-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	first := bytes.Repeat([]byte("first file\n"), 40000)
+	second := []byte("added while serving\n")
+	for name, contents := range map[string][]byte{"b.txt": first, "a.txt": second} {
+		if err = ioutil.WriteFile(filepath.Join(src, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := func(name string, size int) *TarballFile {
+		return &TarballFile{Path: name, LocalPath: filepath.Join(src, name), Size: int64(size), Mode: 0644}
+	}
+	tb, err := NewVirtualTarballReader([]*TarballFile{file("b.txt", len(first))}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	both, err := NewVirtualTarballReader([]*TarballFile{file("a.txt", len(second)), file("b.txt", len(first))}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Slow enough that the files are added partway through:
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13900)
+	s := NewServer(sm, tb, ServerOptions{Rate: 400000, Quiet: true})
+	go s.Run()
+	defer s.Stop()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dst); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13900)
+	log := &bytes.Buffer{}
+	c := NewClient(cm, ClientOptions{HashId: tb.HashId(), TarballOptions: getOptions(), RefreshRate: 50 * time.Millisecond, Quiet: true, Logger: NewLogger(log, LogInfo, false)})
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	for e := range c.Progress() {
+		if e.Bytes > 0 {
+			break
+		}
+	}
+	if err = s.AddFiles([]*TarballFile{file("a.txt", len(second))}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		c.Stop()
+		t.Fatal("client did not return after transfer")
+	}
+	if !bytes.Equal(c.HashId(), both.HashId()) {
+		t.Fatalf("expected to end on %x got %x", both.HashId(), c.HashId())
+	}
+	if !strings.Contains(log.String(), "Keeping") {
+		t.Fatalf("expected what already arrived to be kept; log:\n%s", log)
+	}
+	for name, contents := range map[string][]byte{"b.txt": first, "a.txt": second} {
+		b, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, contents) {
+			t.Fatalf("unexpected contents of %s", name)
+		}
+	}
+}
+
+// Address the system sends to the group from, which needn't be the interface's own:
+func multicastSource(t *testing.T, group net.IP) net.IP {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: group, Port: 9})
+	if err != nil {
+		t.Skipf("no route to %s: %s", group, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func TestClient_IgnoresOtherSources(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13850)
+	defer sm.Close()
+	src, err := ioutil.TempFile("", "lancaster-unheard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.Close()
+	defer os.Remove(src.Name())
+	tb, err := NewVirtualTarballReader([]*TarballFile{{Path: "unheard", LocalPath: src.Name(), Size: 0, Mode: 0644}}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(sm, tb, ServerOptions{Quiet: true}).Run()
+
+	// The server is not where we expect it so is never heard:
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13850)
+	c := NewClient(cm, ClientOptions{Source: net.IPv4(198, 51, 100, 1), StallTimeout: 500 * time.Millisecond, RefreshRate: 100 * time.Millisecond, Quiet: true})
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	select {
+	case err := <-done:
+		if err != ErrStalled || c.hashId != nil {
+			t.Fatalf("expected %v without any announcement got %v", ErrStalled, err)
+		}
+	case <-time.After(10 * time.Second):
+		c.Stop()
+		t.Fatal("client did not give up")
+	}
+}
+
+func TestScatterNaks(t *testing.T) {
+	naks := []Region{{0, 10}, {20, 30}, {40, 50}, {60, 70}}
+	actual := scatterNaks(naks, func(n int) int { return 1 })
+	expected := []Region{{0, 10}, {40, 50}, {60, 70}, {20, 30}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+	if naks[1] != (Region{20, 30}) {
+		t.Fatal("expected the NAKs to be left untouched")
+	}
+}
+
+// Simulates clients missing the same holes each asking for as many as a shrunken --be-polite window
+// allows and counts regions requested by more than one client in a round. Without a window cutting the
+// list short every client asks for every hole whatever the order:
+func simulateDuplicateRequests(clients int, random bool) int {
+	const holes, window = 64, 4
+	naks := NewNakRegions(holes * 20)
+	for i := int64(0); i < holes; i++ {
+		naks.Ack(i*20+10, i*20+20)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	duplicates := 0
+	for round := 0; round < 10; round++ {
+		requested := map[Region]bool{}
+		for c := 0; c < clients; c++ {
+			asked := naks.Naks()
+			if random {
+				asked = scatterNaks(asked, rnd.Intn)
+			}
+			for _, k := range asked[:window] {
+				if requested[k] {
+					duplicates++
+				}
+				requested[k] = true
+			}
+		}
+	}
+	return duplicates
+}
+
+func TestScatterNaks_FewerDuplicateRequests(t *testing.T) {
+	sequential := simulateDuplicateRequests(8, false)
+	random := simulateDuplicateRequests(8, true)
+	if sequential != 10*7*4 {
+		t.Fatalf("expected every client after the first to repeat all its requests got %d", sequential)
+	}
+	// Only the lowest hole, always listed first, is certain to be repeated:
+	if random >= sequential/2 {
+		t.Fatalf("expected far fewer duplicates than %d got %d", sequential, random)
+	}
+}
+
+func TestClient_RunCompletesChecksummed(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13800)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13800)
+	runTransfer(t, sm, cm, ServerOptions{Checksum: true, FEC: FEC{DataShards: 4, ParityShards: 1}}, ClientOptions{}, bytes.Repeat([]byte("0123456789abcdef"), 64*1024))
+}
+
+func TestClient_RunCompletesChunked(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	c := runLoopbackTransfer(t, 13810, ServerOptions{ChunkSize: 1400, Checksum: true}, bytes.Repeat([]byte("0123456789abcdef"), 16*1024), key)
+	if c.nakRegions.Len() != 0 {
+		t.Fatalf("expected nothing outstanding got %v", c.nakRegions.Naks())
+	}
+}
+
+func TestClient_BoundsFragmentedNaks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-fragmented")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tb, err := NewVirtualTarballWriter([]*TarballFile{{Path: "f", Size: 99999, Mode: 0644}}, VirtualTarballOptions{OutputDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	hashId := []byte("01234567")
+	log := &bytes.Buffer{}
+	c := NewClient(nil, ClientOptions{MaxNakRegions: 16, Logger: NewLogger(log, LogInfo, false)})
+	c.tb, c.hashId, c.nakRegions = tb, hashId, NewNakRegions(tb.size)
+
+	// 1. Only every other region arrives, as with heavy loss; the list never grows past the hard cap:
+	for offset := int64(0); offset+10 < tb.size; offset += 20 {
+		if err = c.processData(UDPMessage{Data: dataMessage(hashId, offset, make([]byte, 10))}); err != nil {
+			t.Fatal(err)
+		}
+		if n := c.nakRegions.Len(); n > 16*nakRegionsHardFactor {
+			t.Fatalf("expected at most %d ranges got %d", 16*nakRegionsHardFactor, n)
+		}
+	}
+	if !strings.Contains(log.String(), "Severe loss") {
+		t.Fatalf("expected a warning about severe loss; log:\n%s", log)
+	}
+
+	// 2. The next refresh brings it under the soft cap:
+	c.boundNaks()
+	if n := c.nakRegions.Len(); n > 16 {
+		t.Fatalf("expected at most 16 ranges got %d", n)
+	}
+}
+
+func TestClient_PoliteLossOnlyCountsNakedGaps(t *testing.T) {
+	c := &Client{nakRegions: NewNakRegions(100), polite: newPoliteWindow()}
+	c.nakRegions.Ack(0, 60)
+	c.lastAck = Region{0, 10}
+
+	// Skipping over what we already have loses nothing:
+	c.observeLoss(60, 10)
+	if c.polite.lost != 0 {
+		t.Fatalf("expected no loss got %d", c.polite.lost)
+	}
+
+	// A skipped region we still need was lost:
+	c.lastAck = Region{60, 70}
+	c.observeLoss(80, 10)
+	if c.polite.lost != 1 || c.polite.received != 2 {
+		t.Fatalf("expected 1 lost of 2 got %d of %d", c.polite.lost, c.polite.received)
+	}
+}
+
+func TestClient_DropsCorruptData(t *testing.T) {
+	hashId := []byte("01234567")
+	c := &Client{tb: &VirtualTarballWriter{}, hashId: hashId, checksummed: true, nakRegions: NewNakRegions(100)}
+	msg := appendChecksum(dataMessage(hashId, 0, []byte("0123456789")))
+	msg[ProtocolDataMsgPrefixSize+3] ^= 0x10
+
+	if err := c.processData(UDPMessage{Data: msg}); err != ErrBadChecksum {
+		t.Fatalf("expected %s got %v", ErrBadChecksum, err)
+	}
+	if c.nakRegions.IsAcked(0, 10) {
+		t.Fatal("expected the corrupted region to stay NAKed")
+	}
+}
+
+func TestClient_DiscoversServerOnStartup(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13720)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13720)
+
+	// The periodic announcement never comes so the client has to ask:
+	start := time.Now()
+	runTransfer(t, sm, cm, ServerOptions{AnnounceInterval: time.Hour}, ClientOptions{}, []byte("hello discovery\n"))
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected discovery to find the server promptly; took %v", elapsed)
+	}
+}
+
+func TestClient_RunCompletesCompressed(t *testing.T) {
+	runLoopbackTransfer(t, 13630, ServerOptions{Compression: CompressGzip}, []byte("hello world\n"), nil)
+}
+
+func TestClient_RunRateLimited(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures a rate-limited transfer")
+	}
+
+	// 4 MB at 8 MB/s should take about half a second:
+	const size = 4 * 1000 * 1000
+	const rate = 8 * 1000 * 1000
+	c := runLoopbackTransfer(t, 13640, ServerOptions{Rate: rate}, bytes.Repeat([]byte{0x5a}, size), nil)
+
+	elapsed := c.endTime.Sub(c.startTime)
+	expected := time.Duration(float64(size) / rate * float64(time.Second))
+	if elapsed < expected*7/10 || elapsed > expected*2 {
+		t.Fatalf("expected about %v at %d B/s got %v", expected, rate, elapsed)
+	}
+}
+
+func TestClient_DecodeMetadataOwners(t *testing.T) {
+	tb := &VirtualTarballReader{
+		files: tarballFileList{
+			&TarballFile{Path: "a", Size: 1, Mode: 0644, Uid: 1000, Gid: 0, HasOwner: true},
+			&TarballFile{Path: "b", Size: 2, Mode: 0644},
+		},
+		size: 5,
+	}
+	md, err := encodeMetadata(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md}
+	if err = c.decodeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	files := c.Files()
+	if !files[0].HasOwner || files[0].Uid != 1000 || files[0].Gid != 0 {
+		t.Fatalf("unexpected owner %v %d:%d", files[0].HasOwner, files[0].Uid, files[0].Gid)
+	}
+	if files[1].HasOwner {
+		t.Fatal("expected no owner for a file without one")
+	}
+
+	// Metadata from servers predating ownership leaves files unowned:
+	c = NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md[:len(md)-1-2*2-2*4-2*8]}
+	if err = c.decodeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Files()[0].HasOwner {
+		t.Fatal("expected no owner from older metadata")
+	}
+}
+
+func TestClient_DecodeMetadataSparse(t *testing.T) {
+	tb := &VirtualTarballReader{
+		files: tarballFileList{
+			&TarballFile{Path: "a", Size: 1 << 20, Mode: 0644, Sparse: []Region{{0, 1 << 16}, {1 << 19, 1 << 20}}},
+			&TarballFile{Path: "b", Size: 2, Mode: 0644},
+		},
+		size: 1<<20 + 1 + 3,
+	}
+	md, err := encodeMetadata(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md}
+	if err = c.decodeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	files := c.Files()
+	if len(files[0].Sparse) != 2 || files[0].Sparse[1] != (Region{1 << 19, 1 << 20}) || len(files[1].Sparse) != 0 {
+		t.Fatalf("unexpected sparse extents %v %v", files[0].Sparse, files[1].Sparse)
+	}
+	// Sparse extents are never asked for:
+	if !c.nakRegions.IsAcked(0, 1<<16) || !c.nakRegions.IsAcked(1<<19, 1<<20) || c.nakRegions.IsAcked(1<<16, 1<<19) {
+		t.Fatalf("unexpected NAKs %v", c.nakRegions.Naks())
+	}
+
+	// Extents reaching past the end of a file are refused:
+	tb.files[0].Sparse = []Region{{1 << 19, 1<<20 + 1}}
+	if md, err = encodeMetadata(tb); err != nil {
+		t.Fatal(err)
+	}
+	c = NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md}
+	if err = c.decodeMetadata(); !errors.Is(err, ErrBadSparseExtent) {
+		t.Fatalf("expected ErrBadSparseExtent got %v", err)
+	}
+}
+
+func TestClient_DecodeMetadataModTimes(t *testing.T) {
+	modTime := time.Unix(0, 1234567890123456789)
+	tb := &VirtualTarballReader{
+		files: tarballFileList{
+			&TarballFile{Path: "a", Size: 1, Mode: 0644, ModTime: modTime},
+			&TarballFile{Path: "b", Size: 2, Mode: 0644},
+		},
+		size: 5,
+	}
+	md, err := encodeMetadata(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md}
+	if err = c.decodeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	files := c.Files()
+	if !files[0].ModTime.Equal(modTime) || !files[1].ModTime.IsZero() {
+		t.Fatalf("unexpected modification times %v %v", files[0].ModTime, files[1].ModTime)
+	}
+
+	// Metadata from older servers has no trailing modification times or hashes:
+	c = NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md[:len(md)-1-2*2-2*4-2*8-2*2-2*8]}
+	if err = c.decodeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Files()[0].ModTime.IsZero() {
+		t.Fatal("expected no modification time from older metadata")
+	}
+}
+
+func TestClient_DecodeMetadataTruncated(t *testing.T) {
+	tb := &VirtualTarballReader{
+		files: tarballFileList{
+			&TarballFile{Path: "a", Size: 1, Mode: 0644},
+			&TarballFile{Path: "bb", Size: 2, Mode: 0644},
+		},
+		size: 5,
+	}
+	md, err := encodeMetadata(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anywhere within the file list is an error rather than a panic:
+	fileListEnd := 8 + 4 + (2 + 1 + 8 + 4 + 2) + (2 + 2 + 8 + 4 + 2)
+	for cut := 0; cut < fileListEnd; cut++ {
+		c := NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+		c.metadataSections = [][]byte{md[:cut]}
+		if err = c.decodeMetadata(); !errors.Is(err, ErrBadMetadata) {
+			t.Fatalf("cut at %d: expected %v got %v", cut, ErrBadMetadata, err)
+		}
+	}
+	// Past it, metadata from older servers ends at section boundaries; other cuts mustn't panic either:
+	for cut := fileListEnd; cut < len(md); cut++ {
+		c := NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+		c.metadataSections = [][]byte{md[:cut]}
+		c.decodeMetadata()
+	}
+}
+
+func TestClient_DecodeMetadataOversized(t *testing.T) {
+	header := func(size int64, count uint32) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		binary.Write(buf, byteOrder, size)
+		binary.Write(buf, byteOrder, count)
+		return buf
+	}
+	file := func(buf *bytes.Buffer, pathLen uint16, size int64) []byte {
+		binary.Write(buf, byteOrder, pathLen)
+		buf.WriteString(strings.Repeat("a", int(pathLen)))
+		binary.Write(buf, byteOrder, size)
+		binary.Write(buf, byteOrder, uint32(0644))
+		binary.Write(buf, byteOrder, uint16(0))
+		return buf.Bytes()
+	}
+
+	for name, md := range map[string][]byte{
+		"file count":         header(2, math.MaxUint32).Bytes(),
+		"file count vs data": file(header(2, 1000), 1, 1),
+		"path length":        file(header(maxMetadataPath+3, 1), maxMetadataPath+1, 1),
+		"string past end":    append(header(2, 1).Bytes(), 0xff, 0x0f, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n'),
+		"negative size":      file(header(2, 1), 1, -5),
+		"size past tarball":  file(header(2, 1), 1, 1<<40),
+		"size overflow":      file(header(1<<62, 1), 1, math.MaxInt64),
+	} {
+		c := NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+		c.metadataSections = [][]byte{md}
+		if err := c.decodeMetadata(); !errors.Is(err, ErrBadMetadata) {
+			t.Fatalf("%s: expected %v got %v", name, ErrBadMetadata, err)
+		}
+	}
+}
+
+func TestClient_UnusableMetadataFails(t *testing.T) {
+	hashId := bytes.Repeat([]byte{7}, HashSize)
+	files := tarballFileList{
+		&TarballFile{Path: "a", Size: 1, Mode: 0644},
+		&TarballFile{Path: "bb", Size: 2, Mode: 0644, Sparse: []Region{{0, 3}}},
+	}
+
+	for name, tb := range map[string]*VirtualTarballReader{
+		// Declares 99 bytes while the files add up to 5:
+		"size mismatch": {files: files[:1], size: 99},
+		"sparse extent": {files: files, size: 5},
+	} {
+		md, err := encodeMetadata(tb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewClient(nil, ClientOptions{HashId: hashId, TarballOptions: getOptions()})
+		c.state = ExpectMetadataSections
+		c.metadataSectionCount = 1
+		c.metadataSections = make([][]byte, 1)
+
+		err = c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, append([]byte{0, 0}, md...))})
+		if err == nil || c.state != Failed || !c.fatal(err) {
+			t.Fatalf("%s: expected a fatal error got %v in state %v", name, err, c.state)
+		}
+		// Nothing more is asked for; there's no socket to ask with:
+		if err = c.ask(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestClient_EmptyTransferCompletes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	md, err := encodeMetadata(&VirtualTarballReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashId := bytes.Repeat([]byte{7}, HashSize)
+	c := NewClient(nil, ClientOptions{HashId: hashId, TarballOptions: getOptions(), Quiet: true})
+	c.state = ExpectMetadataSections
+	c.metadataSectionCount = 1
+	c.metadataSections = make([][]byte, 1)
+
+	// Nothing is left to ask for once the metadata is in:
+	err = c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, append([]byte{0, 0}, md...))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.state != Done || len(c.Files()) != 0 || !c.nakRegions.IsAllAcked() {
+		t.Fatalf("expected an empty transfer done got state %v with NAKs %v", c.state, c.nakRegions.Naks())
+	}
+	if e := c.progressEvent(0, false); e.Percent != 100 {
+		t.Fatalf("expected an empty transfer 100%% complete got %v", e.Percent)
+	}
+}
+
+func TestClient_Fatal(t *testing.T) {
+	c := NewClient(nil, ClientOptions{})
+	for _, err := range []error{ErrEncrypted, fmt.Errorf("%w: '/etc'", ErrBadPath), fmt.Errorf("%w: truncated", ErrBadMetadata), ErrInsufficientSpace} {
+		if !c.fatal(err) {
+			t.Fatalf("expected %v to be fatal", err)
+		}
+	}
+	if c.fatal(nil) || c.fatal(ErrMessageTooShort) {
+		t.Fatal("expected other errors to be waited out")
+	}
+	c.state = Failed
+	if !c.fatal(ErrBadSparseExtent) {
+		t.Fatal("expected any error to be fatal once failed")
+	}
+}
+
+func TestClient_ShortMetadataMessages(t *testing.T) {
+	hashId := bytes.Repeat([]byte{7}, HashSize)
+	c := NewClient(nil, ClientOptions{HashId: hashId, TarballOptions: getOptions()})
+	c.state = ExpectMetadataHeader
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataHeader, []byte{1})}); err != ErrMessageTooShort {
+		t.Fatalf("expected %v got %v", ErrMessageTooShort, err)
+	}
+	c.state = ExpectMetadataSections
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, nil)}); err != ErrMessageTooShort {
+		t.Fatalf("expected %v got %v", ErrMessageTooShort, err)
+	}
+}
+
+func TestClient_StopKeepsProgress(t *testing.T) {
+	src, err := ioutil.TempDir("", "lancaster-stop-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "lancaster-stop-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// Slow enough that the client is stopped part way through:
+	contents := bytes.Repeat([]byte{0x5a}, 4*1000*1000)
+	srcPath := filepath.Join(src, "big.bin")
+	if err = ioutil.WriteFile(srcPath, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tb, err := NewVirtualTarballReader([]*TarballFile{{Path: "big.bin", LocalPath: srcPath, Size: int64(len(contents)), Mode: 0644}}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13750)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13750)
+	s := NewServer(sm, tb, ServerOptions{Rate: 1000 * 1000})
+	go s.Run()
+	defer s.Stop()
+
+	options := getOptions()
+	options.OutputDir = dst
+	c := NewClient(cm, ClientOptions{HashId: tb.HashId(), TarballOptions: options, Quiet: true})
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+
+	// Stop once progress has been saved at least once, i.e. data is arriving:
+	progress := filepath.Join(dst, progressPath(tb.HashId()))
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		if _, err = os.Stat(progress); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("no progress saved")
+		}
+	}
+	c.Stop()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not return after Stop")
+	}
+
+	naks, err := loadProgress(progress, tb.HashId(), tb.size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := int64(0)
+	for _, k := range naks.naks {
+		missing += k.endEx - k.start
+	}
+	if missing == 0 || missing == tb.size {
+		t.Fatalf("expected progress part way through; %d of %d bytes missing", missing, tb.size)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "big.bin")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_WriteFailureEndsDownload(t *testing.T) {
+	// Nothing can be written to a writer without files:
+	c := &Client{tb: &VirtualTarballWriter{}, log: defaultLogger(), nakRegions: NewNakRegions(20)}
+	c.writes = newWritePool(1, 1, c.nakRegions.clone())
+	if err := c.accept(0, make([]byte, 10), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.accept(10, make([]byte, 10), nil); err != nil && !errors.Is(err, ErrWriteFailed) {
+		t.Fatalf("expected %v got %v", ErrWriteFailed, err)
+	}
+
+	// Everything arrived but none of it reached the disk, so none of it counts:
+	if err := c.complete(); !errors.Is(err, ErrWriteFailed) {
+		t.Fatalf("expected %v got %v", ErrWriteFailed, err)
+	}
+	if c.state == Done {
+		t.Fatal("expected the download not to complete")
+	}
+	cmp(t, c.nakRegions.Naks(), []Region{{0, 20}})
+}
@@ -0,0 +1,139 @@
+// clients.go
+package lancaster
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// How long a client may go unheard before it is no longer counted:
+const DefaultClientTimeout = 30 * time.Second
+
+// How long to wait for further clients after everyone known has completed:
+const DefaultQuietPeriod = 10 * time.Second
+
+// What the server knows about a receiver from its control messages:
+type ClientStatus struct {
+	Address   string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Every byte of the data region stream before this offset has been received:
+	Acked int64
+}
+
+func (c *ClientStatus) Complete(size int64) bool {
+	return c.Acked >= size
+}
+
+// Tracks clients by source address; only touched from the server's control loop.
+type clientTracker struct {
+	clients map[string]*ClientStatus
+	timeout time.Duration
+
+	// When a client was last seen for the first time:
+	lastJoined time.Time
+	// Clients that have completed, kept after they time out:
+	finished map[string]bool
+}
+
+func newClientTracker(timeout time.Duration) *clientTracker {
+	if timeout <= 0 {
+		timeout = DefaultClientTimeout
+	}
+	return &clientTracker{
+		clients:  make(map[string]*ClientStatus),
+		timeout:  timeout,
+		finished: make(map[string]bool),
+	}
+}
+
+// Records a message from `addr`, returning its status and whether it is new:
+func (t *clientTracker) seen(addr *net.UDPAddr, now time.Time) (*ClientStatus, bool) {
+	key := "?"
+	if addr != nil {
+		key = addr.String()
+	}
+	c, ok := t.clients[key]
+	if !ok {
+		c = &ClientStatus{Address: key, FirstSeen: now}
+		t.clients[key] = c
+		t.lastJoined = now
+	}
+	c.LastSeen = now
+	return c, !ok
+}
+
+// Records how far the client has received; progress never goes backwards:
+func (c *ClientStatus) advance(acked int64) {
+	if acked > c.Acked {
+		c.Acked = acked
+	}
+}
+
+// Whether at least `minClients` have completed, every client still around is complete and nobody new
+// has shown up within `quiet`:
+func (t *clientTracker) allComplete(size int64, minClients int, quiet time.Duration, now time.Time) bool {
+	if len(t.finished) == 0 || len(t.finished) < minClients || now.Sub(t.lastJoined) < quiet {
+		return false
+	}
+	for _, c := range t.clients {
+		if !c.Complete(size) {
+			return false
+		}
+	}
+	return true
+}
+
+// Drops clients not heard from within the timeout and returns them:
+func (t *clientTracker) expire(now time.Time) []*ClientStatus {
+	dropped := []*ClientStatus(nil)
+	for key, c := range t.clients {
+		if now.Sub(c.LastSeen) > t.timeout {
+			dropped = append(dropped, c)
+			delete(t.clients, key)
+		}
+	}
+	sortClients(dropped)
+	return dropped
+}
+
+// Current clients ordered by address:
+func (t *clientTracker) list() []*ClientStatus {
+	l := make([]*ClientStatus, 0, len(t.clients))
+	for _, c := range t.clients {
+		l = append(l, c)
+	}
+	sortClients(l)
+	return l
+}
+
+func sortClients(l []*ClientStatus) {
+	sort.Slice(l, func(i, j int) bool { return l[i].Address < l[j].Address })
+}
+
+// e.g. "3 clients, 1 complete, slowest 45.2%":
+func (t *clientTracker) summary(size int64) string {
+	if len(t.clients) == 0 {
+		return "no clients"
+	}
+
+	complete := 0
+	slowest := int64(-1)
+	for _, c := range t.clients {
+		if c.Complete(size) {
+			complete++
+			continue
+		}
+		if slowest == -1 || c.Acked < slowest {
+			slowest = c.Acked
+		}
+	}
+
+	s := fmt.Sprintf("%d clients, %d complete", len(t.clients), complete)
+	if slowest >= 0 && size > 0 {
+		s += fmt.Sprintf(", slowest %.1f%%", float64(slowest)*100.0/float64(size))
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package lancaster
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientTracker(t *testing.T) {
+	tr := newClientTracker(10 * time.Second)
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	start := time.Unix(1000, 0)
+
+	if s := tr.summary(100); s != "no clients" {
+		t.Fatalf("unexpected summary %q", s)
+	}
+
+	c, isNew := tr.seen(a, start)
+	if !isNew {
+		t.Fatal("expected new client")
+	}
+	c.advance(40)
+	c.advance(20)
+	if c.Acked != 40 {
+		t.Fatalf("expected progress to never go backwards got %d", c.Acked)
+	}
+	c, _ = tr.seen(b, start.Add(5*time.Second))
+	c.advance(100)
+	if _, isNew = tr.seen(a, start.Add(8*time.Second)); isNew {
+		t.Fatal("expected known client")
+	}
+	if s := tr.summary(100); s != "2 clients, 1 complete, slowest 40.0%" {
+		t.Fatalf("unexpected summary %q", s)
+	}
+
+	// Only clients not heard from within the timeout are dropped:
+	dropped := tr.expire(start.Add(16 * time.Second))
+	if len(dropped) != 1 || dropped[0].Address != b.String() {
+		t.Fatalf("expected %s to be dropped got %v", b, dropped)
+	}
+	if l := tr.list(); len(l) != 1 || l[0].Address != a.String() {
+		t.Fatalf("expected only %s left got %v", a, l)
+	}
+}
+
+func TestClientTracker_AllComplete(t *testing.T) {
+	tr := newClientTracker(10 * time.Second)
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	start := time.Unix(1000, 0)
+	quiet := 5 * time.Second
+
+	if tr.allComplete(100, 1, quiet, start.Add(time.Hour)) {
+		t.Fatal("expected to wait for a first client")
+	}
+
+	ca, _ := tr.seen(a, start)
+	ca.advance(100)
+	tr.finished[ca.Address] = true
+	cb, _ := tr.seen(b, start.Add(2*time.Second))
+	if tr.allComplete(100, 1, quiet, start.Add(time.Minute)) {
+		t.Fatal("expected to wait for an incomplete client")
+	}
+
+	cb.advance(100)
+	tr.finished[cb.Address] = true
+	if tr.allComplete(100, 1, quiet, start.Add(6*time.Second)) {
+		t.Fatal("expected to wait out the quiet period since the last join")
+	}
+	if tr.allComplete(100, 3, quiet, start.Add(time.Minute)) {
+		t.Fatal("expected to wait for the minimum client count")
+	}
+
+	// Completed clients still count once they time out:
+	tr.expire(start.Add(time.Minute))
+	if !tr.allComplete(100, 2, quiet, start.Add(time.Minute)) {
+		t.Fatal("expected all complete")
+	}
+}
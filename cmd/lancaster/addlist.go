@@ -0,0 +1,29 @@
+// addlist.go
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// Serve arguments listed one per line in `path` that aren't in `added` yet. Blank lines and lines
+// starting with '#' are skipped:
+func readAddList(path string, added map[string]bool) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	args := []string(nil)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || added[line] {
+			continue
+		}
+		args = append(args, line)
+	}
+	return args, scanner.Err()
+}
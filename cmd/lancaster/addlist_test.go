@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadAddList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-addlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list")
+	if err = ioutil.WriteFile(path, []byte("a.txt\n\n# later\n  b::renamed  \nc:::\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. Blank lines and comments are skipped, arguments already added too:
+	args, err := readAddList(path, map[string]bool{"c:::": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a.txt", "b::renamed"}; !reflect.DeepEqual(args, expected) {
+		t.Fatalf("expected %v got %v", expected, args)
+	}
+
+	// 2. A missing list is an error:
+	if _, err = readAddList(filepath.Join(dir, "missing"), map[string]bool{}); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// admin.go
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/distributed-mind/lancaster"
+	"github.com/dustin/go-humanize"
+)
+
+// Listens for `status` on a Unix socket at `path` while serving. Returns what stops listening and
+// removes the socket.
+func listenAdmin(path string, target lancaster.AdminTarget, l *lancaster.Logger) (func(), error) {
+	// Left behind by a server that didn't get to clean up:
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	go lancaster.ServeAdmin(listener, target, l)
+	l.Infof("Admin socket at '%s'", path)
+
+	return func() {
+		listener.Close()
+		os.Remove(path)
+	}, nil
+}
+
+func printStatus(w io.Writer, transfers []lancaster.ServerStatus) {
+	for _, t := range transfers {
+		name := ""
+		if t.Name != "" {
+			name = fmt.Sprintf(" '%s'", t.Name)
+		}
+		fmt.Fprintf(w, "%s%s\n", t.HashId, name)
+		fmt.Fprintf(w, "  sent %s of %s bytes", humanize.Comma(t.Bytes), humanize.Comma(t.Size))
+		if t.Paused {
+			fmt.Fprintf(w, ", paused\n")
+		} else {
+			fmt.Fprintf(w, " at %s/s\n", humanize.IBytes(uint64(t.Rate)))
+		}
+		fmt.Fprintf(w, "  rate limit %s", formatRate(t.RateLimit))
+		if t.MaxRate != 0 {
+			fmt.Fprintf(w, ", congestion control between %s and %s", formatRate(t.MinRate), formatRate(t.MaxRate))
+		}
+		fmt.Fprintf(w, "\n  %d client(s), %d complete\n", t.Clients, t.ClientsCompleted)
+	}
+}
+
+// Zero is unlimited, as ServerStatus reports it:
+func formatRate(bytesPerSecond float64) string {
+	if bytesPerSecond == 0 {
+		return "unlimited"
+	}
+	return humanize.IBytes(uint64(bytesPerSecond)) + "/s"
+}
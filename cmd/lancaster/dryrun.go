@@ -0,0 +1,104 @@
+// dryrun.go
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+import "github.com/dustin/go-humanize"
+import "github.com/distributed-mind/lancaster"
+
+// Describes where a serve argument's files end up in the transfer, e.g. "../photos:::pics" is
+// "../photos/** -> pics/**":
+func describeArgument(arg string) string {
+	localPath, subdir, isRecursive := lancaster.SplitArgument(arg)
+	if localPath == lancaster.StdinArg && !isRecursive {
+		name := subdir
+		if name == "" {
+			name = lancaster.DefaultStdinName
+		}
+		return "standard input -> " + name
+	}
+
+	stat, err := os.Lstat(localPath)
+	if err != nil {
+		return fmt.Sprintf("skipped: %s", err)
+	}
+	if !stat.IsDir() {
+		if subdir == "" {
+			return localPath
+		}
+		return localPath + " -> " + subdir + " (renamed)"
+	}
+
+	pattern := "/*"
+	if isRecursive {
+		pattern = "/**"
+	}
+	if subdir == "" {
+		return localPath + pattern + " -> " + pattern
+	}
+	return localPath + pattern + " -> " + subdir + pattern
+}
+
+// Prints what serve would send for `tb` at `bytesPerSecond` without opening any sockets. A rate of 0
+// is the server's default pace and +Inf is unlimited.
+func printServePlan(w io.Writer, tb *lancaster.VirtualTarballReader, args []string, excludes []string, bytesPerSecond float64) error {
+	fmt.Fprint(w, "Arguments:\n")
+	for _, arg := range args {
+		fmt.Fprintf(w, "  %-24s %s\n", arg, describeArgument(arg))
+	}
+	fmt.Fprint(w, "Excludes:\n")
+	for _, pattern := range excludes {
+		fmt.Fprintf(w, "  %s\n", pattern)
+	}
+
+	fmt.Fprint(w, "Files:\n")
+	regular := 0
+	for _, f := range tb.Files() {
+		switch {
+		case f.SymlinkDestination != "":
+			fmt.Fprintf(w, "  %v %15s '%s' -> '%s'\n", f.Mode, "", f.Path, f.SymlinkDestination)
+		case f.LinkTarget != "":
+			fmt.Fprintf(w, "  %v %15s '%s' => '%s'\n", f.Mode, "", f.Path, f.LinkTarget)
+		default:
+			fmt.Fprintf(w, "  %v %15s '%s'\n", f.Mode, humanize.Comma(f.Size), f.Path)
+		}
+		if f.Mode.IsRegular() {
+			regular++
+		}
+	}
+
+	// The default pace is in data messages:
+	regionSize := float64(lancaster.DefaultDatagramSize - lancaster.ProtocolDataMsgPrefixSize)
+	rateDesc := "unlimited"
+	if bytesPerSecond == 0 {
+		bytesPerSecond = lancaster.DefaultPace * regionSize
+		rateDesc = fmt.Sprintf("%s/s (default)", humanize.IBytes(uint64(bytesPerSecond)))
+	} else if !math.IsInf(bytesPerSecond, 1) {
+		rateDesc = fmt.Sprintf("%s/s", humanize.IBytes(uint64(bytesPerSecond)))
+	}
+	duration := time.Duration(0)
+	if !math.IsInf(bytesPerSecond, 1) {
+		duration = time.Duration(float64(tb.Size()) / bytesPerSecond * float64(time.Second))
+	}
+
+	e, err := lancaster.EstimateWireSize(tb, lancaster.DefaultDatagramSize, duration)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Total:          %15s bytes in %d file(s) (%d entries)\n", humanize.Comma(tb.Size()), regular, len(tb.Files()))
+	fmt.Fprintf(w, "Wire:           %15s bytes in %s datagrams (%.2f%% overhead)\n", humanize.Comma(e.Total()), humanize.Comma(e.DataDatagrams+e.MetadataDatagrams+e.AnnounceDatagrams), e.Overhead())
+	fmt.Fprintf(w, "Rate:           %15s\n", rateDesc)
+	if math.IsInf(bytesPerSecond, 1) {
+		fmt.Fprintf(w, "Estimated time: %15s\n", "network bound")
+	} else {
+		fmt.Fprintf(w, "Estimated time: %15v\n", duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "ID:             %s\n", hex.EncodeToString(tb.HashId()))
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/distributed-mind/lancaster"
+)
+
+func testOptions() lancaster.VirtualTarballOptions {
+	options := lancaster.VirtualTarballOptions{}
+	if runtime.GOOS == "windows" {
+		options.CompatMode = true
+	}
+	return options
+}
+
+func TestDescribeArgument(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.txt")
+	if err = ioutil.WriteFile(file, []byte("hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for arg, expected := range map[string]string{
+		file:                    file,
+		file + "::b.txt":        file + " -> b.txt (renamed)",
+		dir:                     dir + "/* -> /*",
+		dir + ":::":             dir + "/** -> /**",
+		dir + ":::site":         dir + "/** -> site/**",
+		dir + "::site":          dir + "/* -> site/*",
+		"-":                     "standard input -> stdin",
+		"-::db.dump":            "standard input -> db.dump",
+		filepath.Join(dir, "x"): "skipped: ",
+	} {
+		if actual := describeArgument(arg); !strings.HasPrefix(actual, expected) {
+			t.Fatalf("%s: expected %q got %q", arg, expected, actual)
+		}
+	}
+}
+
+func TestPrintServePlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.txt")
+	if err = ioutil.WriteFile(file, bytes.Repeat([]byte{'a'}, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{file + "::renamed.txt"}
+	files, err := lancaster.BuildTarball(args, []string{"*.tmp"}, false, false, 0, lancaster.IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := lancaster.NewVirtualTarballReader(files, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	out := &bytes.Buffer{}
+	if err = printServePlan(out, tb, args, []string{"*.tmp"}, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"-> renamed.txt (renamed)",
+		"  *.tmp\n",
+		"1,048,576 'renamed.txt'",
+		"1,048,577 bytes in 1 file(s)",
+		"1.0 MiB/s",
+		"Estimated time:              1s",
+		hex.EncodeToString(tb.HashId()),
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected %q in:\n%s", expected, out)
+		}
+	}
+
+	out.Reset()
+	if err = printServePlan(out, tb, args, nil, math.Inf(1)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "network bound") {
+		t.Fatalf("expected no time estimate when unlimited:\n%s", out)
+	}
+}
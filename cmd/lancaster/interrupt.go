@@ -0,0 +1,49 @@
+// interrupt.go
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/distributed-mind/lancaster"
+	"github.com/urfave/cli"
+)
+
+// Exit code after SIGINT or SIGTERM, as shells report a process killed by SIGINT:
+const exitInterrupted = 130
+
+var ErrInterrupted = cli.NewExitError("interrupted", exitInterrupted)
+
+// Calls `stop` on the first SIGINT or SIGTERM so a Run loop can leave its group, flush what it wrote
+// and keep its progress; a second signal exits at once. The returned function stops handling signals
+// and reports whether one arrived.
+func stopOnInterrupt(l *lancaster.Logger, stop func()) func() bool {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	interrupted := int32(0)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			atomic.StoreInt32(&interrupted, 1)
+			l.Warnf("Received %s; cleaning up (again to exit immediately)", sig)
+			stop()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+
+	return func() bool {
+		signal.Stop(signals)
+		close(done)
+		return atomic.LoadInt32(&interrupted) != 0
+	}
+}
@@ -0,0 +1,36 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/distributed-mind/lancaster"
+)
+
+func TestStopOnInterrupt(t *testing.T) {
+	stopped := make(chan struct{})
+	interrupted := stopOnInterrupt(lancaster.NewLogger(ioutil.Discard, lancaster.LogError, false), func() { close(stopped) })
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected SIGTERM to stop")
+	}
+	if !interrupted() {
+		t.Fatal("expected to report the interruption")
+	}
+}
+
+func TestStopOnInterrupt_NoSignal(t *testing.T) {
+	interrupted := stopOnInterrupt(lancaster.NewLogger(ioutil.Discard, lancaster.LogError, false), func() { t.Fatal("unexpected stop") })
+	if interrupted() {
+		t.Fatal("expected no interruption")
+	}
+}
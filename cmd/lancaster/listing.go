@@ -0,0 +1,107 @@
+// listing.go
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/distributed-mind/lancaster"
+)
+
+// Listing is the machine-readable form of `ls` and `id` for tooling to diff against what's deployed.
+// Files are sorted by path and have the descriptor's shape plus the mode in octal:
+//
+//	{"hashId": "<hex>", "size": 5, "files": [{"path": "a/b.txt", "size": 5, "mode": 420, "hash": "<hex>", "modeOctal": "0644"}, ...]}
+type Listing struct {
+	HashId string        `json:"hashId"`
+	Size   int64         `json:"size"`
+	Files  []ListingFile `json:"files"`
+}
+
+type ListingFile struct {
+	lancaster.DescriptorFile
+	ModeOctal string `json:"modeOctal"`
+}
+
+// Hashes the contents of every regular file so the listing carries them:
+func newListing(tb *lancaster.VirtualTarballReader) (*Listing, error) {
+	if err := tb.HashFiles(); err != nil {
+		return nil, err
+	}
+	return listingOf(tb.HashId(), tb.Files()), nil
+}
+
+// Files without a hash, e.g. received from older servers, list an empty one:
+func listingOf(hashId []byte, files []*lancaster.TarballFile) *Listing {
+	l := &Listing{
+		HashId: hex.EncodeToString(hashId),
+		Files:  make([]ListingFile, 0, len(files)),
+	}
+	for _, f := range files {
+		l.Size += f.Size
+		l.Files = append(l.Files, ListingFile{
+			DescriptorFile: lancaster.DescriptorFile{
+				Path: f.Path,
+				Size: f.Size,
+				Mode: f.Mode,
+				Hash: hex.EncodeToString(f.Hash),
+			},
+			ModeOctal: octalMode(f.Mode),
+		})
+	}
+	sort.SliceStable(l.Files, func(i, j int) bool {
+		return l.Files[i].Path < l.Files[j].Path
+	})
+	return l
+}
+
+func printListingJSON(w io.Writer, tb *lancaster.VirtualTarballReader) error {
+	l, err := newListing(tb)
+	if err != nil {
+		return err
+	}
+	return encodeListing(w, l)
+}
+
+func encodeListing(w io.Writer, l *Listing) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// Records what a verified download received, in the same form as `ls --json`, for auditing and `verify`:
+func writeManifest(path string, hashId []byte, files []*lancaster.TarballFile) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = encodeListing(f, listingOf(hashId, files))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Permission bits as chmod takes them, including setuid, setgid and sticky:
+func octalMode(m os.FileMode) string {
+	bits := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
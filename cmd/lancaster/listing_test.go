@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distributed-mind/lancaster"
+)
+
+func TestPrintListingJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-listing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	contents := map[string]string{"b.txt": "bbb\n", "a.txt": "a\n"}
+	for name, data := range contents {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := lancaster.BuildTarball([]string{dir + ":::"}, nil, true, false, 0, lancaster.IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := lancaster.NewVirtualTarballReader(files, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	out := &bytes.Buffer{}
+	if err = printListingJSON(out, tb); err != nil {
+		t.Fatal(err)
+	}
+	l := &Listing{}
+	if err = json.Unmarshal(out.Bytes(), l); err != nil {
+		t.Fatal(err)
+	}
+
+	if l.HashId != hex.EncodeToString(tb.HashId()) {
+		t.Fatalf("expected id %s got %s", hex.EncodeToString(tb.HashId()), l.HashId)
+	}
+	if l.Size != 6 {
+		t.Fatalf("expected total size 6 got %d", l.Size)
+	}
+	paths := []string{}
+	for _, f := range l.Files {
+		paths = append(paths, f.Path)
+		data, ok := contents[f.Path]
+		if !ok {
+			if !f.Mode.IsDir() || f.Hash != "" {
+				t.Fatalf("unexpected entry %+v", f)
+			}
+			continue
+		}
+		sum := sha256.Sum256([]byte(data))
+		if f.Hash != hex.EncodeToString(sum[:]) {
+			t.Fatalf("%s: expected hash %x got %s", f.Path, sum, f.Hash)
+		}
+		if f.Size != int64(len(data)) || f.Mode != 0644 || f.ModeOctal != "0644" {
+			t.Fatalf("%s: unexpected %+v", f.Path, f)
+		}
+	}
+	for i := 1; i < len(paths); i++ {
+		if paths[i-1] >= paths[i] {
+			t.Fatalf("expected files sorted by path: %v", paths)
+		}
+	}
+	if len(paths) < 2 || paths[len(paths)-2] != "a.txt" || paths[len(paths)-1] != "b.txt" {
+		t.Fatalf("expected a.txt and b.txt: %v", paths)
+	}
+}
+
+func TestOctalMode(t *testing.T) {
+	for m, expected := range map[os.FileMode]string{
+		0644:                                 "0644",
+		os.ModeDir | 0755:                    "0755",
+		os.ModeSetuid | 0755:                 "4755",
+		os.ModeSetgid | os.ModeSticky | 0770: "3770",
+	} {
+		if actual := octalMode(m); actual != expected {
+			t.Fatalf("%v: expected %s got %s", m, expected, actual)
+		}
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{"b.txt": "bbb\n", "a.txt": "a\n"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := lancaster.BuildTarball([]string{filepath.Join(dir, "b.txt") + "::b.txt", filepath.Join(dir, "a.txt") + "::a.txt"}, nil, false, false, 0, lancaster.IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := lancaster.NewVirtualTarballReader(files, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	listing := &bytes.Buffer{}
+	if err = printListingJSON(listing, tb); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same as ls --json prints for what was served:
+	path := filepath.Join(dir, "manifest.json")
+	if err = writeManifest(path, tb.HashId(), tb.Files()); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(manifest, listing.Bytes()) {
+		t.Fatalf("expected manifest\n%s\ngot\n%s", listing.Bytes(), manifest)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected temporary file to be renamed; got %v", err)
+	}
+}
@@ -0,0 +1,1414 @@
+// main
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/distributed-mind/lancaster"
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli"
+)
+
+// Exit code when a download gives up on a stalled or missing transfer, as timeout(1) exits:
+const exitTimedOut = 124
+
+func main() {
+	netInterfaceName := ""
+	netInterfaces := []*net.Interface(nil)
+	ttl := 0
+	loopbackEnable := false
+	hashIdStr := ""
+	hashId := []byte(nil)
+	options := lancaster.VirtualTarballOptions{}
+	refreshRate := time.Duration(0)
+	linkLocal := false
+	host := ""
+	devicePath := ""
+	force := false
+	logDir := ""
+	rateFile := ""
+	rateStr := ""
+	congestionControl := false
+	minRateStr := ""
+	maxRateStr := ""
+	carousel := false
+	announceEvery := time.Duration(0)
+	announceTTL := 0
+	clientTimeout := time.Duration(0)
+	untilComplete := false
+	quietPeriod := time.Duration(0)
+	minClients := 0
+	adminSocket := ""
+	setRateStr := ""
+	againstIdStr := ""
+	zeroCopy := false
+	checksum := false
+	chunkSizeStr := ""
+	useMmap := false
+	dryRun := false
+	bePolite := false
+	randomNaks := false
+	delta := false
+	stallTimeout := time.Duration(0)
+	discoverWait := time.Duration(0)
+	discoverRetries := 0
+	randomOrder := false
+	casStore := ""
+	descriptorPath := ""
+	maxRetransmitRatio := float64(0)
+	announceList := false
+	transferName := ""
+	listOnly := false
+	estimate := false
+	estimateDuration := time.Duration(0)
+	jsonOutput := false
+	noDefaultExcludes := false
+	dirModes := false
+	stripComponents := 0
+	noHidden := false
+	onlyHidden := false
+	hiddenMode := lancaster.IncludeHidden
+	excludePatterns := cli.StringSlice{}
+	compressName := ""
+	fecStr := ""
+	pskStr := ""
+	signKeyPath := ""
+	pubKeyStr := ""
+	sourceStr := ""
+	fromTar := false
+	asTarPath := ""
+	outputDir := ""
+	manifestPath := ""
+	statsJson := false
+	progressStr := ""
+	writeWorkers := 0
+	serveEach := false
+	writeQueue := 0
+	maxNakRegions := 0
+	rcvbufStr := ""
+	sndbufStr := ""
+	dscpStr := ""
+	dscpControl := false
+	logLevelStr := ""
+	logJSON := false
+	quiet := false
+	logger := (*lancaster.Logger)(nil)
+	metricsAddr := ""
+	eventLogPath := ""
+	events := (*lancaster.EventLog)(nil)
+	closeEvents := func() error { return nil }
+	metrics := (*lancaster.Metrics)(nil)
+	unicastStr := ""
+	hashAlgorithmStr := ""
+	unicastClients := cli.StringSlice{}
+	dataGroupStrs := cli.StringSlice{}
+	addList := ""
+	// Packet loss injected for testing; the flags are hidden:
+	loss := lancaster.LossSimulation{}
+
+	// Settings shared by multicast and unicast transports:
+	configureMulticast := func(m *lancaster.Multicast) (*lancaster.Multicast, error) {
+		m.SetTTL(ttl)
+		m.SetLoopback(loopbackEnable)
+		if rcvbufStr != "" {
+			n, err := lancaster.ParseBufferSize(rcvbufStr)
+			if err != nil {
+				return nil, err
+			}
+			m.SetReadBufferSize(n)
+		}
+		if sndbufStr != "" {
+			n, err := lancaster.ParseBufferSize(sndbufStr)
+			if err != nil {
+				return nil, err
+			}
+			m.SetWriteBufferSize(n)
+		}
+		if dscpStr != "" {
+			dscp, err := lancaster.ParseDSCP(dscpStr)
+			if err != nil {
+				return nil, err
+			}
+			m.SetDataDSCP(dscp)
+			if dscpControl {
+				m.SetControlDSCP(dscp)
+			}
+		}
+		if pskStr != "" {
+			key, err := lancaster.ParsePSK(pskStr)
+			if err != nil {
+				return nil, err
+			}
+			p, err := lancaster.NewPacketCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			m.SetCipher(p)
+		}
+		if loss.Enabled() {
+			if err := m.SimulateLoss(loss); err != nil {
+				return nil, err
+			}
+			logger.Warnf("Dropping %g of data and %g of control packets on purpose; for testing only", loss.Data, loss.Control)
+		}
+		return m, nil
+	}
+
+	createUnicast := func() (*lancaster.Multicast, error) {
+		serverAddr, err := lancaster.ResolveUnicastAddr(unicastStr, 1360)
+		if err != nil {
+			return nil, err
+		}
+		clients := []*net.UDPAddr(nil)
+		for _, s := range unicastClients {
+			addr, err := lancaster.ResolveUnicastAddr(s, serverAddr.Port)
+			if err != nil {
+				return nil, err
+			}
+			clients = append(clients, addr)
+		}
+		return lancaster.NewUnicast(serverAddr, clients), nil
+	}
+
+	createMulticast := func() (*lancaster.Multicast, error) {
+		if unicastStr != "" {
+			m, err := createUnicast()
+			if err != nil {
+				return nil, err
+			}
+			return configureMulticast(m)
+		}
+
+		// If no address specified use either link-local or well-known:
+		if host == "" {
+			if linkLocal {
+				// link-local address:
+				host = "239.0.0.100"
+			} else {
+				// "well-known" address:
+				host = "224.0.0.100"
+			}
+		}
+		// Resolve address, accepting bracketed IPv6 literals, e.g. "[ff15::100]", and hostnames:
+		netAddr, err := lancaster.ResolveGroupAddr(host, 1360)
+		if err != nil {
+			return nil, err
+		}
+		m, err := lancaster.NewMulticastInterfaces(netAddr, netInterfaces)
+		if err != nil {
+			return nil, err
+		}
+		return configureMulticast(m)
+	}
+
+	app := cli.NewApp()
+
+	app.Name = "lancaster"
+	app.Usage = "a multicast file transfer tool"
+	app.Description = "Lancaster is a UDP multicast file transfer tool designed to efficiently utilize network resources in the transmission of large payloads of multiple files and folders to one or more clients."
+	app.Version = "v0.3.0"
+	app.Authors = []cli.Author{
+		{Name: "James Dunne", Email: "james.jdunne@gmail.com"},
+	}
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:        "interface,i",
+			Value:       "",
+			Usage:       "Interface name to bind to; a comma-separated list joins and sends on each, e.g. eth0,eth1",
+			Destination: &netInterfaceName,
+		},
+		cli.IntFlag{
+			Name:        "ttl,t",
+			Value:       8,
+			Usage:       "Packet TTL, the same out of every interface",
+			Destination: &ttl,
+		},
+		cli.BoolFlag{
+			Name:        "loopback,o",
+			Usage:       "Enable loopback support for testing; with several interfaces local clients hear each message once per interface",
+			Destination: &loopbackEnable,
+		},
+		cli.BoolFlag{
+			Name:        "link-local,k",
+			Usage:       "Use link-local group address 224.0.0.100 which cannot be routed to WAN, usually will only survive across switches",
+			Destination: &linkLocal,
+		},
+		cli.StringFlag{
+			Name: "group,g",
+			// Use IPv4 address 224.0.0.0 to 224.0.0.255 range for LOCAL multicast.
+			Value:       "",
+			Usage:       "Override default multicast address as host[:port] or a hostname resolving to one; IPv6 groups may be given as e.g. [ff15::100]",
+			Destination: &host,
+		},
+		cli.DurationFlag{
+			Name:        "refresh-rate,f",
+			Value:       250 * time.Millisecond,
+			Usage:       "refresh rate of meter UI",
+			Destination: &refreshRate,
+		},
+		cli.StringFlag{
+			Name:        "id",
+			Usage:       "specific hash ID of transfer to download",
+			Value:       "",
+			Destination: &hashIdStr,
+		},
+		cli.BoolFlag{
+			Name:        "no-default-excludes,include-hidden",
+			Usage:       "Include .git, .svn, .hg, .DS_Store and *~ entries found while walking directories",
+			Destination: &noDefaultExcludes,
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "Skip entries matching this gitignore-style glob while walking directories, e.g. node_modules/ or *.log; repeatable",
+			Value: &excludePatterns,
+		},
+		cli.StringFlag{
+			Name:        "unicast",
+			Usage:       "Use plain UDP where multicast doesn't route: host:port of the server to download from, or the address to serve on along with --client",
+			Destination: &unicastStr,
+		},
+		cli.StringFlag{
+			Name:        "rcvbuf",
+			Usage:       "UDP socket receive buffer size, e.g. 16MiB; defaults to room for 64 datagrams. Linux caps it at sysctl net.core.rmem_max so raise that too",
+			Destination: &rcvbufStr,
+		},
+		cli.StringFlag{
+			Name:        "sndbuf",
+			Usage:       "UDP socket send buffer size, e.g. 16MiB; defaults to room for 64 datagrams. Linux caps it at sysctl net.core.wmem_max so raise that too",
+			Destination: &sndbufStr,
+		},
+		cli.StringFlag{
+			Name:        "dscp",
+			Usage:       "Mark data packets with this DSCP, 0-63 or a name: le or cs1 for bulk traffic that yields to everything else, af11-af43, ef, cs0-cs7",
+			Destination: &dscpStr,
+		},
+		cli.BoolFlag{
+			Name:        "dscp-control",
+			Usage:       "Also mark control messages and announcements with --dscp",
+			Destination: &dscpControl,
+		},
+		cli.StringFlag{
+			Name:        "metrics-addr",
+			Usage:       "Serve Prometheus metrics at http://<addr>/metrics, e.g. :9100",
+			Destination: &metricsAddr,
+		},
+		cli.StringFlag{
+			Name:        "event-log",
+			Usage:       "Append every state change, control message, acked region and error to this file as JSON lines for later analysis",
+			Destination: &eventLogPath,
+		},
+		cli.StringFlag{
+			Name:        "log-level",
+			Value:       "info",
+			Usage:       "Least severe messages to log: debug, info, warn or error",
+			Destination: &logLevelStr,
+		},
+		cli.BoolFlag{
+			Name:        "log-json",
+			Usage:       "Log one JSON object per line, e.g. for collection under systemd",
+			Destination: &logJSON,
+		},
+		cli.BoolFlag{
+			Name:        "quiet,q",
+			Usage:       "Don't print the bandwidth meter to stderr",
+			Destination: &quiet,
+		},
+		cli.StringFlag{
+			Name:        "hash",
+			Value:       "sha256",
+			Usage:       "Algorithm served files' contents are hashed with for clients to verify: sha256 or blake3, which is much faster on large payloads; part of the transfer's ID unless sha256",
+			Destination: &hashAlgorithmStr,
+		},
+		cli.BoolFlag{
+			Name:        "dir-modes",
+			Usage:       "Include directories found while walking recursively so downloads recreate them with the same mode",
+			Destination: &dirModes,
+		},
+		cli.IntFlag{
+			Name:        "strip-components",
+			Usage:       "Drop this many leading components from paths found walking directories, before any ::subdir is prepended, and from files not renamed with ::; like tar's option of the same name",
+			Destination: &stripComponents,
+		},
+		cli.BoolFlag{
+			Name:        "no-hidden",
+			Usage:       "Skip .-prefixed entries and anything beneath them while walking directories; explicitly named paths are always kept",
+			Destination: &noHidden,
+		},
+		cli.BoolFlag{
+			Name:        "only-hidden",
+			Usage:       "Only serve .-prefixed entries and what is beneath them found while walking directories, e.g. to copy dotfiles; --exclude and the default excludes still apply",
+			Destination: &onlyHidden,
+		},
+		// Testing aids, left out of --help so nobody drops packets in production by accident:
+		cli.Float64Flag{
+			Name:        "drop-rate-data",
+			Usage:       "Testing only: drop this fraction (0-1) of data packets sent and received",
+			Hidden:      true,
+			Destination: &loss.Data,
+		},
+		cli.Float64Flag{
+			Name:        "drop-rate-control",
+			Usage:       "Testing only: drop this fraction (0-1) of control packets and announcements sent and received",
+			Hidden:      true,
+			Destination: &loss.Control,
+		},
+		cli.Int64Flag{
+			Name:        "drop-seed",
+			Usage:       "Testing only: seed choosing which packets --drop-rate-* drop so runs repeat",
+			Hidden:      true,
+			Destination: &loss.Seed,
+		},
+	}
+	if runtime.GOOS == "windows" {
+		// Windows needs compatibility mode always enabled:
+		options.CompatMode = true
+	} else {
+		app.Flags = append(app.Flags,
+			cli.BoolFlag{
+				Name:        "compat,c",
+				Usage:       "Enable compatibility mode to only share non-special files across incompatible OS/filesystems",
+				Destination: &options.CompatMode,
+			},
+		)
+	}
+	excludes := func() []string {
+		patterns := []string(excludePatterns)
+		if !noDefaultExcludes {
+			patterns = append(patterns, lancaster.DefaultExcludes...)
+		}
+		return patterns
+	}
+
+	// Write out the event log once done:
+	app.After = func(c *cli.Context) error {
+		return closeEvents()
+	}
+	app.Before = func(c *cli.Context) error {
+		level, err := lancaster.ParseLogLevel(logLevelStr)
+		if err != nil {
+			return err
+		}
+		logger = lancaster.NewLogger(os.Stdout, level, logJSON)
+
+		if metricsAddr != "" {
+			metrics = lancaster.NewMetrics()
+			if err = metrics.ListenAndServe(metricsAddr); err != nil {
+				return err
+			}
+		}
+
+		if eventLogPath != "" {
+			f, err := os.OpenFile(eventLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			events = lancaster.NewEventLog(f)
+			closed := false
+			closeEvents = func() error {
+				if closed {
+					return nil
+				}
+				closed = true
+				err := events.Close()
+				if dropped := events.Dropped(); dropped > 0 {
+					logger.Warnf("--event-log: dropped %d events while writing fell behind", dropped)
+				}
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+				return err
+			}
+			// Exit codes skip After so write out what's queued on the way out:
+			exit := cli.OsExiter
+			cli.OsExiter = func(code int) {
+				closeEvents()
+				exit(code)
+			}
+		}
+
+		// Find network interfaces by name:
+		if netInterfaceName != "" {
+			for _, name := range strings.Split(netInterfaceName, ",") {
+				netInterface, err := net.InterfaceByName(strings.TrimSpace(name))
+				if err != nil {
+					return err
+				}
+				if !hasInterface(netInterfaces, netInterface) {
+					netInterfaces = append(netInterfaces, netInterface)
+				}
+			}
+		}
+		if options.HashAlgorithm, err = lancaster.ParseHashAlgorithm(hashAlgorithmStr); err != nil {
+			return err
+		}
+		if noHidden && onlyHidden {
+			return errors.New("Can't combine --no-hidden with --only-hidden")
+		} else if noHidden {
+			hiddenMode = lancaster.SkipHidden
+		} else if onlyHidden {
+			hiddenMode = lancaster.OnlyHidden
+		}
+
+		// Decode hash ID string flag:
+		if hashIdStr != "" {
+			hashId, err = hex.DecodeString(hashIdStr)
+			if err != nil {
+				return err
+			}
+			if len(hashId) != lancaster.HashSize {
+				return errors.New(fmt.Sprintf("id must be %d characters", lancaster.HashSize*2))
+			}
+		}
+
+		return nil
+	}
+	app.HideHelp = true
+	app.Commands = []cli.Command{
+		cli.Command{
+			Name:        "download",
+			Aliases:     []string{"d"},
+			Usage:       "download files from a multicast group locally",
+			UsageText:   "download",
+			Description: "downloads files to current directory or --output-dir. If [id] is specified, it must match the ID generated by a server.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "device",
+					Usage:       "Write a single-file transfer (e.g. a disk image) directly to this block device",
+					Destination: &devicePath,
+				},
+				cli.BoolFlag{
+					Name:        "force",
+					Usage:       "Do not ask for confirmation before overwriting the --device target",
+					Destination: &force,
+				},
+				cli.BoolFlag{
+					Name:        "list",
+					Usage:       "List announced transfers and exit without downloading",
+					Destination: &listOnly,
+				},
+				cli.StringFlag{
+					Name:        "output-dir,o",
+					Usage:       "Create received files under this directory instead of the current one",
+					Destination: &outputDir,
+				},
+				cli.BoolFlag{
+					Name:        "no-owner",
+					Usage:       "Keep downloaded files owned by you instead of restoring the owners recorded by the server when running as root",
+					Destination: &options.NoOwner,
+				},
+				cli.BoolFlag{
+					Name:        "no-space-check",
+					Usage:       "Start without checking there is room for the whole download, e.g. on compressing or deduplicating filesystems",
+					Destination: &options.SkipSpaceCheck,
+				},
+				cli.StringFlag{
+					Name:        "progress",
+					Value:       "compact",
+					Usage:       "compact for a single bandwidth line or detailed for an ETA and per-file breakdown",
+					Destination: &progressStr,
+				},
+				cli.IntFlag{
+					Name:        "write-workers",
+					Value:       4,
+					Usage:       "Goroutines writing received data to disk so a slow disk doesn't stall receiving; 0 writes inline",
+					Destination: &writeWorkers,
+				},
+				cli.IntFlag{
+					Name:        "write-queue",
+					Value:       256,
+					Usage:       "Received regions held in memory waiting for a writer before receiving blocks",
+					Destination: &writeQueue,
+				},
+				cli.IntFlag{
+					Name:        "max-nak-regions",
+					Value:       lancaster.DefaultMaxNakRegions,
+					Usage:       "Missing ranges to track under heavy loss before merging the closest, asking again for the little received between them",
+					Destination: &maxNakRegions,
+				},
+				cli.StringFlag{
+					Name:        "as-tar",
+					Usage:       "Write received entries into this tar archive instead of creating files",
+					Destination: &asTarPath,
+				},
+				cli.StringFlag{
+					Name:        "manifest",
+					Usage:       "Once the download completes and passes verification, write the paths, sizes, modes and hashes received along with the ID to this file, as ls --json prints them",
+					Destination: &manifestPath,
+				},
+				cli.BoolFlag{
+					Name:        "stats-json",
+					Usage:       "Print the final summary of bytes, duration, rates, retransmit requests and duplicate and ignored packets to stdout as JSON",
+					Destination: &statsJson,
+				},
+				cli.StringFlag{
+					Name:        "pubkey",
+					Usage:       "Ignore announcements not signed by the server holding this Ed25519 public key (hex)",
+					Destination: &pubKeyStr,
+				},
+				cli.BoolFlag{
+					Name:        "be-polite",
+					Usage:       "Back off requests when loss suggests we are congesting a shared link; yields to other traffic at the cost of transfer speed",
+					Destination: &bePolite,
+				},
+				cli.DurationFlag{
+					Name:        "timeout",
+					Usage:       "Give up and exit with status 124 once no data has arrived for this long, e.g. 2m; waits forever by default",
+					Destination: &stallTimeout,
+				},
+				cli.DurationFlag{
+					Name:        "wait",
+					Usage:       "Give up and exit with status 124 if no server announces the transfer within this long, e.g. 30s; 0 waits forever",
+					Destination: &discoverWait,
+				},
+				cli.IntFlag{
+					Name:        "retries",
+					Usage:       "Give up and exit with status 124 once this many requests for servers to announce themselves, sent each second, go unanswered; 0 keeps asking",
+					Destination: &discoverRetries,
+				},
+				cli.StringFlag{
+					Name:        "source",
+					Usage:       "Only receive from the server at this IP, or the one it announces with auto, joining source-specifically (IGMPv3) so others on the group can't inject data; falls back to ignoring other senders where unsupported",
+					Destination: &sourceStr,
+				},
+				cli.BoolFlag{
+					Name:        "random-naks",
+					Usage:       "Request missing regions starting from a random one so many clients missing the same data don't all ask for it at once; only has an effect with --be-polite or more holes than fit in one request",
+					Destination: &randomNaks,
+				},
+				cli.BoolFlag{
+					Name:        "delta",
+					Usage:       "Hash files already in the download directory first and keep those matching the transfer, so re-downloading a new version only pulls what changed",
+					Destination: &delta,
+				},
+				cli.StringFlag{
+					Name:        "psk",
+					Usage:       "Encrypt and authenticate all messages with AES-256-GCM using this 64 hex character pre-shared key",
+					Destination: &pskStr,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if devicePath != "" {
+					if !force {
+						fmt.Printf("All data on %s will be overwritten! Continue? [y/N] ", devicePath)
+						answer := ""
+						fmt.Scanln(&answer)
+						if answer != "y" && answer != "Y" {
+							return errors.New("aborted")
+						}
+					}
+					options.DevicePath = devicePath
+				}
+				if manifestPath != "" && (devicePath != "" || listOnly) {
+					return errors.New("--manifest records verified files so can't be used with --device or --list")
+				}
+				if asTarPath != "" {
+					if devicePath != "" {
+						return lancaster.ErrTarAndDevice
+					}
+					options.TarPath = asTarPath
+				}
+				options.OutputDir = outputDir
+				progress, err := lancaster.ParseProgressMode(progressStr)
+				if err != nil {
+					return err
+				}
+
+				pubKey := ed25519.PublicKey(nil)
+				if pubKeyStr != "" {
+					var err error
+					if pubKey, err = lancaster.ParsePublicKey(pubKeyStr); err != nil {
+						return err
+					}
+				}
+
+				source, discoverSource := net.IP(nil), false
+				if sourceStr != "" {
+					if source, discoverSource, err = lancaster.ParseSource(sourceStr); err != nil {
+						return err
+					}
+				}
+
+				m, err := createMulticast()
+				if err != nil {
+					return err
+				}
+
+				clientOptions := lancaster.ClientOptions{
+					HashId:          hashId,
+					TarballOptions:  options,
+					RefreshRate:     refreshRate,
+					BePolite:        bePolite,
+					RandomNaks:      randomNaks,
+					Source:          source,
+					DiscoverSource:  discoverSource,
+					StallTimeout:    stallTimeout,
+					DiscoverWait:    discoverWait,
+					DiscoverRetries: discoverRetries,
+					ListOnly:        listOnly,
+					PublicKey:       pubKey,
+					Logger:          logger,
+					Quiet:           quiet,
+					Metrics:         metrics,
+					Events:          events,
+					Progress:        progress,
+					WriteWorkers:    writeWorkers,
+					WriteQueue:      writeQueue,
+					MaxNakRegions:   maxNakRegions,
+					Delta:           delta,
+				}
+				cl := lancaster.NewClient(m, clientOptions)
+				interrupted := stopOnInterrupt(logger, cl.Stop)
+				err = cl.Run()
+				if interrupted() {
+					return ErrInterrupted
+				}
+				if statsJson && !listOnly {
+					if jsonErr := json.NewEncoder(os.Stdout).Encode(cl.Stats()); jsonErr != nil {
+						return jsonErr
+					}
+				}
+				if err == lancaster.ErrStalled || err == lancaster.ErrNoTransfer {
+					return cli.NewExitError(err.Error(), exitTimedOut)
+				}
+				if err != nil {
+					return err
+				}
+
+				if manifestPath != "" && cl.State() == lancaster.Done {
+					if err = writeManifest(manifestPath, cl.HashId(), cl.Files()); err != nil {
+						return err
+					}
+				}
+
+				if listOnly {
+					for _, e := range cl.Announced() {
+						size := "?"
+						if e.Size >= 0 {
+							size = humanize.Comma(e.Size)
+						}
+						fmt.Printf("%s %15s  %s\n", hex.EncodeToString(e.HashId), size, e.Name)
+					}
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "serve",
+			Aliases:   []string{"s"},
+			Usage:     "serve files to a multicast group",
+			UsageText: "serve [file1] [file2::newname] [directory1] [directory2::assubdir] [directory3recursive:::] [-::name]",
+			Description: `Specify a list of files and directories to serve.
+Files can be renamed by having '::' separating the local filename and the renamed file.
+Folders are added without recursion unless appended with a ':::'
+A '-' serves standard input as a single file named 'stdin' unless renamed, e.g. 'tar c . | lancaster serve -::site.tar'
+Send SIGUSR1 to pause sending data while still answering clients, and again to resume.
+With --add-list, send SIGUSR2 to add the arguments listed in it since; the transfer gets a new ID and
+clients that know to follow it keep the files they already have.`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "each",
+					Usage:       "Serve every argument as its own transfer with its own ID, sharing the group and the send rate",
+					Destination: &serveEach,
+				},
+				cli.StringSliceFlag{
+					Name:  "client",
+					Usage: "With --unicast, send to this client's host[:port]; repeatable",
+					Value: &unicastClients,
+				},
+				cli.StringFlag{
+					Name:        "log-dir",
+					Usage:       "Write each transfer's log to its own file in this directory, named by ID",
+					Destination: &logDir,
+				},
+				cli.StringFlag{
+					Name:        "rate",
+					Usage:       "Cap the data send rate (e.g. 50Mbps, 5MB/s or unlimited); control messages are not limited",
+					Destination: &rateStr,
+				},
+				cli.BoolFlag{
+					Name:        "congestion-control",
+					Usage:       "Halve the send rate when clients report loss and raise it gradually when they don't; --rate still caps it",
+					Destination: &congestionControl,
+				},
+				cli.StringFlag{
+					Name:        "min-rate",
+					Usage:       "With --congestion-control, never back off below this rate (e.g. 1MB/s)",
+					Destination: &minRateStr,
+				},
+				cli.StringFlag{
+					Name:        "max-rate",
+					Usage:       "With --congestion-control, never speed up beyond this rate (e.g. 100Mbps)",
+					Destination: &maxRateStr,
+				},
+				cli.BoolFlag{
+					Name:        "carousel",
+					Usage:       "Cycle through all data continuously so clients joining at any time complete; pace it with --rate",
+					Destination: &carousel,
+				},
+				cli.DurationFlag{
+					Name:        "announce-interval",
+					Value:       lancaster.DefaultAnnounceInterval,
+					Usage:       "How often to announce the transfer",
+					Destination: &announceEvery,
+				},
+				cli.IntFlag{
+					Name:        "announce-ttl",
+					Usage:       "Packet TTL for announcements when it should be lower than --ttl to keep discovery local (0 uses --ttl)",
+					Destination: &announceTTL,
+				},
+				cli.DurationFlag{
+					Name:        "client-timeout",
+					Value:       lancaster.DefaultClientTimeout,
+					Usage:       "Stop counting a client as active once it hasn't been heard from for this long",
+					Destination: &clientTimeout,
+				},
+				cli.BoolFlag{
+					Name:        "until-complete",
+					Usage:       "Exit once every client has completed and no new ones have joined within --quiet-period",
+					Destination: &untilComplete,
+				},
+				cli.BoolFlag{
+					Name:        "random-order",
+					Usage:       "After finishing a requested region move on to a random outstanding one instead of the next in offset order",
+					Destination: &randomOrder,
+				},
+				cli.DurationFlag{
+					Name:        "quiet-period",
+					Value:       lancaster.DefaultQuietPeriod,
+					Usage:       "With --until-complete, how long to wait for further clients after everyone known has completed",
+					Destination: &quietPeriod,
+				},
+				cli.IntFlag{
+					Name:        "min-clients",
+					Value:       1,
+					Usage:       "With --until-complete, keep serving until at least this many clients have completed",
+					Destination: &minClients,
+				},
+				cli.StringFlag{
+					Name:        "rate-file",
+					Usage:       "File containing the send rate (e.g. 5MB/s, 40Mbps) or lines like 'max-rate 40Mbps' and '08:00 rate 1MB/s' scheduling limits by time of day; send SIGHUP to reload it while serving",
+					Destination: &rateFile,
+				},
+				cli.StringFlag{
+					Name:        "compress",
+					Value:       "none",
+					Usage:       "Compress the data stream with gzip, zstd or none; the transfer ID is unaffected",
+					Destination: &compressName,
+				},
+				cli.BoolFlag{
+					Name:        "from-tar",
+					Usage:       "Treat arguments as tar archives and serve their entries without unpacking; gzipped ones (.tar.gz, .tgz) are decompressed to a temporary file",
+					Destination: &fromTar,
+				},
+				cli.StringFlag{
+					Name:        "sign-key",
+					Usage:       "Sign announcements with the Ed25519 key in this file (see keygen) so clients can verify us with --pubkey",
+					Destination: &signKeyPath,
+				},
+				cli.StringFlag{
+					Name:        "source",
+					Usage:       "Announce this IP as the one we send from, signed with --sign-key, so clients with --source auto join only us",
+					Destination: &sourceStr,
+				},
+				cli.StringSliceFlag{
+					Name:  "data-group",
+					Usage: "Send data to this multicast group on the data port, announced so clients join it rather than sharing one with other transfers; a range like 239.1.0.0/16 picks each transfer's group from its ID. With --each, repeat once per argument to choose every transfer's group",
+					Value: &dataGroupStrs,
+				},
+				cli.StringFlag{
+					Name:        "fec",
+					Usage:       "Send Reed-Solomon parity as data:parity shards (e.g. 10:3) so clients repair losses without NAKing",
+					Destination: &fecStr,
+				},
+				cli.StringFlag{
+					Name:        "psk",
+					Usage:       "Encrypt and authenticate all messages with AES-256-GCM using this 64 hex character pre-shared key",
+					Destination: &pskStr,
+				},
+				cli.BoolFlag{
+					Name:        "sendfile",
+					Usage:       "Send file contents with zero-copy sendfile where supported (Linux)",
+					Destination: &zeroCopy,
+				},
+				cli.StringFlag{
+					Name:        "chunk-size",
+					Usage:       "Content bytes per data message, or auto to fit the interface MTU; defaults to filling a 64KB datagram that IP fragments. Sizes fitting the MTU (e.g. 1450, or 8950 with jumbo frames) avoid losing a whole region to one lost fragment but send more packets",
+					Destination: &chunkSizeStr,
+				},
+				cli.BoolFlag{
+					Name:        "checksum",
+					Usage:       "Trail each data message with a CRC-32C so clients drop ones corrupted on the way; costs CPU and disables --sendfile",
+					Destination: &checksum,
+				},
+				cli.BoolFlag{
+					Name:        "mmap",
+					Usage:       "Read file contents through memory mappings instead of read calls where supported",
+					Destination: &useMmap,
+				},
+				cli.IntFlag{
+					Name:        "max-open-files",
+					Value:       lancaster.DefaultMaxOpenFiles,
+					Usage:       "Keep up to this many recently read files open so requests spanning many small files don't reopen them",
+					Destination: &options.MaxOpenFiles,
+				},
+				cli.BoolFlag{
+					Name:        "dry-run",
+					Usage:       "Print the files, ID, size and estimated time of what would be sent and exit without sending",
+					Destination: &dryRun,
+				},
+				cli.StringFlag{
+					Name:        "cas-store",
+					Usage:       "Serve content from a content-addressed store directory of hash-named blobs; requires --descriptor",
+					Destination: &casStore,
+				},
+				cli.StringFlag{
+					Name:        "descriptor",
+					Usage:       "JSON descriptor listing the files to serve from --cas-store",
+					Destination: &descriptorPath,
+				},
+				cli.Float64Flag{
+					Name:        "max-retransmit-ratio",
+					Usage:       "Stop honoring NAKs once this many times the content size has been sent (0 = unlimited)",
+					Destination: &maxRetransmitRatio,
+				},
+				cli.BoolFlag{
+					Name:        "announce-list",
+					Usage:       "Also send a combined announcement listing served transfers for single round-trip discovery",
+					Destination: &announceList,
+				},
+				cli.StringFlag{
+					Name:        "name",
+					Usage:       "Name of the transfer shown to clients listing combined announcements",
+					Destination: &transferName,
+				},
+				cli.StringFlag{
+					Name:        "add-list",
+					Usage:       "File of further arguments to serve, one per line, added to the running transfer on SIGUSR2",
+					Destination: &addList,
+				},
+				cli.StringFlag{
+					Name:        "admin-socket",
+					Usage:       "Listen on a Unix socket at this path for 'status', which reports on and adjusts the running server",
+					Destination: &adminSocket,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if unicastStr != "" && len(unicastClients) == 0 {
+					return lancaster.ErrNoUnicastClients
+				}
+				compression, err := lancaster.ParseCompression(compressName)
+				if err != nil {
+					return err
+				}
+				fec, err := lancaster.ParseFEC(fecStr)
+				if err != nil {
+					return err
+				}
+				chunkSize, discoverChunkSize := 0, false
+				if chunkSizeStr != "" {
+					if chunkSize, discoverChunkSize, err = lancaster.ParseChunkSize(chunkSizeStr); err != nil {
+						return err
+					}
+				}
+				signKey := ed25519.PrivateKey(nil)
+				if signKeyPath != "" {
+					if signKey, err = lancaster.LoadSigningKey(signKeyPath); err != nil {
+						return err
+					}
+				}
+				source := net.IP(nil)
+				if sourceStr != "" {
+					if source = net.ParseIP(sourceStr); source == nil {
+						return errors.New("--source must be the IP address we send from")
+					}
+				}
+				dataGroup, dataGroups := net.IP(nil), (*net.IPNet)(nil)
+				transferGroups := []net.IP(nil)
+				if len(dataGroupStrs) == 1 {
+					if dataGroup, dataGroups, err = lancaster.ParseDataGroup(dataGroupStrs[0]); err != nil {
+						return err
+					}
+				} else if len(dataGroupStrs) > 1 {
+					if !serveEach || len(dataGroupStrs) != len(c.Args()) {
+						return errors.New("--data-group takes one group or range, or with --each one group per argument")
+					}
+					for _, s := range dataGroupStrs {
+						group, groups, err := lancaster.ParseDataGroup(s)
+						if err != nil {
+							return err
+						}
+						if groups != nil {
+							return errors.New("--data-group must be a single group when given per argument")
+						}
+						transferGroups = append(transferGroups, group)
+					}
+				}
+				sendRate := float64(0)
+				if rateStr != "" {
+					if sendRate, err = lancaster.ParseRate(rateStr); err != nil {
+						return err
+					}
+				}
+				minRate, maxRate := float64(0), float64(0)
+				if minRateStr != "" {
+					if minRate, err = lancaster.ParseRate(minRateStr); err != nil {
+						return err
+					}
+				}
+				if maxRateStr != "" {
+					if maxRate, err = lancaster.ParseRate(maxRateStr); err != nil {
+						return err
+					}
+				}
+
+				options.Mmap = useMmap
+				if addList != "" && (serveEach || casStore != "" || compression != lancaster.CompressNone || fec.Enabled()) {
+					return errors.New("--add-list can't be used with --each, --cas-store, --compress or --fec")
+				}
+
+				// Each argument is its own transfer with --each:
+				groups := []cli.Args{c.Args()}
+				if serveEach {
+					if casStore != "" {
+						return errors.New("--each cannot be used with --cas-store")
+					}
+					groups = groups[:0]
+					for _, arg := range c.Args() {
+						groups = append(groups, cli.Args{arg})
+					}
+				}
+
+				tbs := []*lancaster.VirtualTarballReader(nil)
+				names := []string(nil)
+				for _, args := range groups {
+					files := []*lancaster.TarballFile(nil)
+					if casStore != "" || descriptorPath != "" {
+						if casStore == "" || descriptorPath == "" {
+							return errors.New("--cas-store and --descriptor must be used together")
+						}
+						d, err := lancaster.LoadDescriptor(descriptorPath)
+						if err != nil {
+							return err
+						}
+						files, err = lancaster.CASTarballFiles(casStore, d)
+					} else if fromTar {
+						files, err = lancaster.BuildTarArchives(args, options.CompatMode)
+					} else {
+						files, err = lancaster.BuildTarball(args, excludes(), dirModes, !options.CompatMode, stripComponents, hiddenMode)
+					}
+					if err != nil {
+						return err
+					}
+					defer lancaster.RemoveSpooled(files)
+					tb, err := lancaster.NewVirtualTarballReader(files, options)
+					if err != nil {
+						return err
+					}
+					defer tb.Close()
+					tbs = append(tbs, tb)
+					names = append(names, lancaster.ArgumentName(args[0]))
+				}
+
+				if dryRun {
+					// Excludes only apply to walked directories:
+					planExcludes := excludes()
+					if fromTar || casStore != "" {
+						planExcludes = nil
+					}
+					for i, tb := range tbs {
+						if err = printServePlan(os.Stdout, tb, groups[i], planExcludes, sendRate); err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+
+				m, err := createMulticast()
+				if err != nil {
+					return err
+				}
+				m.SetAnnounceTTL(announceTTL)
+
+				serverOptions := lancaster.ServerOptions{
+					RefreshRate:        refreshRate,
+					LogDir:             logDir,
+					Rate:               sendRate,
+					CongestionControl:  congestionControl,
+					MinRate:            minRate,
+					MaxRate:            maxRate,
+					RateFile:           rateFile,
+					ZeroCopy:           zeroCopy,
+					Checksum:           checksum,
+					ChunkSize:          chunkSize,
+					DiscoverChunkSize:  discoverChunkSize,
+					MaxRetransmitRatio: maxRetransmitRatio,
+					AnnounceList:       announceList,
+					Name:               transferName,
+					Compression:        compression,
+					Carousel:           carousel,
+					AnnounceInterval:   announceEvery,
+					FEC:                fec,
+					SigningKey:         signKey,
+					Source:             source,
+					DataGroup:          dataGroup,
+					DataGroups:         dataGroups,
+					ClientTimeout:      clientTimeout,
+					UntilComplete:      untilComplete,
+					QuietPeriod:        quietPeriod,
+					MinClients:         minClients,
+					Logger:             logger,
+					Quiet:              quiet,
+					Metrics:            metrics,
+					Events:             events,
+				}
+				if randomOrder {
+					serverOptions.Selector = lancaster.RandomSelector{}
+				}
+				run, stop := (func() error)(nil), (func())(nil)
+				pause, resume := (func())(nil), (func())(nil)
+				admin := lancaster.AdminTarget(nil)
+				if serveEach {
+					// Transfers are named after their arguments in combined announcements:
+					ms := lancaster.NewMultiServer(m, tbs, names, transferGroups, serverOptions)
+					run, stop, pause, resume = ms.Run, ms.Stop, ms.Pause, ms.Resume
+					admin = ms
+				} else {
+					// Create server and run loop:
+					s := lancaster.NewServer(m, tbs[0], serverOptions)
+					run, stop, pause, resume = s.Run, s.Stop, s.Pause, s.Resume
+					if addList != "" {
+						// Arguments already served may be listed again:
+						added := make(map[string]bool)
+						for _, arg := range c.Args() {
+							added[arg] = true
+						}
+						defer addOnSignal(func() {
+							args, err := readAddList(addList, added)
+							files := []*lancaster.TarballFile(nil)
+							if err == nil && len(args) > 0 {
+								if fromTar {
+									files, err = lancaster.BuildTarArchives(args, options.CompatMode)
+								} else {
+									files, err = lancaster.BuildTarball(args, excludes(), dirModes, !options.CompatMode, stripComponents, hiddenMode)
+								}
+							}
+							if err == nil && len(files) > 0 {
+								err = s.AddFiles(files)
+							}
+							if err != nil {
+								// Left to try again on the next signal:
+								logger.Errorf("--add-list: %s", err)
+								return
+							}
+							for _, arg := range args {
+								added[arg] = true
+							}
+						})()
+					}
+					admin = s
+				}
+				if adminSocket != "" {
+					closeAdmin, err := listenAdmin(adminSocket, admin, logger)
+					if err != nil {
+						return err
+					}
+					defer closeAdmin()
+				}
+				defer pauseOnSignal(pause, resume)()
+				interrupted := stopOnInterrupt(logger, stop)
+				err = run()
+				if interrupted() {
+					return ErrInterrupted
+				}
+				return err
+			},
+		},
+		cli.Command{
+			Name:  "status",
+			Usage: "report on a running server through its --admin-socket, optionally changing its send rate",
+			Description: `Prints each transfer the server is serving with how much it has sent, its current rate and limits,
+and its clients. --set-rate applies until changed again or, with a scheduled --rate-file, until the next step of the
+schedule; --min-rate and --max-rate move the range a server with --congestion-control works within.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "admin-socket",
+					Usage:       "Path of the Unix socket the server was given with serve --admin-socket",
+					Destination: &adminSocket,
+				},
+				cli.StringFlag{
+					Name:        "set-rate",
+					Usage:       "Cap the data send rate (e.g. 50Mbps, 5MB/s or unlimited)",
+					Destination: &setRateStr,
+				},
+				cli.StringFlag{
+					Name:        "min-rate",
+					Usage:       "Never back off below this rate under congestion control",
+					Destination: &minRateStr,
+				},
+				cli.StringFlag{
+					Name:        "max-rate",
+					Usage:       "Never speed up beyond this rate under congestion control",
+					Destination: &maxRateStr,
+				},
+				cli.BoolFlag{
+					Name:        "json",
+					Usage:       "Print the server's reply as JSON",
+					Destination: &jsonOutput,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if adminSocket == "" {
+					return errors.New("Require --admin-socket")
+				}
+				resp, err := lancaster.QueryAdmin(adminSocket, lancaster.AdminRequest{
+					SetRate: setRateStr,
+					MinRate: minRateStr,
+					MaxRate: maxRateStr,
+				})
+				if err != nil {
+					return err
+				}
+				if jsonOutput {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					return enc.Encode(resp)
+				}
+				printStatus(os.Stdout, resp.Transfers)
+				return nil
+			},
+		},
+		cli.Command{
+			Name:    "id",
+			Aliases: []string{"i"},
+			Usage:   "compute id for list of files",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "from-tar",
+					Usage:       "Treat arguments as tar archives and serve their entries without unpacking; gzipped ones (.tar.gz, .tgz) are decompressed to a temporary file",
+					Destination: &fromTar,
+				},
+				cli.BoolFlag{
+					Name:        "estimate",
+					Usage:       "Also estimate the bytes the server will put on the wire including protocol overhead",
+					Destination: &estimate,
+				},
+				cli.DurationFlag{
+					Name:        "duration",
+					Value:       time.Minute,
+					Usage:       "How long the server is expected to run for when estimating announcement overhead",
+					Destination: &estimateDuration,
+				},
+				cli.BoolFlag{
+					Name:        "json",
+					Usage:       "Print the ID, total size and files with their modes and content hashes as JSON",
+					Destination: &jsonOutput,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				files, err := []*lancaster.TarballFile(nil), error(nil)
+				if fromTar {
+					files, err = lancaster.BuildTarArchives(c.Args(), options.CompatMode)
+				} else {
+					files, err = lancaster.BuildTarball(c.Args(), excludes(), dirModes, !options.CompatMode, stripComponents, hiddenMode)
+				}
+				if err != nil {
+					return err
+				}
+				defer lancaster.RemoveSpooled(files)
+				tb, err := lancaster.NewVirtualTarballReader(files, options)
+				if err != nil {
+					return err
+				}
+				tb.Close()
+				if jsonOutput {
+					if estimate {
+						return errors.New("Can't combine --estimate with --json")
+					}
+					return printListingJSON(os.Stdout, tb)
+				}
+				fmt.Printf("%s\n", hex.EncodeToString(tb.HashId()))
+
+				if estimate {
+					e, err := lancaster.EstimateWireSize(tb, lancaster.DefaultDatagramSize, estimateDuration)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("Content:       %15s bytes\n", humanize.Comma(e.ContentSize))
+					fmt.Printf("Data:          %15s bytes in %s datagrams\n", humanize.Comma(e.DataBytes), humanize.Comma(e.DataDatagrams))
+					fmt.Printf("Metadata:      %15s bytes in %s datagrams per client\n", humanize.Comma(e.MetadataBytes), humanize.Comma(e.MetadataDatagrams))
+					fmt.Printf("Announcements: %15s bytes in %s datagrams over %v\n", humanize.Comma(e.AnnounceBytes), humanize.Comma(e.AnnounceDatagrams), estimateDuration)
+					fmt.Printf("Total:         %15s bytes (%.2f%% overhead)\n", humanize.Comma(e.Total()), e.Overhead())
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "verify",
+			Usage:     "check a local directory against a transfer without downloading it",
+			UsageText: "verify --against <id> [directory]\n   verify [--manifest file] <id> [file1] [directory1:::] ...",
+			Description: `With --against, fetches metadata for the transfer with the given ID from a live server and checks
+that every file exists in the directory with the expected type, size and mode. Contents are compared against
+hashes the server computes of each 1MiB block of its files, and the byte ranges that differ are listed.
+Otherwise works offline: computes the ID of the given files exactly as 'id' does, with the same flags the server
+was given, and compares it to <id>. The ID covers names, sizes and modes but not contents; with --manifest, as
+written by 'download --manifest' or 'id --json', contents are hashed too and each file that differs is reported.
+Exits nonzero on any mismatch.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:        "against",
+					Usage:       "hash ID of the transfer to verify against",
+					Destination: &againstIdStr,
+				},
+				cli.StringFlag{
+					Name:        "manifest",
+					Usage:       "Without --against, also compare each file's size, mode and content hash to this manifest",
+					Destination: &manifestPath,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if againstIdStr == "" {
+					return verifyOffline(c.Args(), manifestPath, func(args []string) ([]*lancaster.TarballFile, error) {
+						return lancaster.BuildTarball(args, excludes(), dirModes, !options.CompatMode, stripComponents, hiddenMode)
+					}, options)
+				}
+				if manifestPath != "" {
+					return errors.New("--manifest only applies to verifying offline, without --against")
+				}
+				againstId, err := hex.DecodeString(againstIdStr)
+				if err != nil {
+					return err
+				}
+				if len(againstId) != lancaster.HashSize {
+					return errors.New(fmt.Sprintf("id must be %d characters", lancaster.HashSize*2))
+				}
+				dir := "."
+				if c.Args().Present() {
+					dir = c.Args().First()
+				}
+
+				m, err := createMulticast()
+				if err != nil {
+					return err
+				}
+
+				cl := lancaster.NewClient(m, lancaster.ClientOptions{
+					HashId:         againstId,
+					TarballOptions: options,
+					RefreshRate:    refreshRate,
+					MetadataOnly:   true,
+					Logger:         logger,
+					Quiet:          quiet,
+					Metrics:        metrics,
+					Events:         events,
+					BlockHashes:    true,
+				})
+				interrupted := stopOnInterrupt(logger, cl.Stop)
+				err = cl.Run()
+				if interrupted() {
+					return ErrInterrupted
+				}
+				if err != nil {
+					return err
+				}
+
+				failed := 0
+				for _, r := range lancaster.VerifyTree(dir, cl.Files(), cl.BlockHashes(), options) {
+					if r.Err != nil {
+						failed++
+						fmt.Printf("  FAIL '%s': %s\n", r.File.Path, r.Err)
+						for _, d := range r.Differs {
+							fmt.Printf("         bytes %s up to %s differ\n", humanize.Comma(d.Start), humanize.Comma(d.End))
+						}
+					} else {
+						fmt.Printf("  ok   '%s'\n", r.File.Path)
+					}
+				}
+				if failed > 0 {
+					return errors.New(fmt.Sprintf("%d files failed verification", failed))
+				}
+				return nil
+			},
+		},
+		cli.Command{
+			Name:  "ls",
+			Usage: "compute list of files",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:        "json",
+					Usage:       "Print the ID, total size and files with their modes and content hashes as JSON",
+					Destination: &jsonOutput,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				files, err := lancaster.BuildTarball(c.Args(), excludes(), dirModes, !options.CompatMode, stripComponents, hiddenMode)
+				if err != nil {
+					return err
+				}
+				defer lancaster.RemoveSpooled(files)
+				tb, err := lancaster.NewVirtualTarballReader(files, options)
+				if err != nil {
+					return err
+				}
+				tb.Close()
+				if jsonOutput {
+					return printListingJSON(os.Stdout, tb)
+				}
+				fmt.Print("Files:\n")
+				for _, f := range tb.Files() {
+					fmt.Printf("  %v %15d '%s'\n", f.Mode, f.Size, f.Path)
+				}
+				fmt.Printf("%s\n", hex.EncodeToString(tb.HashId()))
+				return nil
+			},
+		},
+		cli.Command{
+			Name:      "dump-state",
+			Usage:     "print a summary of a persisted state file",
+			UsageText: "dump-state <file>",
+			Action: func(c *cli.Context) error {
+				if !c.Args().Present() {
+					return errors.New("Require a state file to dump")
+				}
+				return lancaster.DumpState(c.Args().First(), os.Stdout)
+			},
+		},
+		cli.Command{
+			Name:      "keygen",
+			Usage:     "generate an Ed25519 key for signing announcements and print its public key",
+			UsageText: "keygen <file>",
+			Action: func(c *cli.Context) error {
+				if !c.Args().Present() {
+					return errors.New("Require a file to write the signing key to")
+				}
+				pub, err := lancaster.GenerateSigningKey(c.Args().First())
+				if err != nil {
+					return err
+				}
+				fmt.Println(hex.EncodeToString(pub))
+				return nil
+			},
+		},
+	}
+
+	app.RunAndExitOnError()
+	return
+}
+
+func hasInterface(netInterfaces []*net.Interface, netInterface *net.Interface) bool {
+	for _, i := range netInterfaces {
+		if i.Index == netInterface.Index {
+			return true
+		}
+	}
+	return false
+}
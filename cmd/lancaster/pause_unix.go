@@ -0,0 +1,38 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Pauses sending data on SIGUSR1 and resumes on the next, e.g. for a maintenance window. The returned
+// function stops handling the signal.
+func pauseOnSignal(pause func(), resume func()) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	done := make(chan struct{})
+
+	go func() {
+		paused := false
+		for {
+			select {
+			case <-signals:
+				if paused = !paused; paused {
+					pause()
+				} else {
+					resume()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,29 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPauseOnSignal(t *testing.T) {
+	toggled := make(chan string, 2)
+	stop := pauseOnSignal(func() { toggled <- "pause" }, func() { toggled <- "resume" })
+	defer stop()
+
+	for _, expected := range []string{"pause", "resume"} {
+		if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case actual := <-toggled:
+			if actual != expected {
+				t.Fatalf("expected %s got %s", expected, actual)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected SIGUSR1 to %s", expected)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// +build windows
+
+package main
+
+// Windows has no SIGUSR1 to pause with:
+func pauseOnSignal(pause func(), resume func()) func() {
+	return func() {}
+}
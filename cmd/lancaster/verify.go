@@ -0,0 +1,131 @@
+// verify.go
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/distributed-mind/lancaster"
+)
+
+var ErrVerifyMismatch = errors.New("verification failed")
+
+// Computes the ID of local files as `id` would and compares it to the first argument, and each file to
+// the manifest when given:
+func verifyOffline(args []string, manifestPath string, build func([]string) ([]*lancaster.TarballFile, error), options lancaster.VirtualTarballOptions) error {
+	if len(args) < 2 {
+		return errors.New("Require an id and the files to verify")
+	}
+	id, err := hex.DecodeString(args[0])
+	if err != nil {
+		return err
+	}
+	if len(id) != lancaster.HashSize {
+		return errors.New(fmt.Sprintf("id must be %d characters", lancaster.HashSize*2))
+	}
+	manifest := (*Listing)(nil)
+	if manifestPath != "" {
+		if manifest, err = readManifest(manifestPath); err != nil {
+			return err
+		}
+		if manifest.HashId != args[0] {
+			fmt.Printf("warning: manifest is for %s\n", manifest.HashId)
+		}
+	}
+
+	files, err := build(args[1:])
+	if err != nil {
+		return err
+	}
+	defer lancaster.RemoveSpooled(files)
+	tb, err := lancaster.NewVirtualTarballReader(files, options)
+	if err != nil {
+		return err
+	}
+	tb.Close()
+
+	failed := 0
+	if manifest != nil {
+		local, err := newListing(tb)
+		if err != nil {
+			return err
+		}
+		for _, r := range diffManifest(manifest, local, options.CompatMode) {
+			if r.Err != nil {
+				failed++
+				fmt.Printf("  FAIL '%s': %s\n", r.Path, r.Err)
+			} else {
+				fmt.Printf("  ok   '%s'\n", r.Path)
+			}
+		}
+	}
+
+	actual := hex.EncodeToString(tb.HashId())
+	if actual != args[0] {
+		if manifest != nil {
+			return fmt.Errorf("%w: id is %s, expected %s; %d files differ", ErrVerifyMismatch, actual, args[0], failed)
+		}
+		return fmt.Errorf("%w: id is %s, expected %s", ErrVerifyMismatch, actual, args[0])
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d files differ", ErrVerifyMismatch, failed)
+	}
+	fmt.Printf("%s ok\n", actual)
+	return nil
+}
+
+func readManifest(path string) (*Listing, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listing{}
+	if err = json.Unmarshal(b, l); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return l, nil
+}
+
+type ManifestResult struct {
+	Path string
+	Err  error
+}
+
+// Compares local files against a manifest, one result per path in either. Modes are skipped in
+// compatibility mode and hashes when either side has none:
+func diffManifest(manifest *Listing, local *Listing, compat bool) []ManifestResult {
+	found := make(map[string]ListingFile, len(local.Files))
+	for _, f := range local.Files {
+		found[f.Path] = f
+	}
+
+	results := make([]ManifestResult, 0, len(manifest.Files))
+	for _, expected := range manifest.Files {
+		f, ok := found[expected.Path]
+		delete(found, expected.Path)
+		err := error(nil)
+		switch {
+		case !ok:
+			err = fmt.Errorf("missing")
+		case f.Mode&os.ModeType != expected.Mode&os.ModeType:
+			err = fmt.Errorf("type mismatch; %v != %v", f.Mode, expected.Mode)
+		case f.Size != expected.Size:
+			err = fmt.Errorf("size mismatch; %d != %d", f.Size, expected.Size)
+		case !compat && f.Mode != expected.Mode:
+			err = fmt.Errorf("mode mismatch; %v != %v", f.Mode, expected.Mode)
+		case f.Hash != "" && expected.Hash != "" && f.Hash != expected.Hash:
+			err = fmt.Errorf("content hash mismatch")
+		}
+		results = append(results, ManifestResult{Path: expected.Path, Err: err})
+	}
+	for _, f := range local.Files {
+		if _, ok := found[f.Path]; ok {
+			results = append(results, ManifestResult{Path: f.Path, Err: fmt.Errorf("not in manifest")})
+		}
+	}
+	return results
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/distributed-mind/lancaster"
+)
+
+func buildForTest(args []string) ([]*lancaster.TarballFile, error) {
+	return lancaster.BuildTarball(args, nil, false, false, 0, lancaster.IncludeHidden)
+}
+
+func TestVerifyOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tree := filepath.Join(dir, "tree")
+	if err = os.Mkdir(tree, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{"a.txt": "a\n", "b.txt": "bbb\n"} {
+		if err = ioutil.WriteFile(filepath.Join(tree, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{tree + ":::"}
+
+	files, err := buildForTest(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := lancaster.NewVirtualTarballReader(files, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb.Close()
+	if err = tb.HashFiles(); err != nil {
+		t.Fatal(err)
+	}
+	id := hex.EncodeToString(tb.HashId())
+	manifest := filepath.Join(dir, "manifest.json")
+	if err = writeManifest(manifest, tb.HashId(), tb.Files()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0: matches with and without the manifest:
+	if err = verifyOffline(append([]string{id}, args...), "", buildForTest, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyOffline(append([]string{id}, args...), manifest, buildForTest, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1: the id covers names, sizes and modes but not contents, which only the manifest catches:
+	if err = ioutil.WriteFile(filepath.Join(tree, "b.txt"), []byte("BBB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyOffline(append([]string{id}, args...), "", buildForTest, testOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyOffline(append([]string{id}, args...), manifest, buildForTest, testOptions()); !errors.Is(err, ErrVerifyMismatch) {
+		t.Fatalf("expected mismatch got %v", err)
+	}
+	files, err = buildForTest(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := lancaster.NewVirtualTarballReader(files, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed.Close()
+	local, err := newListing(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := readManifest(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range diffManifest(expected, local, false) {
+		if (r.Path == "b.txt") != (r.Err != nil) {
+			t.Fatalf("'%s': unexpected result %v", r.Path, r.Err)
+		}
+	}
+
+	// 2: a new file changes the id:
+	if err = ioutil.WriteFile(filepath.Join(tree, "c.txt"), []byte("c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifyOffline(append([]string{id}, args...), "", buildForTest, testOptions()); !errors.Is(err, ErrVerifyMismatch) {
+		t.Fatalf("expected mismatch got %v", err)
+	}
+
+	// 3: bad ids:
+	if err = verifyOffline([]string{"abc", tree + ":::"}, "", buildForTest, testOptions()); err == nil {
+		t.Fatal("expected short id to be rejected")
+	}
+	if err = verifyOffline([]string{id}, "", buildForTest, testOptions()); err == nil {
+		t.Fatal("expected missing files to be rejected")
+	}
+}
+
+func TestDiffManifest(t *testing.T) {
+	file := func(path string, size int64, mode os.FileMode, hash string) ListingFile {
+		return ListingFile{DescriptorFile: lancaster.DescriptorFile{Path: path, Size: size, Mode: mode, Hash: hash}}
+	}
+	manifest := &Listing{Files: []ListingFile{
+		file("same", 1, 0644, "aa"),
+		file("gone", 1, 0644, "aa"),
+		file("resized", 1, 0644, "aa"),
+		file("chmodded", 1, 0644, "aa"),
+		file("edited", 1, 0644, "aa"),
+		file("unhashed", 1, 0644, ""),
+		file("dir", 0, os.ModeDir|0755, ""),
+	}}
+	local := &Listing{Files: []ListingFile{
+		file("same", 1, 0644, "aa"),
+		file("resized", 2, 0644, "aa"),
+		file("chmodded", 1, 0600, "aa"),
+		file("edited", 1, 0644, "bb"),
+		file("unhashed", 1, 0644, "cc"),
+		file("dir", 0, 0644, ""),
+		file("new", 1, 0644, "aa"),
+	}}
+
+	cases := []struct {
+		compat bool
+		failed []string
+	}{
+		// 0: everything compared:
+		{false, []string{"gone", "resized", "chmodded", "edited", "dir", "new"}},
+		// 1: modes don't travel in compatibility mode, though types do:
+		{true, []string{"gone", "resized", "edited", "dir", "new"}},
+	}
+	for i, c := range cases {
+		failed := []string{}
+		for _, r := range diffManifest(manifest, local, c.compat) {
+			if r.Err != nil {
+				failed = append(failed, r.Path)
+			}
+		}
+		if strings.Join(failed, ",") != strings.Join(c.failed, ",") {
+			t.Fatalf("case %d: expected %v got %v", i, c.failed, failed)
+		}
+	}
+}
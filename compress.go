@@ -0,0 +1,131 @@
+// compress.go
+package lancaster
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+import "github.com/klauspost/compress/zstd"
+
+// Compression applied to the virtual tarball byte stream before it is cut into data regions:
+type Compression byte
+
+const (
+	CompressNone Compression = iota
+	CompressGzip
+	CompressZstd
+)
+
+var (
+	ErrBadCompression   = errors.New("unknown compression; expected gzip, zstd or none")
+	ErrDecompressedSize = errors.New("decompressed stream does not match tarball size")
+)
+
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none":
+		return CompressNone, nil
+	case "gzip":
+		return CompressGzip, nil
+	case "zstd":
+		return CompressZstd, nil
+	default:
+		return CompressNone, ErrBadCompression
+	}
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressNone:
+		return "none"
+	case CompressGzip:
+		return "gzip"
+	case CompressZstd:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+func compressStream(c Compression, dst io.Writer, src io.Reader) error {
+	w := io.WriteCloser(nil)
+	switch c {
+	case CompressGzip:
+		w = gzip.NewWriter(dst)
+	case CompressZstd:
+		zw, err := zstd.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+		w = zw
+	default:
+		return ErrBadCompression
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func decompressStream(c Compression, dst io.Writer, src io.Reader) error {
+	r := io.Reader(nil)
+	switch c {
+	case CompressGzip:
+		gr, err := gzip.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	case CompressZstd:
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return ErrBadCompression
+	}
+
+	_, err := io.Copy(dst, r)
+	return err
+}
+
+// Compresses the whole virtual tarball into a temporary file so regions can be served from it.
+// The caller closes and removes the file.
+func compressTarball(c Compression, tb *VirtualTarballReader) (*os.File, int64, error) {
+	f, err := ioutil.TempFile("", "lancaster-compressed")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(0)
+	err = compressStream(c, f, io.NewSectionReader(tb, 0, tb.size))
+	if err == nil {
+		size, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// Adapts an io.WriterAt into a sequential io.Writer:
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package lancaster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, c := range []Compression{CompressNone, CompressGzip, CompressZstd} {
+		actual, err := ParseCompression(c.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != c {
+			t.Fatalf("expected %v got %v", c, actual)
+		}
+	}
+	if _, err := ParseCompression("lz4"); err != ErrBadCompression {
+		t.Fatalf("expected %v got %v", ErrBadCompression, err)
+	}
+}
+
+func TestCompressStream_RoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("key = value\n"), 1000)
+	for _, c := range []Compression{CompressGzip, CompressZstd} {
+		compressed := &bytes.Buffer{}
+		if err := compressStream(c, compressed, bytes.NewReader(payload)); err != nil {
+			t.Fatal(err)
+		}
+		if compressed.Len() >= len(payload) {
+			t.Fatalf("%v: expected repetitive payload to shrink; %d >= %d", c, compressed.Len(), len(payload))
+		}
+
+		decompressed := &bytes.Buffer{}
+		if err := decompressStream(c, decompressed, compressed); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed.Bytes(), payload) {
+			t.Fatalf("%v: round trip mismatch", c)
+		}
+	}
+}
+
+func TestCompressTarball_IntoWriter(t *testing.T) {
+	src, err := ioutil.TempDir("", "lancaster-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "lancaster-decompress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	contents := [][]byte{[]byte("hello\n"), {}, bytes.Repeat([]byte("x"), 10000)}
+	files := make([]*TarballFile, 0, len(contents))
+	for i, b := range contents {
+		path := src + "/" + string('a'+rune(i))
+		if err = ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, &TarballFile{Path: string('a' + rune(i)), LocalPath: path, Size: int64(len(b)), Mode: 0644})
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	hashId := tb.HashId()
+
+	f, size, err := compressTarball(CompressZstd, tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if size >= tb.size {
+		t.Fatalf("expected compressed size below %d got %d", tb.size, size)
+	}
+	if !bytes.Equal(tb.HashId(), hashId) {
+		t.Fatal("expected hashId to be unaffected by compression")
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dst); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	writerFiles := make([]*TarballFile, 0, len(files))
+	for _, tf := range files {
+		writerFiles = append(writerFiles, &TarballFile{Path: tf.Path, Size: tf.Size, Mode: tf.Mode})
+	}
+	tw := newTarballWriter(t, writerFiles)
+	f.Seek(0, 0)
+	w := &offsetWriter{w: tw}
+	if err = decompressStream(CompressZstd, w, f); err != nil {
+		t.Fatal(err)
+	}
+	if w.offset != tw.size {
+		t.Fatalf("expected %d bytes decompressed got %d", tw.size, w.offset)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, b := range contents {
+		actual, err := ioutil.ReadFile(string('a' + rune(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, b) {
+			t.Fatalf("file %d mismatch", i)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// congestion.go
+package lancaster
+
+import "math"
+
+// Pace in data messages per second when no rate is configured:
+const DefaultPace = 1200.0
+
+// Floor for the congestion controller when no minimum rate is configured:
+const defaultMinRate = 64 * 1024.0
+
+// NAK'd ranges per region sent beyond which the network is considered to be dropping packets:
+const congestionLossThreshold = 0.02
+
+// Fraction of the rate range regained per clean interval:
+const congestionIncreaseSteps = 20
+
+// AIMD send rate controller. Loss is estimated from how many holes clients report relative to how
+// many regions were sent: halve the rate when that exceeds the threshold, else creep back up.
+type congestionController struct {
+	min  float64
+	max  float64
+	cap  float64
+	rate float64
+	// Configured rate cap derives from, kept so a new range can loosen it again; +Inf when none:
+	limit float64
+
+	sent int
+	naks int
+}
+
+func newCongestionController(min float64, max float64) *congestionController {
+	if min <= 0 {
+		min = defaultMinRate
+	}
+	if max < min {
+		max = min
+	}
+	return &congestionController{
+		min:   min,
+		max:   max,
+		cap:   max,
+		rate:  max,
+		limit: math.Inf(1),
+	}
+}
+
+func (c *congestionController) observeSent() {
+	if c == nil {
+		return
+	}
+	c.sent++
+}
+
+func (c *congestionController) observeNaks(n int) {
+	if c == nil {
+		return
+	}
+	c.naks += n
+}
+
+// Lowers the ceiling to a configured rate, +Inf restoring the controller's own maximum. Returns the
+// rate to apply now.
+func (c *congestionController) setCap(bytesPerSecond float64) float64 {
+	c.limit = bytesPerSecond
+	c.cap = math.Max(math.Min(bytesPerSecond, c.max), c.min)
+	c.rate = math.Min(c.rate, c.cap)
+	return c.rate
+}
+
+// Moves the range the rate is kept within, 0 leaving either end as it is. The configured ceiling is
+// applied within the new range. Returns the rate to apply now.
+func (c *congestionController) setRange(min float64, max float64) float64 {
+	if min > 0 && !math.IsInf(min, 1) {
+		c.min = min
+	}
+	if max > 0 && !math.IsInf(max, 1) {
+		c.max = max
+	}
+	if c.max < c.min {
+		c.max = c.min
+	}
+	c.cap = math.Max(math.Min(c.limit, c.max), c.min)
+	c.rate = math.Max(math.Min(c.rate, c.cap), c.min)
+	return c.rate
+}
+
+// Closes an observation interval, returning the new rate and whether it changed:
+func (c *congestionController) adjust() (float64, bool) {
+	sent, naks := c.sent, c.naks
+	c.sent, c.naks = 0, 0
+	if sent == 0 {
+		// Nothing to judge by while idle:
+		return c.rate, false
+	}
+
+	last := c.rate
+	if float64(naks)/float64(sent) > congestionLossThreshold {
+		// Multiplicative decrease:
+		c.rate = math.Max(c.rate/2, c.min)
+	} else {
+		// Additive increase:
+		c.rate = math.Min(c.rate+(c.max-c.min)/congestionIncreaseSteps, c.cap)
+	}
+	return c.rate, c.rate != last
+}
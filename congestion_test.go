@@ -0,0 +1,88 @@
+package lancaster
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCongestionController(t *testing.T) {
+	c := newCongestionController(100, 2100)
+	if c.rate != 2100 {
+		t.Fatalf("expected to start at the maximum got %v", c.rate)
+	}
+
+	// Idle intervals change nothing:
+	if _, changed := c.adjust(); changed {
+		t.Fatal("expected no change while idle")
+	}
+
+	// Loss halves the rate down to the minimum:
+	expected := []float64{1050, 525, 262.5, 131.25, 100, 100}
+	for _, e := range expected {
+		for i := 0; i < 100; i++ {
+			c.observeSent()
+		}
+		c.observeNaks(3)
+		if r, _ := c.adjust(); r != e {
+			t.Fatalf("expected %v got %v", e, r)
+		}
+	}
+
+	// Clean intervals add back a twentieth of the range each:
+	for i := 0; i < 100; i++ {
+		c.observeSent()
+	}
+	c.observeNaks(1)
+	if r, changed := c.adjust(); !changed || r != 200 {
+		t.Fatalf("expected 200 got %v", r)
+	}
+}
+
+func TestCongestionController_Cap(t *testing.T) {
+	c := newCongestionController(100, 2100)
+	if r := c.setCap(500); r != 500 {
+		t.Fatalf("expected cap to lower the rate got %v", r)
+	}
+	for i := 0; i < 10; i++ {
+		c.observeSent()
+		c.adjust()
+	}
+	if c.rate != 500 {
+		t.Fatalf("expected increases to stop at the cap got %v", c.rate)
+	}
+
+	// Lifting the cap lets the rate climb again without jumping:
+	if r := c.setCap(math.Inf(1)); r != 500 {
+		t.Fatalf("expected rate to stay put got %v", r)
+	}
+	c.observeSent()
+	if r, _ := c.adjust(); r != 600 {
+		t.Fatalf("expected 600 got %v", r)
+	}
+
+	// A nil controller ignores observations:
+	(*congestionController)(nil).observeSent()
+	(*congestionController)(nil).observeNaks(1)
+}
+
+func TestCongestionController_Range(t *testing.T) {
+	c := newCongestionController(100, 2100)
+	c.setCap(1000)
+
+	// Lowering the maximum below the configured cap lowers the rate with it:
+	if r := c.setRange(0, 800); r != 800 || c.min != 100 {
+		t.Fatalf("expected 800 within [100, 800] got %v within [%v, %v]", r, c.min, c.max)
+	}
+	// Raising it again only lifts the ceiling as far as the configured cap:
+	if r := c.setRange(0, 4000); r != 800 || c.cap != 1000 {
+		t.Fatalf("expected rate 800 under cap 1000 got %v under %v", r, c.cap)
+	}
+	// Raising the minimum past the rate raises the rate:
+	if r := c.setRange(900, 0); r != 900 {
+		t.Fatalf("expected 900 got %v", r)
+	}
+	// And past the maximum raises that too:
+	if r := c.setRange(5000, 0); r != 5000 || c.max != 5000 {
+		t.Fatalf("expected 5000 got %v with maximum %v", r, c.max)
+	}
+}
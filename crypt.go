@@ -0,0 +1,141 @@
+// crypt.go
+package lancaster
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// Protocol version byte of messages sealed with a pre-shared key:
+const protocolVersionSealed = 2
+
+const pskSize = 32
+const saltSize = 4
+
+var (
+	ErrBadPSK      = errors.New("pre-shared key must be 64 hex characters (AES-256)")
+	ErrEncrypted   = errors.New("transfer is encrypted; a pre-shared key is required")
+	ErrNotSealed   = errors.New("message is not sealed")
+	ErrMissingSalt = errors.New("server did not announce an encryption salt")
+)
+
+func ParsePSK(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != pskSize {
+		return nil, ErrBadPSK
+	}
+	return key, nil
+}
+
+// AES-256-GCM over every message payload. Message prefixes stay readable and are authenticated as
+// additional data. Control payloads carry a random nonce; data payloads use a salt followed by the
+// region offset so no bytes are spent on a nonce per region. Each transfer seals its data with a salt
+// of its own so different contents at the same offset never share a nonce.
+type PacketCipher struct {
+	aead cipher.AEAD
+	// Salt data is opened with, and sealed with when the sender has none of its own:
+	salt [saltSize]byte
+}
+
+// Creates a cipher with a fresh random salt; clients replace it with the one their server announces:
+func NewPacketCipher(key []byte) (*PacketCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	p := &PacketCipher{aead: aead}
+	if _, err = rand.Read(p.salt[:]); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Most bytes sealing adds to a message:
+func (p *PacketCipher) overhead() int {
+	return p.aead.NonceSize() + p.aead.Overhead()
+}
+
+func (p *PacketCipher) sealControl(msg []byte) ([]byte, error) {
+	if len(msg) < protocolControlPrefixSize {
+		return nil, ErrMessageTooShort
+	}
+
+	out := make([]byte, protocolControlPrefixSize, protocolControlPrefixSize+p.overhead()+len(msg)-protocolControlPrefixSize)
+	copy(out, msg[:protocolControlPrefixSize])
+	out[0] = protocolVersionSealed
+
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return p.aead.Seal(out, nonce, msg[protocolControlPrefixSize:], out[:protocolControlPrefixSize]), nil
+}
+
+func (p *PacketCipher) openControl(msg []byte) ([]byte, error) {
+	if len(msg) < protocolControlPrefixSize+p.aead.NonceSize() {
+		return nil, ErrMessageTooShort
+	}
+	if msg[0] != protocolVersionSealed {
+		return nil, ErrNotSealed
+	}
+
+	prefix := msg[:protocolControlPrefixSize]
+	nonce := msg[protocolControlPrefixSize : protocolControlPrefixSize+p.aead.NonceSize()]
+	out := make([]byte, protocolControlPrefixSize, len(msg))
+	copy(out, prefix)
+	out[0] = protocolVersion
+	return p.aead.Open(out, nonce, msg[protocolControlPrefixSize+p.aead.NonceSize():], prefix)
+}
+
+func (p *PacketCipher) dataNonce(salt []byte, msg []byte) []byte {
+	nonce := make([]byte, p.aead.NonceSize())
+	copy(nonce, salt)
+	copy(nonce[saltSize:], msg[1+HashSize:ProtocolDataMsgPrefixSize])
+	return nonce
+}
+
+// Seals with `salt`, or the cipher's own when nil:
+func (p *PacketCipher) sealData(salt []byte, msg []byte) ([]byte, error) {
+	if salt == nil {
+		salt = p.salt[:]
+	}
+	if len(msg) < ProtocolDataMsgPrefixSize {
+		return nil, ErrMessageTooShort
+	}
+
+	out := make([]byte, ProtocolDataMsgPrefixSize, len(msg)+p.aead.Overhead())
+	copy(out, msg[:ProtocolDataMsgPrefixSize])
+	out[0] = protocolVersionSealed
+	return p.aead.Seal(out, p.dataNonce(salt, msg), msg[ProtocolDataMsgPrefixSize:], out[:ProtocolDataMsgPrefixSize]), nil
+}
+
+func (p *PacketCipher) openData(msg []byte) ([]byte, error) {
+	if len(msg) < ProtocolDataMsgPrefixSize {
+		return nil, ErrMessageTooShort
+	}
+	if msg[0] != protocolVersionSealed {
+		return nil, ErrNotSealed
+	}
+
+	prefix := msg[:ProtocolDataMsgPrefixSize]
+	out := make([]byte, ProtocolDataMsgPrefixSize, len(msg))
+	copy(out, prefix)
+	out[0] = protocolVersion
+	return p.aead.Open(out, p.dataNonce(p.salt[:], msg), msg[ProtocolDataMsgPrefixSize:], prefix)
+}
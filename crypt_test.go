@@ -0,0 +1,133 @@
+package lancaster
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newTestPacketCipher(t *testing.T, b byte) *PacketCipher {
+	p, err := NewPacketCipher(bytes.Repeat([]byte{b}, pskSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParsePSK(t *testing.T) {
+	key, err := ParsePSK(strings.Repeat("ab", pskSize))
+	if err != nil || len(key) != pskSize {
+		t.Fatalf("expected %d byte key got %v %v", pskSize, key, err)
+	}
+	for _, s := range []string{"", "abcd", strings.Repeat("zz", pskSize), strings.Repeat("ab", pskSize+1)} {
+		if _, err = ParsePSK(s); err != ErrBadPSK {
+			t.Fatalf("expected ErrBadPSK for %q got %v", s, err)
+		}
+	}
+}
+
+func TestPacketCipher_Control(t *testing.T) {
+	p := newTestPacketCipher(t, 1)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	msg := controlToClientMessage(hashId, RespondMetadataHeader, []byte("secret header"))
+
+	sealed, err := p.sealControl(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("expected payload to be encrypted")
+	}
+	if len(sealed) != len(msg)+p.overhead() {
+		t.Fatalf("expected %d bytes of overhead got %d", p.overhead(), len(sealed)-len(msg))
+	}
+
+	// Clients without the key are told rather than misreading the payload:
+	if _, _, _, err = extractClientMessage(UDPMessage{Data: sealed}); err != ErrEncrypted {
+		t.Fatalf("expected ErrEncrypted got %v", err)
+	}
+
+	opened, err := p.openControl(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, msg) {
+		t.Fatalf("expected %v got %v", msg, opened)
+	}
+
+	// Tampering with the prefix or using another key is detected:
+	sealed[1] ^= 1
+	if _, err = p.openControl(sealed); err == nil {
+		t.Fatal("expected tampered prefix to fail")
+	}
+	sealed[1] ^= 1
+	if _, err = newTestPacketCipher(t, 2).openControl(sealed); err == nil {
+		t.Fatal("expected wrong key to fail")
+	}
+
+	// Plaintext is refused when a key is in use:
+	if _, err = p.openControl(msg); err != ErrNotSealed {
+		t.Fatalf("expected ErrNotSealed got %v", err)
+	}
+}
+
+func TestPacketCipher_Data(t *testing.T) {
+	server := newTestPacketCipher(t, 1)
+	client := newTestPacketCipher(t, 1)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	msg := dataMessage(hashId, 4096, []byte("region contents"))
+
+	sealed, err := server.sealData(nil, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data can't be opened until the server's salt is known:
+	if _, err = client.openData(sealed); err == nil {
+		t.Fatal("expected open without the salt to fail")
+	}
+	client.salt = server.salt
+	opened, err := client.openData(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, region, data, err := extractDataMessage(UDPMessage{Data: opened})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region != 4096 || string(data) != "region contents" {
+		t.Fatalf("unexpected region %d data %q", region, data)
+	}
+
+	// Transfers sealing with a salt of their own are opened with the one they announce:
+	salt, err := newSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed2, err := server.sealData(salt, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sealed2, sealed) {
+		t.Fatal("expected another salt to seal differently")
+	}
+	if _, err = client.openData(sealed2); err == nil {
+		t.Fatal("expected open with another transfer's salt to fail")
+	}
+	copy(client.salt[:], salt)
+	if _, err = client.openData(sealed2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving sealed data to another offset is detected:
+	moved := dataMessage(hashId, 8192, nil)
+	moved = append(moved[:ProtocolDataMsgPrefixSize], sealed[ProtocolDataMsgPrefixSize:]...)
+	moved[0] = protocolVersionSealed
+	if _, err = client.openData(moved); err == nil {
+		t.Fatal("expected data moved to another region to fail")
+	}
+}
+
+func TestClient_RunCompletesEncrypted(t *testing.T) {
+	runLoopbackTransfer(t, 13660, ServerOptions{FEC: FEC{DataShards: 2, ParityShards: 1}}, bytes.Repeat([]byte("sealed "), 30000), bytes.Repeat([]byte{7}, pskSize))
+}
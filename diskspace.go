@@ -0,0 +1,82 @@
+// diskspace.go
+package lancaster
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+import "github.com/dustin/go-humanize"
+
+var ErrInsufficientSpace = errors.New("not enough free disk space")
+
+// Filesystems need room beyond file contents for their own metadata and partly filled blocks:
+const freeSpaceMargin = 16 << 20
+
+// Bytes free to the current user on the filesystem holding `path`; false when the platform can't say:
+var diskFree = freeDiskSpace
+
+// Fails before anything is written when the target filesystem can't hold the whole payload. Holes
+// left for sparse extents take no space and files left by an earlier run only need what they are
+// still short of.
+func (t *VirtualTarballWriter) checkFreeSpace() error {
+	dir := t.options.OutputDir
+	if t.options.TarPath != "" {
+		dir = filepath.Dir(t.options.TarPath)
+	}
+	dir = existingDir(dir)
+
+	needed := int64(0)
+	for _, f := range t.files {
+		if !f.Mode.IsRegular() {
+			continue
+		}
+		size := f.Size
+		if t.options.TarPath != "" {
+			needed += size
+			continue
+		}
+		for _, s := range f.Sparse {
+			size -= s.endEx - s.start
+		}
+		if stat, err := os.Lstat(f.LocalPath); err == nil && stat.Mode().IsRegular() {
+			size -= stat.Size()
+		}
+		if size > 0 {
+			needed += size
+		}
+	}
+	if needed == 0 {
+		return nil
+	}
+	needed += needed/100 + freeSpaceMargin
+
+	free, ok, err := diskFree(dir)
+	if err != nil || !ok {
+		// Nothing to check against; writes fail as they would have:
+		return nil
+	}
+	if uint64(needed) > free {
+		return fmt.Errorf("%w: need %s in '%s' but only %s is free", ErrInsufficientSpace, humanize.IBytes(uint64(needed)), dir, humanize.IBytes(free))
+	}
+	return nil
+}
+
+// Closest directory at or above `dir` that exists, as the output directory is created later:
+func existingDir(dir string) string {
+	if dir == "" {
+		dir = "."
+	}
+	for {
+		if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,13 @@
+// +build openbsd
+
+package lancaster
+
+import "syscall"
+
+func freeDiskSpace(path string) (uint64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, false, err
+	}
+	return uint64(stat.F_bavail) * uint64(stat.F_bsize), true, nil
+}
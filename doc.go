@@ -0,0 +1,19 @@
+// Package lancaster sends a set of files from one server to any number of clients at once over
+// multicast, or unicast where multicast isn't routed. The server streams the files as one virtual
+// tarball in fixed size regions; clients NAK the regions they are missing until they have them all.
+// The lancaster command in cmd/lancaster is a thin CLI over this package.
+//
+// Serving builds a VirtualTarballReader over the files, using BuildTarball for the command's
+// argument syntax, and runs a Server for it over a Multicast. Downloading runs a Client over a
+// Multicast on the same group and port with the hash ID of the transfer, or none to take the first
+// one announced. Both publish ProgressEvents on their Progress channel while they Run. A Session runs
+// either in the background; see its example.
+//
+// Each data message carries one region. By default regions fill a datagram of DefaultDatagramSize
+// bytes, which IP fragments into MTU sized packets: few system calls and headers per byte, but losing
+// any one fragment loses the whole region and it has to be sent again. ServerOptions.ChunkSize trades
+// that the other way. Regions that fit within the MTU after headers (e.g. 1450 bytes over Ethernet, or
+// about 8950 with jumbo frames) are never fragmented so loss costs only what was lost, at the price of
+// far more packets per second for the same rate; DiscoverChunkSize picks the largest such size for
+// the interfaces in use. Clients take whatever size the server sends.
+package lancaster
@@ -0,0 +1,61 @@
+// dscp.go
+package lancaster
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var ErrBadDSCP = errors.New("DSCP must be 0-63 or a code point name such as le, cs1, af11 or ef")
+
+// Common DSCP code points by name. Bulk transfers that should yield to everything else are usually
+// marked le (lower effort, RFC 8622) or the older cs1 (scavenger); af1x is high-throughput data and
+// ef is for latency sensitive traffic, not bulk transfers.
+var dscpNames = map[string]int{
+	"be": 0, "df": 0, "le": 1,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+	"ef": 46,
+}
+
+// Parses a DSCP given as a number (0-63) or a code point name:
+func ParseDSCP(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if dscp, ok := dscpNames[s]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.Atoi(s)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, ErrBadDSCP
+	}
+	return dscp, nil
+}
+
+// Marks every socket's outgoing packets with `dscp` in the upper six bits of the IPv4 ToS or IPv6
+// traffic class. Unicast sockets may carry both families so get both:
+func (m *Multicast) setDSCP(conns []*net.UDPConn, dscp int) error {
+	if dscp == 0 {
+		return nil
+	}
+	tos := dscp << 2
+	for _, c := range conns {
+		local, _ := c.LocalAddr().(*net.UDPAddr)
+		if m.ipv6 || (local != nil && local.IP.To4() == nil) {
+			if err := setSocketOptionInt(c, syscall.IPPROTO_IPV6, ipv6TrafficClass, tos); err != nil {
+				return err
+			}
+		}
+		if !m.ipv6 {
+			if err := setSocketOptionInt(c, syscall.IPPROTO_IP, syscall.IP_TOS, tos); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
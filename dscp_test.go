@@ -0,0 +1,43 @@
+package lancaster
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestParseDSCP(t *testing.T) {
+	for s, expected := range map[string]int{"0": 0, "63": 63, "8": 8, "le": 1, "CS1": 8, " af11 ": 10, "af43": 38, "ef": 46} {
+		if dscp, err := ParseDSCP(s); err != nil || dscp != expected {
+			t.Fatalf("%q: expected %d got %d %v", s, expected, dscp, err)
+		}
+	}
+	for _, s := range []string{"", "-1", "64", "af14", "bulk"} {
+		if _, err := ParseDSCP(s); err != ErrBadDSCP {
+			t.Fatalf("%q: expected ErrBadDSCP got %v", s, err)
+		}
+	}
+}
+
+func TestMulticast_DSCP(t *testing.T) {
+	m := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 105), 13780)
+	defer m.Close()
+	m.SetDataDSCP(8)
+	if err := m.SendsData(); err != nil {
+		t.Skipf("cannot open group on loopback: %s", err)
+	}
+	if err := m.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Control is left alone unless asked for:
+	for conn, expected := range map[*net.UDPConn]int{m.dataConns[0]: 8 << 2, m.controlToClientConns[0]: 0} {
+		tos, err := getSocketOptionInt(conn, syscall.IPPROTO_IP, syscall.IP_TOS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tos != expected {
+			t.Fatalf("expected ToS %#x got %#x", expected, tos)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// dumpstate.go
+package lancaster
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+import "github.com/dustin/go-humanize"
+
+var ErrUnknownStateFile = errors.New("unrecognized state file; expected a descriptor or download progress")
+
+// Prints a human-readable summary of a persisted state file, detecting descriptors and download progress.
+func DumpState(path string, w io.Writer) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Descriptors have a "files" array; download progress has "naks":
+	probe := struct {
+		Files *json.RawMessage `json:"files"`
+		Naks  *json.RawMessage `json:"naks"`
+	}{}
+	if json.Unmarshal(b, &probe) != nil {
+		return ErrUnknownStateFile
+	}
+	if probe.Naks != nil {
+		p := progressState{}
+		if err = json.Unmarshal(b, &p); err != nil {
+			return err
+		}
+		return dumpProgress(&p, w)
+	}
+	if probe.Files == nil {
+		return ErrUnknownStateFile
+	}
+	d := &Descriptor{}
+	if err = json.Unmarshal(b, d); err != nil {
+		return err
+	}
+
+	return dumpDescriptor(d, w)
+}
+
+func dumpDescriptor(d *Descriptor, w io.Writer) error {
+	files := tarballFileList(make([]*TarballFile, 0, len(d.Files)))
+	size := int64(0)
+	for _, df := range d.Files {
+		files = append(files, &TarballFile{Path: df.Path, Size: df.Size, Mode: df.Mode})
+		size += df.Size
+	}
+	sort.Sort(files)
+
+	fmt.Fprintf(w, "Type:  descriptor\n")
+	fmt.Fprintf(w, "ID:    %s\n", hex.EncodeToString(tarballHashId(files, HashSHA256)))
+	fmt.Fprintf(w, "Size:  %s bytes in %d files\n", humanize.Comma(size), len(d.Files))
+	fmt.Fprintf(w, "Files:\n")
+	for _, df := range d.Files {
+		fmt.Fprintf(w, "  %v %15s '%s' %s\n", df.Mode, humanize.Comma(df.Size), df.Path, df.Hash)
+	}
+	return nil
+}
+
+func dumpProgress(p *progressState, w io.Writer) error {
+	missing := int64(0)
+	for _, k := range p.Naks {
+		missing += k[1] - k[0]
+	}
+	pct := float64(100)
+	if p.Size > 0 {
+		pct = float64(p.Size-missing) * 100.0 / float64(p.Size)
+	}
+
+	fmt.Fprintf(w, "Type:  download progress\n")
+	fmt.Fprintf(w, "ID:    %s\n", p.HashId)
+	fmt.Fprintf(w, "Size:  %s bytes\n", humanize.Comma(p.Size))
+	fmt.Fprintf(w, "Acked: %s bytes (%.2f%%)\n", humanize.Comma(p.Size-missing), pct)
+	fmt.Fprintf(w, "Missing regions:\n")
+	for _, k := range p.Naks {
+		fmt.Fprintf(w, "  [%d, %d)\n", k[0], k[1])
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package lancaster
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDumpState_Descriptor(t *testing.T) {
+	f, err := ioutil.TempFile("", "lancaster-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"files": [{"path": "a/b.txt", "size": 1234, "mode": 420, "hash": "` + testBlobHash + `"}]}`)
+	f.Close()
+
+	out := &bytes.Buffer{}
+	if err = DumpState(f.Name(), out); err != nil {
+		t.Fatal(err)
+	}
+
+	// ID matches what a reader computes for the same layout:
+	id := tarballHashId(tarballFileList{&TarballFile{Path: "a/b.txt", Size: 1234, Mode: 0644}}, HashSHA256)
+	for _, expected := range []string{"descriptor", hex.EncodeToString(id), "1,234 bytes in 1 files", "'a/b.txt'"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected %q in output:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDumpState_Unknown(t *testing.T) {
+	f, err := ioutil.TempFile("", "lancaster-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not state")
+	f.Close()
+
+	if err = DumpState(f.Name(), &bytes.Buffer{}); err != ErrUnknownStateFile {
+		t.Fatalf("expected %v got %v", ErrUnknownStateFile, err)
+	}
+}
+
+func TestDumpState_Progress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	naks := NewNakRegions(200)
+	naks.Ack(0, 150)
+	path := dir + "/" + progressPath(hashId)
+	if err = saveProgress(path, hashId, naks); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err = DumpState(path, out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"download progress", "0102030405060708", "150 bytes (75.00%)", "[150, 200)"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Fatalf("expected %q in output:\n%s", expected, out.String())
+		}
+	}
+}
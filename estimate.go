@@ -0,0 +1,89 @@
+// estimate.go
+package lancaster
+
+import (
+	"time"
+)
+
+// Assume IPv4 over Ethernet when accounting for per-packet overhead:
+const ipv4HeaderSize = 20
+const ipv6HeaderSize = 40
+const udpHeaderSize = 8
+const ethernetMTU = 1500
+
+// Estimate of the bytes a server puts on the wire for a single lossless pass of a transfer.
+type WireEstimate struct {
+	ContentSize int64
+
+	DataDatagrams int64
+	DataBytes     int64
+
+	MetadataDatagrams int64
+	MetadataBytes     int64
+
+	AnnounceDatagrams int64
+	AnnounceBytes     int64
+}
+
+func (e WireEstimate) Total() int64 {
+	return e.DataBytes + e.MetadataBytes + e.AnnounceBytes
+}
+
+func (e WireEstimate) Overhead() float64 {
+	if e.ContentSize == 0 {
+		return 0
+	}
+	return float64(e.Total()-e.ContentSize) * 100.0 / float64(e.ContentSize)
+}
+
+// Bytes on the wire for a UDP datagram carrying `payloadLen` bytes including IP fragmentation:
+func wireBytes(payloadLen int64) int64 {
+	ipPayload := payloadLen + udpHeaderSize
+	fragmentSize := int64(ethernetMTU - ipv4HeaderSize)
+	fragments := ipPayload / fragmentSize
+	if fragments*fragmentSize < ipPayload {
+		fragments++
+	}
+	return ipPayload + fragments*ipv4HeaderSize
+}
+
+func EstimateWireSize(tb *VirtualTarballReader, datagramSize int, duration time.Duration) (WireEstimate, error) {
+	e := WireEstimate{ContentSize: tb.size}
+
+	// Data sections; the last one is short:
+	regionSize := int64(datagramSize - ProtocolDataMsgPrefixSize)
+	full := tb.size / regionSize
+	tail := tb.size - full*regionSize
+	e.DataDatagrams = full
+	e.DataBytes = full * wireBytes(int64(datagramSize))
+	if tail > 0 {
+		e.DataDatagrams++
+		e.DataBytes += wireBytes(ProtocolDataMsgPrefixSize + tail)
+	}
+
+	// Metadata header and sections as sent to one client:
+	md, err := encodeMetadata(tb)
+	if err != nil {
+		return e, err
+	}
+	e.MetadataDatagrams = 1
+	e.MetadataBytes = wireBytes(protocolControlPrefixSize + metadataHeaderMsgSize)
+	sectionSize := int64(datagramSize - (protocolControlPrefixSize + metadataSectionMsgSize))
+	for o := int64(0); o < int64(len(md)); o += sectionSize {
+		l := sectionSize
+		if o+l > int64(len(md)) {
+			l = int64(len(md)) - o
+		}
+		e.MetadataDatagrams++
+		e.MetadataBytes += wireBytes(protocolControlPrefixSize + metadataSectionMsgSize + l)
+	}
+
+	// Announcements for as long as the server runs:
+	e.AnnounceDatagrams = int64(duration / DefaultAnnounceInterval)
+	if e.AnnounceDatagrams < 1 {
+		e.AnnounceDatagrams = 1
+	}
+	e.AnnounceBytes = e.AnnounceDatagrams * wireBytes(protocolControlPrefixSize)
+
+	return e, nil
+}
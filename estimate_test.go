@@ -0,0 +1,54 @@
+package lancaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWireBytes(t *testing.T) {
+	// Fits in a single frame:
+	if n := wireBytes(100); n != 100+udpHeaderSize+ipv4HeaderSize {
+		t.Fatalf("expected %d got %d", 100+udpHeaderSize+ipv4HeaderSize, n)
+	}
+	// Needs two fragments:
+	if n := wireBytes(1480); n != 1480+udpHeaderSize+2*ipv4HeaderSize {
+		t.Fatalf("expected %d got %d", 1480+udpHeaderSize+2*ipv4HeaderSize, n)
+	}
+}
+
+func TestEstimateWireSize(t *testing.T) {
+	tb := &VirtualTarballReader{
+		files: tarballFileList{
+			&TarballFile{Path: "a.bin", Size: 2999},
+		},
+		size: 3000,
+	}
+
+	const datagramSize = 1000
+	e, err := EstimateWireSize(tb, datagramSize, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	regionSize := int64(datagramSize - ProtocolDataMsgPrefixSize)
+	expectedDatagrams := tb.size / regionSize
+	if expectedDatagrams*regionSize < tb.size {
+		expectedDatagrams++
+	}
+	if e.DataDatagrams != expectedDatagrams {
+		t.Fatalf("expected %d data datagrams got %d", expectedDatagrams, e.DataDatagrams)
+	}
+	// Every byte of content plus a header per datagram:
+	if e.DataBytes != tb.size+e.DataDatagrams*(ProtocolDataMsgPrefixSize+udpHeaderSize+ipv4HeaderSize) {
+		t.Fatalf("unexpected data bytes %d", e.DataBytes)
+	}
+	if e.MetadataDatagrams != 2 {
+		t.Fatalf("expected 2 metadata datagrams got %d", e.MetadataDatagrams)
+	}
+	if e.AnnounceDatagrams != 10 {
+		t.Fatalf("expected 10 announcements got %d", e.AnnounceDatagrams)
+	}
+	if e.Total() <= tb.size {
+		t.Fatal("expected total to exceed content size")
+	}
+}
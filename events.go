@@ -0,0 +1,145 @@
+// events.go
+package lancaster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events queued for writing before further ones are dropped:
+const eventQueueSize = 4096
+
+// One line of an event log. Only the fields that apply to its kind are set.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// The state a client moved to, or what became of a client a server heard from:
+	State string `json:"state,omitempty"`
+	// The control message sent or received and the other end's address:
+	Op   string `json:"op,omitempty"`
+	Peer string `json:"peer,omitempty"`
+	// The [start, end) range of data acked:
+	Region []int64 `json:"region,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Append-only record of what a client or server did, one JSON object per line, for looking back at a
+// transfer after the fact: each state a client moved through and each client a server heard from or saw
+// complete, control messages sent and received, regions acked and errors. Events are queued and written by a goroutine of its own so a slow disk never holds
+// up the transfer; once the queue is full further events are dropped and counted. A nil *EventLog
+// ignores every event.
+type EventLog struct {
+	w       io.Writer
+	events  chan Event
+	dropped int64
+	done    chan empty
+
+	// Held for reading while queueing so Close never closes events under a sender:
+	lock   sync.RWMutex
+	closed bool
+	err    error
+}
+
+func NewEventLog(w io.Writer) *EventLog {
+	l := &EventLog{
+		w:      w,
+		events: make(chan Event, eventQueueSize),
+		done:   make(chan empty),
+	}
+	go l.writer()
+	return l
+}
+
+func (l *EventLog) writer() {
+	defer close(l.done)
+
+	enc := json.NewEncoder(l.w)
+	for e := range l.events {
+		if l.err != nil {
+			continue
+		}
+		l.err = enc.Encode(&e)
+	}
+}
+
+func (l *EventLog) record(e Event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.closed {
+		atomic.AddInt64(&l.dropped, 1)
+		return
+	}
+	select {
+	case l.events <- e:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+func (l *EventLog) state(state ClientState) {
+	l.record(Event{Event: "state", State: state.String()})
+}
+
+// A server hearing from a new client or seeing it complete:
+func (l *EventLog) client(state string, peer *net.UDPAddr) {
+	l.record(Event{Event: "client", State: state, Peer: addrString(peer)})
+}
+
+func (l *EventLog) controlSent(op fmt.Stringer, peer *net.UDPAddr) {
+	l.record(Event{Event: "control-sent", Op: op.String(), Peer: addrString(peer)})
+}
+
+func (l *EventLog) controlReceived(op fmt.Stringer, peer *net.UDPAddr) {
+	l.record(Event{Event: "control-received", Op: op.String(), Peer: addrString(peer)})
+}
+
+func (l *EventLog) acked(start, endEx int64) {
+	l.record(Event{Event: "acked", Region: []int64{start, endEx}})
+}
+
+func (l *EventLog) error(err error) {
+	if err == nil {
+		return
+	}
+	l.record(Event{Event: "error", Error: err.Error()})
+}
+
+// Events dropped because the queue was full:
+func (l *EventLog) Dropped() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.dropped)
+}
+
+// Writes out what is queued and stops; events recorded afterwards are dropped. Returns the first
+// error writing, if any. Doesn't close the underlying writer.
+func (l *EventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.lock.Unlock()
+	<-l.done
+	return l.err
+}
+
+func addrString(addr *net.UDPAddr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,86 @@
+package lancaster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventLog_NilIsNoop(t *testing.T) {
+	l := (*EventLog)(nil)
+	l.state(Done)
+	l.controlSent(RequestAnnouncement, nil)
+	l.acked(0, 10)
+	l.error(errors.New("boom"))
+	if l.Dropped() != 0 || l.Close() != nil {
+		t.Fatal("expected a nil event log to do nothing")
+	}
+}
+
+func TestEventLog_WritesLines(t *testing.T) {
+	b := &bytes.Buffer{}
+	l := NewEventLog(b)
+	l.state(ExpectMetadataHeader)
+	l.controlReceived(AnnounceTarball, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1361})
+	l.controlSent(RequestMetadataHeader, nil)
+	l.acked(100, 200)
+	l.error(nil)
+	l.error(ErrStalled)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Recorded once closed are dropped:
+	l.state(Done)
+
+	expected := []Event{
+		{Event: "state", State: "ExpectMetadataHeader"},
+		{Event: "control-received", Op: "AnnounceTarball", Peer: "192.0.2.1:1361"},
+		{Event: "control-sent", Op: "RequestMetadataHeader"},
+		{Event: "acked", Region: []int64{100, 200}},
+		{Event: "error", Error: ErrStalled.Error()},
+	}
+	actual := []Event(nil)
+	s := bufio.NewScanner(b)
+	for s.Scan() {
+		e := Event{}
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("%q: %s", s.Text(), err)
+		}
+		if e.Time.IsZero() {
+			t.Fatalf("%q: expected a timestamp", s.Text())
+		}
+		e.Time = time.Time{}
+		actual = append(actual, e)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %+v got %+v", expected, actual)
+	}
+	if l.Dropped() != 1 {
+		t.Fatalf("expected the event after Close dropped got %d", l.Dropped())
+	}
+}
+
+func TestEventLog_DropsWhenBehind(t *testing.T) {
+	r, w := io.Pipe()
+	l := NewEventLog(w)
+
+	// Nothing reads the pipe so the writer blocks on the first event and the queue fills up behind it:
+	for i := 0; i < eventQueueSize+10; i++ {
+		l.acked(int64(i), int64(i+1))
+	}
+	if l.Dropped() < 9 {
+		t.Fatalf("expected events past the queue dropped got %d", l.Dropped())
+	}
+
+	// The first failed write is reported:
+	r.CloseWithError(io.ErrClosedPipe)
+	if err := l.Close(); err != io.ErrClosedPipe {
+		t.Fatalf("expected %v got %v", io.ErrClosedPipe, err)
+	}
+}
@@ -0,0 +1,52 @@
+package lancaster_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/distributed-mind/lancaster"
+)
+
+// Serves a directory for a minute while downloading it into another:
+func ExampleSession() {
+	group := &net.UDPAddr{IP: net.IPv4(239, 0, 0, 100), Port: 1360}
+	quiet := lancaster.NewLogger(ioutil.Discard, lancaster.LogInfo, false)
+
+	files, err := lancaster.BuildTarball([]string{"photos:::"}, lancaster.DefaultExcludes, false, true, 0, lancaster.IncludeHidden)
+	if err != nil {
+		panic(err)
+	}
+	tb, err := lancaster.NewVirtualTarballReader(files, lancaster.VirtualTarballOptions{})
+	if err != nil {
+		panic(err)
+	}
+	defer tb.Close()
+	sm, err := lancaster.NewMulticast(group, nil)
+	if err != nil {
+		panic(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	serving := lancaster.NewServerSession(sm, tb, lancaster.ServerOptions{Logger: quiet, Quiet: true})
+	serving.Start(ctx)
+
+	cm, err := lancaster.NewMulticast(group, nil)
+	if err != nil {
+		panic(err)
+	}
+	downloading := lancaster.NewClientSession(cm, lancaster.ClientOptions{
+		HashId:         tb.HashId(),
+		TarballOptions: lancaster.VirtualTarballOptions{OutputDir: "copy"},
+		Logger:         quiet,
+		Quiet:          true,
+	})
+	for e := range downloading.Start(ctx) {
+		fmt.Printf("%d of %d bytes at %.0f B/s\n", e.Bytes, e.Size, e.Rate)
+	}
+	if err = downloading.Wait(); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,88 @@
+// excludes.go
+package lancaster
+
+import (
+	"path"
+	"strings"
+)
+
+// VCS metadata and OS/editor junk skipped when walking directories unless --no-default-excludes is given.
+// These affect the file set and so the hashId; keep the list stable and in sync with the flag usage text.
+var DefaultExcludes = []string{
+	".git",
+	".svn",
+	".hg",
+	".DS_Store",
+	"*~",
+}
+
+// Reports whether a tar-relative path matches any of the exclude patterns. Matching follows gitignore:
+// a pattern without a slash matches a name at any depth, one containing a slash matches the whole path
+// from the root (a leading slash is optional), a trailing slash only matches directories and a "**"
+// segment matches any number of directories. Negation with "!" is not supported.
+func isExcluded(relPath string, isDir bool, patterns []string) bool {
+	for _, p := range patterns {
+		if matchExclude(p, relPath, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchExclude(pattern string, relPath string, isDir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(relPath))
+		return ok
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(relPath, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Which dot-prefixed entries directory walks keep, applied after any excludes:
+type HiddenMode int
+
+const (
+	// Walk hidden entries like any other (the default):
+	IncludeHidden HiddenMode = iota
+	// Skip hidden entries and anything beneath them, as --no-hidden:
+	SkipHidden
+	// Only list entries that are hidden or beneath a hidden directory, as --only-hidden:
+	OnlyHidden
+)
+
+// Reports whether any component of a tar-relative path starts with a ".":
+func isHidden(relPath string) bool {
+	for _, name := range strings.Split(relPath, "/") {
+		if strings.HasPrefix(name, ".") {
+			return true
+		}
+	}
+	return false
+}
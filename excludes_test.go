@@ -0,0 +1,320 @@
+package lancaster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func createExcludesTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lancaster-excludes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{".git/objects", "src", "src/.hg"} {
+		if err = os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{".git/HEAD", ".git/objects/ab", "README", ".DS_Store", "src/main.go", "src/main.go~", "src/.hg/store", ".profile"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func tarballPaths(files []*TarballFile) []string {
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestBuildTarball_DefaultExcludes(t *testing.T) {
+	dir := createExcludesTree(t)
+	defer os.RemoveAll(dir)
+
+	files, err := BuildTarball([]string{dir + ":::"}, DefaultExcludes, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{".profile", "README", "src/main.go"}
+	if actual := tarballPaths(files); !cmpStrings(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+}
+
+func TestBuildTarball_NoDefaultExcludes(t *testing.T) {
+	dir := createExcludesTree(t)
+	defer os.RemoveAll(dir)
+
+	files, err := BuildTarball([]string{dir + ":::"}, nil, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{".DS_Store", ".git/HEAD", ".git/objects/ab", ".profile", "README", "src/.hg/store", "src/main.go", "src/main.go~"}
+	if actual := tarballPaths(files); !cmpStrings(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+}
+
+func TestBuildTarball_ExplicitPathNotExcluded(t *testing.T) {
+	dir := createExcludesTree(t)
+	defer os.RemoveAll(dir)
+
+	files, err := BuildTarball([]string{filepath.Join(dir, ".DS_Store") + "::.DS_Store"}, DefaultExcludes, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Path != ".DS_Store" {
+		t.Fatalf("expected explicitly named file to be kept; got %v", tarballPaths(files))
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "build.log", false, true},
+		{"*.log", "a/b/build.log", false, true},
+		{"*.log", "build.log.txt", false, false},
+		{"node_modules/", "web/node_modules", true, true},
+		{"node_modules/", "web/node_modules", false, false},
+		{"docs/*.md", "docs/a.md", false, true},
+		{"docs/*.md", "src/docs/a.md", false, false},
+		{"/docs", "docs", true, true},
+		{"/docs", "src/docs", true, false},
+		{"**/cache", "a/b/cache", true, true},
+		{"**/cache", "cache", true, true},
+		{"a/**/z", "a/z", false, true},
+		{"a/**/z", "a/b/c/z", false, true},
+		{"a/**/z", "b/a/z", false, false},
+		{"a/**", "a/b", false, true},
+	} {
+		if got := isExcluded(c.path, c.isDir, []string{c.pattern}); got != c.want {
+			t.Fatalf("pattern %q path %q dir %v: expected %v got %v", c.pattern, c.path, c.isDir, c.want, got)
+		}
+	}
+}
+
+func TestBuildTarball_ExcludePatterns(t *testing.T) {
+	dir := createExcludesTree(t)
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"logs", "src/logs", "src/vendor/lib"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"logs/a.log", "src/logs/b.txt", "src/vendor/lib/c.go", "src/run.log", "logfile"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A file named like a directory-only pattern is kept:
+	if err := ioutil.WriteFile(filepath.Join(dir, "src/vendor/logs"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := append([]string{"logs/", "*.log", "src/vendor/lib"}, DefaultExcludes...)
+	files, err := BuildTarball([]string{dir + ":::"}, patterns, true, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{".profile", "README", "logfile", "src", "src/main.go", "src/vendor", "src/vendor/logs"}
+	if actual := tarballPaths(files); !cmpStrings(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+
+	// Same excludes give the same ID:
+	again, err := BuildTarball([]string{dir + ":::"}, patterns, true, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewVirtualTarballReader(again, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compareHashes(a.HashId(), b.HashId()) != 0 {
+		t.Fatal("expected a stable ID")
+	}
+}
+
+func cmpStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuildTarball_EmptyDirsAndFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"empty", "nested/deeper/empty", "full"} {
+		if err = os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"full/zero", "zero"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "full/data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without empty directories only files are listed:
+	files, err := BuildTarball([]string{dir + ":::"}, nil, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"full/data", "full/zero", "zero"}
+	if actual := tarballPaths(files); !cmpStrings(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+
+	files, err = BuildTarball([]string{dir + ":::"}, nil, false, true, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"empty", "full/data", "full/zero", "nested/deeper/empty", "zero"}
+	if actual := tarballPaths(files); !cmpStrings(actual, expected) {
+		t.Fatalf("expected %v got %v", expected, actual)
+	}
+	if getOptions().CompatMode {
+		t.Skip("directory entries are not transferred in compat mode")
+	}
+
+	// Empty entries still occupy their terminating byte so the whole tree arrives:
+	tr, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	buf := make([]byte, tr.size)
+	if _, err = tr.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.TempDir("", "lancaster-empty-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	received := make([]*TarballFile, 0, len(files))
+	for _, f := range files {
+		received = append(received, &TarballFile{Path: f.Path, Size: f.Size, Mode: f.Mode, ModTime: f.ModTime})
+	}
+	options := getOptions()
+	options.OutputDir = out
+	tw, err := NewVirtualTarballWriter(received, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tw.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range received {
+		stat, err := os.Stat(filepath.Join(out, filepath.FromSlash(f.Path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.IsDir() != f.Mode.IsDir() {
+			t.Fatalf("%s: expected directory %v", f.Path, f.Mode.IsDir())
+		}
+		if !stat.IsDir() && stat.Size() != f.Size {
+			t.Fatalf("%s: expected %d bytes got %d", f.Path, f.Size, stat.Size())
+		}
+	}
+}
+
+func TestBuildTarball_Hidden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-hidden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{".config/app", ".git/refs", "a"} {
+		if err = os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{".config/app/settings", ".git/HEAD", ".git/refs/main", "a/.env", "a/b.txt", "README"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		excludes []string
+		hidden   HiddenMode
+		expected []string
+	}{
+		// 0: everything:
+		{nil, IncludeHidden, []string{".config/app/settings", ".git/HEAD", ".git/refs/main", "README", "a/.env", "a/b.txt"}},
+		// 1: default excludes drop .git only:
+		{DefaultExcludes, IncludeHidden, []string{".config/app/settings", "README", "a/.env", "a/b.txt"}},
+		// 2: no hidden entries at any depth:
+		{nil, SkipHidden, []string{"README", "a/b.txt"}},
+		// 3: same with default excludes:
+		{DefaultExcludes, SkipHidden, []string{"README", "a/b.txt"}},
+		// 4: only hidden entries, including those beneath hidden directories:
+		{nil, OnlyHidden, []string{".config/app/settings", ".git/HEAD", ".git/refs/main", "a/.env"}},
+		// 5: excludes still apply to hidden entries:
+		{DefaultExcludes, OnlyHidden, []string{".config/app/settings", "a/.env"}},
+		// 6: as do user globs:
+		{[]string{".config/"}, OnlyHidden, []string{".git/HEAD", ".git/refs/main", "a/.env"}},
+	}
+	for i, c := range cases {
+		files, err := BuildTarball([]string{dir + ":::"}, c.excludes, false, false, 0, c.hidden)
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if actual := tarballPaths(files); !cmpStrings(actual, c.expected) {
+			t.Fatalf("case %d: expected %v got %v", i, c.expected, actual)
+		}
+	}
+
+	// Explicitly named paths are kept whatever the mode:
+	files, err := BuildTarball([]string{filepath.Join(dir, "a", ".env") + "::.env", filepath.Join(dir, "README") + "::README"}, nil, false, false, 0, SkipHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := tarballPaths(files); !cmpStrings(actual, []string{".env", "README"}) {
+		t.Fatalf("expected explicitly named files to be kept; got %v", actual)
+	}
+	files, err = BuildTarball([]string{filepath.Join(dir, "README") + "::README"}, nil, false, false, 0, OnlyHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := tarballPaths(files); !cmpStrings(actual, []string{"README"}) {
+		t.Fatalf("expected explicitly named file to be kept; got %v", actual)
+	}
+}
@@ -0,0 +1,282 @@
+// fec.go
+package lancaster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+import "github.com/klauspost/reedsolomon"
+
+var ErrBadFEC = errors.New("FEC must be given as data:parity shard counts, e.g. 10:3")
+
+// Most shards a Reed-Solomon group may have in total:
+const maxFECShards = 256
+
+// Most FEC groups a client buffers at once; older groups fall back to NAKing:
+const maxFECGroups = 32
+
+// Reed-Solomon forward error correction: every DataShards consecutive shards of the data region stream
+// are protected by ParityShards parity shards sent as extra data regions past the end of the stream.
+type FEC struct {
+	DataShards   int
+	ParityShards int
+}
+
+func ParseFEC(s string) (FEC, error) {
+	if s == "" || s == "none" {
+		return FEC{}, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return FEC{}, ErrBadFEC
+	}
+	k, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return FEC{}, ErrBadFEC
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return FEC{}, ErrBadFEC
+	}
+	if k < 1 || m < 1 || k+m > maxFECShards {
+		return FEC{}, ErrBadFEC
+	}
+	return FEC{DataShards: k, ParityShards: m}, nil
+}
+
+func (f FEC) Enabled() bool {
+	return f.DataShards > 0 && f.ParityShards > 0
+}
+
+func (f FEC) String() string {
+	if !f.Enabled() {
+		return "none"
+	}
+	return fmt.Sprintf("%d:%d", f.DataShards, f.ParityShards)
+}
+
+// Offset a parity shard is sent at; parity lives past the end of the stream so it never collides with data:
+func (f FEC) parityOffset(streamSize int64, shardSize int64, group int64, j int) int64 {
+	return streamSize + (group*int64(f.ParityShards)+int64(j))*shardSize
+}
+
+// Inverse of parityOffset:
+func (f FEC) parityIndex(streamSize int64, shardSize int64, offset int64) (int64, int) {
+	i := (offset - streamSize) / shardSize
+	return i / int64(f.ParityShards), int(i % int64(f.ParityShards))
+}
+
+// Reads the data shards of a group from the stream, zero-padding past its end:
+func readFECGroup(f FEC, stream io.ReaderAt, streamSize int64, shardSize int64, group int64) ([][]byte, error) {
+	shards := make([][]byte, f.DataShards+f.ParityShards)
+	buf := make([]byte, int64(f.DataShards)*shardSize)
+	for i := 0; i < f.DataShards; i++ {
+		shards[i] = buf[int64(i)*shardSize : int64(i+1)*shardSize : int64(i+1)*shardSize]
+	}
+
+	start := group * int64(f.DataShards) * shardSize
+	if start+int64(len(buf)) > streamSize {
+		buf = buf[:streamSize-start]
+	}
+	n, err := stream.ReadAt(buf, start)
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// Computes the parity shards of a group:
+func encodeFECGroup(f FEC, enc reedsolomon.Encoder, stream io.ReaderAt, streamSize int64, shardSize int64, group int64) ([][]byte, error) {
+	shards, err := readFECGroup(f, stream, streamSize, shardSize, group)
+	if err != nil {
+		return nil, err
+	}
+	for j := 0; j < f.ParityShards; j++ {
+		shards[f.DataShards+j] = make([]byte, shardSize)
+	}
+	if err = enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	return shards[f.DataShards:], nil
+}
+
+// Client side: keeps the shards of groups still being received so missing data shards can be rebuilt
+// from parity instead of NAKed.
+type fecDecoder struct {
+	fec        FEC
+	enc        reedsolomon.Encoder
+	shardSize  int64
+	streamSize int64
+	groups     map[int64]*fecGroup
+}
+
+type fecGroup struct {
+	// Data shards share one buffer; parity shards are nil until received:
+	data   []byte
+	shards [][]byte
+}
+
+func newFECDecoder(f FEC, shardSize int64, streamSize int64) (*fecDecoder, error) {
+	enc, err := reedsolomon.New(f.DataShards, f.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &fecDecoder{
+		fec:        f,
+		enc:        enc,
+		shardSize:  shardSize,
+		streamSize: streamSize,
+		groups:     make(map[int64]*fecGroup),
+	}, nil
+}
+
+func (d *fecDecoder) groupBytes() int64 {
+	return int64(d.fec.DataShards) * d.shardSize
+}
+
+func (d *fecDecoder) isParity(offset int64) bool {
+	return offset >= d.streamSize
+}
+
+// Groups overlapped by a data region:
+func (d *fecDecoder) dataGroups(offset int64, n int) (int64, int64) {
+	return offset / d.groupBytes(), (offset + int64(n) - 1) / d.groupBytes()
+}
+
+// Returns the buffer for a group, starting one only while none of its data has been received unbuffered:
+func (d *fecDecoder) group(g int64, naks *NakRegions) *fecGroup {
+	if fg, ok := d.groups[g]; ok {
+		return fg
+	}
+
+	start := g * d.groupBytes()
+	endEx := start + d.groupBytes()
+	if endEx > d.streamSize {
+		endEx = d.streamSize
+	}
+	if start >= d.streamSize || hasAckedBytes(naks, start, endEx) {
+		return nil
+	}
+
+	if len(d.groups) >= maxFECGroups {
+		// Give up on the oldest group; its losses are NAKed as usual:
+		oldest := int64(-1)
+		for k := range d.groups {
+			if oldest == -1 || k < oldest {
+				oldest = k
+			}
+		}
+		delete(d.groups, oldest)
+	}
+
+	fg := &fecGroup{
+		data:   make([]byte, d.groupBytes()),
+		shards: make([][]byte, d.fec.DataShards+d.fec.ParityShards),
+	}
+	d.groups[g] = fg
+	return fg
+}
+
+// Buffers newly received data; called before the region is ACKed:
+func (d *fecDecoder) addData(offset int64, data []byte, naks *NakRegions) {
+	first, last := d.dataGroups(offset, len(data))
+	for g := first; g <= last; g++ {
+		fg := d.group(g, naks)
+		if fg == nil {
+			continue
+		}
+		start := g * d.groupBytes()
+		lo, hi := offset, offset+int64(len(data))
+		if lo < start {
+			lo = start
+		}
+		if hi > start+d.groupBytes() {
+			hi = start + d.groupBytes()
+		}
+		copy(fg.data[lo-start:hi-start], data[lo-offset:hi-offset])
+	}
+}
+
+// Buffers a received parity shard and returns its group:
+func (d *fecDecoder) addParity(offset int64, data []byte, naks *NakRegions) int64 {
+	g, j := d.fec.parityIndex(d.streamSize, d.shardSize, offset)
+	fg := d.group(g, naks)
+	if fg == nil || int64(len(data)) != d.shardSize {
+		return g
+	}
+	fg.shards[d.fec.DataShards+j] = append([]byte(nil), data...)
+	return g
+}
+
+// Rebuilds the missing data shards of a group once enough shards are in, returning the regions that were
+// still NAKed along with their contents. Groups with nothing left to recover are dropped.
+func (d *fecDecoder) recover(g int64, naks *NakRegions) ([]Region, [][]byte, error) {
+	fg, ok := d.groups[g]
+	if !ok {
+		return nil, nil, nil
+	}
+
+	start := g * d.groupBytes()
+	present := 0
+	for i := 0; i < d.fec.DataShards; i++ {
+		lo := start + int64(i)*d.shardSize
+		hi := lo + d.shardSize
+		if hi > d.streamSize {
+			hi = d.streamSize
+		}
+		s := fg.data[int64(i)*d.shardSize : int64(i+1)*d.shardSize : int64(i+1)*d.shardSize]
+		// Shards past the end of the stream are zero padding:
+		if lo >= hi || naks.IsAcked(lo, hi) {
+			fg.shards[i] = s
+			present++
+		} else {
+			fg.shards[i] = s[:0]
+		}
+	}
+	if present == d.fec.DataShards {
+		delete(d.groups, g)
+		return nil, nil, nil
+	}
+	for j := 0; j < d.fec.ParityShards; j++ {
+		if fg.shards[d.fec.DataShards+j] != nil {
+			present++
+		}
+	}
+	if present < d.fec.DataShards {
+		return nil, nil, nil
+	}
+
+	// Missing shards are rebuilt in place within the group's buffer:
+	if err := d.enc.ReconstructData(fg.shards); err != nil {
+		return nil, nil, err
+	}
+	delete(d.groups, g)
+
+	endEx := start + d.groupBytes()
+	if endEx > d.streamSize {
+		endEx = d.streamSize
+	}
+	regions := []Region(nil)
+	contents := [][]byte(nil)
+	for _, k := range naks.Naks() {
+		if k.endEx <= start || k.start >= endEx {
+			continue
+		}
+		if k.start < start {
+			k.start = start
+		}
+		if k.endEx > endEx {
+			k.endEx = endEx
+		}
+		regions = append(regions, k)
+		contents = append(contents, fg.data[k.start-start:k.endEx-start])
+	}
+	return regions, contents, nil
+}
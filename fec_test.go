@@ -0,0 +1,131 @@
+package lancaster
+
+import (
+	"bytes"
+	"testing"
+)
+import "github.com/klauspost/reedsolomon"
+
+func TestParseFEC(t *testing.T) {
+	f, err := ParseFEC("10:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.DataShards != 10 || f.ParityShards != 3 || f.String() != "10:3" {
+		t.Fatalf("unexpected %v", f)
+	}
+
+	f, err = ParseFEC("")
+	if err != nil || f.Enabled() {
+		t.Fatalf("expected FEC disabled by default got %v %v", f, err)
+	}
+
+	for _, s := range []string{"10", "10:", "a:3", "0:3", "10:0", "200:100", "1:2:3"} {
+		if _, err = ParseFEC(s); err != ErrBadFEC {
+			t.Fatalf("expected ErrBadFEC for %q got %v", s, err)
+		}
+	}
+}
+
+func TestFEC_ParityOffset(t *testing.T) {
+	f := FEC{DataShards: 4, ParityShards: 2}
+	for g := int64(0); g < 3; g++ {
+		for j := 0; j < f.ParityShards; j++ {
+			o := f.parityOffset(1000, 16, g, j)
+			if o < 1000 {
+				t.Fatalf("parity offset %d within stream", o)
+			}
+			gg, jj := f.parityIndex(1000, 16, o)
+			if gg != g || jj != j {
+				t.Fatalf("expected group %d shard %d got %d %d", g, j, gg, jj)
+			}
+		}
+	}
+}
+
+// Feeds a decoder every data and parity region except those in `lost`, returning what it rebuilt:
+func feedFECDecoder(t *testing.T, f FEC, shardSize int64, stream []byte, lost map[int64]bool) (*NakRegions, []Region, [][]byte) {
+	streamSize := int64(len(stream))
+	d, err := newFECDecoder(f, shardSize, streamSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := reedsolomon.New(f.DataShards, f.ParityShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	naks := NewNakRegions(streamSize)
+
+	for o := int64(0); o < streamSize; o += shardSize {
+		end := o + shardSize
+		if end > streamSize {
+			end = streamSize
+		}
+		if lost[o] {
+			continue
+		}
+		d.addData(o, stream[o:end], naks)
+		naks.Ack(o, end)
+	}
+
+	groupBytes := int64(f.DataShards) * shardSize
+	regions, contents := []Region(nil), [][]byte(nil)
+	for g := int64(0); g*groupBytes < streamSize; g++ {
+		parity, err := encodeFECGroup(f, enc, bytes.NewReader(stream), streamSize, shardSize, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, p := range parity {
+			o := f.parityOffset(streamSize, shardSize, g, j)
+			if lost[o] {
+				continue
+			}
+			d.addParity(o, p, naks)
+		}
+		r, c, err := d.recover(g, naks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range r {
+			naks.Ack(r[i].start, r[i].endEx)
+		}
+		regions, contents = append(regions, r...), append(contents, c...)
+	}
+	return naks, regions, contents
+}
+
+func TestFECDecoder_RebuildsLostShards(t *testing.T) {
+	f := FEC{DataShards: 4, ParityShards: 2}
+	stream := make([]byte, 150)
+	for i := range stream {
+		stream[i] = byte(i * 7)
+	}
+
+	// Two losses in the first group and one in the short last group:
+	lost := map[int64]bool{16: true, 48: true, 144: true}
+	naks, regions, contents := feedFECDecoder(t, f, 16, stream, lost)
+	if !naks.IsAllAcked() {
+		t.Fatalf("expected everything rebuilt; still missing %v", naks.Naks())
+	}
+	cmp(t, regions, []Region{{16, 32}, {48, 64}, {144, 150}})
+	for i, r := range regions {
+		if !bytes.Equal(contents[i], stream[r.start:r.endEx]) {
+			t.Fatalf("rebuilt %v does not match", r)
+		}
+	}
+}
+
+func TestFECDecoder_TooManyLosses(t *testing.T) {
+	f := FEC{DataShards: 4, ParityShards: 1}
+	stream := bytes.Repeat([]byte{1, 2, 3}, 32)
+
+	naks, regions, _ := feedFECDecoder(t, f, 16, stream, map[int64]bool{0: true, 16: true})
+	if len(regions) != 0 {
+		t.Fatalf("expected nothing rebuilt got %v", regions)
+	}
+	cmp(t, naks.Naks(), []Region{{0, 32}})
+}
+
+func TestClient_RunCompletesWithFEC(t *testing.T) {
+	runLoopbackTransfer(t, 13650, ServerOptions{FEC: FEC{DataShards: 4, ParityShards: 2}}, bytes.Repeat([]byte("parity "), 40000), nil)
+}
@@ -0,0 +1,57 @@
+// hash.go
+package lancaster
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+import "github.com/zeebo/blake3"
+
+// Algorithm for the per-file content hashes clients verify downloads with. Both produce 32 bytes:
+type HashAlgorithm byte
+
+const (
+	HashSHA256 HashAlgorithm = iota
+	// Much faster than SHA-256 on large payloads where SIMD is available:
+	HashBLAKE3
+)
+
+var ErrBadHashAlgorithm = errors.New("unknown hash algorithm; expected sha256 or blake3")
+
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	switch s {
+	case "", "sha256":
+		return HashSHA256, nil
+	case "blake3":
+		return HashBLAKE3, nil
+	default:
+		return HashSHA256, ErrBadHashAlgorithm
+	}
+}
+
+func (a HashAlgorithm) String() string {
+	switch a {
+	case HashSHA256:
+		return "sha256"
+	case HashBLAKE3:
+		return "blake3"
+	default:
+		return "unknown"
+	}
+}
+
+func (a HashAlgorithm) New() hash.Hash {
+	if a == HashBLAKE3 {
+		return blake3.New()
+	}
+	return sha256.New()
+}
+
+// A file's hash when computed with `algorithm`:
+func hashBy(tf *TarballFile, algorithm HashAlgorithm) []byte {
+	if tf.hashAlgorithm != algorithm {
+		return nil
+	}
+	return tf.Hash
+}
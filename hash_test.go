@@ -0,0 +1,97 @@
+package lancaster
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseHashAlgorithm(t *testing.T) {
+	for s, expected := range map[string]HashAlgorithm{"": HashSHA256, "sha256": HashSHA256, "blake3": HashBLAKE3} {
+		if a, err := ParseHashAlgorithm(s); err != nil || a != expected {
+			t.Fatalf("%q: expected %v got %v %v", s, expected, a, err)
+		}
+	}
+	if _, err := ParseHashAlgorithm("md5"); err != ErrBadHashAlgorithm {
+		t.Fatalf("expected ErrBadHashAlgorithm got %v", err)
+	}
+}
+
+func TestHashAlgorithm_BLAKE3(t *testing.T) {
+	h := HashBLAKE3.New()
+	h.Write([]byte("abc"))
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85" {
+		t.Fatalf("unexpected digest %s", actual)
+	}
+}
+
+func TestHashId_DependsOnAlgorithm(t *testing.T) {
+	files := tarballFileList{&TarballFile{Path: "a", Size: 1, Mode: 0644}}
+	if bytes.Equal(tarballHashId(files, HashSHA256), tarballHashId(files, HashBLAKE3)) {
+		t.Fatal("expected transfers hashed differently to have different IDs")
+	}
+}
+
+func TestClient_DecodeMetadataBLAKE3(t *testing.T) {
+	options := getOptions()
+	options.HashAlgorithm = HashBLAKE3
+	hash := bytes.Repeat([]byte{0xb3}, 32)
+	tb := &VirtualTarballReader{
+		files: tarballFileList{
+			&TarballFile{Path: "a", Size: 1, Mode: 0644, Hash: hash, hashAlgorithm: HashBLAKE3},
+			&TarballFile{Path: "b", Size: 2, Mode: 0644},
+		},
+		size:    5,
+		options: options,
+	}
+	md, err := encodeMetadata(tb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md}
+	if err = c.decodeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	files := c.Files()
+	if !bytes.Equal(files[0].Hash, hash) || files[0].hashAlgorithm != HashBLAKE3 || files[1].Hash != nil {
+		t.Fatalf("unexpected hashes %x (%v) %x", files[0].Hash, files[0].hashAlgorithm, files[1].Hash)
+	}
+
+	// Older clients don't get hashes they'd check with SHA-256:
+	c = NewClient(nil, ClientOptions{TarballOptions: getOptions()})
+	c.metadataSections = [][]byte{md[:len(md)-1-2*2-32]}
+	if err = c.decodeMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Files()[0].Hash != nil {
+		t.Fatal("expected no hash where the algorithm is unknown")
+	}
+}
+
+func TestClose_HashMismatchBLAKE3(t *testing.T) {
+	h := HashBLAKE3.New()
+	h.Write([]byte("hi\n"))
+	good := h.Sum(nil)
+	files := []*TarballFile{
+		&TarballFile{Path: "jim-blake3-ok.txt", Size: 3, Mode: 0644, Hash: good, hashAlgorithm: HashBLAKE3},
+		&TarballFile{Path: "jim-blake3-bad.txt", Size: 3, Mode: 0644, Hash: good, hashAlgorithm: HashBLAKE3},
+	}
+	defer os.Remove("jim-blake3-ok.txt")
+	defer os.Remove("jim-blake3-bad.txt")
+
+	tb := newTarballWriter(t, files)
+	if _, err := tb.WriteAt([]byte("hi\n\x00hI\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tb.markComplete()
+
+	err := tb.Close()
+	if !errors.Is(err, ErrHashMismatch) || strings.Contains(err.Error(), "jim-blake3-ok.txt") {
+		t.Fatalf("expected only jim-blake3-bad.txt to mismatch; got %v", err)
+	}
+}
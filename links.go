@@ -0,0 +1,119 @@
+// links.go
+package lancaster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var ErrBadLink = errors.New("hard link target is not a regular file in the transfer")
+
+// Device and inode numbers identifying a file's contents:
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// Sends the contents of files sharing an inode once: the file sorting first carries them and the others
+// become hard links to it. Files on filesystems without inode numbers stay independent copies.
+func linkHardlinks(files []*TarballFile) {
+	groups := make(map[fileID]tarballFileList)
+	for _, tf := range files {
+		if !tf.Mode.IsRegular() || tf.LocalOffset != 0 || tf.spooled {
+			continue
+		}
+		info, err := os.Lstat(tf.LocalPath)
+		if err != nil {
+			continue
+		}
+		id, ok := fileInode(info)
+		if !ok {
+			continue
+		}
+		groups[id] = append(groups[id], tf)
+	}
+
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		sort.Sort(group)
+		for _, tf := range group[1:] {
+			tf.LinkTarget = group[0].Path
+			tf.Size = 0
+		}
+	}
+}
+
+// Resolves every link to the regular file it shares contents with. Links to links, directories or
+// anything missing are refused since the target has to exist once its own contents are written.
+func resolveLinks(files tarballFileList) error {
+	byPath := make(map[string]*TarballFile, len(files))
+	for _, tf := range files {
+		byPath[tf.Path] = tf
+	}
+	for _, tf := range files {
+		if tf.LinkTarget == "" {
+			continue
+		}
+		target, ok := byPath[tf.LinkTarget]
+		if !ok || !tf.Mode.IsRegular() || tf.Size != 0 || !target.Mode.IsRegular() || target.LinkTarget != "" {
+			return fmt.Errorf("%w: '%s' -> '%s'", ErrBadLink, tf.Path, tf.LinkTarget)
+		}
+		tf.linkTo = target
+	}
+	return nil
+}
+
+// Recreates a hard link, copying the target instead in compat mode or where linking fails:
+func makeHardlink(tf *TarballFile, compat bool) error {
+	dir, _ := filepath.Split(tf.LocalPath)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(tf.LocalPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if !compat {
+		if err := os.Link(tf.linkTo.LocalPath, tf.LocalPath); err == nil {
+			return nil
+		}
+		// e.g. a filesystem without hard links:
+	}
+	if err := copyFile(tf.linkTo.LocalPath, tf.LocalPath, tf.linkTo.Mode); err != nil {
+		return err
+	}
+	if compat {
+		return nil
+	}
+	return os.Chmod(tf.LocalPath, localMode(tf.linkTo.Mode))
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
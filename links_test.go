@@ -0,0 +1,59 @@
+package lancaster
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveLinks_BadTargets(t *testing.T) {
+	for name, files := range map[string][]*TarballFile{
+		"missing":   {{Path: "b", Mode: 0644, LinkTarget: "a"}},
+		"directory": {{Path: "a", Mode: os.ModeDir | 0755}, {Path: "b", Mode: 0644, LinkTarget: "a"}},
+		"chained":   {{Path: "a", Size: 1, Mode: 0644}, {Path: "b", Mode: 0644, LinkTarget: "a"}, {Path: "c", Mode: 0644, LinkTarget: "b"}},
+		"contents":  {{Path: "a", Size: 1, Mode: 0644}, {Path: "b", Size: 1, Mode: 0644, LinkTarget: "a"}},
+	} {
+		if _, err := NewVirtualTarballWriter(files, getOptions()); !errors.Is(err, ErrBadLink) {
+			t.Fatalf("%s: expected ErrBadLink got %v", name, err)
+		}
+	}
+
+	// Targets are paths within the download like any other:
+	files := []*TarballFile{{Path: "a", Size: 1, Mode: 0644}, {Path: "b", Mode: 0644, LinkTarget: "../a"}}
+	if _, err := NewVirtualTarballWriter(files, getOptions()); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("expected ErrBadPath got %v", err)
+	}
+}
+
+func TestMakeHardlink_CopiesInCompatMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := &TarballFile{Path: "a", LocalPath: filepath.Join(dir, "a"), Mode: 0644}
+	if err = ioutil.WriteFile(target.LocalPath, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := &TarballFile{Path: "sub/b", LocalPath: filepath.Join(dir, "sub", "b"), Mode: 0644, linkTo: target}
+	if err = makeHardlink(link, true); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(link.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("contents")) {
+		t.Fatalf("unexpected contents %q", b)
+	}
+	a, _ := os.Stat(target.LocalPath)
+	stat, _ := os.Stat(link.LocalPath)
+	if os.SameFile(a, stat) {
+		t.Fatal("expected a copy in compat mode")
+	}
+}
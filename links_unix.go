@@ -0,0 +1,17 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lancaster
+
+import (
+	"os"
+	"syscall"
+)
+
+// Device and inode numbers of a file:
+func fileInode(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
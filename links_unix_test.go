@@ -0,0 +1,107 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lancaster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildTarball_Hardlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-links")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "b"), []byte("shared contents\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"a", "sub/c"} {
+		if err = os.Link(filepath.Join(dir, "b"), filepath.Join(dir, link)); err != nil {
+			t.Skipf("hard links unsupported: %s", err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "d"), []byte("shared contents\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := BuildTarball([]string{dir + ":::"}, nil, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	// The first by path carries the contents; equal contents on another inode aren't linked:
+	links := map[string]string{}
+	for _, f := range tr.files {
+		links[f.Path] = f.LinkTarget
+	}
+	if links["a"] != "" || links["b"] != "a" || links["sub/c"] != "a" || links["d"] != "" {
+		t.Fatalf("unexpected links %v", links)
+	}
+	expectedSize := int64(len("shared contents\n")*2 + 4)
+	if tr.size != expectedSize {
+		t.Fatalf("expected the shared contents once; size %d got %d", expectedSize, tr.size)
+	}
+
+	if err = tr.HashFiles(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, tr.size)
+	if _, err = tr.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.TempDir("", "lancaster-links-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	received := make([]*TarballFile, 0, len(tr.files))
+	for _, f := range tr.files {
+		received = append(received, &TarballFile{Path: f.Path, Size: f.Size, Mode: f.Mode, Hash: f.Hash, LinkTarget: f.LinkTarget})
+	}
+	options := getOptions()
+	options.OutputDir = out
+	tw, err := NewVirtualTarballWriter(received, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tw.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	tw.markComplete()
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := os.Stat(filepath.Join(out, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"b", "sub/c"} {
+		stat, err := os.Stat(filepath.Join(out, link))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(a, stat) {
+			t.Fatalf("expected %s to be a hard link to a", link)
+		}
+	}
+	d, err := os.Stat(filepath.Join(out, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(a, d) {
+		t.Fatal("expected d to be a file of its own")
+	}
+}
@@ -0,0 +1,10 @@
+// +build windows
+
+package lancaster
+
+import "os"
+
+// Windows doesn't report inode numbers through os.FileInfo so hard links are sent as copies:
+func fileInode(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,62 @@
+package lancaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, l := range []LogLevel{LogDebug, LogInfo, LogWarn, LogError} {
+		if got, err := ParseLogLevel(strings.ToUpper(l.String())); err != nil || got != l {
+			t.Fatalf("expected %v got %v %v", l, got, err)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err != ErrBadLogLevel {
+		t.Fatalf("expected ErrBadLogLevel got %v", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	out, tee := &bytes.Buffer{}, &bytes.Buffer{}
+	l := NewLogger(out, LogInfo, false)
+	l.SetTee(tee)
+	l.Debugf("hidden %d", 1)
+	l.Infof("shown %d", 2)
+	l.Warnf("careful")
+	if out.String() != "shown 2\nwarn: careful\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	if strings.Contains(tee.String(), "hidden") || strings.Count(tee.String(), "\n") != 2 {
+		t.Fatalf("expected info and above in tee got %q", tee.String())
+	}
+
+	// Children share the output but not the tee:
+	out.Reset()
+	tee.Reset()
+	child, childTee := l.Child("a: "), &bytes.Buffer{}
+	child.SetTee(childTee)
+	child.Infof("from child")
+	l.Infof("from parent")
+	if out.String() != "a: from child\nfrom parent\n" {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+	if !strings.Contains(childTee.String(), "a: from child") || strings.Contains(childTee.String(), "parent") || strings.Contains(tee.String(), "child") {
+		t.Fatalf("expected each tee to get its own lines got %q and %q", childTee.String(), tee.String())
+	}
+
+	out.Reset()
+	l = NewLogger(out, LogDebug, true)
+	l.Debugf("a \"quoted\" message")
+	line := struct {
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Level != "debug" || line.Msg != "a \"quoted\" message" {
+		t.Fatalf("unexpected line %+v", line)
+	}
+}
@@ -0,0 +1,66 @@
+// loss.go
+package lancaster
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ErrBadDropRate = errors.New("drop rate must be a fraction between 0 and 1")
+
+// Packets to drop on purpose so NAKs, resend timeouts and FEC get exercised over a loopback that never
+// loses anything. For testing only; see Multicast.SimulateLoss.
+type LossSimulation struct {
+	// Fractions of data messages, and of control messages and announcements, dropped; 0 to 1:
+	Data    float64
+	Control float64
+	// Seeds the choice of packets dropped so a run can be repeated; the clock when 0:
+	Seed int64
+}
+
+func (l LossSimulation) Enabled() bool {
+	return l.Data > 0 || l.Control > 0
+}
+
+// Decides which packets to drop; a nil one drops none:
+type lossSimulator struct {
+	sim LossSimulation
+	// Receive loops and senders decide concurrently:
+	lock sync.Mutex
+	rnd  *rand.Rand
+}
+
+func newLossSimulator(sim LossSimulation) (*lossSimulator, error) {
+	for _, rate := range []float64{sim.Data, sim.Control} {
+		if !(rate >= 0 && rate <= 1) {
+			return nil, ErrBadDropRate
+		}
+	}
+	if !sim.Enabled() {
+		return nil, nil
+	}
+	seed := sim.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &lossSimulator{sim: sim, rnd: rand.New(rand.NewSource(seed))}, nil
+}
+
+// Whether to drop the next data message, or control message when not `data`:
+func (l *lossSimulator) drops(data bool) bool {
+	if l == nil {
+		return false
+	}
+	rate := l.sim.Control
+	if data {
+		rate = l.sim.Data
+	}
+	if rate <= 0 {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rnd.Float64() < rate
+}
@@ -0,0 +1,65 @@
+package lancaster
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestNewLossSimulator(t *testing.T) {
+	// 1. Rates are fractions:
+	for _, sim := range []LossSimulation{{Data: -0.1}, {Control: 1.5}, {Data: math.NaN()}} {
+		if _, err := newLossSimulator(sim); err != ErrBadDropRate {
+			t.Fatalf("expected %v for %+v got %v", ErrBadDropRate, sim, err)
+		}
+	}
+
+	// 2. Nothing is dropped without a rate:
+	l, err := newLossSimulator(LossSimulation{Seed: 1})
+	if err != nil || l != nil {
+		t.Fatalf("expected no simulator got %v %v", l, err)
+	}
+	if l.drops(true) || l.drops(false) {
+		t.Fatal("expected a nil simulator to drop nothing")
+	}
+}
+
+func TestLossSimulator_Seeded(t *testing.T) {
+	sim := LossSimulation{Data: 0.25, Seed: 42}
+	a, _ := newLossSimulator(sim)
+	b, _ := newLossSimulator(sim)
+
+	dropped := 0
+	for i := 0; i < 10000; i++ {
+		d := a.drops(true)
+		if d != b.drops(true) {
+			t.Fatalf("expected the same seed to drop the same packets; differed at %d", i)
+		}
+		if d {
+			dropped++
+		}
+		if a.drops(false) {
+			t.Fatal("expected no control packets dropped")
+		}
+		b.drops(false)
+	}
+	if dropped < 2300 || dropped > 2700 {
+		t.Fatalf("expected about 2500 of 10000 dropped got %d", dropped)
+	}
+}
+
+func TestClient_RunCompletesWithLoss(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13910)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13910)
+	if err := sm.SimulateLoss(LossSimulation{Data: 0.2, Control: 0.1, Seed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.SimulateLoss(LossSimulation{Control: 0.1, Seed: 2}); err != nil {
+		t.Fatal(err)
+	}
+	c := runTransfer(t, sm, cm, ServerOptions{ChunkSize: 1000, Quiet: true}, ClientOptions{Quiet: true}, bytes.Repeat([]byte("lossy link\n"), 20000))
+	if c.Stats().RetransmitRequests == 0 {
+		t.Fatal("expected lost regions to be requested again")
+	}
+}
@@ -0,0 +1,152 @@
+// metrics.go
+package lancaster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Transfer health exposed in the Prometheus text format. A nil *Metrics ignores every update so
+// servers and clients pay nothing when metrics are off.
+type Metrics struct {
+	bytesSent              int64
+	bytesReceived          int64
+	dataPacketsSent        int64
+	dataPacketsReceived    int64
+	controlPacketsSent     int64
+	controlPacketsReceived int64
+	retransmitRequests     int64
+	activeClients          int64
+	nakRegions             int64
+
+	// float64 bits:
+	sendRate        uint64
+	receiveRate     uint64
+	percentComplete uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) dataSent(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesSent, int64(n))
+	atomic.AddInt64(&m.dataPacketsSent, 1)
+}
+
+func (m *Metrics) dataReceived(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesReceived, int64(n))
+	atomic.AddInt64(&m.dataPacketsReceived, 1)
+}
+
+func (m *Metrics) controlSent() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.controlPacketsSent, 1)
+}
+
+func (m *Metrics) controlReceived() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.controlPacketsReceived, 1)
+}
+
+// Counts NAK'd ranges, as sent by clients or received by the server:
+func (m *Metrics) retransmitsRequested(regions int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.retransmitRequests, int64(regions))
+}
+
+func (m *Metrics) setActiveClients(n int) {
+	if m == nil {
+		return
+	}
+	atomic.StoreInt64(&m.activeClients, int64(n))
+}
+
+func (m *Metrics) setNakRegions(n int) {
+	if m == nil {
+		return
+	}
+	atomic.StoreInt64(&m.nakRegions, int64(n))
+}
+
+func (m *Metrics) setSendRate(bytesPerSecond float64) {
+	if m == nil {
+		return
+	}
+	atomic.StoreUint64(&m.sendRate, math.Float64bits(bytesPerSecond))
+}
+
+func (m *Metrics) setReceiveRate(bytesPerSecond float64) {
+	if m == nil {
+		return
+	}
+	atomic.StoreUint64(&m.receiveRate, math.Float64bits(bytesPerSecond))
+}
+
+func (m *Metrics) setPercentComplete(pct float64) {
+	if m == nil {
+		return
+	}
+	atomic.StoreUint64(&m.percentComplete, math.Float64bits(pct))
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	b := &bytes.Buffer{}
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	float := func(bits *uint64) float64 {
+		return math.Float64frombits(atomic.LoadUint64(bits))
+	}
+
+	metric("lancaster_bytes_sent_total", "counter", "Data region bytes sent.", atomic.LoadInt64(&m.bytesSent))
+	metric("lancaster_bytes_received_total", "counter", "Data region bytes received.", atomic.LoadInt64(&m.bytesReceived))
+	metric("lancaster_send_rate_bytes", "gauge", "Bytes per second sent over the last refresh interval.", float(&m.sendRate))
+	metric("lancaster_receive_rate_bytes", "gauge", "Bytes per second received over the last refresh interval.", float(&m.receiveRate))
+	metric("lancaster_retransmit_requests_total", "counter", "Ranges of missing data requested via NAKs.", atomic.LoadInt64(&m.retransmitRequests))
+	metric("lancaster_active_clients", "gauge", "Clients heard from within the client timeout.", atomic.LoadInt64(&m.activeClients))
+	metric("lancaster_nak_regions", "gauge", "Ranges of missing data a client is tracking.", atomic.LoadInt64(&m.nakRegions))
+	metric("lancaster_percent_complete", "gauge", "Percentage of the transfer received.", float(&m.percentComplete))
+
+	fmt.Fprintf(b, "# HELP lancaster_packets_total Datagrams by kind and direction.\n# TYPE lancaster_packets_total counter\n")
+	fmt.Fprintf(b, "lancaster_packets_total{kind=\"data\",direction=\"sent\"} %d\n", atomic.LoadInt64(&m.dataPacketsSent))
+	fmt.Fprintf(b, "lancaster_packets_total{kind=\"data\",direction=\"received\"} %d\n", atomic.LoadInt64(&m.dataPacketsReceived))
+	fmt.Fprintf(b, "lancaster_packets_total{kind=\"control\",direction=\"sent\"} %d\n", atomic.LoadInt64(&m.controlPacketsSent))
+	fmt.Fprintf(b, "lancaster_packets_total{kind=\"control\",direction=\"received\"} %d\n", atomic.LoadInt64(&m.controlPacketsReceived))
+
+	return b.WriteTo(w)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// Serves metrics at /metrics on `addr` in the background; only failing to listen is reported:
+func (m *Metrics) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(l, mux)
+	return nil
+}
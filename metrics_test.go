@@ -0,0 +1,64 @@
+package lancaster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_NilIsNoop(t *testing.T) {
+	m := (*Metrics)(nil)
+	m.dataSent(10)
+	m.dataReceived(10)
+	m.controlSent()
+	m.controlReceived()
+	m.retransmitsRequested(3)
+	m.setActiveClients(2)
+	m.setNakRegions(5)
+	m.setSendRate(1)
+	m.setReceiveRate(1)
+	m.setPercentComplete(50)
+}
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := NewMetrics()
+	m.dataSent(1000)
+	m.dataSent(500)
+	m.controlReceived()
+	m.retransmitsRequested(3)
+	m.setActiveClients(2)
+	m.setNakRegions(5)
+	m.setPercentComplete(42.5)
+
+	b := &bytes.Buffer{}
+	if _, err := m.WriteTo(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"lancaster_bytes_sent_total 1500\n",
+		"lancaster_retransmit_requests_total 3\n",
+		"lancaster_active_clients 2\n",
+		"lancaster_nak_regions 5\n",
+		"lancaster_percent_complete 42.5\n",
+		"# TYPE lancaster_packets_total counter\n",
+		`lancaster_packets_total{kind="data",direction="sent"} 2` + "\n",
+		`lancaster_packets_total{kind="control",direction="received"} 1` + "\n",
+	} {
+		if !strings.Contains(b.String(), line) {
+			t.Fatalf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.dataReceived(7)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || !strings.Contains(string(body), "lancaster_bytes_received_total 7\n") {
+		t.Fatalf("unexpected response %q %s", rec.Header().Get("Content-Type"), body)
+	}
+}
@@ -0,0 +1,43 @@
+// mmap.go
+package lancaster
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+var ErrMmapUnsupported = errors.New("memory-mapped reads not supported on this platform")
+
+// Read-only mapping of a whole source file:
+type mappedFile []byte
+
+// Copies from the mapping at `off`. Pages of a file truncated since it was mapped fault rather than
+// reading short, so the fault is turned into ErrSourceChanged instead of crashing the server.
+func (m mappedFile) copyAt(p []byte, off int64, path string) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n, err = 0, fmt.Errorf("%w: '%s'", ErrSourceChanged, path)
+		}
+	}()
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+
+	if off >= int64(len(m)) {
+		return 0, fmt.Errorf("%w: '%s'", ErrSourceChanged, path)
+	}
+	n = copy(p, m[off:])
+	if n < len(p) {
+		return n, fmt.Errorf("%w: '%s'", ErrSourceChanged, path)
+	}
+	return n, nil
+}
+
+// io.ReaderAt over a mapping:
+type mappedReaderAt struct {
+	m    mappedFile
+	path string
+}
+
+func (r mappedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.m.copyAt(p, off, r.path)
+}
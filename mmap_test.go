@@ -0,0 +1,119 @@
+package lancaster
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Files of awkward sizes so regions straddle boundaries:
+func newMmapTestFiles(tb testing.TB, dir string) []*TarballFile {
+	files := []*TarballFile(nil)
+	for i, size := range []int{5000, 1, 0, 70001, 333} {
+		name := fmt.Sprintf("file%d", i)
+		localPath := filepath.Join(dir, name)
+		contents := bytes.Repeat([]byte{byte('a' + i)}, size)
+		if err := ioutil.WriteFile(localPath, contents, 0644); err != nil {
+			tb.Fatal(err)
+		}
+		files = append(files, &TarballFile{Path: name, LocalPath: localPath, Size: int64(size), Mode: 0644})
+	}
+	return files
+}
+
+func TestReadAt_MmapMatchesRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	read := func(mmap bool, regionSize int) []byte {
+		options := getOptions()
+		options.Mmap = mmap
+		tb, err := NewVirtualTarballReader(newMmapTestFiles(t, dir), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tb.Close()
+
+		stream := []byte(nil)
+		for offset := int64(0); offset < tb.size; offset += int64(regionSize) {
+			buf := make([]byte, regionSize)
+			if offset+int64(regionSize) > tb.size {
+				buf = buf[:tb.size-offset]
+			}
+			n, err := tb.ReadAt(buf, offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream = append(stream, buf[:n]...)
+		}
+		return stream
+	}
+
+	expected := read(false, 1<<20)
+	for _, regionSize := range []int{1, 999, 4096, 65000} {
+		if actual := read(true, regionSize); !bytes.Equal(actual, expected) {
+			t.Fatalf("%d byte regions: expected the same stream with mmap", regionSize)
+		}
+	}
+}
+
+func benchmarkSendRegions(b *testing.B, mmap bool) {
+	dir, err := ioutil.TempDir("", "lancaster-mmap")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 64 << 20
+	const regionSize = 60000
+	localPath := filepath.Join(dir, "big")
+	if err = ioutil.WriteFile(localPath, bytes.Repeat([]byte{0xa5}, size), 0644); err != nil {
+		b.Fatal(err)
+	}
+	options := getOptions()
+	options.Mmap = mmap
+	tb, err := NewVirtualTarballReader([]*TarballFile{{Path: "big", LocalPath: localPath, Size: size, Mode: 0644}}, options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tb.Close()
+
+	// Data messages built the way the server does with and without --mmap:
+	hashId := make([]byte, HashSize)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for offset := int64(0); offset < size; offset += regionSize {
+			if mmap {
+				hdr := dataMessage(hashId, offset, nil)
+				msg := append(make([]byte, 0, len(hdr)+regionSize), hdr...)
+				if _, mapped, err := tb.ReadMapped(msg[len(hdr):cap(msg)], offset); err != nil || !mapped {
+					b.Fatal(mapped, err)
+				}
+				continue
+			}
+			buf := make([]byte, regionSize)
+			if _, err := tb.ReadAt(buf, offset); err != nil {
+				b.Fatal(err)
+			}
+			dataMessage(hashId, offset, buf)
+		}
+	}
+}
+
+func BenchmarkSendRegions_Read(b *testing.B) {
+	benchmarkSendRegions(b, false)
+}
+
+func BenchmarkSendRegions_Mmap(b *testing.B) {
+	if !mmapSupported {
+		b.Skip(ErrMmapUnsupported)
+	}
+	benchmarkSendRegions(b, true)
+}
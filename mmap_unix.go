@@ -0,0 +1,25 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lancaster
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+func mmapFile(f *os.File, size int64) (mappedFile, error) {
+	if int64(int(size)) != size {
+		return nil, syscall.EFBIG
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return mappedFile(b), nil
+}
+
+func munmapFile(m mappedFile) error {
+	return syscall.Munmap(m)
+}
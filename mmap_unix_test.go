@@ -0,0 +1,77 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lancaster
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMapped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := getOptions()
+	options.Mmap = true
+	tb, err := NewVirtualTarballReader(newMmapTestFiles(t, dir), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	// Stops at the end of the first file's contents:
+	buf := make([]byte, 65000)
+	n, mapped, err := tb.ReadMapped(buf, 4000)
+	if err != nil || !mapped {
+		t.Fatal(mapped, err)
+	}
+	if n != 1000 || !bytes.Equal(buf[:n], bytes.Repeat([]byte{'a'}, 1000)) {
+		t.Fatalf("unexpected %d bytes %q", n, buf[:n])
+	}
+
+	// Padding isn't within a file:
+	if _, mapped, err = tb.ReadMapped(buf, 5000); err != nil || mapped {
+		t.Fatal(mapped, err)
+	}
+}
+
+func TestReadMapped_SourceTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 1 << 20
+	localPath := filepath.Join(dir, "shrinking")
+	if err = ioutil.WriteFile(localPath, bytes.Repeat([]byte{1}, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := getOptions()
+	options.Mmap = true
+	tb, err := NewVirtualTarballReader([]*TarballFile{{Path: "shrinking", LocalPath: localPath, Size: size, Mode: 0644}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	buf := make([]byte, 4096)
+	if _, mapped, err := tb.ReadMapped(buf, 0); err != nil || !mapped {
+		t.Fatal(mapped, err)
+	}
+
+	// Mapped pages past the new end fault instead of reading short:
+	if err = os.Truncate(localPath, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = tb.ReadMapped(buf, size/2); !errors.Is(err, ErrSourceChanged) {
+		t.Fatalf("expected %v got %v", ErrSourceChanged, err)
+	}
+}
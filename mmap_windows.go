@@ -0,0 +1,16 @@
+// +build windows
+
+package lancaster
+
+import "os"
+
+const mmapSupported = false
+
+// Files are always read with ReadAt on Windows:
+func mmapFile(f *os.File, size int64) (mappedFile, error) {
+	return nil, ErrMmapUnsupported
+}
+
+func munmapFile(m mappedFile) error {
+	return nil
+}
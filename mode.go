@@ -0,0 +1,33 @@
+// mode.go
+package lancaster
+
+import "os"
+
+// Windows keeps no permission bits, only a read-only attribute that Chmod sets when the owner write
+// bit is clear, so recorded modes are narrowed to that before being applied there. Set-ID and sticky
+// bits have no meaning, and directories stay writable since Windows ignores their read-only attribute
+// when checking access.
+func windowsMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() {
+		return mode&os.ModeType | 0777
+	}
+	if mode&0200 == 0 {
+		return mode&os.ModeType | 0444
+	}
+	return mode&os.ModeType | 0666
+}
+
+// Windows reports files as 0666, or 0444 when read-only, and directories as 0777. Those become the
+// modes a Unix tree would usually have so receivers there don't get world-writable files; read-only
+// files stay read-only and symlinks keep the 0777 Unix gives them.
+func modeFromWindows(mode os.FileMode) os.FileMode {
+	switch {
+	case mode.IsDir():
+		return mode&os.ModeType | 0755
+	case mode&os.ModeSymlink != 0:
+		return mode&os.ModeType | 0777
+	case mode&0200 == 0:
+		return mode&os.ModeType | 0444
+	}
+	return mode&os.ModeType | 0644
+}
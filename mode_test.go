@@ -0,0 +1,61 @@
+package lancaster
+
+import (
+	"os"
+	"testing"
+)
+
+// The mappings are pure so run everywhere; which one applies depends on the platform:
+//
+//	served from   received on   mode applied
+//	Unix          Unix          as recorded
+//	Unix          Windows       windowsMode: read-only attribute from the owner write bit
+//	Windows       Unix          modeFromWindows when recorded, then as recorded
+//	Windows       Windows       both, which round-trips the read-only attribute
+//
+// Only Windows builds exercise the writer applying windowsMode end to end.
+func TestWindowsMode(t *testing.T) {
+	for _, c := range []struct {
+		mode     os.FileMode
+		expected os.FileMode
+	}{
+		// 1. Writable files of any kind are simply writable:
+		{0644, 0666},
+		{0755, 0666},
+		{0600, 0666},
+		// 2. No owner write bit is the read-only attribute:
+		{0444, 0444},
+		{0555, 0444},
+		// 3. Set-ID and sticky bits are dropped:
+		{os.ModeSetuid | 0755, 0666},
+		{os.ModeSetgid | os.ModeSticky | 0444, 0444},
+		// 4. Directories stay writable; types are kept:
+		{os.ModeDir | 0555, os.ModeDir | 0777},
+		{os.ModeSymlink | 0777, os.ModeSymlink | 0666},
+	} {
+		if mode := windowsMode(c.mode); mode != c.expected {
+			t.Fatalf("%v: expected %v got %v", c.mode, c.expected, mode)
+		}
+	}
+}
+
+func TestModeFromWindows(t *testing.T) {
+	for _, c := range []struct {
+		mode     os.FileMode
+		expected os.FileMode
+	}{
+		{0666, 0644},
+		{0444, 0444},
+		{os.ModeDir | 0777, os.ModeDir | 0755},
+		{os.ModeDir | 0555, os.ModeDir | 0755},
+		{os.ModeSymlink | 0666, os.ModeSymlink | 0777},
+	} {
+		if mode := modeFromWindows(c.mode); mode != c.expected {
+			t.Fatalf("%v: expected %v got %v", c.mode, c.expected, mode)
+		}
+		// Received back on Windows the read-only attribute survives:
+		if back := windowsMode(modeFromWindows(c.mode)); back&0200 != c.mode&0200 && !c.mode.IsDir() {
+			t.Fatalf("%v: read-only attribute lost, got %v", c.mode, back)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lancaster
+
+import "os"
+
+// Recorded modes apply as they are:
+func localMode(mode os.FileMode) os.FileMode {
+	return mode
+}
+
+// Mode to record for a file being served:
+func recordedMode(info os.FileInfo) os.FileMode {
+	return info.Mode()
+}
@@ -0,0 +1,15 @@
+// +build windows
+
+package lancaster
+
+import "os"
+
+// Only the read-only attribute of a recorded mode applies:
+func localMode(mode os.FileMode) os.FileMode {
+	return windowsMode(mode)
+}
+
+// Mode to record for a file being served, as a Unix receiver would expect it:
+func recordedMode(info os.FileInfo) os.FileMode {
+	return modeFromWindows(info.Mode())
+}
@@ -1,11 +1,21 @@
 // udp
-package main
+package lancaster
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
 	"net"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
+import "github.com/dustin/go-humanize"
 
 // Data messages:
 const (
@@ -14,43 +24,127 @@ const (
 	DataSection
 )
 
+const DefaultDatagramSize = 65000
+
+// Content bytes per data message when the MTU can't be discovered; fits Ethernet's 1500 byte MTU with
+// room to spare for tunnel headers:
+const fallbackChunkSize = 1400
+
+var ErrZeroCopyUnsupported = errors.New("zero-copy send not supported on this platform")
+var ErrBadBufferSize = errors.New("bad buffer size; expected e.g. 4MiB or 16MB")
+var ErrBadChunkSize = errors.New("chunk size must be positive and fit in a datagram")
+var ErrSourceSpecificUnsupported = errors.New("source-specific multicast not supported")
+var ErrBadSource = errors.New("source must be an IP address or auto")
+var ErrBadDataGroup = errors.New("data group must be a multicast address, or a range of them like 239.1.0.0/16")
+var ErrNotMulticast = errors.New("group must be a multicast address, in 224.0.0.0/4 or ff00::/8")
+
 type UDPMessage struct {
 	Error error
 
 	Data          []byte
 	SourceAddress *net.UDPAddr
+
+	// Pooled buffer Data was received into; see Release:
+	packet *[]byte
+	pool   *packetPool
 }
 
 type Multicast struct {
-	netInterface     *net.Interface
+	// Joined and sent out on each; the system's choice when empty:
+	netInterfaces    []*net.Interface
 	datagramSize     int
 	sendControlCount int
 	recvControlCount int
 	sendDataCount    int
 	recvDataCount    int
 	ttl              int
-	loopback         bool
+	// Hops announcements may travel when lower than `ttl`; 0 sends them like everything else:
+	announceTTL int
+	loopback    bool
+	// Marks data, and control messages, for QoS; 0 leaves the default:
+	dataDSCP    int
+	controlDSCP int
+	// Whether the group is an IPv6 address; TTL and loopback use IPv6 socket options then:
+	ipv6 bool
+	// Seals outgoing messages with a pre-shared key when set:
+	cipher *PacketCipher
+	// Drops packets on purpose when testing; nil otherwise:
+	loss *lossSimulator
+	// Socket buffer sizes in bytes; 0 sizes them to hold a number of datagrams:
+	readBufferSize  int
+	writeBufferSize int
 
 	controlToServerAddr *net.UDPAddr
 	controlToClientAddr *net.UDPAddr
 	dataAddr            *net.UDPAddr
 
-	controlToServerConn *net.UDPConn
-	controlToClientConn *net.UDPConn
-	dataConn            *net.UDPConn
+	// Plain UDP to explicit peers instead of the groups; see NewUnicast:
+	unicast            bool
+	clientControlAddrs []*net.UDPAddr
+	clientDataAddrs    []*net.UDPAddr
+
+	// One socket per interface, or just the one when unicast or the system picks the interface:
+	controlToServerConns []*net.UDPConn
+	controlToClientConns []*net.UDPConn
+	dataConns            []*net.UDPConn
+	// Only open with an announce TTL set:
+	announceConns []*net.UDPConn
+	// Copies of control messages received by every socket when there are several:
+	recentControl recentMessages
+	// Sockets closed on purpose whose receive loops should end quietly:
+	retired sync.Map
+	// Joined source-specifically; see JoinSource:
+	source net.IP
 
 	ControlToServer chan UDPMessage
 	ControlToClient chan UDPMessage
 	Data            chan UDPMessage
+
+	// Receive buffers handed back by UDPMessage.Release:
+	packets packetPool
 }
 
+// Joins the group on `netInterface`, or wherever the system routes it when nil:
 func NewMulticast(controlToServerAddr *net.UDPAddr, netInterface *net.Interface) (*Multicast, error) {
+	if netInterface == nil {
+		return NewMulticastInterfaces(controlToServerAddr, nil)
+	}
+	return NewMulticastInterfaces(controlToServerAddr, []*net.Interface{netInterface})
+}
+
+// Joins the group on every one of `netInterfaces` so a multi-homed server reaches clients on each of
+// its networks at once. Every socket is opened once per interface: messages are sent out of each and
+// received from any, with the copies of a control message that every socket receives dropped. TTL and
+// loopback apply to each interface alike, so with loopback enabled local clients hear every message
+// once per interface.
+func NewMulticastInterfaces(controlToServerAddr *net.UDPAddr, netInterfaces []*net.Interface) (*Multicast, error) {
+	// A unicast address gets as far as sending but nothing ever joins it:
+	if !controlToServerAddr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%w: %s", ErrNotMulticast, controlToServerAddr.IP)
+	}
+
 	// Control to-server address is port+0:
 	if controlToServerAddr.Port == 0 {
 		// Set default port if not specified:
 		controlToServerAddr.Port = 1360
 	}
 
+	// Make sure each interface can actually join the group before we get an obscure socket error:
+	for _, netInterface := range netInterfaces {
+		addrs, err := netInterface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		isIPv4 := controlToServerAddr.IP.To4() != nil
+		if !hasAddressFamily(addrs, isIPv4) {
+			family := "IPv6"
+			if isIPv4 {
+				family = "IPv4"
+			}
+			return nil, fmt.Errorf("interface %s has no %s address for group %s", netInterface.Name, family, controlToServerAddr.IP)
+		}
+	}
+
 	// Control to-client address is port+1:
 	controlToClientAddr := &net.UDPAddr{
 		IP:   controlToServerAddr.IP,
@@ -75,14 +169,15 @@ func NewMulticast(controlToServerAddr *net.UDPAddr, netInterface *net.Interface)
 	//}
 
 	c := &Multicast{
-		netInterface:        netInterface,
-		datagramSize:        65000,
+		netInterfaces:       netInterfaces,
+		datagramSize:        DefaultDatagramSize,
 		sendControlCount:    2,
 		recvControlCount:    32,
 		sendDataCount:       64,
 		recvDataCount:       64,
 		ttl:                 8,
 		loopback:            false,
+		ipv6:                controlToServerAddr.IP.To4() == nil,
 		controlToServerAddr: controlToServerAddr,
 		controlToClientAddr: controlToClientAddr,
 		dataAddr:            dataAddr,
@@ -90,134 +185,377 @@ func NewMulticast(controlToServerAddr *net.UDPAddr, netInterface *net.Interface)
 	return c, nil
 }
 
+func hasAddressFamily(addrs []net.Addr, isIPv4 bool) bool {
+	for _, a := range addrs {
+		ip := net.IP(nil)
+		switch v := a.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		default:
+			continue
+		}
+		if (ip.To4() != nil) == isIPv4 {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *Multicast) ListensControlToServer() error {
-	controlToServerConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToServerAddr)
+	conns, err := m.open(m.controlToServerAddr, true)
 	if err != nil {
 		return err
 	}
-	m.controlToServerConn = controlToServerConn
+	m.controlToServerConns = conns
 
-	if err := m.setConnectionProperties(m.controlToServerConn); err != nil {
-		return err
-	}
-	if err := m.controlToServerConn.SetReadBuffer(m.datagramSize * m.recvControlCount); err != nil {
+	if err := setReadBuffers(conns, m.bufferSize(m.readBufferSize, m.recvControlCount)); err != nil {
 		return err
 	}
 	m.ControlToServer = make(chan UDPMessage)
-	go m.receiveLoop(m.controlToServerConn, m.ControlToServer)
+	m.receive(conns, m.ControlToServer, false)
 	return nil
 }
 
 func (m *Multicast) ListensControlToClient() error {
-	controlToClientConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToClientAddr)
+	conns, err := m.open(m.controlToClientAddr, true)
 	if err != nil {
 		return err
 	}
-	m.controlToClientConn = controlToClientConn
-	if err := m.setConnectionProperties(m.controlToClientConn); err != nil {
-		return err
-	}
-	if err := m.controlToClientConn.SetReadBuffer(m.datagramSize * m.recvControlCount); err != nil {
+	m.controlToClientConns = conns
+	if err := setReadBuffers(conns, m.bufferSize(m.readBufferSize, m.recvControlCount)); err != nil {
 		return err
 	}
 	m.ControlToClient = make(chan UDPMessage)
-	go m.receiveLoop(m.controlToClientConn, m.ControlToClient)
+	m.receive(conns, m.ControlToClient, false)
 	return nil
 }
 
 func (m *Multicast) ListensData() error {
-	dataConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.dataAddr)
+	conns, err := m.open(m.dataAddr, true)
 	if err != nil {
 		return err
 	}
 
-	m.dataConn = dataConn
-	if err := m.setConnectionProperties(m.dataConn); err != nil {
-		return err
-	}
-	if err := m.dataConn.SetReadBuffer(m.datagramSize * m.recvDataCount); err != nil {
+	m.dataConns = conns
+	if err := setReadBuffers(conns, m.bufferSize(m.readBufferSize, m.recvDataCount)); err != nil {
 		return err
 	}
 	m.Data = make(chan UDPMessage)
-	go m.receiveLoop(m.dataConn, m.Data)
+	m.receive(conns, m.Data, true)
 	return nil
 }
 
 func (m *Multicast) SendsControlToServer() error {
-	controlToServerConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToServerAddr)
+	conns, err := m.open(m.controlToServerAddr, false)
 	if err != nil {
 		return err
 	}
-	m.controlToServerConn = controlToServerConn
+	m.controlToServerConns = conns
 
-	if err := m.setConnectionProperties(m.controlToServerConn); err != nil {
-		return err
-	}
-	if err := m.controlToServerConn.SetWriteBuffer(m.datagramSize * m.sendControlCount); err != nil {
+	if err := setWriteBuffers(conns, m.bufferSize(m.writeBufferSize, m.sendControlCount)); err != nil {
 		return err
 	}
-
-	return nil
+	return m.setDSCP(conns, m.controlDSCP)
 }
 
 func (m *Multicast) SendsControlToClient() error {
-	controlToClientConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.controlToClientAddr)
+	conns, err := m.open(m.controlToClientAddr, false)
 	if err != nil {
 		return err
 	}
-	m.controlToClientConn = controlToClientConn
+	m.controlToClientConns = conns
 
-	if err := m.setConnectionProperties(m.controlToClientConn); err != nil {
+	if err := setWriteBuffers(conns, m.bufferSize(m.writeBufferSize, m.sendControlCount)); err != nil {
 		return err
 	}
-	if err := m.controlToClientConn.SetWriteBuffer(m.datagramSize * m.sendControlCount); err != nil {
+	if err := m.setDSCP(conns, m.controlDSCP); err != nil {
 		return err
 	}
 
+	if m.announceTTL > 0 && !m.unicast {
+		// Announcements get sockets of their own so their TTL never leaks onto other control messages:
+		announceConns, err := m.open(m.controlToClientAddr, false)
+		if err != nil {
+			return err
+		}
+		m.announceConns = announceConns
+		for _, c := range announceConns {
+			if err := m.setTTL(c, m.announceTTL); err != nil {
+				return err
+			}
+		}
+		if err := m.setDSCP(announceConns, m.controlDSCP); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (m *Multicast) SendsData() error {
-	dataConn, err := net.ListenMulticastUDP("udp", m.netInterface, m.dataAddr)
+	conns, err := m.open(m.dataAddr, false)
 	if err != nil {
 		return err
 	}
 
-	m.dataConn = dataConn
-	if err := m.setConnectionProperties(m.dataConn); err != nil {
-		return err
-	}
-	if err := m.dataConn.SetWriteBuffer(m.datagramSize * m.sendDataCount); err != nil {
+	m.dataConns = conns
+	if err := setWriteBuffers(conns, m.bufferSize(m.writeBufferSize, m.sendDataCount)); err != nil {
 		return err
 	}
+	return m.setDSCP(conns, m.dataDSCP)
+}
 
+func setReadBuffers(conns []*net.UDPConn, size int) error {
+	for _, c := range conns {
+		if err := c.SetReadBuffer(size); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (m *Multicast) Close() error {
-	if m.controlToServerConn != nil {
-		err := m.controlToServerConn.Close()
-		if err != nil {
+func setWriteBuffers(conns []*net.UDPConn, size int) error {
+	for _, c := range conns {
+		if err := c.SetWriteBuffer(size); err != nil {
 			return err
 		}
 	}
-	if m.controlToClientConn != nil {
-		err := m.controlToClientConn.Close()
+	return nil
+}
+
+// Opens a socket on a group address for each interface. Unicast sockets are bound to the port only
+// when they receive; senders can use any port.
+func (m *Multicast) open(addr *net.UDPAddr, receives bool) ([]*net.UDPConn, error) {
+	if m.unicast {
+		if !receives {
+			addr = nil
+		}
+		conn, err := net.ListenUDP("udp", addr)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return []*net.UDPConn{conn}, nil
 	}
-	if m.dataConn != nil {
-		err := m.dataConn.Close()
+
+	netInterfaces := m.netInterfaces
+	if len(netInterfaces) == 0 {
+		netInterfaces = []*net.Interface{nil}
+	}
+	conns := make([]*net.UDPConn, 0, len(netInterfaces))
+	for _, netInterface := range netInterfaces {
+		conn, err := net.ListenMulticastUDP("udp", netInterface, addr)
+		if err == nil {
+			err = m.setConnectionProperties(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
 		if err != nil {
+			closeAll(conns)
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// Only receives messages to the groups clients listen on sent from `source` (an (S,G) join) so others
+// on the group can't inject any. Requires IGMPv3; IPv6 groups and some systems fall back to any source
+// returning ErrSourceSpecificUnsupported. Call once listening.
+func (m *Multicast) JoinSource(source net.IP) error {
+	if m.unicast {
+		return nil
+	}
+	if m.ipv6 || source.To4() == nil {
+		return ErrSourceSpecificUnsupported
+	}
+
+	netInterfaces := m.netInterfaces
+	if len(netInterfaces) == 0 {
+		netInterfaces = []*net.Interface{nil}
+	}
+	for _, group := range []struct {
+		conns []*net.UDPConn
+		addr  *net.UDPAddr
+	}{{m.controlToClientConns, m.controlToClientAddr}, {m.dataConns, m.dataAddr}} {
+		for i, conn := range group.conns {
+			if err := joinSourceGroup(conn, netInterfaces[i], group.addr.IP, source); err != nil {
+				return err
+			}
+		}
+	}
+	m.source = source
+	return nil
+}
+
+// Moves data reception over to `group`, on the same port, once a server announces it sends data
+// there; the sockets on the previous data group are closed. Call once listening; sources joined carry
+// over.
+func (m *Multicast) JoinDataGroup(group net.IP) error {
+	if m.unicast || group.Equal(m.dataAddr.IP) {
+		return nil
+	}
+	if (group.To4() == nil) != m.ipv6 || !group.IsMulticast() {
+		return ErrBadDataGroup
+	}
+
+	addr := &net.UDPAddr{IP: group, Port: m.dataAddr.Port, Zone: m.dataAddr.Zone}
+	conns, err := m.open(addr, true)
+	if err != nil {
+		return err
+	}
+	if err = setReadBuffers(conns, m.bufferSize(m.readBufferSize, m.recvDataCount)); err != nil {
+		closeAll(conns)
+		return err
+	}
+	if m.source != nil {
+		netInterfaces := m.netInterfaces
+		if len(netInterfaces) == 0 {
+			netInterfaces = []*net.Interface{nil}
+		}
+		for i, conn := range conns {
+			if err = joinSourceGroup(conn, netInterfaces[i], group, m.source); err != nil {
+				closeAll(conns)
+				return err
+			}
+		}
+	}
+
+	old := m.dataConns
+	m.dataConns, m.dataAddr = conns, addr
+	m.receive(conns, m.Data, true)
+	for _, conn := range old {
+		m.retired.Store(conn, true)
+	}
+	return closeAll(old)
+}
+
+// Resolves the group clients and servers discover each other on from "host:port", "host" or a hostname
+// with at least one multicast address; a missing port is `defaultPort`:
+func ResolveGroupAddr(s string, defaultPort int) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		host, portStr = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), strconv.Itoa(defaultPort)
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	host, zone := splitZone(host)
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsMulticast() {
+			return &net.UDPAddr{IP: ip, Port: port, Zone: zone}, nil
+		}
+	}
+	if len(ips) == 1 && ips[0].String() == host {
+		return nil, fmt.Errorf("%w: %s", ErrNotMulticast, host)
+	}
+	return nil, fmt.Errorf("%w: %s resolves to %v", ErrNotMulticast, host, ips)
+}
+
+// Splits an IPv6 zone like "ff12::100%eth0" off its address:
+func splitZone(host string) (string, string) {
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// The group, or for a range like "239.1.0.0/16" each transfer's own group within it, that servers
+// send data to instead of the group clients discover them on:
+func ParseDataGroup(s string) (group net.IP, groups *net.IPNet, err error) {
+	if strings.Contains(s, "/") {
+		_, groups, err = net.ParseCIDR(s)
+		if err != nil || !groups.IP.IsMulticast() {
+			return nil, nil, fmt.Errorf("%w: %s", ErrBadDataGroup, s)
+		}
+		return nil, groups, nil
+	}
+	group = net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if group == nil || !group.IsMulticast() {
+		return nil, nil, fmt.Errorf("%w: %s", ErrBadDataGroup, s)
+	}
+	return group, nil, nil
+}
+
+// Picks a transfer's group within `groups` from its hashId so every server derives the same one:
+func DataGroupFor(hashId []byte, groups *net.IPNet) net.IP {
+	ones, bits := groups.Mask.Size()
+	hostBits := bits - ones
+	if hostBits > 64 {
+		hostBits = 64
+	}
+	offset := uint64(0)
+	for i := 0; i < 8 && i < len(hashId); i++ {
+		offset = offset<<8 | uint64(hashId[i])
+	}
+	if hostBits < 64 {
+		offset &= 1<<uint(hostBits) - 1
+	}
+
+	group := append(net.IP(nil), groups.IP...)
+	for i := len(group) - 1; i >= 0 && offset > 0; i-- {
+		group[i] |= byte(offset)
+		offset >>= 8
+	}
+	return group
+}
+
+func sourceUnsupported(err error) error {
+	return fmt.Errorf("%w: %v", ErrSourceSpecificUnsupported, err)
+}
+
+// Address identifying an interface in IPv4 membership requests, as the group was joined with; any when nil:
+func interfaceIPv4(ifi *net.Interface) (net.IP, error) {
+	if ifi == nil {
+		return net.IPv4zero.To4(), nil
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", ifi.Name)
+}
+
+func closeAll(conns []*net.UDPConn) error {
+	firstErr := error(nil)
+	for _, c := range conns {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (m *Multicast) Close() error {
+	for _, conns := range [][]*net.UDPConn{m.controlToServerConns, m.controlToClientConns, m.dataConns, m.announceConns} {
+		if err := closeAll(conns); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (m *Multicast) setTTL(c *net.UDPConn) error {
-	err := setSocketOptionInt(c, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, m.ttl)
+func (m *Multicast) setTTL(c *net.UDPConn, ttl int) error {
+	if m.ipv6 {
+		// TTL is the hop limit in IPv6:
+		return setSocketOptionInt(c, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+	}
+	err := setSocketOptionInt(c, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
 	if err != nil {
 		return err
 	}
@@ -225,6 +563,15 @@ func (m *Multicast) setTTL(c *net.UDPConn) error {
 }
 
 func (m *Multicast) setLoopback(c *net.UDPConn) error {
+	if m.ipv6 {
+		// IPv6 only accepts 0 or 1:
+		lp := 0
+		if m.loopback {
+			lp = 1
+		}
+		return setSocketOptionInt(c, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, lp)
+	}
+
 	lp := 0
 	if m.loopback {
 		lp = -1
@@ -237,7 +584,7 @@ func (m *Multicast) setLoopback(c *net.UDPConn) error {
 }
 
 func (m *Multicast) setConnectionProperties(c *net.UDPConn) error {
-	if err := m.setTTL(c); err != nil {
+	if err := m.setTTL(c, m.ttl); err != nil {
 		return err
 	}
 	if err := m.setLoopback(c); err != nil {
@@ -250,46 +597,397 @@ func (m *Multicast) SetDatagramSize(datagramSize int) {
 	m.datagramSize = datagramSize
 }
 
+// Overrides the socket receive buffer size; the OS may grant less:
+func (m *Multicast) SetReadBufferSize(size int) {
+	m.readBufferSize = size
+}
+
+// Overrides the socket send buffer size; the OS may grant less:
+func (m *Multicast) SetWriteBufferSize(size int) {
+	m.writeBufferSize = size
+}
+
+func (m *Multicast) bufferSize(override int, datagramCount int) int {
+	if override > 0 {
+		return override
+	}
+	return m.datagramSize * datagramCount
+}
+
+// Receive and send buffer sizes the OS actually granted the data socket. Linux reports double what
+// was set to account for bookkeeping and caps requests at net.core.rmem_max/wmem_max.
+func (m *Multicast) DataBufferSizes() (int, int, error) {
+	if len(m.dataConns) == 0 {
+		return 0, 0, nil
+	}
+	// Every interface's socket asked for the same:
+	r, err := getSocketOptionInt(m.dataConns[0], syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	w, err := getSocketOptionInt(m.dataConns[0], syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	return r, w, nil
+}
+
+// Parses a socket buffer size such as "16MiB"; sockets take an int so sizes beyond 2GiB are refused:
+func ParseBufferSize(s string) (int, error) {
+	n, err := humanize.ParseBytes(strings.TrimSpace(s))
+	if err != nil || n == 0 || n > math.MaxInt32 {
+		return 0, ErrBadBufferSize
+	}
+	return int(n), nil
+}
+
+// Parses a data chunk size in bytes such as "1400", or "auto" to discover one from the MTU:
+func ParseChunkSize(s string) (size int, discover bool, err error) {
+	s = strings.TrimSpace(s)
+	if s == "auto" {
+		return 0, true, nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil || n == 0 || n > math.MaxUint16 {
+		return 0, false, ErrBadChunkSize
+	}
+	return int(n), false, nil
+}
+
+// Logs what the OS granted a socket buffer, warning when it is less than was asked for:
+// Takes "auto" to learn the server's address from its announcements, or the address itself:
+func ParseSource(s string) (source net.IP, discover bool, err error) {
+	s = strings.TrimSpace(s)
+	if s == "auto" {
+		return nil, true, nil
+	}
+	if source = net.ParseIP(s); source == nil {
+		return nil, false, ErrBadSource
+	}
+	return source, false, nil
+}
+
+func logBufferSize(l *Logger, name string, granted int, requested int, sysctl string) {
+	if granted < requested {
+		l.Warnf("%s buffer is %s; asked for %s (raise sysctl %s)", name, humanize.IBytes(uint64(granted)), humanize.IBytes(uint64(requested)), sysctl)
+		return
+	}
+	l.Infof("%s buffer is %s", name, humanize.IBytes(uint64(granted)))
+}
+
 func (m *Multicast) SetTTL(ttl int) {
 	m.ttl = ttl
 }
 
+// Keeps announcements within fewer hops than data so discovery stays local; has no effect in unicast mode:
+func (m *Multicast) SetAnnounceTTL(ttl int) {
+	m.announceTTL = ttl
+}
+
 func (m *Multicast) SetLoopback(enable bool) {
 	m.loopback = enable
 }
 
+// Marks outgoing data with a DSCP, e.g. to yield to interactive traffic on QoS-managed networks:
+func (m *Multicast) SetDataDSCP(dscp int) {
+	m.dataDSCP = dscp
+}
+
+// Marks outgoing control messages and announcements with a DSCP:
+func (m *Multicast) SetControlDSCP(dscp int) {
+	m.controlDSCP = dscp
+}
+
+// Drops a fraction of the packets sent and received at random, for testing retransmission over links
+// that don't lose any. Never meant for production use; nothing drops packets unless this is called
+// with a non-zero rate.
+func (m *Multicast) SimulateLoss(sim LossSimulation) error {
+	loss, err := newLossSimulator(sim)
+	if err != nil {
+		return err
+	}
+	m.loss = loss
+	return nil
+}
+
+// Encrypts and authenticates every message with a pre-shared key:
+func (m *Multicast) SetCipher(p *PacketCipher) {
+	m.cipher = p
+}
+
+// Largest message callers may build; sealing needs room for its nonce and tag:
 func (m *Multicast) MaxMessageSize() int {
+	if m.cipher != nil {
+		return m.datagramSize - m.cipher.overhead()
+	}
 	return m.datagramSize
 }
 
-func (m *Multicast) receiveLoop(conn *net.UDPConn, ch chan UDPMessage) error {
+// Smallest MTU of the interfaces sending data, or of every multicast capable interface that is up
+// when the system picks; 0 when unknown:
+func (m *Multicast) MTU() int {
+	ifaces := m.netInterfaces
+	if len(ifaces) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return 0
+		}
+		for i := range all {
+			if all[i].Flags&net.FlagUp != 0 && all[i].Flags&net.FlagMulticast != 0 && all[i].Flags&net.FlagLoopback == 0 {
+				ifaces = append(ifaces, &all[i])
+			}
+		}
+	}
+
+	mtu := 0
+	for _, iface := range ifaces {
+		if iface.MTU > 0 && (mtu == 0 || iface.MTU < mtu) {
+			mtu = iface.MTU
+		}
+	}
+	return mtu
+}
+
+// Bytes of a datagram carrying `payloadLen` bytes once IP and UDP headers are added:
+func (m *Multicast) packetSize(payloadLen int) int {
+	if m.ipv6 {
+		return payloadLen + ipv6HeaderSize + udpHeaderSize
+	}
+	return payloadLen + ipv4HeaderSize + udpHeaderSize
+}
+
+// Authenticates and decrypts a received control message; messages pass through untouched without a key:
+func (m *Multicast) OpenControl(msg UDPMessage) (UDPMessage, error) {
+	if m.cipher == nil {
+		return msg, nil
+	}
+	data, err := m.cipher.openControl(msg.Data)
+	if err != nil {
+		return msg, err
+	}
+	msg.Data = data
+	return msg, nil
+}
+
+// Authenticates and decrypts a received data message:
+func (m *Multicast) OpenData(msg UDPMessage) (UDPMessage, error) {
+	if m.cipher == nil {
+		return msg, nil
+	}
+	data, err := m.cipher.openData(msg.Data)
+	if err != nil {
+		return msg, err
+	}
+	msg.Data = data
+	return msg, nil
+}
+
+// Copies of one datagram reach each socket within moments; a client repeating itself takes longer:
+const duplicateWindow = 10 * time.Millisecond
+
+// Control messages seen lately by source and content:
+type recentMessages struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+// Whether `data` from `from` was already seen within duplicateWindow, remembering it if not:
+func (r *recentMessages) duplicate(from *net.UDPAddr, data []byte, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write(data)
+	key := fmt.Sprintf("%s/%x", from, h.Sum64())
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if at, ok := r.seen[key]; ok && now.Sub(at) < duplicateWindow {
+		return true
+	}
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+	if len(r.seen) >= 1024 {
+		for k, at := range r.seen {
+			if now.Sub(at) >= duplicateWindow {
+				delete(r.seen, k)
+			}
+		}
+	}
+	r.seen[key] = now
+	return false
+}
+
+// Receives from every socket onto `ch`, dropping copies of control messages. Duplicate data is cheaper
+// to ignore than to look for; clients drop regions they already have:
+func (m *Multicast) receive(conns []*net.UDPConn, ch chan UDPMessage, data bool) {
+	for _, conn := range conns {
+		go m.receiveLoop(conn, ch, data, !data && len(conns) > 1)
+	}
+}
+
+func (m *Multicast) receiveLoop(conn *net.UDPConn, ch chan UDPMessage, data bool, dedupe bool) error {
 	// Lock receive loops to specific CPU core:
 	runtime.LockOSThread()
 
 	// Start a message receive loop:
 	for {
-		buf := make([]byte, m.MaxMessageSize())
+		packet := m.packets.get(m.datagramSize)
+		buf := (*packet)[:m.datagramSize]
 		n, recvAddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			m.packets.put(packet)
+			if _, retired := m.retired.Load(conn); retired {
+				return nil
+			}
 			ch <- UDPMessage{Error: err}
 			return err
 		}
-		ch <- UDPMessage{Data: buf[0:n], SourceAddress: recvAddr}
+		if dedupe && m.recentControl.duplicate(recvAddr, buf[0:n], time.Now()) {
+			m.packets.put(packet)
+			continue
+		}
+		if m.loss.drops(data) {
+			m.packets.put(packet)
+			continue
+		}
+		ch <- UDPMessage{Data: buf[0:n], SourceAddress: recvAddr, packet: packet, pool: &m.packets}
 	}
 	return nil
 }
 
 func (m *Multicast) SendControlToServer(msg []byte) (int, error) {
-	n, err := m.controlToServerConn.WriteToUDP(msg, m.controlToServerAddr)
-	return n, err
+	if m.loss.drops(false) {
+		return len(msg), nil
+	}
+	if m.cipher != nil {
+		var err error
+		if msg, err = m.cipher.sealControl(msg); err != nil {
+			return 0, err
+		}
+	}
+	return writeToAll(m.controlToServerConns, msg, m.controlToServerAddr)
 }
 
 func (m *Multicast) SendControlToClient(msg []byte) (int, error) {
-	n, err := m.controlToClientConn.WriteToUDP(msg, m.controlToClientAddr)
-	return n, err
+	if m.loss.drops(false) {
+		return len(msg), nil
+	}
+	if m.cipher != nil {
+		var err error
+		if msg, err = m.cipher.sealControl(msg); err != nil {
+			return 0, err
+		}
+	}
+	return m.writeToClients(m.controlToClientConns, msg, m.controlToClientAddr, m.clientControlAddrs)
+}
+
+// Sends an announcement to clients, limited to the announce TTL when one is set:
+func (m *Multicast) SendAnnouncement(msg []byte) (int, error) {
+	if m.announceConns == nil {
+		return m.SendControlToClient(msg)
+	}
+	if m.loss.drops(false) {
+		return len(msg), nil
+	}
+	if m.cipher != nil {
+		var err error
+		if msg, err = m.cipher.sealControl(msg); err != nil {
+			return 0, err
+		}
+	}
+	return writeToAll(m.announceConns, msg, m.controlToClientAddr)
 }
 
 func (m *Multicast) SendData(msg []byte) (int, error) {
-	n, err := m.dataConn.WriteToUDP(msg, m.dataAddr)
-	return n, err
+	return m.sendData(m.dataAddr, nil, msg)
+}
+
+// Sends to `group` on the data port rather than the data group, unless unicast or nil. Sealed with
+// `salt` when encrypting, or the cipher's own when nil:
+func (m *Multicast) sendData(group *net.UDPAddr, salt []byte, msg []byte) (int, error) {
+	if group == nil {
+		group = m.dataAddr
+	}
+	if m.loss.drops(true) {
+		return len(msg), nil
+	}
+	if m.cipher != nil {
+		var err error
+		if msg, err = m.cipher.sealData(salt, msg); err != nil {
+			return 0, err
+		}
+	}
+	return m.writeToClients(m.dataConns, msg, group, m.clientDataAddrs)
+}
+
+// Sends a data message made of `hdr` followed by `n` bytes from `f` at `offset` without copying file contents:
+func (m *Multicast) SendDataFile(hdr []byte, f *os.File, offset int64, n int) (int, error) {
+	return m.sendDataFile(m.dataAddr, hdr, f, offset, n)
+}
+
+func (m *Multicast) sendDataFile(group *net.UDPAddr, hdr []byte, f *os.File, offset int64, n int) (int, error) {
+	if m.cipher != nil {
+		// File contents have to pass through userspace to be encrypted:
+		return 0, ErrZeroCopyUnsupported
+	}
+	if m.loss.drops(true) {
+		return len(hdr) + n, nil
+	}
+	peers := m.clientDataAddrs
+	if group == nil {
+		group = m.dataAddr
+	}
+	if !m.unicast {
+		peers = []*net.UDPAddr{group}
+	}
+
+	sent, firstErr := 0, error(nil)
+	for _, conn := range m.dataConns {
+		for _, addr := range peers {
+			s, err := sendFileDatagram(conn, addr, hdr, f, offset, n)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			sent = s
+		}
+	}
+	return sent, firstErr
+}
+
+// Sends to the group out of every interface, or in unicast mode a copy to every client. One
+// unreachable client or interface doesn't stop the others being sent to; the first error is returned.
+func (m *Multicast) writeToClients(conns []*net.UDPConn, msg []byte, group *net.UDPAddr, peers []*net.UDPAddr) (int, error) {
+	if !m.unicast {
+		return writeToAll(conns, msg, group)
+	}
+
+	sent, firstErr := 0, error(nil)
+	for _, addr := range peers {
+		n, err := writeToAll(conns, msg, addr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent = n
+	}
+	return sent, firstErr
+}
+
+func writeToAll(conns []*net.UDPConn, msg []byte, addr *net.UDPAddr) (int, error) {
+	sent, firstErr := 0, error(nil)
+	for _, conn := range conns {
+		n, err := conn.WriteToUDP(msg, addr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		sent = n
+	}
+	return sent, firstErr
 }
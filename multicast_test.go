@@ -0,0 +1,355 @@
+package lancaster
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHasAddressFamily(t *testing.T) {
+	v4 := &net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: net.CIDRMask(24, 32)}
+	v6 := &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}
+
+	if !hasAddressFamily([]net.Addr{v4}, true) {
+		t.Fatal("expected IPv4 address to be found")
+	}
+	if hasAddressFamily([]net.Addr{v6}, true) {
+		t.Fatal("expected no IPv4 address on IPv6-only interface")
+	}
+	if !hasAddressFamily([]net.Addr{v4, v6}, false) {
+		t.Fatal("expected IPv6 address to be found")
+	}
+	if hasAddressFamily(nil, true) {
+		t.Fatal("expected no address on interface without addresses")
+	}
+}
+
+// Finds an interface able to carry multicast for the group's address family, preferring loopback:
+func multicastInterface(t *testing.T, group net.IP) *net.Interface {
+	isIPv4 := group.To4() != nil
+	if isIPv4 {
+		if lo, err := net.InterfaceByName("lo"); err == nil {
+			return lo
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("cannot list interfaces: %s", err)
+	}
+	found := (*net.Interface)(nil)
+	for i := range ifaces {
+		ifi := &ifaces[i]
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil || !hasAddressFamily(addrs, isIPv4) {
+			continue
+		}
+		if ifi.Flags&net.FlagLoopback != 0 {
+			return ifi
+		}
+		if found == nil {
+			found = ifi
+		}
+	}
+	if found == nil {
+		t.Skipf("no multicast interface for %s", group)
+	}
+	return found
+}
+
+func newLoopbackMulticast(t *testing.T, group net.IP, port int) *Multicast {
+	m, err := NewMulticast(&net.UDPAddr{IP: group, Port: port}, multicastInterface(t, group))
+	if err != nil {
+		t.Skipf("loopback multicast unavailable: %s", err)
+	}
+	m.SetLoopback(true)
+	m.SetTTL(1)
+	return m
+}
+
+func testMulticastRoundTrip(t *testing.T, group net.IP, port int) {
+	sender := newLoopbackMulticast(t, group, port)
+	defer sender.Close()
+	receiver := newLoopbackMulticast(t, group, port)
+	defer receiver.Close()
+
+	if err := sender.SendsControlToClient(); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiver.ListensControlToClient(); err != nil {
+		t.Skipf("cannot join %s on loopback: %s", group, err)
+	}
+
+	msg := controlToClientMessage([]byte{1, 2, 3, 4, 5, 6, 7, 8}, AnnounceTarball, nil)
+	timeout := time.After(2 * time.Second)
+	resend := time.Tick(100 * time.Millisecond)
+	for {
+		if _, err := sender.SendControlToClient(msg); err != nil {
+			t.Skipf("cannot send to %s on loopback: %s", group, err)
+		}
+		select {
+		case got := <-receiver.ControlToClient:
+			if got.Error != nil {
+				t.Fatal(got.Error)
+			}
+			if !bytes.Equal(got.Data, msg) {
+				t.Fatalf("expected %v got %v", msg, got.Data)
+			}
+			return
+		case <-resend:
+		case <-timeout:
+			t.Fatalf("no message received on %s", group)
+		}
+	}
+}
+
+func TestMulticast_IPv4Loopback(t *testing.T) {
+	testMulticastRoundTrip(t, net.IPv4(239, 0, 0, 101), 13610)
+}
+
+func TestMulticast_IPv6Loopback(t *testing.T) {
+	m := newLoopbackMulticast(t, net.ParseIP("ff15::100"), 13620)
+	if !m.ipv6 {
+		t.Fatal("expected IPv6 group to be detected")
+	}
+	testMulticastRoundTrip(t, net.ParseIP("ff15::100"), 13620)
+}
+
+func TestMulticast_AnnounceTTL(t *testing.T) {
+	m := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 103), 13710)
+	defer m.Close()
+	m.SetTTL(4)
+	m.SetAnnounceTTL(1)
+	if err := m.SendsControlToClient(); err != nil {
+		t.Skipf("cannot open group on loopback: %s", err)
+	}
+	if len(m.announceConns) != 1 {
+		t.Fatal("expected a separate announcement socket")
+	}
+
+	for conn, expected := range map[*net.UDPConn]int{m.controlToClientConns[0]: 4, m.announceConns[0]: 1} {
+		ttl, err := getSocketOptionInt(conn, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != expected {
+			t.Fatalf("expected TTL %d got %d", expected, ttl)
+		}
+	}
+}
+
+func TestParseBufferSize(t *testing.T) {
+	for s, expected := range map[string]int{"4MiB": 4 << 20, "16MB": 16000000, " 65536 ": 65536} {
+		if n, err := ParseBufferSize(s); err != nil || n != expected {
+			t.Fatalf("%q: expected %d got %d %v", s, expected, n, err)
+		}
+	}
+	for _, s := range []string{"", "0", "lots", "8GiB"} {
+		if _, err := ParseBufferSize(s); err != ErrBadBufferSize {
+			t.Fatalf("%q: expected ErrBadBufferSize got %v", s, err)
+		}
+	}
+}
+
+func TestParseChunkSize(t *testing.T) {
+	for s, expected := range map[string]int{"1400": 1400, " 8950 ": 8950, "9KB": 9000} {
+		if n, discover, err := ParseChunkSize(s); err != nil || discover || n != expected {
+			t.Fatalf("%q: expected %d got %d %v %v", s, expected, n, discover, err)
+		}
+	}
+	if _, discover, err := ParseChunkSize("auto"); err != nil || !discover {
+		t.Fatalf("expected auto to discover got %v %v", discover, err)
+	}
+	for _, s := range []string{"", "0", "big", "1MiB"} {
+		if _, _, err := ParseChunkSize(s); err != ErrBadChunkSize {
+			t.Fatalf("%q: expected ErrBadChunkSize got %v", s, err)
+		}
+	}
+}
+
+func TestMulticast_BufferSizes(t *testing.T) {
+	m := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 102), 13670)
+	defer m.Close()
+	m.SetReadBufferSize(128 << 10)
+	if err := m.ListensData(); err != nil {
+		t.Skipf("cannot join group on loopback: %s", err)
+	}
+
+	// The kernel may round up but shouldn't hand out less than this modest size:
+	r, _, err := m.DataBufferSizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r < 128<<10 {
+		t.Fatalf("expected at least %d byte receive buffer got %d", 128<<10, r)
+	}
+}
+
+func TestRecentMessages_Duplicate(t *testing.T) {
+	r := recentMessages{}
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 1), Port: 4000}
+
+	if r.duplicate(a, []byte("nak"), now) {
+		t.Fatal("expected the first message through")
+	}
+	if !r.duplicate(a, []byte("nak"), now.Add(time.Millisecond)) {
+		t.Fatal("expected the copy to be dropped")
+	}
+	if r.duplicate(b, []byte("nak"), now.Add(time.Millisecond)) || r.duplicate(a, []byte("ack"), now.Add(time.Millisecond)) {
+		t.Fatal("expected other sources and contents through")
+	}
+	if r.duplicate(a, []byte("nak"), now.Add(duplicateWindow+time.Millisecond)) {
+		t.Fatal("expected a repeat after the window through")
+	}
+}
+
+func TestMulticast_SeveralInterfaces(t *testing.T) {
+	group := net.IPv4(239, 0, 0, 104)
+	lo := multicastInterface(t, group)
+	receiver, err := NewMulticastInterfaces(&net.UDPAddr{IP: group, Port: 13770}, []*net.Interface{lo, lo})
+	if err != nil {
+		t.Skipf("loopback multicast unavailable: %s", err)
+	}
+	receiver.SetLoopback(true)
+	receiver.SetTTL(1)
+	defer receiver.Close()
+	sender := newLoopbackMulticast(t, group, 13770)
+	defer sender.Close()
+
+	if err = receiver.ListensControlToServer(); err != nil {
+		t.Skipf("cannot join %s on loopback: %s", group, err)
+	}
+	if len(receiver.controlToServerConns) != 2 {
+		t.Fatalf("expected a socket per interface got %d", len(receiver.controlToServerConns))
+	}
+	if err = sender.SendsControlToServer(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both sockets hear the message but it is delivered once:
+	msg := []byte("hello from one client")
+	if _, err = sender.SendControlToServer(msg); err != nil {
+		t.Skipf("cannot send to %s on loopback: %s", group, err)
+	}
+	received := 0
+	timeout := time.After(500 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case got := <-receiver.ControlToServer:
+			if got.Error != nil {
+				t.Fatal(got.Error)
+			}
+			if !bytes.Equal(got.Data, msg) {
+				t.Fatalf("expected %q got %q", msg, got.Data)
+			}
+			received++
+		case <-timeout:
+			done = true
+		}
+	}
+	if received != 1 {
+		t.Fatalf("expected the message once got %d copies", received)
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	if source, discover, err := ParseSource("auto"); err != nil || source != nil || !discover {
+		t.Fatalf("expected auto to discover got %v %v %v", source, discover, err)
+	}
+	if source, discover, err := ParseSource(" 192.0.2.1 "); err != nil || !source.Equal(net.IPv4(192, 0, 2, 1)) || discover {
+		t.Fatalf("expected 192.0.2.1 got %v %v %v", source, discover, err)
+	}
+	for _, s := range []string{"", "server.example", "192.0.2"} {
+		if _, _, err := ParseSource(s); err != ErrBadSource {
+			t.Fatalf("expected ErrBadSource for %q got %v", s, err)
+		}
+	}
+}
+
+func TestParseDataGroup(t *testing.T) {
+	if group, groups, err := ParseDataGroup("239.1.2.3"); err != nil || !group.Equal(net.IPv4(239, 1, 2, 3)) || groups != nil {
+		t.Fatalf("expected 239.1.2.3 got %v %v %v", group, groups, err)
+	}
+	if group, groups, err := ParseDataGroup("239.1.0.0/16"); err != nil || group != nil || groups.String() != "239.1.0.0/16" {
+		t.Fatalf("expected 239.1.0.0/16 got %v %v %v", group, groups, err)
+	}
+	if group, _, err := ParseDataGroup("[ff15::101]"); err != nil || !group.Equal(net.ParseIP("ff15::101")) {
+		t.Fatalf("expected ff15::101 got %v %v", group, err)
+	}
+	for _, s := range []string{"", "192.0.2.1", "10.0.0.0/8", "239.1.0.0/33"} {
+		if _, _, err := ParseDataGroup(s); !errors.Is(err, ErrBadDataGroup) {
+			t.Fatalf("expected ErrBadDataGroup for %q got %v", s, err)
+		}
+	}
+}
+
+func TestResolveGroupAddr(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		expected string
+	}{
+		{"239.0.0.100", "239.0.0.100:1360"},
+		{"239.0.0.100:2000", "239.0.0.100:2000"},
+		{"[ff15::100]", "[ff15::100]:1360"},
+		{"[ff15::100]:2000", "[ff15::100]:2000"},
+		{"ff12::100%lo", "[ff12::100%lo]:1360"},
+	} {
+		addr, err := ResolveGroupAddr(c.s, 1360)
+		if err != nil {
+			t.Fatalf("%s: %s", c.s, err)
+		}
+		if addr.String() != c.expected {
+			t.Fatalf("%s: expected %s got %s", c.s, c.expected, addr)
+		}
+	}
+
+	// Unicast addresses, given or resolved, are refused:
+	for _, s := range []string{"192.0.2.1", "[::1]:2000", "localhost"} {
+		if _, err := ResolveGroupAddr(s, 1360); !errors.Is(err, ErrNotMulticast) {
+			t.Fatalf("expected ErrNotMulticast for %q got %v", s, err)
+		}
+	}
+
+	// Names that don't resolve fail as lookups:
+	if _, err := ResolveGroupAddr("group.invalid", 1360); err == nil || errors.Is(err, ErrNotMulticast) {
+		t.Fatalf("expected a lookup error got %v", err)
+	}
+}
+
+func TestNewMulticast_RefusesUnicast(t *testing.T) {
+	if _, err := NewMulticast(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}, nil); !errors.Is(err, ErrNotMulticast) {
+		t.Fatalf("expected ErrNotMulticast got %v", err)
+	}
+}
+
+func TestDataGroupFor(t *testing.T) {
+	_, groups, _ := net.ParseCIDR("239.1.0.0/16")
+	hashId := []byte{0xAB, 0xCD, 0xEF, 1, 2, 3, 4, 5}
+
+	// 1. The hashId's low bits within the range pick the group:
+	if group := DataGroupFor(hashId, groups); !group.Equal(net.IPv4(239, 1, 4, 5)) {
+		t.Fatalf("expected 239.1.4.5 got %s", group)
+	}
+	// 2. Every server derives the same group:
+	if a, b := DataGroupFor(hashId, groups), DataGroupFor(append([]byte(nil), hashId...), groups); !a.Equal(b) {
+		t.Fatalf("expected the same group got %s and %s", a, b)
+	}
+	// 3. A single address range is that group:
+	_, single, _ := net.ParseCIDR("239.2.3.4/32")
+	if group := DataGroupFor(hashId, single); !group.Equal(net.IPv4(239, 2, 3, 4)) {
+		t.Fatalf("expected 239.2.3.4 got %s", group)
+	}
+	// 4. IPv6 ranges vary up to the low 64 bits:
+	_, v6, _ := net.ParseCIDR("ff15::/16")
+	if group := DataGroupFor(hashId, v6); !group.Equal(net.ParseIP("ff15::abcd:ef01:203:405")) {
+		t.Fatalf("expected ff15::abcd:ef01:203:405 got %s", group)
+	}
+}
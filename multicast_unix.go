@@ -1,6 +1,6 @@
 // +build darwin dragonfly freebsd linux netbsd openbsd solaris
 
-package main
+package lancaster
 
 import (
 	"net"
@@ -8,6 +8,8 @@ import (
 	"syscall"
 )
 
+const ipv6TrafficClass = syscall.IPV6_TCLASS
+
 func setSocketOptionInt(conn *net.UDPConn, level, option, value int) error {
 	sysConn, err := conn.SyscallConn()
 	if err != nil {
@@ -24,6 +26,23 @@ func setSocketOptionInt(conn *net.UDPConn, level, option, value int) error {
 	return serr
 }
 
+func getSocketOptionInt(conn *net.UDPConn, level, option int) (int, error) {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var value int
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		value, serr = syscall.GetsockoptInt(int(fd), level, option)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, serr
+}
+
 func isENOBUFS(err error) bool {
 	if err == nil {
 		return false
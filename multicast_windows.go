@@ -1,12 +1,17 @@
 // +build windows
 
-package main
+package lancaster
 
 import (
 	"net"
 	"syscall"
+	"unsafe"
 )
 
+// IPV6_TCLASS from ws2ipdef.h, which syscall lacks. Windows only honors it, like IP_TOS, where a
+// QoS policy allows applications to set their own marking:
+const ipv6TrafficClass = 39
+
 func setSocketOptionInt(conn *net.UDPConn, level, option, value int) error {
 	sysConn, err := conn.SyscallConn()
 	if err != nil {
@@ -23,6 +28,24 @@ func setSocketOptionInt(conn *net.UDPConn, level, option, value int) error {
 	return serr
 }
 
+func getSocketOptionInt(conn *net.UDPConn, level, option int) (int, error) {
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var value int32
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		size := int32(unsafe.Sizeof(value))
+		serr = syscall.Getsockopt(syscall.Handle(fd), int32(level), int32(option), (*byte)(unsafe.Pointer(&value)), &size)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(value), serr
+}
+
 func isENOBUFS(err error) bool {
 	if err == nil {
 		return false
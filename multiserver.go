@@ -0,0 +1,208 @@
+// multiserver.go
+package lancaster
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+var ErrDuplicateTransfer = errors.New("the same transfer is listed more than once")
+
+// Serves several independent transfers over one Multicast. Each transfer is an ordinary Server with
+// its own hashId, announcements, clients and NAK state; control messages are routed to it by the
+// hashId they carry. Data regions from every transfer share the data group and clients drop those
+// not for the transfer they chose, unless each has a data group of its own that only its clients join.
+// For fairness the configured rate (or the default pace) is split evenly so every transfer progresses
+// at the same speed and together they stay within the limit.
+// Under congestion control each transfer adapts to loss on its own.
+type MultiServer struct {
+	m       *Multicast
+	servers []*Server
+	log     *Logger
+	// Keyed by hex hashId:
+	byHashId map[string]*Server
+}
+
+// `names` label the transfers in combined announcements and may be nil, as may `groups` which give
+// each transfer its own data group.
+func NewMultiServer(m *Multicast, tbs []*VirtualTarballReader, names []string, groups []net.IP, options ServerOptions) *MultiServer {
+	if options.Logger == nil {
+		options.Logger = defaultLogger()
+	}
+
+	ms := &MultiServer{
+		m:        m,
+		log:      options.Logger,
+		byHashId: make(map[string]*Server),
+	}
+	share := 1 / float64(len(tbs))
+	entries := make([]AnnouncementEntry, 0, len(tbs))
+	for i, tb := range tbs {
+		opts := options
+		if names != nil {
+			opts.Name = names[i]
+		}
+		if groups != nil {
+			opts.DataGroup = groups[i]
+		}
+		// Bandwidth lines from each transfer would overwrite one another:
+		opts.Quiet = true
+		// One combined announcement lists them all:
+		opts.AnnounceList = options.AnnounceList && i == 0
+
+		// Lines from each transfer are told apart by its hashId, and go to its own file with LogDir:
+		opts.Logger = options.Logger.Child(hex.EncodeToString(tb.HashId()) + ": ")
+		s := NewServer(m, tb, opts)
+		s.shared = true
+		s.control = make(chan UDPMessage, 16)
+		s.share = share
+		s.limiter.SetLimit(rate.Limit(DefaultPace * share))
+		ms.servers = append(ms.servers, s)
+		entries = append(entries, AnnouncementEntry{HashId: s.hashId, Size: tb.size, Name: opts.Name})
+	}
+	if len(ms.servers) > 0 {
+		ms.servers[0].listed = entries
+	}
+	return ms
+}
+
+// Runs every transfer until they all return, or until the first to fail which stops the rest:
+func (ms *MultiServer) Run() error {
+	defer ms.m.Close()
+
+	for _, s := range ms.servers {
+		key := hex.EncodeToString(s.hashId)
+		if _, ok := ms.byHashId[key]; ok {
+			return ErrDuplicateTransfer
+		}
+		ms.byHashId[key] = s
+	}
+	if err := openServerSockets(ms.m, ms.log); err != nil {
+		return err
+	}
+
+	results := make(chan error, len(ms.servers))
+	for _, s := range ms.servers {
+		go func(s *Server) {
+			results <- s.Run()
+		}(s)
+	}
+	ms.log.Infof("Serving %d transfers", len(ms.servers))
+
+	firstErr := error(nil)
+	stopAll := ms.Stop
+	for running := len(ms.servers); running > 0; {
+		select {
+		case err := <-results:
+			running--
+			if err != nil && firstErr == nil {
+				firstErr = err
+				stopAll()
+			}
+		case ctrl := <-ms.m.ControlToServer:
+			if ctrl.Error != nil {
+				if firstErr == nil {
+					firstErr = ctrl.Error
+				}
+				stopAll()
+				continue
+			}
+			ms.route(ctrl)
+		}
+	}
+	return firstErr
+}
+
+// Makes every transfer's Run return as though its clients had completed, and with them Run:
+func (ms *MultiServer) Stop() {
+	for _, s := range ms.servers {
+		s.Stop()
+	}
+}
+
+// Pauses sending data for every transfer; see Server.Pause:
+func (ms *MultiServer) Pause() {
+	for _, s := range ms.servers {
+		s.Pause()
+	}
+}
+
+func (ms *MultiServer) Resume() {
+	for _, s := range ms.servers {
+		s.Resume()
+	}
+}
+
+// Sets the rate every transfer shares between them; see Server.SetRate:
+func (ms *MultiServer) SetRate(bytesPerSecond float64) {
+	for _, s := range ms.servers {
+		s.SetRate(bytesPerSecond)
+	}
+}
+
+// Moves the range each transfer's congestion control works within; see Server.SetRateRange:
+func (ms *MultiServer) SetRateRange(min float64, max float64) error {
+	for _, s := range ms.servers {
+		if err := s.SetRateRange(min, max); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Every transfer still being served:
+func (ms *MultiServer) Transfers() ([]ServerStatus, error) {
+	l := []ServerStatus(nil)
+	for _, s := range ms.servers {
+		st, err := s.Status()
+		if err == ErrNotServing {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		l = append(l, st)
+	}
+	return l, nil
+}
+
+// Hands a control message to the transfer it is about, which releases it; anything else is dropped.
+// Discovery requests go to every transfer as copies of their own:
+func (ms *MultiServer) route(ctrl UDPMessage) {
+	ctrl, err := ms.m.OpenControl(ctrl)
+	if err != nil {
+		// Not from a client holding our key:
+		ctrl.Release()
+		return
+	}
+	hashId, op, _, err := extractServerMessage(ctrl)
+	if err != nil {
+		ctrl.Release()
+		return
+	}
+	if op == RequestAnnouncement && isZeroHash(hashId) {
+		// Discovery for any transfer; every one of them answers:
+		for _, s := range ms.servers {
+			ms.deliver(s, ctrl.clone())
+		}
+		ctrl.Release()
+		return
+	}
+	s, ok := ms.byHashId[hex.EncodeToString(hashId)]
+	if !ok {
+		ctrl.Release()
+		return
+	}
+	ms.deliver(s, ctrl)
+}
+
+func (ms *MultiServer) deliver(s *Server, ctrl UDPMessage) {
+	select {
+	case s.control <- ctrl:
+	case <-s.stop:
+		// Finished; nobody is listening any more.
+		ctrl.Release()
+	}
+}
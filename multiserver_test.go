@@ -0,0 +1,112 @@
+package lancaster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArgumentName(t *testing.T) {
+	for _, c := range []struct {
+		arg      string
+		expected string
+	}{
+		{"../photos:::", "photos"},
+		{"../photos:::album", "album"},
+		{"/tmp/a.iso", "a.iso"},
+		{"a.iso::b.iso", "b.iso"},
+		{"dir::", "dir"},
+		{"-", DefaultStdinName},
+		{"-::piped", "piped"},
+	} {
+		if actual := ArgumentName(c.arg); actual != c.expected {
+			t.Fatalf("%s: expected %s got %s", c.arg, c.expected, actual)
+		}
+	}
+}
+
+func TestMultiServer_ServesEachTransfer(t *testing.T) {
+	src, err := ioutil.TempDir("", "lancaster-multi-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	contents := [][]byte{[]byte("first transfer\n"), bytes.Repeat([]byte("second transfer\n"), 4096)}
+	tbs := []*VirtualTarballReader(nil)
+	for i, b := range contents {
+		name := []string{"one.txt", "two.txt"}[i]
+		path := filepath.Join(src, name)
+		if err = ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		tb, err := NewVirtualTarballReader([]*TarballFile{{Path: name, LocalPath: path, Size: int64(len(b)), Mode: 0644}}, getOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tb.Close()
+		tbs = append(tbs, tb)
+	}
+
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13700)
+	ms := NewMultiServer(sm, tbs, []string{"one", "two"}, nil, ServerOptions{})
+	stopped := make(chan error, 1)
+	go func() { stopped <- ms.Run() }()
+
+	// Each client picks its transfer by ID over the same group:
+	for i, tb := range tbs {
+		dst, err := ioutil.TempDir("", "lancaster-multi-dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dst)
+
+		cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13700)
+		options := getOptions()
+		options.OutputDir = dst
+		c := NewClient(cm, ClientOptions{HashId: tb.HashId(), TarballOptions: options})
+		done := make(chan error, 1)
+		go func() { done <- c.Run() }()
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(20 * time.Second):
+			t.Fatal("client did not return after transfer")
+		}
+
+		name := tb.files[0].Path
+		b, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, contents[i]) {
+			t.Fatalf("%s: unexpected contents", name)
+		}
+	}
+
+	for _, s := range ms.servers {
+		s.Stop()
+	}
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestMultiServer_DuplicateTransfer(t *testing.T) {
+	tb := &VirtualTarballReader{hashId: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	ms := NewMultiServer(&Multicast{}, []*VirtualTarballReader{tb, tb}, nil, nil, ServerOptions{})
+	if err := ms.Run(); err != ErrDuplicateTransfer {
+		t.Fatalf("expected %v got %v", ErrDuplicateTransfer, err)
+	}
+}
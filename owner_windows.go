@@ -0,0 +1,10 @@
+// +build windows
+
+package lancaster
+
+import "os"
+
+// Windows files have no user and group IDs:
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	return -1, -1, false
+}
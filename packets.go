@@ -0,0 +1,44 @@
+// packets.go
+package lancaster
+
+import "sync"
+
+// Received datagrams are read into buffers recycled through a pool rather than a fresh allocation
+// per packet, which at high packet rates would keep the garbage collector busy.
+type packetPool struct {
+	pool sync.Pool
+}
+
+// Buffer of at least `size` bytes:
+func (p *packetPool) get(size int) *[]byte {
+	buf, _ := p.pool.Get().(*[]byte)
+	if buf == nil || len(*buf) < size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	return buf
+}
+
+func (p *packetPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// Hands the buffer the message was received into back for reuse. Neither Data nor anything sliced
+// from it may be used afterwards; messages not received from a socket are left alone.
+func (msg UDPMessage) Release() {
+	if msg.pool != nil {
+		msg.pool.put(msg.packet)
+	}
+}
+
+// Copy of the message in a buffer of its own, released separately from the original:
+func (msg UDPMessage) clone() UDPMessage {
+	c := msg
+	if msg.pool == nil {
+		c.Data = append([]byte(nil), msg.Data...)
+		return c
+	}
+	c.packet = msg.pool.get(len(*msg.packet))
+	c.Data = (*c.packet)[:copy(*c.packet, msg.Data)]
+	return c
+}
@@ -0,0 +1,80 @@
+package lancaster
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPacketPool_Get(t *testing.T) {
+	p := &packetPool{}
+	small := make([]byte, 10)
+	p.put(&small)
+	if buf := p.get(100); len(*buf) < 100 {
+		t.Fatalf("expected at least 100 bytes got %d", len(*buf))
+	}
+
+	// Messages made up rather than received have nothing to give back:
+	UDPMessage{Data: small}.Release()
+}
+
+func TestUDPMessage_Clone(t *testing.T) {
+	p := &packetPool{}
+	buf := p.get(100)
+	copy(*buf, "hello")
+	msg := UDPMessage{Data: (*buf)[:5], packet: buf, pool: p}
+
+	// Copies outlive the original being released and reused:
+	c := msg.clone()
+	msg.Release()
+	copy(*p.get(100), "HELLO")
+	if string(c.Data) != "hello" || c.packet == buf {
+		t.Fatalf("expected an independent copy got %q", c.Data)
+	}
+	c.Release()
+
+	if c = (UDPMessage{Data: []byte("hi")}).clone(); string(c.Data) != "hi" || c.pool != nil {
+		t.Fatalf("unexpected copy %+v", c)
+	}
+}
+
+func benchmarkReceive(b *testing.B, release bool) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	send, err := net.DialUDP("udp4", nil, recv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer send.Close()
+
+	m := &Multicast{datagramSize: DefaultDatagramSize}
+	ch := make(chan UDPMessage, 1)
+	go m.receiveLoop(recv, ch, false, false)
+	defer recv.Close()
+
+	payload := make([]byte, 8000)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = send.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+		msg := <-ch
+		if msg.Error != nil {
+			b.Fatal(msg.Error)
+		}
+		if release {
+			msg.Release()
+		}
+	}
+}
+
+func BenchmarkReceive_Unreleased(b *testing.B) {
+	benchmarkReceive(b, false)
+}
+
+func BenchmarkReceive_Pooled(b *testing.B) {
+	benchmarkReceive(b, true)
+}
@@ -0,0 +1,166 @@
+// progress.go
+package lancaster
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+import "github.com/dustin/go-humanize"
+
+var ErrBadProgressMode = errors.New("progress must be compact or detailed")
+
+type ProgressMode int
+
+const (
+	// One line of aggregate rate and percentage rewritten in place:
+	ProgressCompact = ProgressMode(iota)
+	// Overall ETA plus which files are complete, in progress and pending:
+	ProgressDetailed
+)
+
+func ParseProgressMode(s string) (ProgressMode, error) {
+	switch s {
+	case "", "compact":
+		return ProgressCompact, nil
+	case "detailed":
+		return ProgressDetailed, nil
+	}
+	return ProgressCompact, ErrBadProgressMode
+}
+
+// Progress of a Client or Server, published by Run once per refresh and once more when it returns:
+type ProgressEvent struct {
+	// Received by a client or sent by a server, including retransmissions:
+	Bytes int64
+	// Of the transfer's stream; 0 until a client has its metadata:
+	Size int64
+	// Of the stream a client has, by what it has received:
+	Percent float64
+	// Bytes per second since the previous event:
+	Rate float64
+	// Paths of files a client has all of since the previous event:
+	Completed []string
+	// Clients a server has heard from recently, and those that have reported completion:
+	Clients          int
+	ClientsCompleted int
+	// Set on the last event, once Run is returning Err:
+	Done bool
+	Err  error
+}
+
+// Events waiting for a subscriber to read them:
+const progressBacklog = 16
+
+// Progress events for a subscriber. A slow subscriber misses the oldest rather than stalling the
+// transfer, so the final event always arrives.
+type progressEvents chan ProgressEvent
+
+func (p progressEvents) publish(e ProgressEvent) {
+	for {
+		select {
+		case p <- e:
+			return
+		default:
+		}
+		select {
+		case <-p:
+		default:
+		}
+	}
+}
+
+// Weight of the latest sample in the smoothed receive rate:
+const rateSmoothing = 0.3
+
+// Below this many bytes per second a transfer counts as stalled rather than producing a silly ETA:
+const stalledRate = 1.0
+
+// Longest ETA worth printing; anything beyond reads as stalled too:
+const maxETA = 100 * time.Hour
+
+// At most this many in-progress files are listed individually:
+const maxProgressFiles = 10
+
+func smoothRate(smoothed float64, sample float64) float64 {
+	if smoothed == 0 {
+		return sample
+	}
+	return smoothed + rateSmoothing*(sample-smoothed)
+}
+
+func formatETA(remaining int64, bytesPerSecond float64) string {
+	if remaining <= 0 {
+		return "0s"
+	}
+	if bytesPerSecond < stalledRate {
+		return "stalled"
+	}
+	seconds := float64(remaining) / bytesPerSecond
+	if seconds > maxETA.Seconds() {
+		return "stalled"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
+
+type activeFile struct {
+	path     string
+	received int64
+	size     int64
+}
+
+type fileProgress struct {
+	complete int
+	pending  int
+	active   []activeFile
+}
+
+// Sorts files by how much of their contents has arrived. Entries without contents count as complete
+// once their terminating byte has.
+func summarizeFileProgress(files []*TarballFile, naks *NakRegions) fileProgress {
+	p := fileProgress{}
+	for _, tf := range files {
+		missing := naks.NakedBytes(tf.offset, tf.offset+tf.Size+1)
+		switch {
+		case missing == 0:
+			p.complete++
+		case missing == tf.Size+1:
+			p.pending++
+		default:
+			received := tf.Size + 1 - missing
+			if received > tf.Size {
+				received = tf.Size
+			}
+			p.active = append(p.active, activeFile{path: tf.Path, received: received, size: tf.Size})
+		}
+	}
+	return p
+}
+
+// Multi-line progress: overall rate, percentage and ETA then a per-file breakdown. Compressed streams
+// don't map onto files so only the overall line is shown for them.
+func (c *Client) formatDetailedProgress(rate float64) string {
+	b := &strings.Builder{}
+	remaining := c.nakRegions.NakedBytes(0, c.nakRegions.size)
+	pct := float64(c.nakRegions.size-remaining) * 100.0 / float64(c.nakRegions.size)
+	fmt.Fprintf(b, "%9s/s %6.2f%% ETA %s\n", humanize.IBytes(uint64(rate)), pct, formatETA(remaining, c.smoothedRate))
+	if c.compression != CompressNone {
+		return b.String()
+	}
+
+	p := summarizeFileProgress(c.tb.files, c.nakRegions)
+	fmt.Fprintf(b, "  %d complete, %d in progress, %d pending\n", p.complete, len(p.active), p.pending)
+	for i, f := range p.active {
+		if i == maxProgressFiles {
+			fmt.Fprintf(b, "  ... and %d more\n", len(p.active)-maxProgressFiles)
+			break
+		}
+		filePct := float64(100)
+		if f.size > 0 {
+			filePct = float64(f.received) * 100.0 / float64(f.size)
+		}
+		fmt.Fprintf(b, "  %6.2f%% %15s '%s'\n", filePct, humanize.Comma(f.size), f.path)
+	}
+	return b.String()
+}
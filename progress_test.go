@@ -0,0 +1,83 @@
+package lancaster
+
+import (
+	"testing"
+)
+
+func TestFormatETA(t *testing.T) {
+	cases := []struct {
+		remaining int64
+		rate      float64
+		expected  string
+	}{
+		{0, 0, "0s"},
+		{1000, 100, "10s"},
+		{90 * 1024 * 1024, 1024 * 1024, "1m30s"},
+		{1000, 0, "stalled"},
+		{1000, 0.001, "stalled"},
+		{1 << 50, 2, "stalled"},
+	}
+	for _, c := range cases {
+		if actual := formatETA(c.remaining, c.rate); actual != c.expected {
+			t.Fatalf("%d bytes at %v/s: expected %s got %s", c.remaining, c.rate, c.expected, actual)
+		}
+	}
+}
+
+func TestSmoothRate(t *testing.T) {
+	r := smoothRate(0, 100)
+	if r != 100 {
+		t.Fatalf("expected first sample to be taken as is got %v", r)
+	}
+	if r = smoothRate(r, 0); r != 70 {
+		t.Fatalf("expected a stall to decay the rate got %v", r)
+	}
+}
+
+func TestSummarizeFileProgress(t *testing.T) {
+	files := []*TarballFile{
+		{Path: "done", Size: 9, offset: 0},
+		{Path: "half", Size: 9, offset: 10},
+		{Path: "empty", Size: 0, offset: 20},
+		{Path: "todo", Size: 9, offset: 21},
+	}
+	naks := NewNakRegions(31)
+	naks.Ack(0, 15)
+	naks.Ack(20, 21)
+
+	p := summarizeFileProgress(files, naks)
+	if p.complete != 2 || p.pending != 1 || len(p.active) != 1 {
+		t.Fatalf("unexpected summary %+v", p)
+	}
+	if a := p.active[0]; a.path != "half" || a.received != 5 || a.size != 9 {
+		t.Fatalf("unexpected active file %+v", a)
+	}
+}
+
+func TestParseProgressMode(t *testing.T) {
+	if m, err := ParseProgressMode("detailed"); err != nil || m != ProgressDetailed {
+		t.Fatalf("expected detailed got %v %v", m, err)
+	}
+	if _, err := ParseProgressMode("fancy"); err != ErrBadProgressMode {
+		t.Fatalf("expected ErrBadProgressMode got %v", err)
+	}
+}
+
+func TestProgressEvents_DropsOldest(t *testing.T) {
+	p := make(progressEvents, progressBacklog)
+	for i := 0; i < progressBacklog+4; i++ {
+		p.publish(ProgressEvent{Bytes: int64(i)})
+	}
+	close(p)
+
+	expected := int64(4)
+	for e := range p {
+		if e.Bytes != expected {
+			t.Fatalf("expected event %d got %d", expected, e.Bytes)
+		}
+		expected++
+	}
+	if expected != progressBacklog+4 {
+		t.Fatalf("expected the latest event last; ended at %d", expected)
+	}
+}
@@ -1,31 +1,75 @@
 // protocol.go
-package main
+package lancaster
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"math"
+	"sort"
 	"time"
 )
 
 const protocolVersion = 1
-const hashSize = 8
-const protocolControlPrefixSize = 1 + hashSize + 1
-const protocolDataMsgPrefixSize = 1 + hashSize + 8
+const HashSize = 8
+const protocolControlPrefixSize = 1 + HashSize + 1
+const ProtocolDataMsgPrefixSize = 1 + HashSize + 8
 
 const metadataSectionMsgSize = 2
-const metadataHeaderMsgSize = 2
+
+// CRC-32C trailing every data message when checksums are on, covering the message before it:
+const dataChecksumSize = 4
+
+// Set in the metadata header's compression byte when data messages carry a checksum; older clients
+// reject the unknown compression rather than write what they can't check:
+const checksumFlag = 0x80
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Section count, compression and size of the data region stream, FEC data/parity shard counts and shard size,
+// then the salt of data region nonces when encrypted and a SHA-256 digest of the joined metadata sections
+// so a signature over the header vouches for them too:
+const metadataHeaderMsgSize = 2 + 1 + 8 + 1 + 1 + 2 + saltSize + sha256.Size
+const metadataDigestOffset = 15 + saltSize
 
 //const bufferFullTimeoutMilli = 50
 
 var resendTimeout = 250 * time.Millisecond
 
+// Requests for data bunched closer together than this are coalesced into one so a busy client
+// advertises its progress at most this often:
+var minAskInterval = 5 * time.Millisecond
+
+// The same region NAK'd again within this long, by the same client or another, was most likely sent
+// before our resend reached anyone and is ignored:
+var nakDebounce = 20 * time.Millisecond
+
+// Largest announcement payload a client will accept; anything bigger belongs in metadata:
+var maxAnnouncementSize = 1024
+
 var (
 	ErrMessageTooShort      = errors.New("message too short")
 	ErrWrongProtocolVersion = errors.New("wrong protocol version")
 	ErrAckOutOfRange        = errors.New("ack out of range")
+	ErrAnnouncementTooLarge = errors.New("announcement too large")
+	ErrBadAnnouncementList  = errors.New("malformed announcement list")
+	ErrBadRegionList        = errors.New("malformed region list")
+	ErrBadBitmap            = errors.New("malformed region bitmap")
+	ErrBadMetadata          = errors.New("malformed metadata")
+	ErrBadChecksum          = errors.New("data checksum mismatch")
+	ErrMetadataMismatch     = errors.New("metadata does not match the header's digest")
+)
+
+// Limits on decoded metadata so a truncated or hostile server can't make a client allocate without bound:
+const (
+	maxMetadataFiles = 1 << 24
+	// Paths, symlink destinations and hard link targets:
+	maxMetadataPath = 4096
+	// Content hashes of any supported algorithm:
+	maxMetadataHash = 64
 )
 
 var byteOrder = binary.LittleEndian
@@ -44,10 +88,95 @@ const (
 	RequestMetadataHeader = ControlToServerOp(iota)
 	RequestMetadataSection
 	AckDataSection
+
+	// To-Client control messages (continued):
+	AnnounceTarballList = ControlToClientOp(iota)
+
+	// To-Server control messages (continued):
+	RequestDataRegions = ControlToServerOp(iota)
+	// Asks servers to announce now rather than at their next interval:
+	RequestAnnouncement
+
+	// To-Client control messages (continued):
+	// Where the server sends from, following its announcement, so clients can join only that source:
+	AnnounceSource = ControlToClientOp(iota)
+	// The group the server sends data to when not the shared one, so clients join it instead:
+	AnnounceDataGroup
+	// Answers messages for a transfer files were since added to, carrying the ID it's served under now:
+	AnnounceReplaced
+
+	// To-Server control messages (continued):
+	// Asks for hashes of the blocks of a file's contents from a given block on, to verify against:
+	RequestBlockHashes = ControlToServerOp(iota)
+
+	// To-Client control messages (continued):
+	RespondBlockHashes = ControlToClientOp(iota)
 )
 
+func (op ControlToClientOp) String() string {
+	switch op {
+	case AnnounceTarball:
+		return "AnnounceTarball"
+	case RespondMetadataHeader:
+		return "RespondMetadataHeader"
+	case RespondMetadataSection:
+		return "RespondMetadataSection"
+	case DeliverDataSection:
+		return "DeliverDataSection"
+	case AnnounceTarballList:
+		return "AnnounceTarballList"
+	case AnnounceSource:
+		return "AnnounceSource"
+	case AnnounceDataGroup:
+		return "AnnounceDataGroup"
+	case AnnounceReplaced:
+		return "AnnounceReplaced"
+	case RespondBlockHashes:
+		return "RespondBlockHashes"
+	default:
+		return fmt.Sprintf("ControlToClientOp(%d)", byte(op))
+	}
+}
+
+func (op ControlToServerOp) String() string {
+	switch op {
+	case RequestMetadataHeader:
+		return "RequestMetadataHeader"
+	case RequestMetadataSection:
+		return "RequestMetadataSection"
+	case AckDataSection:
+		return "AckDataSection"
+	case RequestDataRegions:
+		return "RequestDataRegions"
+	case RequestAnnouncement:
+		return "RequestAnnouncement"
+	case RequestBlockHashes:
+		return "RequestBlockHashes"
+	default:
+		return fmt.Sprintf("ControlToServerOp(%d)", byte(op))
+	}
+}
+
+// Bounds on a combined announcement so each chunk stays well under maxAnnouncementSize:
+const maxAnnouncementEntries = 8
+const maxAnnouncementNameSize = 64
+
+// A transfer listed in a combined announcement:
+type AnnouncementEntry struct {
+	HashId []byte
+	Size   int64
+	Name   string
+}
+
 func compareHashes(a []byte, b []byte) int {
-	return bytes.Compare(a[:hashSize], b[:hashSize])
+	return bytes.Compare(a[:HashSize], b[:HashSize])
+}
+
+// Discovery requests carry an all-zero ID when the client will take any transfer:
+var anyHashId = make([]byte, HashSize)
+
+func isZeroHash(hashId []byte) bool {
+	return compareHashes(hashId, anyHashId) == 0
 }
 
 type Region struct {
@@ -60,8 +189,11 @@ type NakRegions struct {
 	size int64
 }
 
+// Every byte of `size` NAKed; an empty transfer has nothing to ask for so starts out all ACKed:
 func NewNakRegions(size int64) *NakRegions {
-	return &NakRegions{naks: []Region{{start: 0, endEx: size}}, size: size}
+	r := &NakRegions{size: size}
+	r.NakAll()
+	return r
 }
 
 func (r *NakRegions) Naks() []Region {
@@ -86,11 +218,19 @@ func (r *NakRegions) Acks() []Region {
 	return o
 }
 
+func (r *NakRegions) clone() *NakRegions {
+	return &NakRegions{naks: append([]Region(nil), r.naks...), size: r.size}
+}
+
 func (r *NakRegions) Len() int {
 	return len(r.naks)
 }
 
 func (r *NakRegions) NakAll() {
+	if r.size <= 0 {
+		r.naks = []Region{}
+		return
+	}
 	r.naks = []Region{{start: 0, endEx: r.size}}
 }
 
@@ -128,14 +268,31 @@ func (r *NakRegions) NextNakRegion(p int64) int64 {
 	return -1
 }
 
+// Whether every byte within [start, endEx) has been ACKed, including ranges only partly NAK'd:
 func (r *NakRegions) IsAcked(start int64, endEx int64) bool {
+	return r.NakedBytes(start, endEx) == 0
+}
+
+// Number of bytes within [start, endEx) not yet ACKed:
+func (r *NakRegions) NakedBytes(start int64, endEx int64) int64 {
+	n := int64(0)
 	for _, k := range r.naks {
-		if start >= k.start && endEx <= k.endEx {
-			return false
+		if k.endEx <= start {
+			continue
+		}
+		if k.start >= endEx {
+			break
+		}
+		s, e := k.start, k.endEx
+		if s < start {
+			s = start
+		}
+		if e > endEx {
+			e = endEx
 		}
+		n += e - s
 	}
-
-	return true
+	return n
 }
 
 func (r *NakRegions) Ack(start, endEx int64) error {
@@ -145,6 +302,10 @@ func (r *NakRegions) Ack(start, endEx int64) error {
 	if endEx > r.size {
 		return ErrAckOutOfRange
 	}
+	// Empty ranges would otherwise split a NAK into two touching ones:
+	if endEx <= start {
+		return nil
+	}
 
 	// ACK has no effect on a fully-acked region:
 	a := r.naks
@@ -204,7 +365,7 @@ func (r *NakRegions) Ack(start, endEx int64) error {
 			o = append(o, a[kWithEnd])
 		}
 	} else if start > a[kWithStart].start && endEx == a[kWithEnd].endEx {
-		if start < a[kWithEnd].endEx {
+		if start < a[kWithStart].endEx {
 			o = append(o, Region{a[kWithStart].start, start})
 		} else {
 			o = append(o, a[kWithStart])
@@ -229,6 +390,10 @@ func (r *NakRegions) Nak(start, endEx int64) error {
 		return ErrAckOutOfRange
 	}
 
+	if endEx <= start {
+		return nil
+	}
+
 	// Shortcut for full replacement:
 	if start == 0 && endEx == r.size {
 		r.naks = []Region{{start, endEx}}
@@ -263,62 +428,95 @@ func (r *NakRegions) Nak(start, endEx int64) error {
 		o = append(o, Region{start, endEx})
 		o = append(o, a...)
 	} else {
-		first := (*Region)(nil)
-		last := (*Region)(nil)
-		for i, _ := range a {
-			k := &a[i]
-			if start <= k.endEx {
-				first = k
-				break
-			}
+		//  [{2 3} {5 19}]
+		// +{3 5}
+		// =[{2 19}]
+		o = make([]Region, 0, len(a)+1)
+		nak := Region{start, endEx}
+
+		// Emit NAKs before, merge those touching or overlapping, then emit those after:
+		i := 0
+		for ; i < len(a) && a[i].endEx < start; i++ {
+			o = append(o, a[i])
 		}
-		for i := len(a) - 1; i >= 0; i-- {
-			k := &a[i]
-			if endEx >= k.start {
-				last = k
-				break
+		for ; i < len(a) && a[i].start <= endEx; i++ {
+			if a[i].start < nak.start {
+				nak.start = a[i].start
+			}
+			if a[i].endEx > nak.endEx {
+				nak.endEx = a[i].endEx
 			}
 		}
+		o = append(o, nak)
+		o = append(o, a[i:]...)
+	}
 
-		// Merge with existing NAKs:
-		o = make([]Region, 0, len(a))
+	r.naks = o
+	return nil
+}
 
-		// Emit first NAKs:
-		i := 0
-		for ; i < len(a); i++ {
-			if &a[i] == first {
-				break
+// Sorts NAKs, merges those touching or overlapping and drops empty ones so the list holds the fewest,
+// largest holes. Ack and Nak keep the list this way; lists built up otherwise are normalized with it.
+func (r *NakRegions) Coalesce() {
+	sort.Slice(r.naks, func(i, j int) bool { return r.naks[i].start < r.naks[j].start })
+	o := r.naks[:0]
+	for _, k := range r.naks {
+		if k.endEx <= k.start {
+			continue
+		}
+		if n := len(o); n > 0 && k.start <= o[n-1].endEx {
+			if k.endEx > o[n-1].endEx {
+				o[n-1].endEx = k.endEx
 			}
-			o = append(o, a[i])
+			continue
 		}
+		o = append(o, k)
+	}
+	r.naks = o
+}
 
-		//  [{2 3} {5 19}]
-		// +{3 5}
-		// =[{2 19}]
-		nak := Region{first.start, last.endEx}
-		if start < nak.start {
-			nak.start = start
-		}
-		if endEx > nak.endEx {
-			nak.endEx = endEx
+// Merges the NAKs closest together until at most `max` remain, giving up the ACKs between them, and
+// returns how many ACKed bytes that is. Keeps a badly fragmented list bounded at the cost of asking for
+// some data again.
+func (r *NakRegions) Squeeze(max int) int64 {
+	if max < 1 {
+		max = 1
+	}
+	excess := len(r.naks) - max
+	if excess <= 0 {
+		return 0
+	}
+
+	// Close the `excess` smallest gaps, the earliest first among equals:
+	gaps := make([]int64, len(r.naks)-1)
+	for i := range gaps {
+		gaps[i] = r.naks[i+1].start - r.naks[i].endEx
+	}
+	sorted := append([]int64(nil), gaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	threshold, ties := sorted[excess-1], 0
+	for _, g := range sorted[:excess] {
+		if g == threshold {
+			ties++
 		}
-		o = append(o, nak)
+	}
 
-		// Omit middle NAKs:
-		for ; i < len(a); i++ {
-			if &a[i] == last {
-				i++
-				break
+	forgotten := int64(0)
+	o := r.naks[:1]
+	for i, g := range gaps {
+		k := r.naks[i+1]
+		if g < threshold || (g == threshold && ties > 0) {
+			if g == threshold {
+				ties--
 			}
+			o[len(o)-1].endEx = k.endEx
+			forgotten += g
+			continue
 		}
-		// Emit last NAKs:
-		for ; i < len(a); i++ {
-			o = append(o, a[i])
-		}
+		o = append(o, k)
 	}
-
 	r.naks = o
-	return nil
+	return forgotten
 }
 
 func (r *NakRegions) asciiMeter(charSize float64, nakMeter []byte) {
@@ -369,10 +567,189 @@ func (r *NakRegions) ASCIIMeterPosition(nakMeterLen int, pos int64) string {
 
 }
 
+// Acked chunks of `chunkSize` bytes as a raw bitmap, least significant bit first. A chunk only counts as
+// acked once all of it is so the bitmap never claims more than the region list does.
+func (r *NakRegions) ToBitmap(chunkSize int64) ([]byte, error) {
+	if chunkSize <= 0 {
+		return nil, ErrBadBitmap
+	}
+	chunks := (r.size + chunkSize - 1) / chunkSize
+	bitmap := make([]byte, (chunks+7)/8)
+	for c := int64(0); c < chunks; c++ {
+		bitmap[c/8] |= 1 << uint(c%8)
+	}
+	for _, k := range r.naks {
+		for c := k.start / chunkSize; c < (k.endEx+chunkSize-1)/chunkSize; c++ {
+			bitmap[c/8] &^= 1 << uint(c%8)
+		}
+	}
+	return bitmap, nil
+}
+
+// Inverse of ToBitmap for a tarball of `size` bytes:
+func FromBitmap(bitmap []byte, chunkSize int64, size int64) (*NakRegions, error) {
+	if chunkSize <= 0 || size < 0 {
+		return nil, ErrBadBitmap
+	}
+	chunks := (size + chunkSize - 1) / chunkSize
+	if int64(len(bitmap)) != (chunks+7)/8 {
+		return nil, ErrBadBitmap
+	}
+
+	r := &NakRegions{naks: []Region{}, size: size}
+	for c := int64(0); c < chunks; c++ {
+		if bitmap[c/8]&(1<<uint(c%8)) != 0 {
+			continue
+		}
+		start, endEx := c*chunkSize, (c+1)*chunkSize
+		if endEx > size {
+			endEx = size
+		}
+		// Extend the previous NAK when contiguous:
+		if n := len(r.naks); n > 0 && r.naks[n-1].endEx == start {
+			r.naks[n-1].endEx = endEx
+			continue
+		}
+		r.naks = append(r.naks, Region{start, endEx})
+	}
+	return r, nil
+}
+
+// Encodes transfers into as many announcement list payloads as needed. Each payload is:
+//
+//	uint16 chunk index, uint16 chunk count, uint16 entry count,
+//	entries of [hashId, int64 size, uint16 name length, name]
+func encodeAnnouncementList(entries []AnnouncementEntry) [][]byte {
+	chunkCount := (len(entries) + maxAnnouncementEntries - 1) / maxAnnouncementEntries
+	chunks := make([][]byte, 0, chunkCount)
+	for c := 0; c < chunkCount; c++ {
+		chunk := entries[c*maxAnnouncementEntries:]
+		if len(chunk) > maxAnnouncementEntries {
+			chunk = chunk[:maxAnnouncementEntries]
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, 6+len(chunk)*(HashSize+8+2+maxAnnouncementNameSize)))
+		binary.Write(buf, byteOrder, uint16(c))
+		binary.Write(buf, byteOrder, uint16(chunkCount))
+		binary.Write(buf, byteOrder, uint16(len(chunk)))
+		for _, e := range chunk {
+			name := e.Name
+			if len(name) > maxAnnouncementNameSize {
+				name = name[:maxAnnouncementNameSize]
+			}
+			buf.Write(e.HashId[:HashSize])
+			binary.Write(buf, byteOrder, e.Size)
+			binary.Write(buf, byteOrder, uint16(len(name)))
+			buf.WriteString(name)
+		}
+		chunks = append(chunks, buf.Bytes())
+	}
+	return chunks
+}
+
+func decodeAnnouncementList(data []byte) (chunkIndex uint16, chunkCount uint16, entries []AnnouncementEntry, err error) {
+	if len(data) < 6 {
+		err = ErrBadAnnouncementList
+		return
+	}
+	chunkIndex = byteOrder.Uint16(data[0:2])
+	chunkCount = byteOrder.Uint16(data[2:4])
+	count := int(byteOrder.Uint16(data[4:6]))
+	if count > maxAnnouncementEntries || chunkIndex >= chunkCount {
+		err = ErrBadAnnouncementList
+		return
+	}
+
+	i := 6
+	entries = make([]AnnouncementEntry, 0, count)
+	for n := 0; n < count; n++ {
+		if len(data)-i < HashSize+8+2 {
+			err = ErrBadAnnouncementList
+			return
+		}
+		e := AnnouncementEntry{}
+		e.HashId = make([]byte, HashSize)
+		copy(e.HashId, data[i:i+HashSize])
+		i += HashSize
+		e.Size = int64(byteOrder.Uint64(data[i : i+8]))
+		i += 8
+		nameLen := int(byteOrder.Uint16(data[i : i+2]))
+		i += 2
+		if nameLen > maxAnnouncementNameSize || len(data)-i < nameLen {
+			err = ErrBadAnnouncementList
+			return
+		}
+		e.Name = string(data[i : i+nameLen])
+		i += nameLen
+		entries = append(entries, e)
+	}
+
+	return
+}
+
+// Most NAK regions a client lists in one RequestDataRegions message:
+const maxRequestedRegions = 256
+
+// Encodes as many regions as fit in `max` bytes and returns how many made it. Region list layout:
+//
+//	uvarint count, then count pairs of [uvarint start, uvarint endEx]
+func encodeRegionList(regions []Region, max int) ([]byte, int) {
+	if len(regions) > maxRequestedRegions {
+		regions = regions[:maxRequestedRegions]
+	}
+
+	// Leave room for the count which is only known at the end:
+	body := make([]byte, 0, max)
+	pair := make([]byte, 2*binary.MaxVarintLen64)
+	count := 0
+	for _, r := range regions {
+		l := binary.PutUvarint(pair, uint64(r.start))
+		l += binary.PutUvarint(pair[l:], uint64(r.endEx))
+		if binary.MaxVarintLen16+len(body)+l > max {
+			break
+		}
+		body = append(body, pair[:l]...)
+		count++
+	}
+
+	buf := make([]byte, binary.MaxVarintLen16, binary.MaxVarintLen16+len(body))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(count))], body...)
+	return buf, count
+}
+
+func decodeRegionList(data []byte) ([]Region, error) {
+	count, i := binary.Uvarint(data)
+	if i <= 0 || count > maxRequestedRegions {
+		return nil, ErrBadRegionList
+	}
+
+	regions := make([]Region, 0, count)
+	for n := uint64(0); n < count; n++ {
+		start, l := binary.Uvarint(data[i:])
+		if l <= 0 {
+			return nil, ErrBadRegionList
+		}
+		i += l
+		endEx, l := binary.Uvarint(data[i:])
+		if l <= 0 {
+			return nil, ErrBadRegionList
+		}
+		i += l
+		if endEx <= start || endEx > math.MaxInt64 {
+			return nil, ErrBadRegionList
+		}
+		regions = append(regions, Region{int64(start), int64(endEx)})
+	}
+	if i != len(data) {
+		return nil, ErrBadRegionList
+	}
+	return regions, nil
+}
+
 func controlToClientMessage(hashId []byte, op ControlToClientOp, data []byte) []byte {
 	msg := make([]byte, 0, protocolControlPrefixSize+len(data))
 	msg = append(msg, protocolVersion)
-	msg = append(msg, hashId[:hashSize]...)
+	msg = append(msg, hashId[:HashSize]...)
 	msg = append(msg, byte(op))
 	msg = append(msg, data...)
 	return msg
@@ -381,35 +758,57 @@ func controlToClientMessage(hashId []byte, op ControlToClientOp, data []byte) []
 func controlToServerMessage(hashId []byte, op ControlToServerOp, data []byte) []byte {
 	msg := make([]byte, 0, protocolControlPrefixSize+len(data))
 	msg = append(msg, protocolVersion)
-	msg = append(msg, hashId[:hashSize]...)
+	msg = append(msg, hashId[:HashSize]...)
 	msg = append(msg, byte(op))
 	msg = append(msg, data...)
 	return msg
 }
 
 func dataMessage(hashId []byte, region int64, data []byte) []byte {
-	msg := make([]byte, 0, protocolDataMsgPrefixSize+len(data))
+	msg := make([]byte, 0, ProtocolDataMsgPrefixSize+len(data))
 	buf := bytes.NewBuffer(msg)
 	buf.WriteByte(protocolVersion)
-	buf.Write(hashId[:hashSize])
+	buf.Write(hashId[:HashSize])
 	binary.Write(buf, byteOrder, region)
 	buf.Write(data)
 	return buf.Bytes()
 }
 
+func appendChecksum(msg []byte) []byte {
+	sum := make([]byte, dataChecksumSize)
+	byteOrder.PutUint32(sum, crc32.Checksum(msg, castagnoli))
+	return append(msg, sum...)
+}
+
+// Returns the message without its checksum if intact:
+func verifyChecksum(msg []byte) ([]byte, error) {
+	if len(msg) < ProtocolDataMsgPrefixSize+dataChecksumSize {
+		return nil, ErrMessageTooShort
+	}
+	body := msg[:len(msg)-dataChecksumSize]
+	if crc32.Checksum(body, castagnoli) != byteOrder.Uint32(msg[len(body):]) {
+		return nil, ErrBadChecksum
+	}
+	return body, nil
+}
+
 func extractControlMessage(ctrl UDPMessage) (hashId []byte, op byte, data []byte, err error) {
 	if len(ctrl.Data) < protocolControlPrefixSize {
 		err = ErrMessageTooShort
 		return
 	}
 
+	if ctrl.Data[0] == protocolVersionSealed {
+		err = ErrEncrypted
+		return
+	}
 	if ctrl.Data[0] != protocolVersion {
 		err = ErrWrongProtocolVersion
 		return
 	}
 
-	hashId = ctrl.Data[1 : 1+hashSize]
-	op = ctrl.Data[1+hashSize]
+	hashId = ctrl.Data[1 : 1+HashSize]
+	op = ctrl.Data[1+HashSize]
 	data = ctrl.Data[protocolControlPrefixSize:]
 
 	return
@@ -419,6 +818,14 @@ func extractClientMessage(ctrl UDPMessage) (hashId []byte, op ControlToClientOp,
 	var opByte byte
 	hashId, opByte, data, err = extractControlMessage(ctrl)
 	op = ControlToClientOp(opByte)
+	if err != nil {
+		return
+	}
+
+	// Drop oversized announcements before anyone gets a chance to parse them:
+	if op == AnnounceTarball && len(data) > maxAnnouncementSize {
+		hashId, data, err = nil, nil, ErrAnnouncementTooLarge
+	}
 	return
 }
 
@@ -430,19 +837,23 @@ func extractServerMessage(ctrl UDPMessage) (hashId []byte, op ControlToServerOp,
 }
 
 func extractDataMessage(ctrl UDPMessage) (hashId []byte, region int64, data []byte, err error) {
-	if len(ctrl.Data) < protocolDataMsgPrefixSize {
+	if len(ctrl.Data) < ProtocolDataMsgPrefixSize {
 		err = ErrMessageTooShort
 		return
 	}
 
+	if ctrl.Data[0] == protocolVersionSealed {
+		err = ErrEncrypted
+		return
+	}
 	if ctrl.Data[0] != protocolVersion {
 		err = ErrWrongProtocolVersion
 		return
 	}
 
-	hashId = ctrl.Data[1 : 1+hashSize]
-	region = int64(byteOrder.Uint64(ctrl.Data[1+hashSize : protocolDataMsgPrefixSize]))
-	data = ctrl.Data[protocolDataMsgPrefixSize:]
+	hashId = ctrl.Data[1 : 1+HashSize]
+	region = int64(byteOrder.Uint64(ctrl.Data[1+HashSize : ProtocolDataMsgPrefixSize]))
+	data = ctrl.Data[ProtocolDataMsgPrefixSize:]
 
 	return
 }
@@ -1,7 +1,8 @@
 // protocol_test.go
-package main
+package lancaster
 
 import (
+	"math/rand"
 	"testing"
 )
 
@@ -34,6 +35,22 @@ func TestNakRegions_NakAll2(t *testing.T) {
 	cmp(t, r.Acks(), []Region{})
 }
 
+func TestNakRegions_Empty(t *testing.T) {
+	// An empty transfer has nothing to ask for:
+	r := NewNakRegions(0)
+	cmp(t, r.Naks(), []Region{})
+	cmp(t, r.Acks(), []Region{})
+	if !r.IsAllAcked() || !r.IsAcked(0, 0) || r.NextNakRegion(0) != -1 {
+		t.Fatalf("expected an empty transfer all ACKed got %v", r.Naks())
+	}
+
+	// And still nothing once NAKed again:
+	r.NakAll()
+	if !r.IsAllAcked() {
+		t.Fatalf("expected an empty transfer all ACKed got %v", r.Naks())
+	}
+}
+
 // [].ack(?, ?) => []
 func TestNakRegions_Ack1(t *testing.T) {
 	r := NewNakRegions(10)
@@ -169,6 +186,43 @@ func TestNakRegions_Ack14(t *testing.T) {
 	cmp(t, r.Naks(), []Region{{start: 0, endEx: 1}, {start: 16, endEx: 20}})
 }
 
+// [(0, 20)].ack(2, 8).ack(5, 12).ack(4, 6) => [(0, 2), (12, 20)]
+func TestNakRegions_Ack15(t *testing.T) {
+	r := NewNakRegions(20)
+	r.Ack(2, 8)
+	r.Ack(5, 12)
+	r.Ack(4, 6)
+	cmp(t, r.Naks(), []Region{{start: 0, endEx: 2}, {start: 12, endEx: 20}})
+	checkNormalized(t, r)
+}
+
+// [(0, 20)].ack(16, 18).ack(8, 10).ack(2, 4).ack(10, 16) => [(0, 2), (4, 8), (18, 20)]
+func TestNakRegions_Ack16(t *testing.T) {
+	r := NewNakRegions(20)
+	r.Ack(16, 18)
+	r.Ack(8, 10)
+	r.Ack(2, 4)
+	r.Ack(10, 16)
+	cmp(t, r.Naks(), []Region{{start: 0, endEx: 2}, {start: 4, endEx: 8}, {start: 18, endEx: 20}})
+	checkNormalized(t, r)
+}
+
+// [(0, 20)].ack(7, 7) => [(0, 20)]
+func TestNakRegions_Ack17(t *testing.T) {
+	r := NewNakRegions(20)
+	r.Ack(7, 7)
+	r.Ack(9, 3)
+	cmp(t, r.Naks(), []Region{{start: 0, endEx: 20}})
+}
+
+// [(0, 10), (197, 200)].ack(104, 200) => [(0, 10)]
+func TestNakRegions_Ack18(t *testing.T) {
+	r := NewNakRegions(200)
+	r.Ack(10, 197)
+	r.Ack(104, 200)
+	cmp(t, r.Naks(), []Region{{start: 0, endEx: 10}})
+}
+
 // [(5, 10)].nak(0,  10) => [(0, 10)]
 func TestNakRegions_Nak1(t *testing.T) {
 	r := NewNakRegions(10)
@@ -275,6 +329,25 @@ func TestNakRegions_Nak10(t *testing.T) {
 	cmp(t, r.Naks(), []Region{{0, 20}})
 }
 
+// [(0, 2), (8, 10)].nak(4, 5) => [(0, 2), (4, 5), (8, 10)]
+func TestNakRegions_Nak11(t *testing.T) {
+	r := NewNakRegions(10)
+	r.Ack(2, 8)
+	r.Nak(4, 5)
+	cmp(t, r.Naks(), []Region{{0, 2}, {4, 5}, {8, 10}})
+}
+
+// [(0, 2), (8, 10)].nak(2, 4).nak(6, 8) => [(0, 4), (6, 10)]
+func TestNakRegions_Nak12(t *testing.T) {
+	r := NewNakRegions(10)
+	r.Ack(2, 8)
+	r.Nak(2, 4)
+	r.Nak(6, 8)
+	cmp(t, r.Naks(), []Region{{0, 4}, {6, 10}})
+	r.Nak(5, 5)
+	cmp(t, r.Naks(), []Region{{0, 4}, {6, 10}})
+}
+
 func TestNextNakRegion1(t *testing.T) {
 	r := NewNakRegions(20)
 	r.Ack(1, 2)
@@ -399,3 +472,457 @@ func TestNextNakRegion12(t *testing.T) {
 		t.Fatalf("expected %d got %d", expected, n)
 	}
 }
+
+func TestExtractClientMessage_AnnouncementTooLarge(t *testing.T) {
+	hashId := make([]byte, HashSize)
+	msg := UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, make([]byte, maxAnnouncementSize+1))}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		_, _, data, err := extractClientMessage(msg)
+		if err != ErrAnnouncementTooLarge {
+			t.Fatalf("expected ErrAnnouncementTooLarge got %v", err)
+		}
+		if data != nil {
+			t.Fatal("expected nil data")
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations got %v", allocs)
+	}
+}
+
+func TestExtractClientMessage_AnnouncementMaxSize(t *testing.T) {
+	hashId := make([]byte, HashSize)
+	msg := UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, make([]byte, maxAnnouncementSize))}
+
+	_, op, data, err := extractClientMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != AnnounceTarball {
+		t.Fatalf("expected AnnounceTarball got %d", op)
+	}
+	if len(data) != maxAnnouncementSize {
+		t.Fatalf("expected %d bytes got %d", maxAnnouncementSize, len(data))
+	}
+}
+
+func TestAnnouncementList_RoundTrip(t *testing.T) {
+	entries := make([]AnnouncementEntry, 0, maxAnnouncementEntries+3)
+	for i := 0; i < cap(entries); i++ {
+		entries = append(entries, AnnouncementEntry{
+			HashId: []byte{byte(i), 1, 2, 3, 4, 5, 6, 7},
+			Size:   int64(i) * 1000,
+			Name:   string(rune('a' + i)),
+		})
+	}
+
+	chunks := encodeAnnouncementList(entries)
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks got %d", len(chunks))
+	}
+
+	decoded := []AnnouncementEntry(nil)
+	for i, chunk := range chunks {
+		if len(chunk) > maxAnnouncementSize {
+			t.Fatalf("chunk %d exceeds maxAnnouncementSize", i)
+		}
+		chunkIndex, chunkCount, e, err := decodeAnnouncementList(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(chunkIndex) != i || chunkCount != 2 {
+			t.Fatalf("expected chunk %d of 2 got %d of %d", i, chunkIndex, chunkCount)
+		}
+		decoded = append(decoded, e...)
+	}
+
+	if len(decoded) != len(entries) {
+		t.Fatalf("expected %d entries got %d", len(entries), len(decoded))
+	}
+	for i, e := range decoded {
+		if compareHashes(e.HashId, entries[i].HashId) != 0 || e.Size != entries[i].Size || e.Name != entries[i].Name {
+			t.Fatalf("entry %d mismatch; %v != %v", i, e, entries[i])
+		}
+	}
+}
+
+func TestAnnouncementList_LongNameFits(t *testing.T) {
+	entries := make([]AnnouncementEntry, maxAnnouncementEntries)
+	for i := range entries {
+		entries[i] = AnnouncementEntry{HashId: make([]byte, HashSize), Name: string(make([]byte, 1000))}
+	}
+	for _, chunk := range encodeAnnouncementList(entries) {
+		if len(chunk) > maxAnnouncementSize {
+			t.Fatalf("chunk of %d bytes exceeds maxAnnouncementSize", len(chunk))
+		}
+	}
+}
+
+func TestAnnouncementList_Truncated(t *testing.T) {
+	chunk := encodeAnnouncementList([]AnnouncementEntry{{HashId: make([]byte, HashSize), Name: "hello"}})[0]
+	for n := 0; n < len(chunk); n++ {
+		if _, _, _, err := decodeAnnouncementList(chunk[:n]); err != ErrBadAnnouncementList {
+			t.Fatalf("expected ErrBadAnnouncementList for %d bytes got %v", n, err)
+		}
+	}
+}
+
+func TestRegionList_RoundTrip(t *testing.T) {
+	regions := []Region{{0, 10}, {300, 70000}, {1 << 40, 1<<40 + 1}}
+	data, n := encodeRegionList(regions, 1024)
+	if n != len(regions) {
+		t.Fatalf("expected %d regions encoded got %d", len(regions), n)
+	}
+	decoded, err := decodeRegionList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, decoded, regions)
+
+	// Nothing to ask for still encodes a valid empty list:
+	data, n = encodeRegionList(nil, 1024)
+	decoded, err = decodeRegionList(data)
+	if err != nil || n != 0 || len(decoded) != 0 {
+		t.Fatalf("expected empty list got %v %v", decoded, err)
+	}
+}
+
+func TestRegionList_FitsMessage(t *testing.T) {
+	regions := make([]Region, 0, 100)
+	for i := int64(0); i < 100; i++ {
+		regions = append(regions, Region{i * 1000, i*1000 + 500})
+	}
+	data, n := encodeRegionList(regions, 64)
+	if len(data) > 64 || n == 0 || n == len(regions) {
+		t.Fatalf("expected a partial list within 64 bytes got %d regions in %d bytes", n, len(data))
+	}
+	decoded, err := decodeRegionList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, decoded, regions[:n])
+}
+
+func TestRegionList_Malformed(t *testing.T) {
+	good, _ := encodeRegionList([]Region{{5, 10}}, 64)
+	for _, data := range [][]byte{
+		nil,
+		good[:len(good)-1],
+		append(good, 0),
+		{1, 10, 5},
+		{1, 5, 5},
+	} {
+		if _, err := decodeRegionList(data); err != ErrBadRegionList {
+			t.Fatalf("expected ErrBadRegionList for %v got %v", data, err)
+		}
+	}
+}
+
+func TestNakRegions_Bitmap(t *testing.T) {
+	r := NewNakRegions(100)
+	r.Ack(0, 100)
+	r.Nak(16, 48)
+	r.Nak(96, 100)
+
+	bitmap, err := r.ToBitmap(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bitmap) != 1 || bitmap[0] != 0x39 {
+		t.Fatalf("unexpected bitmap %08b", bitmap)
+	}
+	b, err := FromBitmap(bitmap, 16, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, b.Naks(), []Region{{16, 48}, {96, 100}})
+}
+
+func TestNakRegions_BitmapPartialChunk(t *testing.T) {
+	// A chunk that is only partly NAKed is reported missing as a whole:
+	r := NewNakRegions(64)
+	r.Ack(0, 64)
+	r.Nak(20, 21)
+	bitmap, err := r.ToBitmap(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := FromBitmap(bitmap, 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, b.Naks(), []Region{{16, 32}})
+}
+
+func TestNakRegions_BitmapMalformed(t *testing.T) {
+	if _, err := FromBitmap([]byte{0, 0}, 16, 100); err != ErrBadBitmap {
+		t.Fatalf("expected ErrBadBitmap for wrong length got %v", err)
+	}
+	if _, err := FromBitmap([]byte{0}, 0, 100); err != ErrBadBitmap {
+		t.Fatalf("expected ErrBadBitmap for zero chunk size got %v", err)
+	}
+	for _, chunkSize := range []int64{0, -16} {
+		if _, err := NewNakRegions(100).ToBitmap(chunkSize); err != ErrBadBitmap {
+			t.Fatalf("expected ErrBadBitmap encoding with chunk size %d got %v", chunkSize, err)
+		}
+	}
+}
+
+// Applies chunk-aligned ACKs and NAKs decoded from fuzz input and checks the bitmap agrees with the list:
+func FuzzNakRegions_Bitmap(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 3, 1, 1, 2, 5})
+	f.Add([]byte{1, 0, 62, 0, 10, 20, 1, 15, 16})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		const chunkSize = 16
+		const size = 1000
+		const chunks = (size + chunkSize - 1) / chunkSize
+
+		r := NewNakRegions(size)
+		for i := 0; i+2 < len(ops); i += 3 {
+			a, b := int64(ops[i+1])%chunks, int64(ops[i+2])%chunks
+			if a > b {
+				a, b = b, a
+			}
+			start, endEx := a*chunkSize, (b+1)*chunkSize
+			if endEx > size {
+				endEx = size
+			}
+			if ops[i]%2 == 0 {
+				r.Ack(start, endEx)
+			} else {
+				r.Nak(start, endEx)
+			}
+		}
+
+		bitmap, err := r.ToBitmap(chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := FromBitmap(bitmap, chunkSize, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmp(t, b.Naks(), r.Naks())
+	})
+}
+
+func TestNakRegions_NakedBytes(t *testing.T) {
+	r := NewNakRegions(100)
+	r.Ack(10, 20)
+	r.Ack(50, 100)
+	cases := []struct {
+		start, endEx, expected int64
+	}{
+		{0, 100, 40},
+		{0, 10, 10},
+		{10, 20, 0},
+		{5, 55, 35},
+		{60, 100, 0},
+	}
+	for _, c := range cases {
+		if actual := r.NakedBytes(c.start, c.endEx); actual != c.expected {
+			t.Fatalf("[%d, %d): expected %d got %d", c.start, c.endEx, c.expected, actual)
+		}
+	}
+}
+
+// [(0, 4) (10, 14)].isAcked(0, 8) => false
+func TestNakRegions_IsAckedPartialOverlap(t *testing.T) {
+	r := NewNakRegions(20)
+	r.Ack(4, 10)
+	r.Ack(14, 20)
+	if r.IsAcked(0, 8) || r.IsAcked(2, 12) || r.IsAcked(12, 20) {
+		t.Fatal("expected ranges overlapping a NAK not to be ACKed")
+	}
+	if !r.IsAcked(4, 10) || !r.IsAcked(14, 20) {
+		t.Fatal("expected ACKed ranges to be ACKed")
+	}
+}
+
+// [(0, 4) (10, 14) (18, 20)].isAcked(?, ?) at and across each boundary
+func TestNakRegions_IsAckedBoundaries(t *testing.T) {
+	r := NewNakRegions(20)
+	r.Ack(4, 10)
+	r.Ack(14, 18)
+	cmp(t, r.Naks(), []Region{{0, 4}, {10, 14}, {18, 20}})
+
+	cases := []struct {
+		start, endEx int64
+		expected     bool
+	}{
+		// Exactly an ACK, or touching the NAKs either side of it:
+		{4, 10, true},
+		{3, 10, false},
+		{4, 11, false},
+		{14, 18, true},
+		// A single byte either side of a boundary:
+		{3, 4, false},
+		{4, 5, true},
+		{9, 10, true},
+		{10, 11, false},
+		{17, 18, true},
+		{18, 19, false},
+		// Spanning several holes, or the ACK between two of them:
+		{0, 20, false},
+		{4, 18, false},
+		{5, 9, true},
+		// Empty ranges have nothing left to receive:
+		{10, 10, true},
+	}
+	for _, c := range cases {
+		if actual := r.IsAcked(c.start, c.endEx); actual != c.expected {
+			t.Fatalf("[%d, %d): expected %v got %v", c.start, c.endEx, c.expected, actual)
+		}
+	}
+}
+
+func TestNakRegions_IsAllAckedHoles(t *testing.T) {
+	r := NewNakRegions(20)
+	if r.IsAllAcked() {
+		t.Fatal("expected a full NAK not to be all ACKed")
+	}
+
+	// Each hole left keeps it from being all ACKed until the last is filled:
+	r.Ack(4, 10)
+	r.Ack(14, 18)
+	for _, k := range []Region{{10, 14}, {0, 4}, {18, 20}} {
+		if r.IsAllAcked() {
+			t.Fatalf("expected holes %v not to be all ACKed", r.Naks())
+		}
+		r.Ack(k.start, k.endEx)
+	}
+	if !r.IsAllAcked() || !r.IsAcked(0, 20) {
+		t.Fatalf("expected all ACKed got %v", r.Naks())
+	}
+
+	// A single byte NAKed again is enough to undo it:
+	r.Nak(19, 20)
+	if r.IsAllAcked() || r.IsAcked(0, 20) || !r.IsAcked(0, 19) {
+		t.Fatalf("expected the last byte missing got %v", r.Naks())
+	}
+}
+
+// Sorted, non-empty and neither touching nor overlapping:
+func checkNormalized(t *testing.T, r *NakRegions) {
+	for i, k := range r.naks {
+		if k.endEx <= k.start || (i > 0 && k.start <= r.naks[i-1].endEx) {
+			t.Fatalf("expected normalized NAKs got %v", r.naks)
+		}
+	}
+}
+
+func TestNakRegions_Coalesce(t *testing.T) {
+	r := &NakRegions{naks: []Region{{8, 10}, {0, 2}, {2, 3}, {5, 5}, {1, 4}, {9, 12}, {14, 15}}, size: 20}
+	r.Coalesce()
+	cmp(t, r.Naks(), []Region{{0, 4}, {8, 12}, {14, 15}})
+}
+
+func TestNakRegions_Squeeze(t *testing.T) {
+	r := &NakRegions{naks: []Region{{0, 10}, {12, 20}, {30, 40}, {41, 50}, {60, 70}}, size: 100}
+
+	// 1. Nothing changes within the limit:
+	if n := r.Squeeze(5); n != 0 {
+		t.Fatalf("expected nothing given up got %d", n)
+	}
+	cmp(t, r.Naks(), []Region{{0, 10}, {12, 20}, {30, 40}, {41, 50}, {60, 70}})
+
+	// 2. The smallest gaps close first:
+	if n := r.Squeeze(3); n != 3 {
+		t.Fatalf("expected 3 bytes given up got %d", n)
+	}
+	cmp(t, r.Naks(), []Region{{0, 20}, {30, 50}, {60, 70}})
+
+	// 3. Equal gaps close earliest first:
+	if n := r.Squeeze(2); n != 10 {
+		t.Fatalf("expected 10 bytes given up got %d", n)
+	}
+	cmp(t, r.Naks(), []Region{{0, 50}, {60, 70}})
+}
+
+func TestNakRegions_StaysNormalized(t *testing.T) {
+	const size = 200
+	rnd := rand.New(rand.NewSource(1))
+	r := NewNakRegions(size)
+	naked := make([]bool, size)
+	for i := range naked {
+		naked[i] = true
+	}
+	for i := 0; i < 5000; i++ {
+		start := rnd.Int63n(size)
+		endEx := start + rnd.Int63n(size-start+1)
+		nak := rnd.Intn(3) == 0
+		if nak {
+			r.Nak(start, endEx)
+		} else {
+			r.Ack(start, endEx)
+		}
+		for j := start; j < endEx; j++ {
+			naked[j] = nak
+		}
+		checkNormalized(t, r)
+
+		// Matches a byte by byte model:
+		for j := int64(0); j < size; j++ {
+			if r.IsAcked(j, j+1) == naked[j] {
+				t.Fatalf("byte %d after %v: expected NAK'd %v", j, Region{start, endEx}, naked[j])
+			}
+		}
+	}
+}
+
+// Offsets and lengths past what fits in 32 bits:
+func TestNakRegions_Beyond4GiB(t *testing.T) {
+	const size = 6 << 30
+	r := NewNakRegions(size)
+	r.Ack(0, 4<<30-1)
+	r.Ack(4<<30+1, 5<<30)
+	cmp(t, r.Naks(), []Region{{4<<30 - 1, 4<<30 + 1}, {5 << 30, size}})
+	if n := r.NakedBytes(0, size); n != 2+1<<30 {
+		t.Fatalf("expected %d NAK'd bytes got %d", int64(2+1<<30), n)
+	}
+	if next := r.NextNakRegion(4 << 30); next != 4<<30 {
+		t.Fatalf("expected next NAK at %d got %d", int64(4<<30), next)
+	}
+
+	r.Nak(3<<30, 4<<30)
+	cmp(t, r.Naks(), []Region{{3 << 30, 4<<30 + 1}, {5 << 30, size}})
+
+	// Region lists carry them intact:
+	buf, _ := encodeRegionList(r.Naks(), 1000)
+	naks, err := decodeRegionList(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, naks, r.Naks())
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	hashId := []byte("01234567")
+	msg := appendChecksum(dataMessage(hashId, 1234, []byte("hello world")))
+	if len(msg) != ProtocolDataMsgPrefixSize+11+dataChecksumSize {
+		t.Fatalf("unexpected message size %d", len(msg))
+	}
+	body, err := verifyChecksum(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, region, data, err := extractDataMessage(UDPMessage{Data: body})
+	if err != nil || region != 1234 || string(data) != "hello world" {
+		t.Fatalf("unexpected region %d data %q err %v", region, data, err)
+	}
+
+	// A flipped bit anywhere, including the region offset and checksum itself, is caught:
+	for i := range msg {
+		corrupt := append([]byte(nil), msg...)
+		corrupt[i] ^= 0x01
+		if _, err = verifyChecksum(corrupt); err != ErrBadChecksum {
+			t.Fatalf("byte %d: expected %s got %v", i, ErrBadChecksum, err)
+		}
+	}
+
+	if _, err = verifyChecksum(msg[:ProtocolDataMsgPrefixSize]); err != ErrMessageTooShort {
+		t.Fatalf("expected %s got %v", ErrMessageTooShort, err)
+	}
+}
@@ -0,0 +1,132 @@
+// ratefile.go
+package lancaster
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrBadRateFile = errors.New("bad rate file line; expected e.g. 5MB/s, max-rate 40Mbps or 08:00 rate 1MB/s")
+
+// Send rate limits in bytes per second; 0 leaves a limit as it is:
+type RateLimits struct {
+	Rate float64
+	// Range congestion control keeps the rate within:
+	MinRate float64
+	MaxRate float64
+}
+
+// Rate limits read from a rate file: those that always apply, overridden by whichever daily step is
+// current. Each line is a rate, optionally preceded by the limit it sets (rate, min-rate or max-rate)
+// and before that the time of day it applies from, e.g.
+//
+//	max-rate 40Mbps
+//	08:00 rate 5MB/s
+//	18:00 rate unlimited
+//
+// A step lasts until the next, the last running past midnight until the first. Lines starting with
+// '#' are ignored and a file without a rate is unlimited, so a file holding just a rate works as it
+// always has.
+type RateSchedule struct {
+	always RateLimits
+	steps  []rateStep
+}
+
+type rateStep struct {
+	// Since midnight:
+	at     time.Duration
+	limits RateLimits
+}
+
+func ParseRateSchedule(s string) (*RateSchedule, error) {
+	r := &RateSchedule{always: RateLimits{Rate: math.Inf(1)}}
+	steps := make(map[time.Duration]*RateLimits)
+	for _, line := range strings.Split(s, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		limits := &r.always
+		if strings.Contains(fields[0], ":") {
+			t, err := time.Parse("15:04", fields[0])
+			if err != nil {
+				return nil, ErrBadRateFile
+			}
+			at := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+			if steps[at] == nil {
+				steps[at] = &RateLimits{}
+			}
+			limits = steps[at]
+			fields = fields[1:]
+		}
+
+		limit := &limits.Rate
+		if len(fields) > 0 {
+			switch fields[0] {
+			case "rate":
+				fields = fields[1:]
+			case "min-rate":
+				limit, fields = &limits.MinRate, fields[1:]
+			case "max-rate":
+				limit, fields = &limits.MaxRate, fields[1:]
+			}
+		}
+		if len(fields) == 0 {
+			return nil, ErrBadRateFile
+		}
+		bytesPerSecond, err := ParseRate(strings.Join(fields, ""))
+		if err != nil {
+			return nil, err
+		}
+		if limit != &limits.Rate && math.IsInf(bytesPerSecond, 1) {
+			// Congestion control needs a range to work within:
+			return nil, ErrBadRateFile
+		}
+		*limit = bytesPerSecond
+	}
+
+	for at, limits := range steps {
+		r.steps = append(r.steps, rateStep{at: at, limits: *limits})
+	}
+	sort.Slice(r.steps, func(i, j int) bool {
+		return r.steps[i].at < r.steps[j].at
+	})
+	return r, nil
+}
+
+// Whether the limits change with the time of day:
+func (r *RateSchedule) Scheduled() bool {
+	return len(r.steps) > 0
+}
+
+// Limits in force at `t`, by its time of day in its own location:
+func (r *RateSchedule) At(t time.Time) RateLimits {
+	limits := r.always
+	if len(r.steps) == 0 {
+		return limits
+	}
+
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	// Before the first step of the day the last from the day before still applies:
+	step := r.steps[len(r.steps)-1]
+	for _, s := range r.steps {
+		if s.at > since {
+			break
+		}
+		step = s
+	}
+	if step.limits.Rate != 0 {
+		limits.Rate = step.limits.Rate
+	}
+	if step.limits.MinRate != 0 {
+		limits.MinRate = step.limits.MinRate
+	}
+	if step.limits.MaxRate != 0 {
+		limits.MaxRate = step.limits.MaxRate
+	}
+	return limits
+}
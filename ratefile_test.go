@@ -0,0 +1,57 @@
+package lancaster
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseRateSchedule(t *testing.T) {
+	// A bare rate, as rate files have always held:
+	r, err := ParseRateSchedule("5MB/s\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Scheduled() || r.At(time.Now()) != (RateLimits{Rate: 5000000}) {
+		t.Fatalf("unexpected limits %+v", r.At(time.Now()))
+	}
+	if r, err = ParseRateSchedule(""); err != nil || !math.IsInf(r.At(time.Now()).Rate, 1) {
+		t.Fatalf("expected an empty file to be unlimited got %+v %v", r, err)
+	}
+
+	r, err = ParseRateSchedule(`
+# Busy during the day:
+max-rate 40Mbps
+min-rate 1MB
+08:00 rate 1MB/s
+18:30 rate unlimited
+18:30 max-rate 80Mbps
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(hour, minute int) time.Time {
+		return time.Date(2020, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		at       time.Time
+		expected RateLimits
+	}{
+		// The evening step runs on past midnight:
+		{day(7, 59), RateLimits{Rate: math.Inf(1), MinRate: 1000000, MaxRate: 10000000}},
+		{day(8, 0), RateLimits{Rate: 1000000, MinRate: 1000000, MaxRate: 5000000}},
+		{day(18, 29), RateLimits{Rate: 1000000, MinRate: 1000000, MaxRate: 5000000}},
+		{day(18, 30), RateLimits{Rate: math.Inf(1), MinRate: 1000000, MaxRate: 10000000}},
+	}
+	for _, c := range cases {
+		if got := r.At(c.at); got != c.expected {
+			t.Fatalf("at %s expected %+v got %+v", c.at.Format("15:04"), c.expected, got)
+		}
+	}
+
+	for _, bad := range []string{"8am rate 1MB", "08:00", "max-rate", "min-rate unlimited", "rate fast"} {
+		if _, err := ParseRateSchedule(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// resume.go
+package lancaster
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+var ErrStaleProgress = errors.New("resume state does not match files on disk")
+
+// Sidecar in the download directory recording which regions are still missing, named by hashId:
+const progressFilePrefix = ".lancaster-progress-"
+
+type progressState struct {
+	HashId string     `json:"hashId"`
+	Size   int64      `json:"size"`
+	Naks   [][2]int64 `json:"naks"`
+}
+
+func progressPath(hashId []byte) string {
+	return progressFilePrefix + hex.EncodeToString(hashId)
+}
+
+func saveProgress(path string, hashId []byte, naks *NakRegions) error {
+	p := progressState{
+		HashId: hex.EncodeToString(hashId),
+		Size:   naks.size,
+		Naks:   make([][2]int64, 0, len(naks.naks)),
+	}
+	for _, k := range naks.naks {
+		p.Naks = append(p.Naks, [2]int64{k.start, k.endEx})
+	}
+	b, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+
+	// Replace atomically so an interruption never leaves a torn file behind:
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Loads NAK state saved for this transfer. Returns nil without error when there is nothing to resume.
+func loadProgress(path string, hashId []byte, size int64) (*NakRegions, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p := progressState{}
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	id, err := hex.DecodeString(p.HashId)
+	if err != nil || !bytes.Equal(id, hashId) || p.Size != size {
+		return nil, ErrStaleProgress
+	}
+
+	// NAKs must be ordered, non-overlapping and within the tarball:
+	r := &NakRegions{naks: make([]Region, 0, len(p.Naks)), size: size}
+	last := int64(0)
+	for _, k := range p.Naks {
+		if k[0] < last || k[1] <= k[0] || k[1] > size {
+			return nil, ErrStaleProgress
+		}
+		r.naks = append(r.naks, Region{start: k[0], endEx: k[1]})
+		last = k[1]
+	}
+	// Touching NAKs from older versions are merged:
+	r.Coalesce()
+	return r, nil
+}
+
+// Checks that every file holding already-received bytes is on disk at its full reserved size:
+func progressMatchesFiles(files []*TarballFile, naks *NakRegions) bool {
+	for _, tf := range files {
+		if tf.Mode&os.ModeType != 0 || tf.Size == 0 {
+			continue
+		}
+		if !hasAckedBytes(naks, tf.offset, tf.offset+tf.Size) {
+			continue
+		}
+		stat, err := os.Lstat(tf.LocalPath)
+		if err != nil || !stat.Mode().IsRegular() || stat.Size() != tf.Size {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAckedBytes(naks *NakRegions, start, endEx int64) bool {
+	for _, k := range naks.naks {
+		if k.endEx <= start || k.start >= endEx {
+			continue
+		}
+		if k.start <= start && endEx <= k.endEx {
+			return false
+		}
+		return true
+	}
+	return true
+}
+
+// Bytes already received according to the NAK state:
+func ackedBytes(naks *NakRegions) int64 {
+	n := naks.size
+	for _, k := range naks.naks {
+		n -= k.endEx - k.start
+	}
+	return n
+}
+
+// What had arrived of a regular file, relative to its start, before following its transfer to a new hashId:
+type carriedFile struct {
+	size     int64
+	mode     os.FileMode
+	hash     []byte
+	received []Region
+}
+
+// Received contents of each file by path, to keep once the same files turn up under a new hashId:
+func carryOver(files []*TarballFile, naks *NakRegions) map[string]carriedFile {
+	carried := make(map[string]carriedFile)
+	acks := naks.Acks()
+	for _, tf := range files {
+		if tf.Mode&os.ModeType != 0 || tf.LinkTarget != "" || tf.Size == 0 {
+			continue
+		}
+		received := []Region(nil)
+		for _, a := range acks {
+			start, endEx := a.start, a.endEx
+			if start < tf.offset {
+				start = tf.offset
+			}
+			if endEx > tf.offset+tf.Size {
+				endEx = tf.offset + tf.Size
+			}
+			if start < endEx {
+				received = append(received, Region{start - tf.offset, endEx - tf.offset})
+			}
+		}
+		if received != nil {
+			carried[tf.Path] = carriedFile{size: tf.Size, mode: tf.Mode, hash: tf.Hash, received: received}
+		}
+	}
+	return carried
+}
+
+// ACKs what was carried over of files that are unchanged and still on disk at their full size,
+// returning how many bytes that adds:
+func reuseCarried(files []*TarballFile, naks *NakRegions, carried map[string]carriedFile) int64 {
+	n := int64(0)
+	for _, tf := range files {
+		cf, ok := carried[tf.Path]
+		if !ok || tf.LinkTarget != "" || cf.size != tf.Size || cf.mode != tf.Mode || !bytes.Equal(cf.hash, tf.Hash) {
+			continue
+		}
+		stat, err := os.Lstat(tf.LocalPath)
+		if err != nil || !stat.Mode().IsRegular() || stat.Size() != tf.Size {
+			continue
+		}
+		for _, r := range cf.received {
+			n += naks.NakedBytes(tf.offset+r.start, tf.offset+r.endEx)
+			naks.Ack(tf.offset+r.start, tf.offset+r.endEx)
+		}
+	}
+	return n
+}
+
+// ACKs the contents of regular files already on disk at their full size whose hash matches the one
+// they are served with, returning how many bytes that adds. Each file's trailing NUL is left to be
+// asked for so the file is still opened and given its mode. Files without a hash are left to download.
+func ackMatching(files []*TarballFile, naks *NakRegions) (int64, error) {
+	n := int64(0)
+	for _, tf := range files {
+		if tf.Mode&os.ModeType != 0 || tf.LinkTarget != "" || tf.Size == 0 || tf.Hash == nil {
+			continue
+		}
+		naked := naks.NakedBytes(tf.offset, tf.offset+tf.Size)
+		if naked == 0 {
+			continue
+		}
+		stat, err := os.Lstat(tf.LocalPath)
+		if err != nil || !stat.Mode().IsRegular() || stat.Size() != tf.Size {
+			continue
+		}
+		h, err := hashFile(tf.LocalPath, tf.hashAlgorithm)
+		if err != nil {
+			return n, err
+		}
+		if !bytes.Equal(h, tf.Hash) {
+			continue
+		}
+		naks.Ack(tf.offset, tf.offset+tf.Size)
+		n += naked
+	}
+	return n, nil
+}
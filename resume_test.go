@@ -0,0 +1,201 @@
+package lancaster
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgress_RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	path := filepath.Join(dir, progressPath(hashId))
+	naks := NewNakRegions(100)
+	naks.Ack(0, 30)
+	naks.Ack(50, 60)
+	if err = saveProgress(path, hashId, naks); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadProgress(path, hashId, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, loaded.Naks(), []Region{{30, 50}, {60, 100}})
+	if ackedBytes(loaded) != 40 {
+		t.Fatalf("expected 40 acked bytes got %d", ackedBytes(loaded))
+	}
+
+	// Another transfer or size is stale:
+	if _, err = loadProgress(path, []byte{8, 7, 6, 5, 4, 3, 2, 1}, 100); err != ErrStaleProgress {
+		t.Fatalf("expected %v got %v", ErrStaleProgress, err)
+	}
+	if _, err = loadProgress(path, hashId, 200); err != ErrStaleProgress {
+		t.Fatalf("expected %v got %v", ErrStaleProgress, err)
+	}
+
+	// Nothing saved is nothing to resume:
+	loaded, err = loadProgress(filepath.Join(dir, "missing"), hashId, 100)
+	if loaded != nil || err != nil {
+		t.Fatalf("expected nothing to resume got %v %v", loaded, err)
+	}
+}
+
+func TestProgress_BadNaks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "progress")
+	for _, naks := range []string{`[[50,60],[10,20]]`, `[[10,10]]`, `[[90,110]]`} {
+		err = ioutil.WriteFile(path, []byte(`{"hashId":"0102030405060708","size":100,"naks":`+naks+`}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadProgress(path, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 100); err != ErrStaleProgress {
+			t.Fatalf("%s: expected %v got %v", naks, ErrStaleProgress, err)
+		}
+	}
+}
+
+func TestProgress_MatchesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	if err = ioutil.WriteFile(a, make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []*TarballFile{
+		&TarballFile{Path: "a", LocalPath: a, Size: 10, offset: 0},
+		&TarballFile{Path: "b", LocalPath: b, Size: 10, offset: 11},
+	}
+
+	// Only 'a' has received bytes and it is complete on disk:
+	naks := NewNakRegions(22)
+	naks.Ack(0, 5)
+	if !progressMatchesFiles(files, naks) {
+		t.Fatal("expected progress to match files")
+	}
+
+	// 'b' has received bytes but is missing:
+	naks.Ack(12, 13)
+	if progressMatchesFiles(files, naks) {
+		t.Fatal("expected missing file to invalidate progress")
+	}
+
+	// 'b' is there but the wrong size:
+	if err = ioutil.WriteFile(b, make([]byte, 3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if progressMatchesFiles(files, naks) {
+		t.Fatal("expected short file to invalidate progress")
+	}
+}
+
+func TestCarryOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-carry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	c := filepath.Join(dir, "c")
+	for _, p := range []string{a, b, c} {
+		if err = ioutil.WriteFile(p, make([]byte, 10), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []*TarballFile{
+		&TarballFile{Path: "a", LocalPath: a, Size: 10, Hash: []byte("a"), offset: 0},
+		&TarballFile{Path: "b", LocalPath: b, Size: 10, Hash: []byte("b"), offset: 11},
+		&TarballFile{Path: "c", LocalPath: c, Size: 10, Hash: []byte("c"), offset: 22},
+	}
+	naks := NewNakRegions(33)
+	naks.Ack(3, 16)
+	naks.Ack(22, 33)
+
+	// 1. Received bytes are noted relative to each file, leaving out the NULs between them:
+	carried := carryOver(files, naks)
+	cmp(t, carried["a"].received, []Region{{3, 10}})
+	cmp(t, carried["b"].received, []Region{{0, 5}})
+	cmp(t, carried["c"].received, []Region{{0, 10}})
+
+	// 2. Once a file is laid out in front, unchanged files keep theirs at their new offsets; 'c' changed:
+	moved := []*TarballFile{
+		&TarballFile{Path: "0", LocalPath: filepath.Join(dir, "0"), Size: 4, offset: 0},
+		&TarballFile{Path: "a", LocalPath: a, Size: 10, Hash: []byte("a"), offset: 5},
+		&TarballFile{Path: "b", LocalPath: b, Size: 10, Hash: []byte("b"), offset: 16},
+		&TarballFile{Path: "c", LocalPath: c, Size: 10, Hash: []byte("C"), offset: 27},
+	}
+	naks = NewNakRegions(38)
+	if n := reuseCarried(moved, naks, carried); n != 12 {
+		t.Fatalf("expected 12 bytes kept got %d", n)
+	}
+	cmp(t, naks.Naks(), []Region{{0, 8}, {15, 16}, {21, 38}})
+
+	// 3. Nothing is kept of a file no longer on disk at its full size:
+	if err = ioutil.WriteFile(b, make([]byte, 3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	naks = NewNakRegions(38)
+	if n := reuseCarried(moved, naks, carried); n != 7 {
+		t.Fatalf("expected 7 bytes kept got %d", n)
+	}
+}
+
+func TestAckMatching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 'a' and 'b' match the files served, 'c' changed since and 'd' isn't there yet:
+	served := map[string]string{"a": "unchanged a", "b": "unchanged b", "c": "new version", "d": "brand new d"}
+	onDisk := map[string]string{"a": "unchanged a", "b": "unchanged b", "c": "old version"}
+	for name, contents := range onDisk {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []*TarballFile(nil)
+	offset := int64(0)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		h := sha256.Sum256([]byte(served[name]))
+		size := int64(len(served[name]))
+		files = append(files, &TarballFile{Path: name, LocalPath: filepath.Join(dir, name), Size: size, Hash: h[:], offset: offset})
+		offset += size + 1
+	}
+
+	naks := NewNakRegions(offset)
+	n, err := ackMatching(files, naks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 22 {
+		t.Fatalf("expected 22 bytes kept got %d", n)
+	}
+	// Only the NULs after 'a' and 'b' remain of them:
+	cmp(t, naks.Naks(), []Region{{11, 12}, {23, offset}})
+
+	// Files already ACKed aren't hashed again:
+	if n, err = ackMatching(files, naks); err != nil || n != 0 {
+		t.Fatalf("expected nothing more kept got %d %v", n, err)
+	}
+}
@@ -0,0 +1,128 @@
+// rtt.go
+package lancaster
+
+import (
+	"time"
+)
+
+const minResendTimeout = 50 * time.Millisecond
+const maxResendTimeout = 5 * time.Second
+
+// Smoothed round-trip time estimator in the style of TCP's SRTT/RTTVAR (RFC 6298).
+type rttEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	valid  bool
+}
+
+func (e *rttEstimator) sample(r time.Duration) {
+	if !e.valid {
+		e.srtt = r
+		e.rttvar = r / 2
+		e.valid = true
+		return
+	}
+
+	delta := e.srtt - r
+	if delta < 0 {
+		delta = -delta
+	}
+	e.rttvar = (3*e.rttvar + delta) / 4
+	e.srtt = (7*e.srtt + r) / 8
+}
+
+// Smoothed RTT or 0 if nothing has been measured yet:
+func (e *rttEstimator) RTT() time.Duration {
+	return e.srtt
+}
+
+// Resend timeout of srtt + 4*rttvar clamped to sane bounds; the fixed resendTimeout until measured.
+func (e *rttEstimator) timeout() time.Duration {
+	if !e.valid {
+		return resendTimeout
+	}
+
+	t := e.srtt + 4*e.rttvar
+	if t < minResendTimeout {
+		t = minResendTimeout
+	}
+	if t > maxResendTimeout {
+		t = maxResendTimeout
+	}
+	return t
+}
+
+// Most NAK regions we keep send times for at once:
+const maxTrackedRegions = 64
+
+// Remembers when the start of each NAK region was first requested so the arrival of its data yields
+// an RTT sample. Regions requested more than once are ambiguous and never sampled (Karn's algorithm).
+type regionSendTimes struct {
+	sent map[int64]time.Time
+}
+
+func newRegionSendTimes() *regionSendTimes {
+	return &regionSendTimes{sent: make(map[int64]time.Time)}
+}
+
+func (r *regionSendTimes) requested(start int64, now time.Time) {
+	if t, ok := r.sent[start]; ok {
+		if !t.IsZero() {
+			// Asked again before it arrived; the eventual arrival can't be attributed to either ask:
+			r.sent[start] = time.Time{}
+		}
+		return
+	}
+	if len(r.sent) >= maxTrackedRegions {
+		return
+	}
+	r.sent[start] = now
+}
+
+// Returns the round trip for data arriving at `start` if it was requested unambiguously:
+func (r *regionSendTimes) arrived(start int64, now time.Time) (time.Duration, bool) {
+	t, ok := r.sent[start]
+	if !ok {
+		return 0, false
+	}
+	delete(r.sent, start)
+	if t.IsZero() {
+		return 0, false
+	}
+	return now.Sub(t), true
+}
+
+// Forgets regions that are no longer outstanding:
+func (r *regionSendTimes) prune(naks *NakRegions) {
+	for start := range r.sent {
+		if naks.IsAcked(start, start+1) {
+			delete(r.sent, start)
+		}
+	}
+}
+
+// Send time of the outstanding metadata request; answered once, ambiguous if re-asked (Karn's algorithm).
+type controlSendTime struct {
+	at        time.Time
+	pending   bool
+	ambiguous bool
+}
+
+func (c *controlSendTime) requested(now time.Time) {
+	if c.pending {
+		c.ambiguous = true
+		return
+	}
+	c.at, c.pending, c.ambiguous = now, true, false
+}
+
+func (c *controlSendTime) answered(now time.Time) (time.Duration, bool) {
+	if !c.pending {
+		return 0, false
+	}
+	c.pending = false
+	if c.ambiguous {
+		return 0, false
+	}
+	return now.Sub(c.at), true
+}
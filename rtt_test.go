@@ -0,0 +1,90 @@
+package lancaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimator_Initial(t *testing.T) {
+	e := rttEstimator{}
+	if e.timeout() != resendTimeout {
+		t.Fatalf("expected %v before any sample got %v", resendTimeout, e.timeout())
+	}
+
+	e.sample(100 * time.Millisecond)
+	if e.RTT() != 100*time.Millisecond {
+		t.Fatalf("expected srtt 100ms got %v", e.RTT())
+	}
+	// srtt + 4 * (srtt / 2):
+	if e.timeout() != 300*time.Millisecond {
+		t.Fatalf("expected timeout 300ms got %v", e.timeout())
+	}
+}
+
+func TestRTTEstimator_Converges(t *testing.T) {
+	e := rttEstimator{}
+	for i := 0; i < 100; i++ {
+		e.sample(20 * time.Millisecond)
+	}
+	if e.RTT() != 20*time.Millisecond {
+		t.Fatalf("expected srtt 20ms got %v", e.RTT())
+	}
+	// Variance decays so the timeout bottoms out at the floor:
+	if e.timeout() != minResendTimeout {
+		t.Fatalf("expected timeout %v got %v", minResendTimeout, e.timeout())
+	}
+
+	e.sample(time.Minute)
+	if e.timeout() != maxResendTimeout {
+		t.Fatalf("expected timeout capped at %v got %v", maxResendTimeout, e.timeout())
+	}
+}
+
+func TestRegionSendTimes(t *testing.T) {
+	r := newRegionSendTimes()
+	t0 := time.Now()
+
+	r.requested(0, t0)
+	r.requested(100, t0)
+	// Asked again; ambiguous:
+	r.requested(100, t0.Add(time.Second))
+
+	d, ok := r.arrived(0, t0.Add(30*time.Millisecond))
+	if !ok || d != 30*time.Millisecond {
+		t.Fatalf("expected 30ms sample got %v %v", d, ok)
+	}
+	if _, ok = r.arrived(0, t0.Add(40*time.Millisecond)); ok {
+		t.Fatal("expected only one sample per request")
+	}
+	if _, ok = r.arrived(100, t0.Add(time.Second)); ok {
+		t.Fatal("expected no sample for a region requested twice")
+	}
+}
+
+func TestControlSendTime(t *testing.T) {
+	c := controlSendTime{}
+	t0 := time.Now()
+
+	if _, ok := c.answered(t0); ok {
+		t.Fatal("expected no sample without a request")
+	}
+
+	c.requested(t0)
+	d, ok := c.answered(t0.Add(20 * time.Millisecond))
+	if !ok || d != 20*time.Millisecond {
+		t.Fatalf("expected 20ms sample got %v %v", d, ok)
+	}
+
+	// Re-asked before the answer; ambiguous:
+	c.requested(t0)
+	c.requested(t0.Add(time.Second))
+	if _, ok = c.answered(t0.Add(time.Second)); ok {
+		t.Fatal("expected no sample for a repeated request")
+	}
+
+	// Next request measures afresh:
+	c.requested(t0)
+	if _, ok = c.answered(t0.Add(time.Millisecond)); !ok {
+		t.Fatal("expected sample after ambiguity is cleared")
+	}
+}
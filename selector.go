@@ -0,0 +1,83 @@
+// selector.go
+package lancaster
+
+import "math/rand"
+
+// Chooses which region the server sends next. Implementations are called with the server's NAK lock
+// held and must not retain `naks`.
+type RegionSelector interface {
+	// Returns the offset to send from next given the outstanding NAKs and the offset just past the last
+	// region sent, or -1 when nothing is outstanding.
+	Next(naks *NakRegions, cursor int64) int64
+}
+
+// Sends NAKed regions in offset order, wrapping around at the end; the default.
+type SequentialSelector struct{}
+
+func (SequentialSelector) Next(naks *NakRegions, cursor int64) int64 {
+	return naks.NextNakRegion(cursor)
+}
+
+// Finishes the NAKed region being sent then moves on to the largest outstanding one, so the biggest
+// holes across clients shrink first. Ties go to the earliest region.
+type LargestNakFirstSelector struct{}
+
+func (LargestNakFirstSelector) Next(naks *NakRegions, cursor int64) int64 {
+	best := Region{start: -1}
+	for _, k := range naks.Naks() {
+		if k.start <= cursor && cursor < k.endEx {
+			return cursor
+		}
+		if k.endEx-k.start > best.endEx-best.start {
+			best = k
+		}
+	}
+	return best.start
+}
+
+// Sends one region from each NAKed hole in turn rather than finishing a hole before moving on, so
+// clients missing different holes all see progress every round. Relies on the server ACKing what it
+// sends: the hole just sent from then starts at the cursor and is passed over until the others have
+// had their turn.
+type InterleavedSelector struct{}
+
+func (InterleavedSelector) Next(naks *NakRegions, cursor int64) int64 {
+	regions := naks.Naks()
+	if len(regions) == 0 {
+		return -1
+	}
+	for _, k := range regions {
+		if k.start > cursor {
+			return k.start
+		}
+	}
+	// Wrap around to the first hole:
+	return regions[0].start
+}
+
+// Finishes the NAKed region being sent then moves on to a randomly chosen outstanding one, so servers
+// and clients sharing a group don't all converge on the same hole.
+type RandomSelector struct {
+	// Source of choices; the shared math/rand source when nil:
+	Rand *rand.Rand
+}
+
+func (s RandomSelector) Next(naks *NakRegions, cursor int64) int64 {
+	regions := naks.Naks()
+	if len(regions) == 0 {
+		return -1
+	}
+	for _, k := range regions {
+		if k.start <= cursor && cursor < k.endEx {
+			return cursor
+		}
+	}
+	return regions[s.intn(len(regions))].start
+}
+
+func (s RandomSelector) intn(n int) int {
+	if s.Rand == nil {
+		return rand.Intn(n)
+	}
+	return s.Rand.Intn(n)
+}
@@ -0,0 +1,161 @@
+package lancaster
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func newSelectorNaks(size int64, naks ...Region) *NakRegions {
+	r := NewNakRegions(size)
+	r.Ack(0, size)
+	for _, k := range naks {
+		r.Nak(k.start, k.endEx)
+	}
+	return r
+}
+
+func TestSequentialSelector(t *testing.T) {
+	sel := SequentialSelector{}
+	naks := newSelectorNaks(100, Region{10, 20}, Region{50, 80})
+
+	cases := []struct {
+		cursor   int64
+		expected int64
+	}{
+		{0, 10},
+		{15, 15},
+		{20, 50},
+		{60, 60},
+		// Wraps around:
+		{90, 10},
+	}
+	for _, c := range cases {
+		if actual := sel.Next(naks, c.cursor); actual != c.expected {
+			t.Fatalf("cursor %d: expected %d got %d", c.cursor, c.expected, actual)
+		}
+	}
+
+	if actual := sel.Next(newSelectorNaks(100), 0); actual != -1 {
+		t.Fatalf("expected -1 when all ACKed got %d", actual)
+	}
+}
+
+func TestLargestNakFirstSelector(t *testing.T) {
+	sel := LargestNakFirstSelector{}
+	naks := newSelectorNaks(100, Region{10, 20}, Region{30, 40}, Region{50, 80})
+
+	cases := []struct {
+		cursor   int64
+		expected int64
+	}{
+		{0, 50},
+		// Finish the region in progress:
+		{15, 15},
+		{20, 50},
+		{85, 50},
+	}
+	for _, c := range cases {
+		if actual := sel.Next(naks, c.cursor); actual != c.expected {
+			t.Fatalf("cursor %d: expected %d got %d", c.cursor, c.expected, actual)
+		}
+	}
+
+	// Ties go to the earliest region:
+	naks = newSelectorNaks(100, Region{60, 70}, Region{10, 20})
+	if actual := sel.Next(naks, 0); actual != 10 {
+		t.Fatalf("expected 10 got %d", actual)
+	}
+
+	if actual := sel.Next(newSelectorNaks(100), 0); actual != -1 {
+		t.Fatalf("expected -1 when all ACKed got %d", actual)
+	}
+}
+
+func TestInterleavedSelector(t *testing.T) {
+	sel := InterleavedSelector{}
+	naks := newSelectorNaks(100, Region{10, 20}, Region{30, 40}, Region{50, 80})
+
+	cases := []struct {
+		cursor   int64
+		expected int64
+	}{
+		{0, 10},
+		// Move on to the next hole rather than finishing the one in progress:
+		{15, 30},
+		{35, 50},
+		// Wraps around:
+		{60, 10},
+		{90, 10},
+	}
+	for _, c := range cases {
+		if actual := sel.Next(naks, c.cursor); actual != c.expected {
+			t.Fatalf("cursor %d: expected %d got %d", c.cursor, c.expected, actual)
+		}
+	}
+
+	// Sending a region at a time takes turns between the holes:
+	order := []int64(nil)
+	for cursor := int64(0); !naks.IsAllAcked(); {
+		next := sel.Next(naks, cursor)
+		naks.Ack(next, next+5)
+		order = append(order, next)
+		cursor = next + 5
+	}
+	expected := []int64{10, 30, 50, 15, 35, 55, 60, 65, 70, 75}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, order)
+	}
+	for i := range order {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v got %v", expected, order)
+		}
+	}
+
+	if actual := sel.Next(newSelectorNaks(100), 0); actual != -1 {
+		t.Fatalf("expected -1 when all ACKed got %d", actual)
+	}
+}
+
+type fixedSelector int64
+
+func (f fixedSelector) Next(naks *NakRegions, cursor int64) int64 {
+	return int64(f)
+}
+
+func TestNewServer_DefaultSelector(t *testing.T) {
+	s := NewServer(nil, &VirtualTarballReader{}, ServerOptions{})
+	if _, ok := s.options.Selector.(SequentialSelector); !ok {
+		t.Fatalf("expected SequentialSelector got %T", s.options.Selector)
+	}
+
+	s = NewServer(nil, &VirtualTarballReader{}, ServerOptions{Selector: fixedSelector(42)})
+	if s.options.Selector.Next(nil, 0) != 42 {
+		t.Fatal("expected custom selector to be kept")
+	}
+}
+
+func TestRandomSelector(t *testing.T) {
+	sel := RandomSelector{Rand: rand.New(rand.NewSource(1))}
+	naks := newSelectorNaks(100, Region{10, 20}, Region{30, 40}, Region{50, 80})
+
+	// Finish the region in progress:
+	if actual := sel.Next(naks, 35); actual != 35 {
+		t.Fatalf("expected 35 got %d", actual)
+	}
+
+	seen := map[int64]bool{}
+	for i := 0; i < 100; i++ {
+		next := sel.Next(naks, 90)
+		if next != 10 && next != 30 && next != 50 {
+			t.Fatalf("expected the start of a NAKed region got %d", next)
+		}
+		seen[next] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected every region to be picked eventually got %v", seen)
+	}
+
+	if actual := sel.Next(newSelectorNaks(100), 0); actual != -1 {
+		t.Fatalf("expected -1 when all ACKed got %d", actual)
+	}
+}
@@ -0,0 +1,73 @@
+// +build linux
+
+package lancaster
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const zeroCopySupported = true
+
+// Sends `hdr` followed by `n` bytes of `f` at `offset` as a single datagram without copying the file
+// contents through userspace. The header is queued as a corked datagram with MSG_MORE and sendfile
+// appends the file pages to it.
+func sendFileDatagram(conn *net.UDPConn, addr *net.UDPAddr, hdr []byte, f *os.File, offset int64, n int) (int, error) {
+	sa := syscall.Sockaddr(nil)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	src := int(f.Fd())
+	queued := false
+	sent := 0
+	var serr error
+	err = rawConn.Write(func(fd uintptr) bool {
+		// Only queue the header once even if sendfile has to wait for buffer space:
+		if !queued {
+			serr = syscall.Sendto(int(fd), hdr, syscall.MSG_MORE, sa)
+			if serr == syscall.EAGAIN {
+				return false
+			}
+			if serr != nil {
+				return true
+			}
+			queued = true
+		}
+
+		off := offset
+		sent, serr = syscall.Sendfile(int(fd), src, &off, n)
+		return serr != syscall.EAGAIN
+	})
+	if queued && (err != nil || serr != nil || sent < n) {
+		// Whatever is still corked would be merged into the next datagram; send it on its own:
+		flushCork(rawConn, sa)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, os.NewSyscallError("sendfile", serr)
+	}
+	return len(hdr) + sent, nil
+}
+
+// Ends a corked datagram with an empty send without MSG_MORE. Receivers ignore a header without
+// contents and keep what did arrive of short ones:
+func flushCork(rawConn syscall.RawConn, sa syscall.Sockaddr) {
+	rawConn.Write(func(fd uintptr) bool {
+		return syscall.Sendto(int(fd), nil, 0, sa) != syscall.EAGAIN
+	})
+}
@@ -0,0 +1,168 @@
+// +build linux
+
+package lancaster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func newLoopbackPair(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return send, recv
+}
+
+func newPayloadFile(t testing.TB, size int) *os.File {
+	f, err := ioutil.TempFile("", "lancaster-sendfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	if _, err = f.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestSendFileDatagram(t *testing.T) {
+	send, recv := newLoopbackPair(t)
+	defer send.Close()
+	defer recv.Close()
+
+	f := newPayloadFile(t, 4096)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	hdr := dataMessage(hashId, 100, nil)
+	n, err := sendFileDatagram(send, recv.LocalAddr().(*net.UDPAddr), hdr, f, 100, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(hdr)+1000 {
+		t.Fatalf("expected %d bytes sent got %d", len(hdr)+1000, n)
+	}
+
+	buf := make([]byte, 65536)
+	m, _, err := recv.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Must arrive as one well-formed data message:
+	msgHashId, region, data, err := extractDataMessage(UDPMessage{Data: buf[:m]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compareHashes(msgHashId, hashId) != 0 || region != 100 {
+		t.Fatalf("bad header; hashId = %v region = %d", msgHashId, region)
+	}
+	expected := make([]byte, 1000)
+	f.ReadAt(expected, 100)
+	if !bytes.Equal(data, expected) {
+		t.Fatal("payload mismatch")
+	}
+}
+
+func TestSendFileDatagram_FlushesHeaderOnError(t *testing.T) {
+	send, recv := newLoopbackPair(t)
+	defer send.Close()
+	defer recv.Close()
+
+	// A closed file fails sendfile after the header was queued:
+	f := newPayloadFile(t, 4096)
+	defer os.Remove(f.Name())
+	f.Close()
+
+	addr := recv.LocalAddr().(*net.UDPAddr)
+	hdr := dataMessage([]byte{1, 2, 3, 4, 5, 6, 7, 8}, 100, nil)
+	if _, err := sendFileDatagram(send, addr, hdr, f, 100, 1000); err == nil {
+		t.Fatal("expected sendfile from a closed file to fail")
+	}
+	next := []byte("next datagram")
+	if _, err := send.WriteToUDP(next, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The header goes out alone rather than in front of the next datagram:
+	buf := make([]byte, 65536)
+	for _, expected := range [][]byte{hdr, next} {
+		m, _, err := recv.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:m], expected) {
+			t.Fatalf("expected %q got %q", expected, buf[:m])
+		}
+	}
+}
+
+func drain(conn *net.UDPConn) {
+	buf := make([]byte, 65536)
+	for {
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
+
+const benchRegionSize = 60000
+
+func BenchmarkSendData_Copy(b *testing.B) {
+	send, recv := newLoopbackPair(b)
+	defer send.Close()
+	defer recv.Close()
+	go drain(recv)
+
+	f := newPayloadFile(b, benchRegionSize)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hashId := make([]byte, HashSize)
+	addr := recv.LocalAddr().(*net.UDPAddr)
+	b.SetBytes(benchRegionSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := make([]byte, benchRegionSize)
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := send.WriteToUDP(dataMessage(hashId, 0, buf), addr); err != nil && !isENOBUFS(err) {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendData_Sendfile(b *testing.B) {
+	send, recv := newLoopbackPair(b)
+	defer send.Close()
+	defer recv.Close()
+	go drain(recv)
+
+	f := newPayloadFile(b, benchRegionSize)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hashId := make([]byte, HashSize)
+	addr := recv.LocalAddr().(*net.UDPAddr)
+	b.SetBytes(benchRegionSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sendFileDatagram(send, addr, dataMessage(hashId, 0, nil), f, 0, benchRegionSize); err != nil && !isENOBUFS(err) {
+			b.Fatal(err)
+		}
+	}
+}
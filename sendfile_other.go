@@ -0,0 +1,14 @@
+// +build !linux
+
+package lancaster
+
+import (
+	"net"
+	"os"
+)
+
+const zeroCopySupported = false
+
+func sendFileDatagram(conn *net.UDPConn, addr *net.UDPAddr, hdr []byte, f *os.File, offset int64, n int) (int, error) {
+	return 0, ErrZeroCopyUnsupported
+}
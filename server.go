@@ -1,20 +1,44 @@
-package main
+package lancaster
 
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 import "github.com/dustin/go-humanize"
 import "golang.org/x/time/rate"
+import "github.com/klauspost/reedsolomon"
 
 type empty struct{}
 
+const DefaultAnnounceInterval = 1 * time.Second
+
+// Discovery requests arriving this soon after an announcement are already answered by it:
+const discoveryHoldoff = 100 * time.Millisecond
+
+var (
+	ErrAppendUnsupported = errors.New("files can't be added to a compressed, FEC or shared transfer")
+	ErrNotServing        = errors.New("server is not running")
+	ErrNoRateRange       = errors.New("min and max rates only apply under congestion control")
+)
+
 type Server struct {
 	m  *Multicast
 	tb *VirtualTarballReader
@@ -23,11 +47,24 @@ type Server struct {
 
 	hashId []byte
 
-	announceTicker <-chan time.Time
-	announceMsg    []byte
+	// Per-transfer log when LogDir is set:
+	transferLogFile *os.File
+	log             *Logger
+
+	announceTicker   <-chan time.Time
+	announceMsg      []byte
+	announceListMsgs [][]byte
+	// Only set with ServerOptions.Source:
+	announceSourceMsg []byte
+	// Where data goes when this transfer has a data group of its own:
+	dataAddr             *net.UDPAddr
+	announceDataGroupMsg []byte
+	lastAnnounce         time.Time
 
 	metadataHeader   []byte
 	metadataSections [][]byte
+	// Data regions are sealed with this when encrypting; fresh whenever the files are laid out:
+	salt []byte
 
 	packetsSentSinceLastAck int
 	allowSend               chan empty
@@ -39,6 +76,14 @@ type Server struct {
 	regionSize  uint16
 	regionCount int64
 
+	// Byte stream cut into data regions; the tarball itself unless compressed:
+	stream     io.ReaderAt
+	streamSize int64
+
+	// Parity regions waiting to be sent ahead of further data when FEC is enabled:
+	fecEncoder reedsolomon.Encoder
+	parityMsgs [][]byte
+
 	rate          int
 	lastSendTime  time.Time
 	lastAckTime   time.Time
@@ -46,123 +91,813 @@ type Server struct {
 	bytesSentLast int64
 	timeLast      time.Time
 	lastRate      float64
+
+	retransmitCapped bool
+	// Regions lately NAK'd, to ignore repeats of:
+	recentNaks recentRegions
+
+	// Receivers heard from recently:
+	clients *clientTracker
+
+	// Files to add, handed from AddFiles to Run's loop:
+	additions chan addition
+	// Whether tb replaced the reader the server was given, so is the server's to close:
+	ownsTb bool
+	// IDs served before files were added, by hex, and when clients asking for each were last told the
+	// current one:
+	replaced map[string]time.Time
+
+	startTime time.Time
+	// Closed when Run returns to stop the send loop:
+	stop chan empty
+	// Receives the error the send loop can't carry on from, e.g. a source file changing:
+	failed chan error
+
+	metrics *Metrics
+	events  *EventLog
+
+	// Adapts the send rate to observed loss when enabled; guarded by nextLock:
+	congestion *congestionController
+
+	// Set when sharing a Multicast with other transfers; see MultiServer:
+	shared bool
+	// Control messages for this transfer, already opened, when shared:
+	control chan UDPMessage
+	// Fraction of the configured rate this transfer may use:
+	share float64
+	// Entries for the combined announcement; just this transfer when nil:
+	listed []AnnouncementEntry
+	// Closed by Stop to make Run return:
+	quit     chan empty
+	quitOnce sync.Once
+	// Non-zero while Pause holds back data; control messages are still answered:
+	paused int32
+
+	// Each refresh's progress goes to every subscriber in turn; printing the bandwidth line is the first:
+	subscribers []func(ProgressEvent)
+	progress    progressEvents
+
+	// Where Run's loop answers Status:
+	statusRequests chan chan ServerStatus
+	// Limits from the rate file and those last applied from it, followed as the time of day changes:
+	schedule  *RateSchedule
+	scheduled RateLimits
 }
 
 type ServerOptions struct {
 	RefreshRate time.Duration
+	// Directory to write a log file per transfer, named by hashId:
+	LogDir string
+	// Caps the data send rate in bytes per second; 0 keeps the default pace and +Inf is unlimited:
+	Rate float64
+	// File containing the data send rate or a schedule of limits (see RateSchedule), re-read on SIGHUP:
+	RateFile string
+	// Send file contents with sendfile where possible instead of copying through userspace:
+	ZeroCopy bool
+	// Content bytes carried by each data message; as many as fit in a datagram when 0. Clients follow
+	// whatever the server picks:
+	ChunkSize int
+	// Size chunks to fit the MTU of the interfaces sending data instead, overriding ChunkSize:
+	DiscoverChunkSize bool
+	// Trail each data message with a CRC-32C so clients drop corrupted ones; turns off ZeroCopy:
+	Checksum bool
+	// Stop honoring NAKs once this many multiples of the content size have been sent; 0 is unlimited:
+	MaxRetransmitRatio float64
+	// Also send a combined announcement listing every served transfer:
+	AnnounceList bool
+	// Human-readable name for the transfer in combined announcements:
+	Name string
+	// Picks the next region to send; SequentialSelector when nil:
+	Selector RegionSelector
+	// Compresses the tarball stream before cutting it into data regions:
+	Compression Compression
+	// Cycle through all data regions continuously so late joiners complete without NAKing:
+	Carousel bool
+	// How often to announce the transfer; DefaultAnnounceInterval when 0:
+	AnnounceInterval time.Duration
+	// Reed-Solomon parity sent along with data regions so clients can repair losses without NAKing:
+	FEC FEC
+	// Signs announcements and the metadata header so clients can reject rogue servers:
+	SigningKey ed25519.PrivateKey
+	// Address data is sent from, announced (and signed along with announcements) so clients can join
+	// the group source-specifically; not announced when nil:
+	Source net.IP
+	// Group data is sent to on the data port, announced so clients join it rather than the group they
+	// discover servers on and only receive this transfer's data; the shared data group when nil:
+	DataGroup net.IP
+	// Range to derive DataGroup from the hashId within when it isn't given, e.g. 239.1.0.0/16:
+	DataGroups *net.IPNet
+	// Stop counting a client once it hasn't been heard from for this long; DefaultClientTimeout when 0:
+	ClientTimeout time.Duration
+	// Return from Run once every client has completed and no new ones showed up for QuietPeriod:
+	UntilComplete bool
+	// DefaultQuietPeriod when 0:
+	QuietPeriod time.Duration
+	// Keep serving until at least this many clients have completed:
+	MinClients int
+	// Where messages go; info level text on stdout when nil:
+	Logger *Logger
+	// Don't print the bandwidth line:
+	Quiet bool
+	// Counters to expose for scraping; nil when disabled:
+	Metrics *Metrics
+	// Back off the send rate on loss and speed up again when clean, between MinRate and MaxRate:
+	CongestionControl bool
+	// Bytes per second; defaultMinRate when 0:
+	MinRate float64
+	// Bytes per second; the default pace when 0. Rate, when set, caps it further:
+	MaxRate float64
+	// Where control messages and errors are recorded; nil when disabled:
+	Events *EventLog
 }
 
 func NewServer(m *Multicast, tb *VirtualTarballReader, options ServerOptions) *Server {
 	if options.RefreshRate <= time.Duration(0) {
 		options.RefreshRate = time.Second
 	}
+	if options.Selector == nil {
+		options.Selector = SequentialSelector{}
+	}
+	if options.AnnounceInterval <= time.Duration(0) {
+		options.AnnounceInterval = DefaultAnnounceInterval
+	}
+	if options.QuietPeriod <= time.Duration(0) {
+		options.QuietPeriod = DefaultQuietPeriod
+	}
+	if options.Logger == nil {
+		options.Logger = defaultLogger()
+	}
 
-	return &Server{
+	s := &Server{
 		m:         m,
 		tb:        tb,
 		options:   options,
+		log:       options.Logger,
+		metrics:   options.Metrics,
+		events:    options.Events,
 		hashId:    tb.HashId(),
 		allowSend: make(chan empty, 1),
-		limiter:   rate.NewLimiter(rate.Limit(1200.0), 1),
+		limiter:   rate.NewLimiter(rate.Limit(DefaultPace), 1),
+		clients:   newClientTracker(options.ClientTimeout),
+		additions: make(chan addition),
+		replaced:  make(map[string]time.Time),
+		stop:      make(chan empty),
+		failed:    make(chan error, 1),
+		share:     1,
+		quit:      make(chan empty),
+		progress:  make(progressEvents, progressBacklog),
+
+		statusRequests: make(chan chan ServerStatus),
 	}
+	s.subscribers = []func(ProgressEvent){s.printBandwidth, s.progress.publish}
+	if s.options.DataGroup == nil && s.options.DataGroups != nil {
+		s.options.DataGroup = DataGroupFor(s.hashId, s.options.DataGroups)
+	}
+	// Before anything paces itself by the chunk size:
+	if options.DiscoverChunkSize {
+		s.options.ChunkSize = s.discoverChunkSize()
+	}
+	if options.CongestionControl {
+		max := options.MaxRate
+		if max <= 0 || math.IsInf(max, 1) {
+			max = DefaultPace * float64(s.chunkSize())
+		}
+		min := options.MinRate
+		if math.IsInf(min, 1) {
+			min = 0
+		}
+		s.congestion = newCongestionController(min, max)
+	}
+	return s
+}
+
+// Progress of serving, closed once Run has returned:
+func (s *Server) Progress() <-chan ProgressEvent {
+	return s.progress
 }
 
 func (s *Server) Run() error {
+	err := s.run()
+
+	e := s.progressEvent(0)
+	e.Done, e.Err = true, err
+	s.progress.publish(e)
+	close(s.progress)
+	return err
+}
+
+func (s *Server) run() error {
 	err := (error)(nil)
+	if !s.shared {
+		defer func() {
+			err = s.m.Close()
+		}()
+	}
+	// Stops the send loop:
+	defer close(s.stop)
 	defer func() {
-		err = s.m.Close()
+		if s.ownsTb {
+			s.tb.Close()
+		}
 	}()
 
-	// Construct metadata sections:
-	if err = s.buildMetadata(); err != nil {
-		return err
+	// Open the per-transfer log:
+	if s.options.LogDir != "" {
+		if err = s.openTransferLog(); err != nil {
+			return err
+		}
+		defer s.closeTransferLog()
 	}
 
-	s.regionSize = uint16(s.m.MaxMessageSize() - (protocolDataMsgPrefixSize))
-	s.nextRegion = 0
-	s.regionCount = s.tb.size / int64(s.regionSize)
-	if int64(s.regionSize)*s.regionCount < s.tb.size {
-		s.regionCount++
+	// Compress the stream up front so regions can be read back at random:
+	s.stream, s.streamSize = s.tb, s.tb.size
+	if s.options.Compression != CompressNone {
+		f, size, err := compressTarball(s.options.Compression, s.tb)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		s.stream, s.streamSize = f, size
+		// Regions no longer map onto files:
+		s.options.ZeroCopy = false
+		s.log.Infof("Compressed %s bytes to %s with %s", humanize.Comma(s.tb.size), humanize.Comma(size), s.options.Compression)
 	}
 
-	// Initialize with fully ACKed so that resuming clients send NAK state:
-	s.nakRegions = NewNakRegions(s.tb.size)
-	// ACK all at first so that no data is sent until clients send NAKs:
-	s.nakRegions.Ack(0, s.tb.size)
+	if s.tb.options.Mmap && !mmapSupported {
+		s.log.Warnf("%s; reading files instead", ErrMmapUnsupported)
+	}
 
-	// Let Multicast know what channels we're interested in sending/receiving:
-	err = s.m.SendsControlToClient()
-	if err != nil {
+	// Hash contents so clients can verify what they wrote:
+	if err = s.tb.HashFiles(); err != nil {
 		return err
 	}
-	err = s.m.SendsData()
-	if err != nil {
-		return err
+
+	// Regions double as FEC shards so their size is part of the metadata header:
+	if s.options.ChunkSize < 0 || s.options.ChunkSize > s.maxChunkSize() {
+		return ErrBadChunkSize
 	}
-	err = s.m.ListensControlToServer()
-	if err != nil {
+	s.regionSize = uint16(s.chunkSize())
+	if s.options.ChunkSize > 0 {
+		s.warnFragmentation()
+	}
+	if s.options.Checksum {
+		// Contents never pass through us to be summed:
+		s.options.ZeroCopy = false
+	}
+	if s.options.FEC.Enabled() {
+		if s.fecEncoder, err = reedsolomon.New(s.options.FEC.DataShards, s.options.FEC.ParityShards); err != nil {
+			return err
+		}
+		s.log.Infof("FEC %s over %s byte shards", s.options.FEC, humanize.Comma(int64(s.regionSize)))
+	}
+
+	// Construct metadata sections:
+	if err = s.buildMetadata(); err != nil {
 		return err
 	}
 
+	s.resetRegions()
+
+	// Let Multicast know what channels we're interested in sending/receiving:
+	control := s.control
+	if !s.shared {
+		if err = openServerSockets(s.m, s.log); err != nil {
+			return err
+		}
+		control = s.m.ControlToServer
+	}
+
 	// Tick to send a server announcement:
-	s.announceTicker = time.Tick(1 * time.Second)
+	s.announceTicker = time.Tick(s.options.AnnounceInterval)
 
-	// Create an announcement message:
-	s.announceMsg = controlToClientMessage(s.hashId, AnnounceTarball, nil)
+	if group := s.options.DataGroup; group != nil && !s.m.unicast {
+		if (group.To4() == nil) != s.m.ipv6 || !group.IsMulticast() {
+			return fmt.Errorf("%w: %s", ErrBadDataGroup, group)
+		}
+		s.dataAddr = &net.UDPAddr{IP: group, Port: s.m.dataAddr.Port, Zone: s.m.dataAddr.Zone}
+		s.log.Infof("Sending data to %s", s.dataAddr)
+	}
+	s.buildAnnouncements()
 
 	// Create a one-second ticker for reporting:
 	refreshTimer := time.Tick(s.options.RefreshRate)
 
-	fmt.Print("Started server\n")
-	fmt.Printf("%15s  ID: %s\n", humanize.Comma(s.tb.size), hex.EncodeToString(s.hashId))
+	// Apply the configured rate; a rate file takes precedence:
+	if s.options.Rate != 0 {
+		s.SetRate(s.options.Rate)
+		s.logRate(s.options.Rate)
+	} else if s.congestion != nil {
+		s.setLimit(s.congestion.rate)
+	}
+	if s.congestion != nil {
+		s.log.Infof("Congestion control between %s/s and %s/s", humanize.IBytes(uint64(s.congestion.min)), humanize.IBytes(uint64(s.congestion.cap)))
+	}
+
+	// Reload rate limits on SIGHUP without disturbing clients:
+	reload := make(chan os.Signal, 1)
+	if s.options.RateFile != "" {
+		if err = s.loadRateFile(); err != nil {
+			return err
+		}
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+	}
+
+	s.log.Infof("Started server")
+	if s.options.Carousel {
+		s.log.Infof("Carousel mode; cycling all data continuously")
+	}
+	s.log.Infof("%15s  ID: %s", humanize.Comma(s.tb.size), hex.EncodeToString(s.hashId))
+	if s.options.UntilComplete {
+		s.log.Infof("Stopping once %d client(s) complete and none join for %v", s.options.MinClients, s.options.QuietPeriod)
+	}
 
 	// Send/recv loop:
+	s.startTime = time.Now()
 	go s.sendDataLoop()
 
+loop:
 	for {
 		select {
-		case ctrl := <-s.m.ControlToServer:
+		case err := <-s.failed:
+			return err
+		case <-s.quit:
+			break loop
+		case ctrl := <-control:
 			if ctrl.Error != nil {
 				return ctrl.Error
 			}
+			if s.shared {
+				// Already opened by the MultiServer:
+			} else if ctrl, err = s.m.OpenControl(ctrl); err != nil {
+				// Not from a client holding our key:
+				ctrl.Release()
+				continue
+			}
 			// Process client requests:
 			err := s.processControl(ctrl)
 			if err != nil {
-				fmt.Printf("%s\n", err)
+				s.log.Warnf("%s", err)
+				s.events.error(err)
 			}
+			ctrl.Release()
 		case <-s.announceTicker:
-			// Announce transfer available:
-			//fmt.Printf("announce %s\n", hex.EncodeToString(s.hashId))
-
-			_, err := s.m.SendControlToClient(s.announceMsg)
-			if isENOBUFS(err) {
-				fmt.Print("\r!")
-				err = nil
-			}
-
-			if err != nil {
-				fmt.Printf("%s\n", err)
-			}
+			s.announce()
 		case <-refreshTimer:
+			s.followSchedule(time.Now())
 			s.reportBandwidth()
+			if s.options.UntilComplete && s.clients.allComplete(s.streamSize, s.options.MinClients, s.options.QuietPeriod, time.Now()) {
+				break loop
+			}
+		case <-reload:
+			if err := s.loadRateFile(); err != nil {
+				s.log.Errorf("%s", err)
+				s.events.error(err)
+			}
+		case a := <-s.additions:
+			a.done <- s.addFiles(a.files)
+		case reply := <-s.statusRequests:
+			reply <- s.status()
 		}
 	}
 
-	fmt.Print("Stopped server\n")
+	// Final summary:
+	printProgress(s.options.Quiet, "\n")
+	s.log.Infof("%d client(s) completed in %v; sent %s bytes for %s bytes of data", len(s.clients.finished), time.Since(s.startTime).Round(time.Millisecond), humanize.Comma(s.sentBytes()), humanize.Comma(s.streamSize))
+	s.log.Infof("Stopped server")
+	return nil
+}
+
+func (s *Server) resetRegions() {
+	s.nextRegion = 0
+	s.regionCount = s.streamSize / int64(s.regionSize)
+	if int64(s.regionSize)*s.regionCount < s.streamSize {
+		s.regionCount++
+	}
+
+	// Initialize with fully ACKed so that resuming clients send NAK state:
+	s.nakRegions = NewNakRegions(s.streamSize)
+	// ACK all at first so that no data is sent until clients send NAKs:
+	s.nakRegions.Ack(0, s.streamSize)
+}
+
+// Files AddFiles hands to Run's loop, and where the outcome goes back:
+type addition struct {
+	files []*TarballFile
+	done  chan error
+}
+
+// Adds files to the transfer while Run is serving it, e.g. ones produced after serving began.
+//
+// The hashId identifies the file list so adding to it makes a different transfer: the new hashId and
+// size are announced in place of the old ones and nothing more is sent under the old hashId. Clients
+// still asking for it are told the new one and start over on it, keeping what they already have of
+// files that are unchanged so only the rest needs sending; older clients keep asking for the old
+// hashId and go unanswered, as for any transfer no longer served, rather than being sent data that
+// doesn't fit the metadata they were given.
+//
+// Not supported when compressing, with FEC or under a MultiServer since regions there don't map onto
+// files. Files already served are checked for changes against when they were first looked at.
+func (s *Server) AddFiles(files []*TarballFile) error {
+	if s.options.Compression != CompressNone || s.options.FEC.Enabled() || s.shared {
+		return ErrAppendUnsupported
+	}
+	a := addition{files: files, done: make(chan error, 1)}
+	select {
+	case s.additions <- a:
+	case <-s.stop:
+		return ErrNotServing
+	}
+	return <-a.done
+}
+
+// Serves the current files along with `files` under the hashId they make together:
+func (s *Server) addFiles(files []*TarballFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	// Lay out copies since the current reader keeps reading by the offsets it was given:
+	all := make([]*TarballFile, 0, len(s.tb.files)+len(files))
+	for _, tf := range s.tb.files {
+		c := *tf
+		all = append(all, &c)
+	}
+	all = append(all, files...)
+	tb, err := NewVirtualTarballReader(all, s.tb.options)
+	if err != nil {
+		return err
+	}
+	for i, tf := range s.tb.files {
+		all[i].localSize, all[i].localModTime = tf.localSize, tf.localModTime
+	}
+	if err = tb.HashFiles(); err != nil {
+		return err
+	}
+
+	oldId, old := s.hashId, s.tb
+	s.nextLock.Lock()
+	s.tb, s.stream, s.streamSize, s.hashId = tb, tb, tb.size, tb.hashId
+	s.resetRegions()
+	err = s.buildMetadata()
+	s.nextLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if s.ownsTb {
+		old.Close()
+	}
+	s.ownsTb = true
+
+	// Clients start over on the new hashId so progress on the old one no longer counts:
+	s.clients = newClientTracker(s.options.ClientTimeout)
+	s.replaced[hex.EncodeToString(oldId)] = time.Time{}
+	s.buildAnnouncements()
+
+	s.log.Infof("Added %d file(s); serving %s bytes as %s in place of %s", len(files), humanize.Comma(s.tb.size), hex.EncodeToString(s.hashId), hex.EncodeToString(oldId))
+	s.announce()
+	return nil
+}
+
+// Tells clients asking for a hashId served before files were added which one to ask for now. One
+// notice answers every client that asked at once:
+func (s *Server) noticeReplaced(hashId []byte) error {
+	key := hex.EncodeToString(hashId)
+	if last, ok := s.replaced[key]; !ok || time.Since(last) < discoveryHoldoff {
+		return nil
+	}
+	s.replaced[key] = time.Now()
+	_, err := s.m.SendControlToClient(controlToClientMessage(hashId, AnnounceReplaced, encodeReplaced(s.options.SigningKey, hashId, s.hashId)))
+	s.metrics.controlSent()
+	s.events.controlSent(AnnounceReplaced, nil)
 	return err
 }
 
+// Creates the announcement messages for the current hashId:
+func (s *Server) buildAnnouncements() {
+	announcement := []byte(nil)
+	if s.options.SigningKey != nil {
+		announcement = signAnnouncement(s.options.SigningKey, s.hashId, uint16(len(s.metadataSections)))
+	}
+	s.announceMsg = controlToClientMessage(s.hashId, AnnounceTarball, announcement)
+	if s.options.Source != nil {
+		// Sent along with each announcement; older clients ignore it:
+		s.announceSourceMsg = controlToClientMessage(s.hashId, AnnounceSource, encodeSource(s.options.SigningKey, s.hashId, s.options.Source))
+	}
+	if s.dataAddr != nil {
+		s.announceDataGroupMsg = controlToClientMessage(s.hashId, AnnounceDataGroup, encodeDataGroup(s.options.SigningKey, s.hashId, s.dataAddr.IP))
+	}
+	s.announceListMsgs = nil
+	if s.options.AnnounceList {
+		// Combined announcements are not about any one transfer so carry a zero hashId:
+		zeroId := make([]byte, HashSize)
+		entries := s.listed
+		if entries == nil {
+			entries = []AnnouncementEntry{{HashId: s.hashId, Size: s.tb.size, Name: s.options.Name}}
+		}
+		for _, chunk := range encodeAnnouncementList(entries) {
+			s.announceListMsgs = append(s.announceListMsgs, controlToClientMessage(zeroId, AnnounceTarballList, chunk))
+		}
+	}
+}
+
+// Clients don't ask for sparse extents when regions map directly onto files and no parity is sent:
+func (s *Server) skipsSparse() bool {
+	return s.options.Compression == CompressNone && !s.options.FEC.Enabled()
+}
+
+// Sets up the sockets a server sends and receives on:
+func openServerSockets(m *Multicast, l *Logger) error {
+	err := m.SendsControlToClient()
+	if err != nil {
+		return err
+	}
+	err = m.SendsData()
+	if err != nil {
+		return err
+	}
+	if _, w, err := m.DataBufferSizes(); err == nil {
+		logBufferSize(l, "Send", w, m.bufferSize(m.writeBufferSize, m.sendDataCount), "net.core.wmem_max")
+	}
+	return m.ListensControlToServer()
+}
+
+// Sets the data send rate in bytes per second. The limiter picks up the new rate at its next refill.
+// Under congestion control the rate is a ceiling the controller won't exceed. Transfers served by a
+// MultiServer each get their share of it.
+func (s *Server) SetRate(bytesPerSecond float64) {
+	bytesPerSecond *= s.share
+	if s.congestion != nil {
+		s.nextLock.Lock()
+		bytesPerSecond = s.congestion.setCap(bytesPerSecond)
+		s.nextLock.Unlock()
+	}
+	s.setLimit(bytesPerSecond)
+}
+
+// Makes Run return as though every client had completed:
+func (s *Server) Stop() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+}
+
+// Stops sending data until Resume while still announcing and answering metadata requests. Clients
+// see a gap and keep NAKing, so nothing they have received is lost:
+func (s *Server) Pause() {
+	if atomic.CompareAndSwapInt32(&s.paused, 0, 1) {
+		s.log.Infof("Paused sending data")
+	}
+}
+
+// Sends data again after Pause, starting with whatever clients asked for in the meantime:
+func (s *Server) Resume() {
+	if atomic.CompareAndSwapInt32(&s.paused, 1, 0) {
+		s.log.Infof("Resumed sending data")
+	}
+}
+
+func (s *Server) Paused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
+
+// Moves the range congestion control keeps the send rate within, in bytes per second; 0 leaves either
+// end as it is. The rate set by SetRate still caps it.
+func (s *Server) SetRateRange(min float64, max float64) error {
+	if s.congestion == nil {
+		return ErrNoRateRange
+	}
+	s.nextLock.Lock()
+	r := s.congestion.setRange(min, max)
+	s.nextLock.Unlock()
+	s.setLimit(r)
+	return nil
+}
+
+func (s *Server) setLimit(bytesPerSecond float64) {
+	if math.IsInf(bytesPerSecond, 1) {
+		s.limiter.SetLimit(rate.Inf)
+		return
+	}
+
+	// Limiter works in data messages:
+	s.limiter.SetLimit(rate.Limit(bytesPerSecond / float64(s.chunkSize())))
+}
+
+func (s *Server) loadRateFile() error {
+	b, err := ioutil.ReadFile(s.options.RateFile)
+	if err != nil {
+		return err
+	}
+	schedule, err := ParseRateSchedule(string(b))
+	if err != nil {
+		return err
+	}
+
+	s.schedule = schedule
+	s.scheduled = schedule.At(time.Now())
+	s.applyRateLimits(s.scheduled)
+	return nil
+}
+
+// Applies the rate file's limits again once the time of day moves on to another step. Rates set since
+// through the admin socket hold until then.
+func (s *Server) followSchedule(now time.Time) {
+	if s.schedule == nil || !s.schedule.Scheduled() {
+		return
+	}
+	limits := s.schedule.At(now)
+	if limits == s.scheduled {
+		return
+	}
+	s.scheduled = limits
+	s.applyRateLimits(limits)
+}
+
+func (s *Server) applyRateLimits(limits RateLimits) {
+	if limits.MinRate != 0 || limits.MaxRate != 0 {
+		if err := s.SetRateRange(limits.MinRate, limits.MaxRate); err != nil {
+			s.log.Warnf("Rate file: %s", err)
+		} else {
+			s.logRateRange()
+		}
+	}
+	if limits.Rate != 0 {
+		s.SetRate(limits.Rate)
+		s.logRate(limits.Rate)
+	}
+}
+
+func (s *Server) logRateRange() {
+	s.nextLock.Lock()
+	min, max := s.congestion.min, s.congestion.max
+	s.nextLock.Unlock()
+	s.log.Infof("Congestion control between %s/s and %s/s", humanize.IBytes(uint64(min)), humanize.IBytes(uint64(max)))
+}
+
+func (s *Server) logRate(bytesPerSecond float64) {
+	if math.IsInf(bytesPerSecond, 1) {
+		s.log.Infof("Rate set to unlimited")
+	} else {
+		s.log.Infof("Rate set to %s/s", humanize.IBytes(uint64(bytesPerSecond)))
+	}
+}
+
+// Snapshot of the transfer taken by Run's loop, so safe to ask for while it runs:
+func (s *Server) Status() (ServerStatus, error) {
+	reply := make(chan ServerStatus, 1)
+	select {
+	case s.statusRequests <- reply:
+	case <-s.stop:
+		return ServerStatus{}, ErrNotServing
+	}
+	return <-reply, nil
+}
+
+// The one transfer, for an admin socket:
+func (s *Server) Transfers() ([]ServerStatus, error) {
+	st, err := s.Status()
+	if err != nil {
+		return nil, err
+	}
+	return []ServerStatus{st}, nil
+}
+
+func (s *Server) status() ServerStatus {
+	st := ServerStatus{
+		HashId:           hex.EncodeToString(s.hashId),
+		Name:             s.options.Name,
+		Size:             s.streamSize,
+		Bytes:            s.sentBytes(),
+		Rate:             s.lastRate,
+		Clients:          len(s.clients.clients),
+		ClientsCompleted: len(s.clients.finished),
+		Paused:           s.Paused(),
+	}
+	if limit := s.limiter.Limit(); limit != rate.Inf {
+		st.RateLimit = float64(limit) * float64(s.chunkSize())
+	}
+	if s.congestion != nil {
+		s.nextLock.Lock()
+		st.MinRate, st.MaxRate = s.congestion.min, s.congestion.max
+		s.nextLock.Unlock()
+	}
+	return st
+}
+
+func (s *Server) openTransferLog() error {
+	err := os.MkdirAll(s.options.LogDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Start each run of a transfer with a fresh log:
+	path := filepath.Join(s.options.LogDir, hex.EncodeToString(s.hashId)+".log")
+	s.transferLogFile, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+	// The file is this transfer's own, so tee a child rather than the logger it was given:
+	s.log = s.log.Child("")
+	s.log.SetTee(s.transferLogFile)
+
+	s.log.Infof("Logging transfer to '%s'", path)
+	return nil
+}
+
+func (s *Server) closeTransferLog() {
+	s.log.SetTee(nil)
+	s.transferLogFile.Close()
+}
+
 func (s *Server) reportBandwidth() {
 	rightMeow := time.Now()
 	sec := rightMeow.Sub(s.timeLast).Seconds()
 	{
-		byteCount := s.bytesSent - s.bytesSentLast
+		sent := s.sentBytes()
+		byteCount := sent - s.bytesSentLast
 		s.lastRate = float64(byteCount) / sec
-		s.bytesSentLast = s.bytesSent
+		s.bytesSentLast = sent
 		s.timeLast = rightMeow
 	}
 
-	fmt.Printf("\b%9s/s        [%s]\r", humanize.IBytes(uint64(s.lastRate)), s.nakRegions.ASCIIMeterPosition(48, s.nextRegion))
+	for _, c := range s.clients.expire(rightMeow) {
+		s.log.Infof("Client %s timed out", c.Address)
+	}
+	s.metrics.setSendRate(s.lastRate)
+	s.metrics.setActiveClients(len(s.clients.clients))
+
+	if s.congestion != nil {
+		s.nextLock.Lock()
+		r, changed := s.congestion.adjust()
+		s.nextLock.Unlock()
+		if changed {
+			s.setLimit(r)
+			s.log.Debugf("Congestion control set rate to %s/s", humanize.IBytes(uint64(r)))
+		}
+	}
+
+	e := s.progressEvent(s.lastRate)
+	for _, subscriber := range s.subscribers {
+		subscriber(e)
+	}
+}
+
+// Bytes sent so far; the send loop keeps adding to it under nextLock:
+func (s *Server) sentBytes() int64 {
+	s.nextLock.Lock()
+	defer s.nextLock.Unlock()
+	return s.bytesSent
+}
+
+func (s *Server) progressEvent(rate float64) ProgressEvent {
+	return ProgressEvent{
+		Bytes:            s.sentBytes(),
+		Size:             s.streamSize,
+		Rate:             rate,
+		Clients:          len(s.clients.clients),
+		ClientsCompleted: len(s.clients.finished),
+	}
+}
+
+// The default subscriber rewrites a bandwidth line in place:
+func (s *Server) printBandwidth(e ProgressEvent) {
+	s.nextLock.Lock()
+	meter := s.nakRegions.ASCIIMeterPosition(48, s.nextRegion)
+	s.nextLock.Unlock()
+
+	if s.Paused() {
+		printProgress(s.options.Quiet, "\b%9s          [%s] %s\r", "paused", meter, s.clients.summary(s.streamSize))
+		return
+	}
+	printProgress(s.options.Quiet, "\b%9s/s        [%s] %s\r", humanize.IBytes(uint64(e.Rate)), meter, s.clients.summary(s.streamSize))
+}
+
+// Notes progress reported by a client, logging when it joins or completes:
+func (s *Server) trackClient(addr *net.UDPAddr, acked int64) {
+	now := time.Now()
+	c, isNew := s.clients.seen(addr, now)
+	wasComplete := !isNew && c.Complete(s.streamSize)
+	c.advance(acked)
+	if isNew {
+		s.log.Infof("Client %s joined", c.Address)
+		s.events.client("joined", addr)
+	}
+	if !wasComplete && c.Complete(s.streamSize) {
+		s.clients.finished[c.Address] = true
+		s.log.Infof("Client %s complete", c.Address)
+		s.events.client("complete", addr)
+	}
+}
+
+// Snapshot of the clients heard from within the client timeout; only safe once Run has returned:
+func (s *Server) Clients() []ClientStatus {
+	l := []ClientStatus(nil)
+	for _, c := range s.clients.list() {
+		l = append(l, *c)
+	}
+	return l
 }
 
 // goroutine to only send data while clients request it:
@@ -171,12 +906,18 @@ func (s *Server) sendDataLoop() {
 	runtime.LockOSThread()
 
 	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
 		// Rate limit our sending:
 		if werr := s.limiter.Wait(context.Background()); werr != nil {
 			continue
 		}
 
-		if s.nakRegions.IsAllAcked() {
+		if s.Paused() || !s.hasDataToSend() {
 			time.Sleep(250 * time.Millisecond)
 			continue
 		}
@@ -186,14 +927,43 @@ func (s *Server) sendDataLoop() {
 		if err == nil {
 
 		} else if isENOBUFS(err) {
-			fmt.Print("\r!")
+			printProgress(s.options.Quiet, "\r!")
 			err = nil
 		}
 
+		if errors.Is(err, ErrSourceChanged) {
+			s.log.Errorf("%s; stopping so clients don't receive a mix of old and new contents", err)
+			s.events.error(err)
+			s.failed <- err
+			return
+		}
 		if err != nil {
-			fmt.Printf("\b%s\n", err)
+			s.log.Errorf("%s", err)
+			s.events.error(err)
+		}
+	}
+}
+
+// Whether any region is waiting to be sent. In carousel mode everything is queued again once a full
+// cycle completes so data never stops flowing.
+func (s *Server) hasDataToSend() bool {
+	s.nextLock.Lock()
+	defer s.nextLock.Unlock()
+
+	if len(s.parityMsgs) > 0 {
+		return true
+	}
+	if s.nakRegions.IsAllAcked() {
+		if !s.options.Carousel {
+			return false
+		}
+		s.nakRegions.NakAll()
+		if s.skipsSparse() {
+			ackSparse(s.nakRegions, s.tb.files)
 		}
 	}
+	// An empty or all-sparse transfer has nothing to send even once queued again:
+	return !s.nakRegions.IsAllAcked()
 }
 
 func (s *Server) sendData() error {
@@ -203,22 +973,40 @@ func (s *Server) sendData() error {
 	s.nextLock.Lock()
 	defer s.nextLock.Unlock()
 
+	// Parity for a group just sent goes out before more data:
+	if len(s.parityMsgs) > 0 {
+		return s.sendParity()
+	}
+
 	lastRegion := s.nextRegion
 
 	// Filter out ACKed regions:
 	//fmt.Printf("\r\bold = %15d\n", s.nextRegion)
-	nextNak := s.nakRegions.NextNakRegion(s.nextRegion)
+	nextNak := s.options.Selector.Next(s.nakRegions, s.nextRegion)
 	if nextNak != -1 {
 		//fmt.Printf("\bnew = %15d\n", nextNak)
 		s.nextRegion = nextNak
 	}
 
-	// Read data from virtual tarball:
+	// Send data message:
 	n := 0
-	buf := make([]byte, s.regionSize)
-	n, err = s.tb.ReadAt(buf, s.nextRegion)
+	sent := false
+	if s.options.ZeroCopy {
+		n, sent, err = s.sendDataZeroCopy()
+		if err == ErrZeroCopyUnsupported {
+			s.log.Warnf("%s; falling back to copying", err)
+			s.options.ZeroCopy = false
+			err = nil
+		}
+	}
+	if err == nil && !sent && s.stream == io.ReaderAt(s.tb) {
+		n, sent, err = s.sendDataMapped()
+	}
+	if err == nil && !sent {
+		n, err = s.sendDataCopy()
+	}
 	if err == ErrOutOfRange {
-		fmt.Printf("ReadAt: %s\n", err)
+		s.log.Errorf("ReadAt: %s", err)
 		return nil
 	}
 	if err != nil {
@@ -226,101 +1014,454 @@ func (s *Server) sendData() error {
 		s.nextRegion = lastRegion
 		return err
 	}
-	buf = buf[:n]
-
-	// Send data message:
-	m := 0
-	dataMsg := dataMessage(s.hashId, s.nextRegion, buf)
-	m, err = s.m.SendData(dataMsg)
-	if err != nil {
-		// Rewind due to error:
-		s.nextRegion = lastRegion
-		return err
-	}
 	s.lastSendTime = time.Now()
-	if m < len(buf) {
-		fmt.Printf("m < buf: %d < %d\n", m, len(buf))
-	}
 
 	// ACK last send region:
 	s.nakRegions.Ack(s.nextRegion, s.nextRegion+int64(n))
 	s.bytesSent += int64(n)
+	s.metrics.dataSent(n)
+	s.congestion.observeSent()
+
+	// Queue parity once the last region of a group has gone out:
+	if s.fecEncoder != nil {
+		if err = s.queueParity(s.nextRegion, n); err != nil {
+			return err
+		}
+	}
 
 	// Advance to next region:
 	s.nextRegion += int64(n)
-	if s.nextRegion >= s.tb.size {
+	if s.nextRegion >= s.streamSize {
 		s.nextRegion = 0
 	}
 
 	return nil
 }
 
+func (s *Server) sendDataCopy() (int, error) {
+	// Read data from virtual tarball:
+	buf := make([]byte, s.regionSize)
+	n, err := s.stream.ReadAt(buf, s.nextRegion)
+	if err == io.EOF && n > 0 {
+		// Short tail region of a compressed stream file:
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	buf = buf[:n]
+
+	m := 0
+	dataMsg := s.dataMessage(s.nextRegion, buf)
+	m, err = s.m.sendData(s.dataAddr, s.salt, dataMsg)
+	if err != nil {
+		return 0, err
+	}
+	if m < len(dataMsg) {
+		s.log.Warnf("m < buf: %d < %d", m, len(dataMsg))
+	}
+	return n, nil
+}
+
+// Content bytes carried by each data message:
+func (s *Server) chunkSize() int {
+	if s.options.ChunkSize > 0 {
+		return s.options.ChunkSize
+	}
+	return s.maxChunkSize()
+}
+
+func (s *Server) maxChunkSize() int {
+	n := s.m.MaxMessageSize() - ProtocolDataMsgPrefixSize
+	if s.options.Checksum {
+		n -= dataChecksumSize
+	}
+	return n
+}
+
+// Largest chunk whose packets fit the smallest MTU of the interfaces sending data. Multicast gets no
+// ICMP feedback to probe the path with so the interfaces are the best guess there is; routers along
+// the way with a smaller MTU still fragment.
+func (s *Server) discoverChunkSize() int {
+	mtu := s.m.MTU()
+	overhead := s.m.packetSize(s.m.datagramSize - s.maxChunkSize())
+	if mtu <= overhead {
+		s.log.Warnf("Could not determine the MTU; sending %d byte chunks", fallbackChunkSize)
+		return fallbackChunkSize
+	}
+
+	size := mtu - overhead
+	if size > s.maxChunkSize() {
+		size = s.maxChunkSize()
+	}
+	s.log.Infof("MTU is %d; sending %s byte chunks", mtu, humanize.Comma(int64(size)))
+	return size
+}
+
+// Datagrams larger than the MTU are fragmented and a single lost fragment loses the whole region:
+func (s *Server) warnFragmentation() {
+	mtu := s.m.MTU()
+	if mtu == 0 {
+		return
+	}
+	size := s.m.packetSize(s.m.datagramSize - s.maxChunkSize() + s.chunkSize())
+	if size > mtu {
+		s.log.Warnf("Chunks of %s bytes make %s byte packets which will be fragmented over the %d byte MTU", humanize.Comma(int64(s.chunkSize())), humanize.Comma(int64(size)), mtu)
+	}
+}
+
+// Data message for the region at `offset`, checksummed when enabled:
+func (s *Server) dataMessage(offset int64, data []byte) []byte {
+	msg := dataMessage(s.hashId, offset, data)
+	if s.options.Checksum {
+		msg = appendChecksum(msg)
+	}
+	return msg
+}
+
+// Encodes parity for every group whose last region lies within [start, start+n):
+func (s *Server) queueParity(start int64, n int) error {
+	shardSize := int64(s.regionSize)
+	groupBytes := int64(s.options.FEC.DataShards) * shardSize
+	endEx := start + int64(n)
+	for g := start / groupBytes; g <= (endEx-1)/groupBytes; g++ {
+		groupEnd := (g + 1) * groupBytes
+		if groupEnd > s.streamSize {
+			groupEnd = s.streamSize
+		}
+		if groupEnd > endEx {
+			continue
+		}
+
+		parity, err := encodeFECGroup(s.options.FEC, s.fecEncoder, s.stream, s.streamSize, shardSize, g)
+		if err != nil {
+			return err
+		}
+		for j, p := range parity {
+			s.parityMsgs = append(s.parityMsgs, s.dataMessage(s.options.FEC.parityOffset(s.streamSize, shardSize, g, j), p))
+		}
+	}
+	return nil
+}
+
+func (s *Server) sendParity() error {
+	msg := s.parityMsgs[0]
+	m, err := s.m.sendData(s.dataAddr, s.salt, msg)
+	if err != nil {
+		return err
+	}
+	s.parityMsgs = s.parityMsgs[1:]
+	s.lastSendTime = time.Now()
+	s.bytesSent += int64(m - ProtocolDataMsgPrefixSize)
+	s.metrics.dataSent(m - ProtocolDataMsgPrefixSize)
+	return nil
+}
+
+// Sends the next region straight from its file when it lies within a single file's contents:
+func (s *Server) sendDataZeroCopy() (int, bool, error) {
+	f, localOffset, n, release, err := s.tb.FileRegion(s.nextRegion, int(s.regionSize))
+	if err != nil {
+		return 0, false, err
+	}
+	if f == nil {
+		return 0, false, nil
+	}
+	// Keep the file from being closed for other reads until it's sent:
+	defer release()
+
+	hdr := dataMessage(s.hashId, s.nextRegion, nil)
+	m, err := s.m.sendDataFile(s.dataAddr, hdr, f, localOffset, n)
+	if err != nil {
+		return 0, false, err
+	}
+	if m < len(hdr)+n {
+		// Only count what made it into the datagram:
+		n = m - len(hdr)
+	}
+	return n, true, nil
+}
+
+// Builds the next data message straight from the mapping of its file when it lies within a single
+// mapped file's contents, saving the copy through a read buffer:
+func (s *Server) sendDataMapped() (int, bool, error) {
+	hdr := dataMessage(s.hashId, s.nextRegion, nil)
+	msg := append(make([]byte, 0, len(hdr)+int(s.regionSize)+dataChecksumSize), hdr...)
+	n, mapped, err := s.tb.ReadMapped(msg[len(hdr):len(hdr)+int(s.regionSize)], s.nextRegion)
+	if err != nil || !mapped {
+		return 0, false, err
+	}
+	msg = msg[:len(hdr)+n]
+	if s.options.Checksum {
+		msg = appendChecksum(msg)
+	}
+
+	m, err := s.m.sendData(s.dataAddr, s.salt, msg)
+	if err != nil {
+		return 0, false, err
+	}
+	if m < len(msg) {
+		s.log.Warnf("m < buf: %d < %d", m, len(msg))
+	}
+	return n, true, nil
+}
+
+// Announces the transfer available:
+func (s *Server) announce() {
+	s.log.Debugf("announce %s", hex.EncodeToString(s.hashId))
+	s.lastAnnounce = time.Now()
+
+	_, err := s.m.SendAnnouncement(s.announceMsg)
+	s.metrics.controlSent()
+	s.events.controlSent(AnnounceTarball, nil)
+	if err == nil && s.announceSourceMsg != nil {
+		_, err = s.m.SendAnnouncement(s.announceSourceMsg)
+		s.metrics.controlSent()
+		s.events.controlSent(AnnounceSource, nil)
+	}
+	if err == nil && s.announceDataGroupMsg != nil {
+		_, err = s.m.SendAnnouncement(s.announceDataGroupMsg)
+		s.metrics.controlSent()
+		s.events.controlSent(AnnounceDataGroup, nil)
+	}
+	for _, msg := range s.announceListMsgs {
+		if err != nil {
+			break
+		}
+		_, err = s.m.SendAnnouncement(msg)
+		s.metrics.controlSent()
+		s.events.controlSent(AnnounceTarballList, nil)
+	}
+	if isENOBUFS(err) {
+		printProgress(s.options.Quiet, "\r!")
+		err = nil
+	}
+
+	if err != nil {
+		s.log.Errorf("%s", err)
+		s.events.error(err)
+	}
+}
+
 func (s *Server) processControl(ctrl UDPMessage) error {
 	hashId, op, data, err := extractServerMessage(ctrl)
 	if err != nil {
 		return err
 	}
 
+	if op == RequestAnnouncement && (isZeroHash(hashId) || compareHashes(hashId, s.hashId) == 0) {
+		// A client just started looking; one announcement answers every client that asked at once:
+		s.metrics.controlReceived()
+		s.events.controlReceived(op, ctrl.SourceAddress)
+		if time.Since(s.lastAnnounce) >= discoveryHoldoff {
+			s.announce()
+		}
+		return nil
+	}
+
+	if _, ok := s.replaced[hex.EncodeToString(hashId)]; ok {
+		s.metrics.controlReceived()
+		s.events.controlReceived(op, ctrl.SourceAddress)
+		err = s.noticeReplaced(hashId)
+		if isENOBUFS(err) {
+			printProgress(s.options.Quiet, "\r!")
+			err = nil
+		}
+		return err
+	}
+
 	if compareHashes(hashId, s.hashId) != 0 {
 		// Ignore message not for us:
 		//fmt.Printf("ignore message for %s; expecting for %s\n", hex.EncodeToString(hashId), hex.EncodeToString(s.hashId))
 		return nil
 	}
+	s.metrics.controlReceived()
+	s.events.controlReceived(op, ctrl.SourceAddress)
 
 	switch op {
 	case RequestMetadataHeader:
 		_ = data
+		s.trackClient(ctrl.SourceAddress, 0)
 
 		// Respond with metadata header:
 		_, err = s.m.SendControlToClient(controlToClientMessage(hashId, RespondMetadataHeader, s.metadataHeader))
+		s.metrics.controlSent()
+		s.events.controlSent(RespondMetadataHeader, nil)
 	case RequestMetadataSection:
+		if len(data) < 2 {
+			return ErrMessageTooShort
+		}
 		sectionIndex := byteOrder.Uint16(data[0:2])
 		if sectionIndex >= uint16(len(s.metadataSections)) {
 			// Out of range
 			return nil
 		}
 
+		s.trackClient(ctrl.SourceAddress, 0)
+
 		// Send metadata section message:
 		section := s.metadataSections[sectionIndex]
 		_, err = s.m.SendControlToClient(controlToClientMessage(hashId, RespondMetadataSection, section))
+		s.metrics.controlSent()
+		s.events.controlSent(RespondMetadataSection, nil)
+	case RequestBlockHashes:
+		if len(data) < blockHashesMsgSize {
+			return ErrMessageTooShort
+		}
+		fileIndex, first := byteOrder.Uint32(data[0:4]), int64(byteOrder.Uint64(data[4:12]))
+		if fileIndex >= uint32(len(s.tb.files)) || first < 0 {
+			// Out of range
+			return nil
+		}
+
+		tf := s.tb.files[fileIndex]
+		hashes := []byte(nil)
+		if hashes, err = hashBlocks(s.tb, tf.offset, tf.Size, first, blockHashesPerMessage); err != nil {
+			return err
+		}
+		_, err = s.m.SendControlToClient(controlToClientMessage(hashId, RespondBlockHashes, append(data[:blockHashesMsgSize:blockHashesMsgSize], hashes...)))
+		s.metrics.controlSent()
+		s.events.controlSent(RespondBlockHashes, nil)
 	case AckDataSection:
+		ack, naks, err := decodeAckDataSection(data)
+		if err != nil {
+			return err
+		}
 		s.nextLock.Lock()
-		i := 0
-		var ack Region
-		ack, i = readRegion(data, i)
+		// Everything before the first NAK has arrived; no NAKs means everything has:
+		acked := s.streamSize
+		if len(naks) > 0 {
+			acked = naks[0].start
+		}
+		s.trackClient(ctrl.SourceAddress, acked)
 		s.nakRegions.Ack(ack.start, ack.endEx)
-		for i < len(data) {
-			var nak Region
-			nak, i = readRegion(data, i)
+		if s.retransmitBudgetExhausted() {
+			// Protect the shared medium from a pathological receiver:
+			s.nextLock.Unlock()
+			return nil
+		}
+		now := time.Now()
+		for _, nak := range naks {
 			//fmt.Printf("\bnak [%15v %15v]\n", nak.start, nak.endEx)
+			if s.recentNaks.repeated(nak, now) {
+				continue
+			}
 			s.nakRegions.Nak(nak.start, nak.endEx)
+			s.metrics.retransmitsRequested(1)
+			s.congestion.observeNaks(1)
 		}
 		s.lastAckTime = time.Now()
 		s.nextLock.Unlock()
 		return nil
+	case RequestDataRegions:
+		naks, err := decodeRegionList(data)
+		if err != nil {
+			return err
+		}
+		acked := s.streamSize
+		if len(naks) > 0 {
+			acked = naks[0].start
+		}
+		s.trackClient(ctrl.SourceAddress, acked)
+		s.nextLock.Lock()
+		defer s.nextLock.Unlock()
+		if s.retransmitBudgetExhausted() {
+			return nil
+		}
+		now, n := time.Now(), 0
+		for _, nak := range naks {
+			if s.recentNaks.repeated(nak, now) {
+				continue
+			}
+			s.nakRegions.Nak(nak.start, nak.endEx)
+			n++
+		}
+		s.metrics.retransmitsRequested(n)
+		s.congestion.observeNaks(n)
+		s.lastAckTime = time.Now()
+		return nil
 	}
 
 	if isENOBUFS(err) {
-		fmt.Print("\r!")
+		printProgress(s.options.Quiet, "\r!")
 		err = nil
 	}
 
 	return err
 }
 
-func readRegion(data []byte, i int) (Region, int) {
+// Must be called with nextLock held:
+func (s *Server) retransmitBudgetExhausted() bool {
+	if s.options.MaxRetransmitRatio <= 0 {
+		return false
+	}
+	if float64(s.bytesSent) < s.options.MaxRetransmitRatio*float64(s.streamSize) {
+		return false
+	}
+
+	if !s.retransmitCapped {
+		s.retransmitCapped = true
+		s.log.Warnf("Retransmit budget exhausted after %s bytes sent; ignoring further NAKs", humanize.Comma(s.bytesSent))
+	}
+	return true
+}
+
+// NAK'd regions by when, only touched with nextLock held:
+type recentRegions map[Region]time.Time
+
+// Whether `nak` was NAK'd within nakDebounce, remembering it if not:
+func (r *recentRegions) repeated(nak Region, now time.Time) bool {
+	if at, ok := (*r)[nak]; ok && now.Sub(at) < nakDebounce {
+		return true
+	}
+	if *r == nil {
+		*r = make(recentRegions)
+	}
+	if len(*r) >= 1024 {
+		for k, at := range *r {
+			if now.Sub(at) >= nakDebounce {
+				delete(*r, k)
+			}
+		}
+	}
+	(*r)[nak] = now
+	return false
+}
+
+func readRegion(data []byte, i int) (Region, int, error) {
 	start, n := binary.Uvarint(data[i:])
+	if n <= 0 {
+		return Region{}, i, ErrBadRegionList
+	}
 	i += n
 	endEx, n := binary.Uvarint(data[i:])
+	if n <= 0 || endEx < start || endEx > math.MaxInt64 {
+		return Region{}, i, ErrBadRegionList
+	}
 	i += n
-	return Region{int64(start), int64(endEx)}, i
+	return Region{int64(start), int64(endEx)}, i, nil
 }
 
-func (s *Server) buildMetadata() error {
+// Decodes an AckDataSection message: the region last ACKed followed by the NAKed regions, all as
+// uvarint pairs of [start, endEx]:
+func decodeAckDataSection(data []byte) (ack Region, naks []Region, err error) {
+	i := 0
+	if ack, i, err = readRegion(data, i); err != nil {
+		return Region{}, nil, err
+	}
+	for i < len(data) {
+		var nak Region
+		if nak, i, err = readRegion(data, i); err != nil {
+			return Region{}, nil, err
+		}
+		naks = append(naks, nak)
+	}
+	return ack, naks, nil
+}
+
+func encodeMetadata(tb *VirtualTarballReader) ([]byte, error) {
 	err := error(nil)
 
-	tb := s.tb
-	mdSize := (2 + 8) + (len(tb.files) * (2 + 40 + 8 + 4 + 32))
+	mdSize := (2 + 8) + (len(tb.files) * (2 + 40 + 8 + 4 + 32 + 8 + 2 + 32 + 4 + 4))
 	mdBuf := bytes.NewBuffer(make([]byte, 0, mdSize))
 
 	writePrimitive := func(data interface{}) {
@@ -337,21 +1478,71 @@ func (s *Server) buildMetadata() error {
 
 	writePrimitive(tb.size)
 	writePrimitive(uint32(len(tb.files)))
-	fmt.Print("Files:\n")
 	for _, f := range tb.files {
 		writeString(f.Path)
 		writePrimitive(f.Size)
 		writePrimitive(f.Mode)
 		writeString(f.SymlinkDestination)
-		fmt.Printf("  %v %15s '%s'\n", f.Mode, humanize.Comma(f.Size), f.Path)
+	}
+	// Modification times trail the file list so older clients can ignore them:
+	for _, f := range tb.files {
+		writePrimitive(unixNanos(f.ModTime))
+	}
+	// Followed by SHA-256 content hashes; empty when unknown or hashed otherwise:
+	for _, f := range tb.files {
+		writeString(string(hashBy(f, HashSHA256)))
+	}
+	// Then owning user and group IDs; -1 when unknown:
+	for _, f := range tb.files {
+		uid, gid := int32(-1), int32(-1)
+		if f.HasOwner {
+			uid, gid = int32(f.Uid), int32(f.Gid)
+		}
+		writePrimitive(uid)
+		writePrimitive(gid)
+	}
+	// Then runs of zeros within the contents as offset and length pairs:
+	for _, f := range tb.files {
+		writePrimitive(uint32(len(f.Sparse)))
+		for _, e := range f.Sparse {
+			writePrimitive(e.start)
+			writePrimitive(e.endEx - e.start)
+		}
+	}
+	// Then hard link targets; empty for files with contents of their own:
+	for _, f := range tb.files {
+		writeString(f.LinkTarget)
+	}
+	// Then the algorithm contents were hashed with and, unless SHA-256, those hashes. Older clients
+	// only see SHA-256 hashes so they never verify against hashes of another kind:
+	writePrimitive(tb.options.HashAlgorithm)
+	if tb.options.HashAlgorithm != HashSHA256 {
+		for _, f := range tb.files {
+			writeString(string(hashBy(f, tb.options.HashAlgorithm)))
+		}
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return mdBuf.Bytes(), nil
+}
+
+func (s *Server) buildMetadata() error {
+	md, err := encodeMetadata(s.tb)
 	if err != nil {
 		return err
 	}
 
-	// Slice into sections:
-	md := mdBuf.Bytes()
+	s.log.Infof("Files:")
+	for _, f := range s.tb.files {
+		s.log.Infof("  %v %15s '%s'", f.Mode, humanize.Comma(f.Size), f.Path)
+	}
+	if sparse := s.tb.SparseSize(); sparse > 0 && s.skipsSparse() {
+		s.log.Infof("%15s bytes of zeros won't be sent", humanize.Comma(sparse))
+	}
 
+	// Slice into sections:
 	sectionSize := (s.m.MaxMessageSize() - (protocolControlPrefixSize + metadataSectionMsgSize))
 	sectionCount := len(md) / sectionSize
 	if sectionCount*sectionSize < len(md) {
@@ -377,9 +1568,28 @@ func (s *Server) buildMetadata() error {
 		o += l
 	}
 
-	// Create metadata header to describe how many sections there are:
+	// Create metadata header to describe how many sections there are and how data regions are encoded:
 	s.metadataHeader = make([]byte, metadataHeaderMsgSize)
-	byteOrder.PutUint16(s.metadataHeader, uint16(sectionCount))
+	byteOrder.PutUint16(s.metadataHeader[0:2], uint16(sectionCount))
+	s.metadataHeader[2] = byte(s.options.Compression)
+	if s.options.Checksum {
+		s.metadataHeader[2] |= checksumFlag
+	}
+	byteOrder.PutUint64(s.metadataHeader[3:11], uint64(s.streamSize))
+	s.metadataHeader[11] = byte(s.options.FEC.DataShards)
+	s.metadataHeader[12] = byte(s.options.FEC.ParityShards)
+	byteOrder.PutUint16(s.metadataHeader[13:15], s.regionSize)
+	if s.m.cipher != nil {
+		if s.salt, err = newSalt(); err != nil {
+			return err
+		}
+		copy(s.metadataHeader[15:15+saltSize], s.salt)
+	}
+	digest := sha256.Sum256(md)
+	copy(s.metadataHeader[metadataDigestOffset:], digest[:])
+	if s.options.SigningKey != nil {
+		s.metadataHeader = signMetadataHeader(s.options.SigningKey, s.hashId, s.metadataHeader)
+	}
 
 	return nil
 }
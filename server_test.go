@@ -0,0 +1,369 @@
+package lancaster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func newTestServer(size int64, options ServerOptions) *Server {
+	s := &Server{
+		tb:      &VirtualTarballReader{size: size},
+		options: options,
+		log:     defaultLogger(),
+		hashId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		clients: newClientTracker(options.ClientTimeout),
+	}
+	s.stream, s.streamSize = s.tb, size
+	s.nakRegions = NewNakRegions(size)
+	s.nakRegions.Ack(0, size)
+	return s
+}
+
+func ackMessage(hashId []byte, ack Region, naks ...Region) UDPMessage {
+	buf := make([]byte, 0, 64)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, r := range append([]Region{ack}, naks...) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(r.start))]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(r.endEx))]...)
+	}
+	return UDPMessage{Data: controlToServerMessage(hashId, AckDataSection, buf)}
+}
+
+func TestServer_RetransmitBudget(t *testing.T) {
+	s := newTestServer(100, ServerOptions{MaxRetransmitRatio: 2})
+
+	// Within budget NAKs are honored:
+	s.bytesSent = 150
+	if err := s.processControl(ackMessage(s.hashId, Region{0, 0}, Region{10, 20})); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{10, 20}})
+
+	// Once exhausted only ACKs are applied:
+	s.bytesSent = 200
+	if err := s.processControl(ackMessage(s.hashId, Region{10, 20}, Region{50, 60})); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{})
+	if !s.retransmitCapped {
+		t.Fatal("expected retransmitCapped")
+	}
+}
+
+func TestServer_Carousel(t *testing.T) {
+	s := newTestServer(100, ServerOptions{})
+	if s.hasDataToSend() {
+		t.Fatal("expected nothing to send until NAKed")
+	}
+
+	s = newTestServer(100, ServerOptions{Carousel: true})
+	if !s.hasDataToSend() {
+		t.Fatal("expected carousel to always have data to send")
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{0, 100}})
+
+	// Once a cycle completes it starts over:
+	s.nakRegions.Ack(0, 100)
+	if !s.hasDataToSend() {
+		t.Fatal("expected carousel to start another cycle")
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{0, 100}})
+}
+
+func TestServer_RequestDataRegions(t *testing.T) {
+	s := newTestServer(100, ServerOptions{})
+	req, _ := encodeRegionList([]Region{{10, 20}, {50, 60}, {90, 100}}, 64)
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(s.hashId, RequestDataRegions, req)}); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{10, 20}, {50, 60}, {90, 100}})
+
+	// Still understands the single-message ACK/NAK form:
+	if err := s.processControl(ackMessage(s.hashId, Region{10, 20}, Region{0, 5})); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{0, 5}, {50, 60}, {90, 100}})
+}
+
+func TestServer_DebouncesRepeatedNaks(t *testing.T) {
+	s := newTestServer(100, ServerOptions{Metrics: NewMetrics()})
+	s.metrics = s.options.Metrics
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	// 1. Every client that lost the same region asks for it at once; it's counted once:
+	req, _ := encodeRegionList([]Region{{10, 20}, {50, 60}}, 64)
+	for _, from := range []*net.UDPAddr{a, b, a} {
+		if err := s.processControl(UDPMessage{Data: controlToServerMessage(s.hashId, RequestDataRegions, req), SourceAddress: from}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.metrics.retransmitRequests; n != 2 {
+		t.Fatalf("expected 2 regions requested got %d", n)
+	}
+
+	// 2. A repeat arriving just after the region was resent doesn't send it again:
+	s.nakRegions.Ack(10, 20)
+	msg := ackMessage(s.hashId, Region{0, 0}, Region{10, 20})
+	msg.SourceAddress = b
+	if err := s.processControl(msg); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{50, 60}})
+
+	// 3. Once the window has passed it's a fresh loss:
+	for k := range s.recentNaks {
+		s.recentNaks[k] = time.Now().Add(-nakDebounce)
+	}
+	if err := s.processControl(msg); err != nil {
+		t.Fatal(err)
+	}
+	cmp(t, s.nakRegions.Naks(), []Region{{10, 20}, {50, 60}})
+}
+
+func TestServer_TracksClients(t *testing.T) {
+	s := newTestServer(100, ServerOptions{})
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+	// Progress is everything before the first hole:
+	msg := ackMessage(s.hashId, Region{0, 10}, Region{30, 40})
+	msg.SourceAddress = a
+	if err := s.processControl(msg); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := encodeRegionList([]Region{{60, 70}}, 64)
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(s.hashId, RequestDataRegions, req), SourceAddress: b}); err != nil {
+		t.Fatal(err)
+	}
+	clients := s.Clients()
+	if len(clients) != 2 || clients[0].Acked != 30 || clients[1].Acked != 60 {
+		t.Fatalf("unexpected clients %v", clients)
+	}
+
+	// A truncated ACK is dropped rather than taken as progress:
+	for _, cut := range []int{1, 3} {
+		msg = ackMessage(s.hashId, Region{0, 10}, Region{300, 400})
+		msg.Data, msg.SourceAddress = msg.Data[:len(msg.Data)-cut], a
+		if err := s.processControl(msg); err != ErrBadRegionList {
+			t.Fatalf("expected %v got %v", ErrBadRegionList, err)
+		}
+	}
+	if clients = s.Clients(); clients[0].Acked != 30 {
+		t.Fatalf("expected progress to stay at 30 got %d", clients[0].Acked)
+	}
+
+	// An empty request reports completion:
+	req, _ = encodeRegionList(nil, 64)
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(s.hashId, RequestDataRegions, req), SourceAddress: b}); err != nil {
+		t.Fatal(err)
+	}
+	if clients = s.Clients(); !clients[1].Complete(s.streamSize) {
+		t.Fatalf("expected %s to be complete", clients[1].Address)
+	}
+}
+
+func TestServer_AnswersDiscovery(t *testing.T) {
+	s := newTestServer(100, ServerOptions{})
+	s.announceMsg = controlToClientMessage(s.hashId, AnnounceTarball, nil)
+	s.m = newLoopbackMulticast(t, net.IPv4(239, 0, 0, 104), 13730)
+	defer s.m.Close()
+	if err := s.m.SendsControlToClient(); err != nil {
+		t.Skipf("cannot open group on loopback: %s", err)
+	}
+
+	// Requests for another transfer are left to its own server:
+	other := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(other, RequestAnnouncement, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.lastAnnounce.IsZero() {
+		t.Fatal("expected no announcement for another transfer")
+	}
+
+	for _, hashId := range [][]byte{anyHashId, s.hashId} {
+		s.lastAnnounce = time.Time{}
+		if err := s.processControl(UDPMessage{Data: controlToServerMessage(hashId, RequestAnnouncement, nil)}); err != nil {
+			t.Fatal(err)
+		}
+		if s.lastAnnounce.IsZero() {
+			t.Fatalf("expected an announcement for %v", hashId)
+		}
+	}
+
+	// A burst of requests is answered once:
+	announced := s.lastAnnounce
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(anyHashId, RequestAnnouncement, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.lastAnnounce.Equal(announced) {
+		t.Fatal("expected the request to be covered by the last announcement")
+	}
+}
+
+func TestServer_NoticesReplaced(t *testing.T) {
+	s := newTestServer(100, ServerOptions{})
+	s.m = newLoopbackMulticast(t, net.IPv4(239, 0, 0, 104), 13890)
+	defer s.m.Close()
+	if err := s.m.SendsControlToClient(); err != nil {
+		t.Skipf("cannot open group on loopback: %s", err)
+	}
+	oldId := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	s.replaced = map[string]time.Time{hex.EncodeToString(oldId): {}}
+
+	// 1. A client still on the old ID is told the new one instead of being sent anything:
+	req, _ := encodeRegionList([]Region{{0, 100}}, 64)
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(oldId, RequestDataRegions, req)}); err != nil {
+		t.Fatal(err)
+	}
+	noticed := s.replaced[hex.EncodeToString(oldId)]
+	if noticed.IsZero() {
+		t.Fatal("expected a notice for the old ID")
+	}
+	if !s.nakRegions.IsAllAcked() {
+		t.Fatalf("expected nothing queued for the old ID; got %v", s.nakRegions.Naks())
+	}
+
+	// 2. A burst of requests is answered once:
+	if err := s.processControl(UDPMessage{Data: controlToServerMessage(oldId, RequestAnnouncement, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.replaced[hex.EncodeToString(oldId)].Equal(noticed) {
+		t.Fatal("expected the request to be covered by the last notice")
+	}
+}
+
+func TestServer_AddFilesUnsupported(t *testing.T) {
+	// 1. Regions of a compressed stream don't map onto files:
+	s := newTestServer(100, ServerOptions{Compression: CompressGzip})
+	if err := s.AddFiles(nil); err != ErrAppendUnsupported {
+		t.Fatalf("expected %v got %v", ErrAppendUnsupported, err)
+	}
+
+	// 2. Nothing takes the files once Run has returned:
+	s = newTestServer(100, ServerOptions{})
+	s.stop = make(chan empty)
+	close(s.stop)
+	if err := s.AddFiles(nil); err != ErrNotServing {
+		t.Fatalf("expected %v got %v", ErrNotServing, err)
+	}
+}
+
+func TestServer_ChunkSize(t *testing.T) {
+	cases := []struct {
+		options  ServerOptions
+		expected int
+	}{
+		{ServerOptions{}, DefaultDatagramSize - ProtocolDataMsgPrefixSize},
+		{ServerOptions{Checksum: true}, DefaultDatagramSize - ProtocolDataMsgPrefixSize - dataChecksumSize},
+		{ServerOptions{ChunkSize: 1400}, 1400},
+		{ServerOptions{ChunkSize: 1400, Checksum: true}, 1400},
+	}
+	for i, c := range cases {
+		s := newTestServer(100, c.options)
+		s.m = &Multicast{datagramSize: DefaultDatagramSize}
+		if actual := s.chunkSize(); actual != c.expected {
+			t.Fatalf("%d: expected %d got %d", i, c.expected, actual)
+		}
+	}
+
+	// Headers of a 1400 byte chunk fit within Ethernet's MTU:
+	m := &Multicast{datagramSize: DefaultDatagramSize}
+	if size := m.packetSize(1400 + ProtocolDataMsgPrefixSize); size != 1445 {
+		t.Fatalf("expected 1445 byte packets got %d", size)
+	}
+	m.ipv6 = true
+	if size := m.packetSize(1400 + ProtocolDataMsgPrefixSize); size != 1465 {
+		t.Fatalf("expected 1465 byte packets got %d", size)
+	}
+}
+
+func TestServer_DiscoverChunkSize(t *testing.T) {
+	cases := []struct {
+		mtu      int
+		checksum bool
+		expected int
+	}{
+		// Ethernet less IPv4, UDP and the data message prefix:
+		{1500, false, 1500 - 20 - 8 - ProtocolDataMsgPrefixSize},
+		{9000, true, 9000 - 20 - 8 - ProtocolDataMsgPrefixSize - dataChecksumSize},
+		// Loopback's MTU is larger than a datagram:
+		{65536, false, DefaultDatagramSize - ProtocolDataMsgPrefixSize},
+		// Unknown or nonsensical:
+		{0, false, fallbackChunkSize},
+		{40, false, fallbackChunkSize},
+	}
+	for i, c := range cases {
+		s := newTestServer(100, ServerOptions{Checksum: c.checksum})
+		s.m = &Multicast{datagramSize: DefaultDatagramSize, netInterfaces: []*net.Interface{{Name: "test0", MTU: c.mtu}}}
+		if actual := s.discoverChunkSize(); actual != c.expected {
+			t.Fatalf("%d: expected %d got %d", i, c.expected, actual)
+		}
+	}
+}
+
+// Every layout of the files seals data under a salt of its own, so transfers sharing a key never
+// reuse a nonce:
+func TestServer_FreshSaltPerLayout(t *testing.T) {
+	p, err := NewPacketCipher(make([]byte, pskSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	salts := [][]byte(nil)
+	for i := 0; i < 2; i++ {
+		s := newTestServer(100, ServerOptions{})
+		s.m = &Multicast{cipher: p, datagramSize: 1500}
+		for j := 0; j < 2; j++ {
+			if err = s.buildMetadata(); err != nil {
+				t.Fatal(err)
+			}
+			if salt := s.metadataHeader[15 : 15+saltSize]; !bytes.Equal(salt, s.salt) {
+				t.Fatalf("expected header to announce %x got %x", s.salt, salt)
+			}
+			for _, salt := range salts {
+				if bytes.Equal(salt, s.salt) {
+					t.Fatalf("salt %x reused", salt)
+				}
+			}
+			salts = append(salts, s.salt)
+		}
+	}
+}
+
+func TestServer_FollowsRateSchedule(t *testing.T) {
+	s := newTestServer(100, ServerOptions{ChunkSize: 1000})
+	s.limiter = rate.NewLimiter(rate.Inf, 1)
+	s.share = 1
+	if err := s.SetRateRange(1000, 0); err != ErrNoRateRange {
+		t.Fatalf("expected ErrNoRateRange without congestion control got %v", err)
+	}
+
+	s.congestion = newCongestionController(1000, 100000)
+	schedule, err := ParseRateSchedule("max-rate 50KB\n08:00 rate 20KB\n20:00 rate 40KB\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.schedule = schedule
+	morning := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	s.followSchedule(morning)
+	if s.congestion.max != 50000 || s.congestion.cap != 20000 {
+		t.Fatalf("expected range up to 50KB capped at 20KB got %v capped at %v", s.congestion.max, s.congestion.cap)
+	}
+
+	// Changes since hold until the next step:
+	s.SetRate(30000)
+	s.followSchedule(morning.Add(time.Hour))
+	if s.congestion.cap != 30000 {
+		t.Fatalf("expected the rate set since to hold got %v", s.congestion.cap)
+	}
+	s.followSchedule(morning.Add(12 * time.Hour))
+	if s.congestion.cap != 40000 {
+		t.Fatalf("expected the evening step to apply got %v", s.congestion.cap)
+	}
+}
@@ -0,0 +1,89 @@
+// session.go
+package lancaster
+
+import (
+	"context"
+	"sync"
+)
+
+// Session runs a Server, MultiServer or Client in the background for programs embedding lancaster
+// rather than running the command. Start it once, read progress until the channel closes, then Wait
+// for the result.
+type Session struct {
+	run      func() error
+	stop     func()
+	progress <-chan ProgressEvent
+	// Holds back or lets data go again when serving; nil for clients:
+	pause  func()
+	resume func()
+
+	once sync.Once
+	done chan empty
+	err  error
+}
+
+// A session serving `tb` over `m`:
+func NewServerSession(m *Multicast, tb *VirtualTarballReader, options ServerOptions) *Session {
+	s := NewServer(m, tb, options)
+	return &Session{
+		run:      s.Run,
+		stop:     s.Stop,
+		progress: s.Progress(),
+		pause:    s.Pause,
+		resume:   s.Resume,
+		done:     make(chan empty),
+	}
+}
+
+// A session downloading the transfer chosen by `options` over `m`:
+func NewClientSession(m *Multicast, options ClientOptions) *Session {
+	c := NewClient(m, options)
+	return &Session{
+		run:      c.Run,
+		stop:     c.Stop,
+		progress: c.Progress(),
+		done:     make(chan empty),
+	}
+}
+
+// Runs the session until it completes or `ctx` is done, in which case it is stopped and cleans up
+// as on an interrupt. The events are those of the Client's or Server's Progress.
+func (s *Session) Start(ctx context.Context) <-chan ProgressEvent {
+	s.once.Do(func() {
+		result := make(chan error, 1)
+		go func() {
+			result <- s.run()
+		}()
+		go func() {
+			select {
+			case s.err = <-result:
+			case <-ctx.Done():
+				s.stop()
+				if s.err = <-result; s.err == nil {
+					s.err = ctx.Err()
+				}
+			}
+			close(s.done)
+		}()
+	})
+	return s.progress
+}
+
+// Stops sending data until Resume when serving, as Server.Pause; clients have nothing to pause:
+func (s *Session) Pause() {
+	if s.pause != nil {
+		s.pause()
+	}
+}
+
+func (s *Session) Resume() {
+	if s.resume != nil {
+		s.resume()
+	}
+}
+
+// Waits for a started session to finish and returns why it did; nil when it completed:
+func (s *Session) Wait() error {
+	<-s.done
+	return s.err
+}
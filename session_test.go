@@ -0,0 +1,185 @@
+package lancaster
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSession_ServeAndDownload(t *testing.T) {
+	src, err := ioutil.TempDir("", "lancaster-session-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "lancaster-session-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if err = ioutil.WriteFile(filepath.Join(src, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := BuildTarball([]string{src + ":::"}, nil, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	quiet := NewLogger(ioutil.Discard, LogInfo, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13760)
+	serveCtx, stopServing := context.WithCancel(ctx)
+	serving := NewServerSession(sm, tb, ServerOptions{Rate: 2 * 1000 * 1000, RefreshRate: 50 * time.Millisecond, Logger: quiet, Quiet: true})
+	sent := make(chan int64, 1)
+	counted := make(chan empty)
+	go func() {
+		last := ProgressEvent{}
+		for e := range serving.Start(serveCtx) {
+			if e.ClientsCompleted == 1 && last.ClientsCompleted == 0 {
+				close(counted)
+			}
+			last = e
+		}
+		if !last.Done || last.ClientsCompleted != 1 {
+			t.Errorf("expected a final event with the client completed got %+v", last)
+		}
+		sent <- last.Bytes
+	}()
+
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13760)
+	options := getOptions()
+	options.OutputDir = dst
+	downloading := NewClientSession(cm, ClientOptions{HashId: tb.HashId(), TarballOptions: options, RefreshRate: 50 * time.Millisecond, Logger: quiet, Quiet: true})
+	last := ProgressEvent{}
+	completed := []string{}
+	for e := range downloading.Start(ctx) {
+		if e.Bytes < last.Bytes || last.Done {
+			t.Fatalf("expected progress to grow until done; %+v after %+v", e, last)
+		}
+		completed = append(completed, e.Completed...)
+		last = e
+	}
+	if err = downloading.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !last.Done || last.Err != nil || last.Size != tb.Size() || last.Percent < 100 {
+		t.Fatalf("expected a final event for the whole transfer got %+v", last)
+	}
+	if len(completed) != 2 || completed[0] != "a.bin" && completed[1] != "a.bin" || completed[0] == completed[1] {
+		t.Fatalf("expected each file reported complete once: %v", completed)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dst, "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, contents) {
+		t.Fatal("unexpected contents")
+	}
+
+	// The client tells the server it's complete as it finishes; let that arrive:
+	select {
+	case <-counted:
+	case <-time.After(5 * time.Second):
+	}
+
+	// Cancelling stops the server, which otherwise runs until interrupted:
+	stopServing()
+	if err = serving.Wait(); err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+	if <-sent == 0 {
+		t.Fatal("expected server progress")
+	}
+}
+
+func TestSession_PauseResume(t *testing.T) {
+	src, err := ioutil.TempDir("", "lancaster-pause-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "lancaster-pause-dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err = ioutil.WriteFile(filepath.Join(src, "a.bin"), bytes.Repeat([]byte("0123456789abcdef"), 16*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := BuildTarball([]string{src + ":::"}, nil, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	quiet := NewLogger(ioutil.Discard, LogInfo, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13830)
+	serving := NewServerSession(sm, tb, ServerOptions{RefreshRate: 50 * time.Millisecond, Logger: quiet, Quiet: true})
+	serving.Pause()
+	go func() {
+		for range serving.Start(ctx) {
+		}
+	}()
+	defer serving.Wait()
+	defer cancel()
+
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13830)
+	options := getOptions()
+	options.OutputDir = dst
+	downloading := NewClientSession(cm, ClientOptions{HashId: tb.HashId(), TarballOptions: options, RefreshRate: 50 * time.Millisecond, Logger: quiet, Quiet: true})
+	events := downloading.Start(ctx)
+
+	// Metadata is still answered while paused, but no data arrives:
+	paused := (<-chan time.Time)(nil)
+wait:
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok || e.Done {
+				t.Fatalf("expected the download to wait while paused got %+v", e)
+			}
+			if e.Bytes > 0 {
+				t.Fatalf("expected no data while paused got %+v", e)
+			}
+			if paused == nil && e.Size == tb.Size() {
+				paused = time.After(time.Second)
+			}
+		case <-paused:
+			break wait
+		}
+	}
+
+	serving.Resume()
+	for range events {
+	}
+	if err = downloading.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, "a.bin")); err != nil {
+		t.Fatal(err)
+	}
+}
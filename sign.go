@@ -0,0 +1,170 @@
+// sign.go
+package lancaster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+var (
+	ErrBadSigningKey = errors.New("signing key file must hold a 64 hex character Ed25519 seed")
+	ErrBadPublicKey  = errors.New("public key must be 64 hex characters (Ed25519)")
+)
+
+// Domain separation so an announcement signature can't be passed off as a header signature:
+const announcementSignContext = "lancaster announcement\x00"
+const metadataHeaderSignContext = "lancaster metadata header\x00"
+const sourceSignContext = "lancaster source\x00"
+const dataGroupSignContext = "lancaster data group\x00"
+const replacedSignContext = "lancaster replaced\x00"
+
+// Signed announcement payload: uint16 metadata section count, then the signature.
+const signedAnnouncementSize = 2 + ed25519.SignatureSize
+
+func GenerateSigningKey(path string) (ed25519.PublicKey, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrBadSigningKey
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	pub, err := hex.DecodeString(s)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, ErrBadPublicKey
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+func signedMessage(context string, hashId []byte, data []byte) []byte {
+	msg := bytes.NewBufferString(context)
+	msg.Write(hashId[:HashSize])
+	msg.Write(data)
+	return msg.Bytes()
+}
+
+// Announcement payload vouching for the transfer and how many metadata sections it has:
+func signAnnouncement(key ed25519.PrivateKey, hashId []byte, sectionCount uint16) []byte {
+	count := make([]byte, 2)
+	byteOrder.PutUint16(count, sectionCount)
+	return append(count, ed25519.Sign(key, signedMessage(announcementSignContext, hashId, count))...)
+}
+
+// Returns the announced metadata section count if the announcement is signed by `pub`:
+func verifyAnnouncement(pub ed25519.PublicKey, hashId []byte, data []byte) (uint16, bool) {
+	if len(data) != signedAnnouncementSize {
+		return 0, false
+	}
+	if !ed25519.Verify(pub, signedMessage(announcementSignContext, hashId, data[:2]), data[2:]) {
+		return 0, false
+	}
+	return byteOrder.Uint16(data[0:2]), true
+}
+
+// Appends a signature over the whole header; clients that don't verify ignore trailing bytes:
+func signMetadataHeader(key ed25519.PrivateKey, hashId []byte, header []byte) []byte {
+	return append(header, ed25519.Sign(key, signedMessage(metadataHeaderSignContext, hashId, header))...)
+}
+
+// Returns the header without its signature if signed by `pub`:
+func verifyMetadataHeader(pub ed25519.PublicKey, hashId []byte, data []byte) ([]byte, bool) {
+	if len(data) < ed25519.SignatureSize {
+		return nil, false
+	}
+	header := data[:len(data)-ed25519.SignatureSize]
+	if !ed25519.Verify(pub, signedMessage(metadataHeaderSignContext, hashId, header), data[len(header):]) {
+		return nil, false
+	}
+	return header, true
+}
+
+// Source announcement payload: the address's length and the address the server sends from, then a
+// signature over both when signing:
+func encodeSource(key ed25519.PrivateKey, hashId []byte, source net.IP) []byte {
+	return encodeAddress(key, sourceSignContext, hashId, source)
+}
+
+// Returns the announced source, only if signed by `pub` when set:
+func decodeSource(pub ed25519.PublicKey, hashId []byte, data []byte) (net.IP, bool) {
+	return decodeAddress(pub, sourceSignContext, hashId, data)
+}
+
+// Data group announcement payload, laid out like the source's:
+func encodeDataGroup(key ed25519.PrivateKey, hashId []byte, group net.IP) []byte {
+	return encodeAddress(key, dataGroupSignContext, hashId, group)
+}
+
+func decodeDataGroup(pub ed25519.PublicKey, hashId []byte, data []byte) (net.IP, bool) {
+	return decodeAddress(pub, dataGroupSignContext, hashId, data)
+}
+
+// Replaced notice payload: the new hashId, then a signature binding it to the old one when signing:
+func encodeReplaced(key ed25519.PrivateKey, oldId []byte, newId []byte) []byte {
+	data := append([]byte(nil), newId[:HashSize]...)
+	if key != nil {
+		data = append(data, ed25519.Sign(key, signedMessage(replacedSignContext, oldId, data))...)
+	}
+	return data
+}
+
+// Returns the ID `oldId` is now served under, only if signed by `pub` when set:
+func decodeReplaced(pub ed25519.PublicKey, oldId []byte, data []byte) ([]byte, bool) {
+	if len(data) < HashSize {
+		return nil, false
+	}
+	newId := data[:HashSize]
+	if pub != nil {
+		sig := data[HashSize:]
+		if len(sig) != ed25519.SignatureSize || !ed25519.Verify(pub, signedMessage(replacedSignContext, oldId, newId), sig) {
+			return nil, false
+		}
+	}
+	return append([]byte(nil), newId...), true
+}
+
+func encodeAddress(key ed25519.PrivateKey, context string, hashId []byte, ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	data := append([]byte{byte(len(ip))}, ip...)
+	if key != nil {
+		data = append(data, ed25519.Sign(key, signedMessage(context, hashId, data))...)
+	}
+	return data
+}
+
+func decodeAddress(pub ed25519.PublicKey, context string, hashId []byte, data []byte) (net.IP, bool) {
+	if len(data) < 1 || (data[0] != net.IPv4len && data[0] != net.IPv6len) || len(data) < 1+int(data[0]) {
+		return nil, false
+	}
+	signed := data[:1+int(data[0])]
+	if pub != nil {
+		sig := data[len(signed):]
+		if len(sig) != ed25519.SignatureSize || !ed25519.Verify(pub, signedMessage(context, hashId, signed), sig) {
+			return nil, false
+		}
+	}
+	return net.IP(append([]byte(nil), signed[1:]...)), true
+}
@@ -0,0 +1,329 @@
+package lancaster
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSigningKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	dir, err := ioutil.TempDir("", "lancaster-sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key")
+	pub, err := GenerateSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(key.Public()) {
+		t.Fatal("loaded key does not match generated public key")
+	}
+	return pub, key
+}
+
+func TestParsePublicKey(t *testing.T) {
+	if _, err := ParsePublicKey(strings.Repeat("ab", ed25519.PublicKeySize)); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"", "abcd", strings.Repeat("zz", ed25519.PublicKeySize)} {
+		if _, err := ParsePublicKey(s); err != ErrBadPublicKey {
+			t.Fatalf("expected ErrBadPublicKey for %q got %v", s, err)
+		}
+	}
+}
+
+func TestSignAnnouncement(t *testing.T) {
+	pub, key := newTestSigningKey(t)
+	other, _ := newTestSigningKey(t)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	data := signAnnouncement(key, hashId, 3)
+	if count, ok := verifyAnnouncement(pub, hashId, data); !ok || count != 3 {
+		t.Fatalf("expected valid announcement of 3 sections got %d %v", count, ok)
+	}
+	if _, ok := verifyAnnouncement(other, hashId, data); ok {
+		t.Fatal("expected announcement to fail against another key")
+	}
+	if _, ok := verifyAnnouncement(pub, []byte{8, 7, 6, 5, 4, 3, 2, 1}, data); ok {
+		t.Fatal("expected announcement to fail for another hashId")
+	}
+	data[0]++
+	if _, ok := verifyAnnouncement(pub, hashId, data); ok {
+		t.Fatal("expected tampered section count to fail")
+	}
+	if _, ok := verifyAnnouncement(pub, hashId, nil); ok {
+		t.Fatal("expected unsigned announcement to fail")
+	}
+}
+
+func TestSignMetadataHeader(t *testing.T) {
+	pub, key := newTestSigningKey(t)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	header := []byte{3, 0, 1, 2, 3}
+
+	signed := signMetadataHeader(key, hashId, append([]byte(nil), header...))
+	got, ok := verifyMetadataHeader(pub, hashId, signed)
+	if !ok || string(got) != string(header) {
+		t.Fatalf("expected header %v got %v %v", header, got, ok)
+	}
+
+	// An announcement signature can't stand in for a header signature:
+	if _, ok = verifyMetadataHeader(pub, hashId, signAnnouncement(key, hashId, 3)); ok {
+		t.Fatal("expected announcement signature to be rejected for header")
+	}
+	if _, ok = verifyMetadataHeader(pub, hashId, header); ok {
+		t.Fatal("expected unsigned header to fail")
+	}
+}
+
+func TestClient_VerifiesAnnouncements(t *testing.T) {
+	m, conn := newTestClientMulticast(t)
+	defer conn.Close()
+
+	pub, key := newTestSigningKey(t)
+	_, rogue := newTestSigningKey(t)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	c := NewClient(m, ClientOptions{PublicKey: pub})
+
+	// Unsigned and badly signed announcements are ignored:
+	for _, data := range [][]byte{nil, signAnnouncement(rogue, hashId, 1)} {
+		if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, data)}); err != nil {
+			t.Fatal(err)
+		}
+		if c.state != ExpectAnnouncement || c.hashId != nil {
+			t.Fatal("expected untrusted announcement to be ignored")
+		}
+	}
+
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, signAnnouncement(key, hashId, 1))}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectMetadataHeader {
+		t.Fatalf("expected ExpectMetadataHeader got %v", c.state)
+	}
+
+	// A forged header is ignored while the genuine one is accepted:
+	header := make([]byte, metadataHeaderMsgSize)
+	byteOrder.PutUint16(header[0:2], 1)
+	forged := signMetadataHeader(rogue, hashId, append([]byte(nil), header...))
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataHeader, forged)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectMetadataHeader {
+		t.Fatal("expected forged header to be ignored")
+	}
+	genuine := signMetadataHeader(key, hashId, append([]byte(nil), header...))
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataHeader, genuine)}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != ExpectMetadataSections || c.metadataSectionCount != 1 {
+		t.Fatalf("expected ExpectMetadataSections with 1 section got %v %d", c.state, c.metadataSectionCount)
+	}
+}
+
+func TestEncodeSource(t *testing.T) {
+	pub, key := newTestSigningKey(t)
+	other, _ := newTestSigningKey(t)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	for _, ip := range []net.IP{net.IPv4(192, 0, 2, 1), net.ParseIP("2001:db8::1")} {
+		if source, ok := decodeSource(nil, hashId, encodeSource(nil, hashId, ip)); !ok || !source.Equal(ip) {
+			t.Fatalf("expected %s got %s %v", ip, source, ok)
+		}
+		// Clients not verifying ignore the signature:
+		if source, ok := decodeSource(nil, hashId, encodeSource(key, hashId, ip)); !ok || !source.Equal(ip) {
+			t.Fatalf("expected %s got %s %v", ip, source, ok)
+		}
+		if source, ok := decodeSource(pub, hashId, encodeSource(key, hashId, ip)); !ok || !source.Equal(ip) {
+			t.Fatalf("expected signed %s got %s %v", ip, source, ok)
+		}
+	}
+
+	ip := net.IPv4(192, 0, 2, 1)
+	if _, ok := decodeSource(other, hashId, encodeSource(key, hashId, ip)); ok {
+		t.Fatal("expected source to fail against another key")
+	}
+	if _, ok := decodeSource(pub, hashId, encodeSource(nil, hashId, ip)); ok {
+		t.Fatal("expected unsigned source to fail")
+	}
+	tampered := encodeSource(key, hashId, ip)
+	tampered[4]++
+	if _, ok := decodeSource(pub, hashId, tampered); ok {
+		t.Fatal("expected tampered source to fail")
+	}
+	for _, data := range [][]byte{nil, {4, 1, 2}, {5, 1, 2, 3, 4, 5}} {
+		if _, ok := decodeSource(nil, hashId, data); ok {
+			t.Fatalf("expected %v to be rejected", data)
+		}
+	}
+}
+
+func TestEncodeDataGroup(t *testing.T) {
+	pub, key := newTestSigningKey(t)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	group := net.IPv4(239, 1, 2, 3)
+
+	if g, ok := decodeDataGroup(pub, hashId, encodeDataGroup(key, hashId, group)); !ok || !g.Equal(group) {
+		t.Fatalf("expected signed %s got %s %v", group, g, ok)
+	}
+	// A source signature can't be passed off as a data group's:
+	if _, ok := decodeDataGroup(pub, hashId, encodeSource(key, hashId, group)); ok {
+		t.Fatal("expected a source announcement to fail as a data group")
+	}
+}
+
+func TestEncodeReplaced(t *testing.T) {
+	pub, key := newTestSigningKey(t)
+	oldId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	newId := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+
+	if id, ok := decodeReplaced(pub, oldId, encodeReplaced(key, oldId, newId)); !ok || !bytes.Equal(id, newId) {
+		t.Fatalf("expected signed %v got %v %v", newId, id, ok)
+	}
+	if id, ok := decodeReplaced(nil, oldId, encodeReplaced(nil, oldId, newId)); !ok || !bytes.Equal(id, newId) {
+		t.Fatalf("expected unsigned %v got %v %v", newId, id, ok)
+	}
+	// The signature binds the new ID to the old so a notice can't be replayed for another transfer:
+	if _, ok := decodeReplaced(pub, newId, encodeReplaced(key, oldId, newId)); ok {
+		t.Fatal("expected a notice for another transfer to fail")
+	}
+	if _, ok := decodeReplaced(pub, oldId, encodeReplaced(nil, oldId, newId)); ok {
+		t.Fatal("expected an unsigned notice to fail")
+	}
+}
+
+func TestClient_FollowsReplaced(t *testing.T) {
+	m, conn := newTestClientMulticast(t)
+	defer conn.Close()
+
+	pub, key := newTestSigningKey(t)
+	_, rogue := newTestSigningKey(t)
+	oldId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	newId := []byte{8, 7, 6, 5, 4, 3, 2, 1}
+	c := NewClient(m, ClientOptions{HashId: oldId, PublicKey: pub})
+	c.state = ExpectMetadataSections
+	notice := func(data []byte) {
+		if err := c.processControl(UDPMessage{Data: controlToClientMessage(oldId, AnnounceReplaced, data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1. A notice not signed by the server is ignored:
+	notice(encodeReplaced(rogue, oldId, newId))
+	if !bytes.Equal(c.hashId, oldId) || c.state != ExpectMetadataSections {
+		t.Fatalf("expected forged notice to be ignored; got %v in %v", c.hashId, c.state)
+	}
+
+	// 2. A genuine one starts over on the new ID:
+	notice(encodeReplaced(key, oldId, newId))
+	if !bytes.Equal(c.hashId, newId) || c.state != ExpectAnnouncement {
+		t.Fatalf("expected to follow to %v; got %v in %v", newId, c.hashId, c.state)
+	}
+}
+
+func TestClient_DiscoversSource(t *testing.T) {
+	m, conn := newTestClientMulticast(t)
+	defer conn.Close()
+
+	pub, key := newTestSigningKey(t)
+	_, rogue := newTestSigningKey(t)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	source := net.IPv4(192, 0, 2, 1)
+	c := NewClient(m, ClientOptions{PublicKey: pub, DiscoverSource: true})
+	announce := func(data []byte) {
+		if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, AnnounceSource, data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is learned before the transfer is chosen, or from a source not signed by the server:
+	announce(encodeSource(key, hashId, source))
+	if c.source != nil {
+		t.Fatal("expected source to be ignored before the announcement")
+	}
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, signAnnouncement(key, hashId, 1))}); err != nil {
+		t.Fatal(err)
+	}
+	announce(encodeSource(rogue, hashId, net.IPv4(192, 0, 2, 66)))
+	if c.source != nil {
+		t.Fatal("expected forged source to be ignored")
+	}
+
+	announce(encodeSource(key, hashId, source))
+	if !c.source.Equal(source) {
+		t.Fatalf("expected source %s got %s", source, c.source)
+	}
+	if c.state != ExpectMetadataHeader {
+		t.Fatalf("expected source announcement to leave state alone; got %v", c.state)
+	}
+
+	// Only messages from the source are taken:
+	if !c.fromSource(UDPMessage{SourceAddress: &net.UDPAddr{IP: source, Port: 1361}}) {
+		t.Fatal("expected message from source to be taken")
+	}
+	if c.fromSource(UDPMessage{SourceAddress: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 66), Port: 1361}}) {
+		t.Fatal("expected message from elsewhere to be ignored")
+	}
+}
+
+func TestClient_VerifiesMetadataSections(t *testing.T) {
+	m, conn := newTestClientMulticast(t)
+	defer conn.Close()
+
+	pub, key := newTestSigningKey(t)
+	hashId := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	c := NewClient(m, ClientOptions{PublicKey: pub, MetadataOnly: true})
+	if err := c.processControl(UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, signAnnouncement(key, hashId, 1))}); err != nil {
+		t.Fatal(err)
+	}
+
+	md, err := encodeMetadata(&VirtualTarballReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, metadataHeaderMsgSize)
+	byteOrder.PutUint16(header[0:2], 1)
+	digest := sha256.Sum256(md)
+	copy(header[metadataDigestOffset:], digest[:])
+	if err = c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataHeader, signMetadataHeader(key, hashId, header))}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sections that don't match the signed digest are asked for again rather than trusted:
+	forged := append([]byte{0, 0}, md...)
+	forged[len(forged)-1] ^= 1
+	if err = c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, forged)}); err != ErrMetadataMismatch {
+		t.Fatalf("expected %v got %v", ErrMetadataMismatch, err)
+	}
+	if c.state != ExpectMetadataSections || c.nextSectionIndex != 0 {
+		t.Fatalf("expected to ask for section 0 again got %v %d", c.state, c.nextSectionIndex)
+	}
+	if err = c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataSection, append([]byte{0, 0}, md...))}); err != nil {
+		t.Fatal(err)
+	}
+	if c.state != Done {
+		t.Fatalf("expected Done got %v", c.state)
+	}
+
+	// Signed headers without a digest leave nothing to check the sections against:
+	c = NewClient(m, ClientOptions{PublicKey: pub, MetadataOnly: true})
+	c.processControl(UDPMessage{Data: controlToClientMessage(hashId, AnnounceTarball, signAnnouncement(key, hashId, 1))})
+	err = c.processControl(UDPMessage{Data: controlToClientMessage(hashId, RespondMetadataHeader, signMetadataHeader(key, hashId, header[:metadataDigestOffset]))})
+	if !errors.Is(err, ErrBadMetadata) {
+		t.Fatalf("expected %v got %v", ErrBadMetadata, err)
+	}
+}
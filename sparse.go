@@ -0,0 +1,164 @@
+// sparse.go
+package lancaster
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+var ErrBadSparseExtent = errors.New("sparse extent outside file contents")
+
+// Zeros are looked for in blocks of this size, aligned to the start of the file:
+const sparseBlockSize = 4096
+
+// Shorter runs of zeros aren't worth their space in metadata:
+const minSparseExtent = 64 * 1024
+
+var zeroBlock = make([]byte, 256*1024)
+
+func isZeros(p []byte) bool {
+	for len(p) > 0 {
+		n := len(p)
+		if n > len(zeroBlock) {
+			n = len(zeroBlock)
+		}
+		if !bytes.Equal(p[:n], zeroBlock[:n]) {
+			return false
+		}
+		p = p[n:]
+	}
+	return true
+}
+
+// Hash of `size` bytes at `offset` within a file along with the runs of zeros in them. Holes in
+// sparse files read back as zeros so they are found the same as zeros written out in full.
+func scanFileSection(path string, offset int64, size int64, algorithm HashAlgorithm) ([]byte, []Region, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	h := algorithm.New()
+	sparse := []Region(nil)
+	run := Region{start: -1}
+	endRun := func(at int64) {
+		if run.start >= 0 && at-run.start >= minSparseExtent {
+			sparse = append(sparse, Region{start: run.start, endEx: at})
+		}
+		run.start = -1
+	}
+
+	r := io.NewSectionReader(f, offset, size)
+	buf := make([]byte, 256*sparseBlockSize)
+	pos := int64(0)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			for i := 0; i < n; i += sparseBlockSize {
+				end := i + sparseBlockSize
+				if end > n {
+					end = n
+				}
+				if !isZeros(buf[i:end]) {
+					endRun(pos + int64(i))
+				} else if run.start < 0 {
+					run.start = pos + int64(i)
+				}
+			}
+			pos += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	endRun(pos)
+
+	return h.Sum(nil), sparse, nil
+}
+
+// Writes `p` at `localOffset` within a file's contents except where it falls within a sparse extent,
+// which stays a hole. `base` is where the contents start within `w`.
+func writeAroundSparse(w io.WriterAt, p []byte, base int64, localOffset int64, sparse []Region) (int, error) {
+	end := localOffset + int64(len(p))
+	pos := localOffset
+	for _, e := range sparse {
+		if e.endEx <= pos {
+			continue
+		}
+		if e.start >= end {
+			break
+		}
+		if e.start > pos {
+			if _, err := w.WriteAt(p[pos-localOffset:e.start-localOffset], base+pos); err != nil {
+				return 0, err
+			}
+		}
+		pos = e.endEx
+	}
+	if pos < end {
+		if _, err := w.WriteAt(p[pos-localOffset:], base+pos); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Zeros whatever an existing file holds within its sparse extents since they are never written.
+// Only blocks that aren't zero already are written so holes stay holes.
+func clearSparse(f *os.File, sparse []Region) error {
+	buf := make([]byte, len(zeroBlock))
+	for _, e := range sparse {
+		for pos := e.start; pos < e.endEx; {
+			p := buf
+			if int64(len(p)) > e.endEx-pos {
+				p = p[:e.endEx-pos]
+			}
+			n, err := f.ReadAt(p, pos)
+			if err == io.EOF {
+				// Past the end of the file reads as zeros:
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+			if !isZeros(p[:n]) {
+				if _, err = f.WriteAt(zeroBlock[:n], pos); err != nil {
+					return err
+				}
+			}
+			if n == 0 {
+				break
+			}
+			pos += int64(n)
+		}
+	}
+	return nil
+}
+
+// Marks the sparse extents of every file as already transferred:
+func ackSparse(r *NakRegions, files tarballFileList) {
+	for _, f := range files {
+		for _, e := range f.Sparse {
+			r.Ack(f.offset+e.start, f.offset+e.endEx)
+		}
+	}
+}
+
+// Checks received extents are in order, don't overlap and lie within the file's contents:
+func validSparse(f *TarballFile) bool {
+	pos := int64(0)
+	for _, e := range f.Sparse {
+		if e.start < pos || e.endEx <= e.start || e.endEx > f.Size {
+			return false
+		}
+		pos = e.endEx
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package lancaster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanFileSection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// data | 128 KiB zeros | data | 32 KiB zeros | data | 64 KiB zeros
+	contents := []byte(nil)
+	data := bytes.Repeat([]byte{0x5a}, sparseBlockSize)
+	contents = append(contents, data...)
+	contents = append(contents, make([]byte, 128<<10)...)
+	contents = append(contents, data...)
+	contents = append(contents, make([]byte, 32<<10)...)
+	contents = append(contents, data...)
+	contents = append(contents, make([]byte, 64<<10)...)
+	path := filepath.Join(dir, "a")
+	if err = ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, sparse, err := scanFileSection(path, 0, int64(len(contents)), HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := hashFile(path, HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h, expected) {
+		t.Fatal("expected the hash of the whole file")
+	}
+
+	end := int64(len(contents))
+	want := []Region{{sparseBlockSize, sparseBlockSize + 128<<10}, {end - 64<<10, end}}
+	if len(sparse) != len(want) || sparse[0] != want[0] || sparse[1] != want[1] {
+		t.Fatalf("expected %v got %v", want, sparse)
+	}
+
+	// Offsets are relative to the section:
+	_, sparse, err = scanFileSection(path, sparseBlockSize, 128<<10, HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sparse) != 1 || sparse[0] != (Region{0, 128 << 10}) {
+		t.Fatalf("unexpected extents %v", sparse)
+	}
+}
+
+type recordingWriterAt struct {
+	buf []byte
+}
+
+func (w *recordingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(w.buf[off:], p), nil
+}
+
+func TestWriteAroundSparse(t *testing.T) {
+	w := &recordingWriterAt{buf: bytes.Repeat([]byte{'.'}, 20)}
+	sparse := []Region{{2, 4}, {6, 8}, {11, 20}}
+
+	// Writes contents 1..10 at base 5:
+	p := []byte("abcdefghi")
+	n, err := writeAroundSparse(w, p, 5, 1, sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(p) {
+		t.Fatalf("expected %d got %d", len(p), n)
+	}
+	if string(w.buf) != "......a..de..hi....." {
+		t.Fatalf("unexpected writes %q", w.buf)
+	}
+}
+
+func TestWriteAt_ClearsStaleSparseData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file left behind by something else:
+	const size = 256 << 10
+	if err = ioutil.WriteFile(filepath.Join(dir, "a"), bytes.Repeat([]byte{0xff}, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := getOptions()
+	options.OutputDir = dir
+	tb, err := NewVirtualTarballWriter([]*TarballFile{{Path: "a", Size: size, Mode: 0644, Sparse: []Region{{0, size - 1}}}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the last byte and the padding are ever received:
+	if _, err = tb.WriteAt([]byte{1, 0}, size-1); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(make([]byte, size-1), 1)
+	if !bytes.Equal(b, expected) {
+		t.Fatal("expected stale data within the sparse extent to be zeroed")
+	}
+}
+
+func TestClient_RunCompletesSparse(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13740)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13740)
+
+	// A mostly empty disk image:
+	contents := make([]byte, 16<<20)
+	copy(contents, "boot sector")
+	copy(contents[8<<20:], "superblock")
+	copy(contents[len(contents)-5:], "tail\n")
+
+	c := runTransfer(t, sm, cm, ServerOptions{}, ClientOptions{}, contents)
+	if c.bytesReceived > 1<<20 {
+		t.Fatalf("expected zeros not to be sent; received %d bytes", c.bytesReceived)
+	}
+}
@@ -0,0 +1,48 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lancaster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteAt_LeavesSparseHoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 64 << 20
+	options := getOptions()
+	options.OutputDir = dir
+	tb, err := NewVirtualTarballWriter([]*TarballFile{{Path: "disk.img", Size: size, Mode: 0644, Sparse: []Region{{sparseBlockSize, size}}}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Zeros received anyway, e.g. with FEC, are skipped too:
+	buf := make([]byte, size+1)
+	copy(buf, "boot sector")
+	if _, err = tb.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != size {
+		t.Fatalf("expected size %d got %d", size, stat.Size())
+	}
+	if allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512; allocated > 1<<20 {
+		t.Fatalf("expected a sparse file; %d bytes allocated", allocated)
+	}
+}
@@ -0,0 +1,11 @@
+// +build dragonfly netbsd openbsd solaris windows
+
+package lancaster
+
+import (
+	"net"
+)
+
+func joinSourceGroup(conn *net.UDPConn, ifi *net.Interface, group net.IP, source net.IP) error {
+	return ErrSourceSpecificUnsupported
+}
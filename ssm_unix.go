@@ -0,0 +1,51 @@
+// +build darwin freebsd linux
+
+package lancaster
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// Swaps the socket's any-source membership of `group` for one only receiving from `source`, going back
+// to any source if the system refuses:
+func joinSourceGroup(conn *net.UDPConn, ifi *net.Interface, group net.IP, source net.IP) error {
+	iface, err := interfaceIPv4(ifi)
+	if err != nil {
+		return err
+	}
+	mreq := &syscall.IPMreq{}
+	copy(mreq.Multiaddr[:], group.To4())
+	copy(mreq.Interface[:], iface)
+
+	// struct ip_mreq_source; Linux puts the interface before the source, the BSDs after:
+	mreqSource := make([]byte, 0, 12)
+	if runtime.GOOS == "linux" {
+		mreqSource = append(append(append(mreqSource, group.To4()...), iface...), source.To4()...)
+	} else {
+		mreqSource = append(append(append(mreqSource, group.To4()...), source.To4()...), iface...)
+	}
+
+	sysConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = sysConn.Control(func(fd uintptr) {
+		// Joining a source is refused while joined to any:
+		if serr = syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_DROP_MEMBERSHIP, mreq); serr != nil {
+			return
+		}
+		if joinErr := syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_SOURCE_MEMBERSHIP, string(mreqSource)); joinErr != nil {
+			serr = syscall.SetsockoptIPMreq(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq)
+			if serr == nil {
+				serr = sourceUnsupported(joinErr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
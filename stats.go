@@ -0,0 +1,36 @@
+// stats.go
+package lancaster
+
+import (
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Summary of a download, for comparing how transfers fare across network configurations:
+type ClientStats struct {
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"durationNs"`
+	// Bytes per second over the whole download and at its fastest refresh:
+	AverageRate float64 `json:"averageRate"`
+	PeakRate    float64 `json:"peakRate"`
+	// Regions asked to be sent again:
+	RetransmitRequests int64 `json:"retransmitRequests"`
+	// Data packets for regions already received:
+	DuplicatePackets int64 `json:"duplicatePackets"`
+	// Data packets not for this transfer, from another source, corrupted or arriving before the metadata:
+	IgnoredPackets int64 `json:"ignoredPackets"`
+	BytesRecovered int64 `json:"bytesRecovered"`
+}
+
+func (s ClientStats) report(log *Logger) {
+	log.Infof("%15s bytes in %v", humanize.Comma(s.Bytes), s.Duration)
+	log.Infof("%15s/s avg", humanize.IBytes(uint64(s.AverageRate)))
+	log.Infof("%15s/s peak", humanize.IBytes(uint64(s.PeakRate)))
+	log.Infof("%15s regions requested again", humanize.Comma(s.RetransmitRequests))
+	log.Infof("%15s duplicate data packets", humanize.Comma(s.DuplicatePackets))
+	log.Infof("%15s ignored data packets", humanize.Comma(s.IgnoredPackets))
+	if s.BytesRecovered > 0 {
+		log.Infof("%15s bytes rebuilt from parity", humanize.Comma(s.BytesRecovered))
+	}
+}
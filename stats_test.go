@@ -0,0 +1,57 @@
+// stats_test.go
+package lancaster
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestClient_StatsPeakRate(t *testing.T) {
+	c := &Client{options: ClientOptions{RefreshRate: time.Second}}
+
+	// 1. A full interval counts towards the peak:
+	c.lastTime = time.Now().Add(-2 * time.Second)
+	c.bytesReceived = 2000
+	c.reportBandwidth()
+	peak := c.Stats().PeakRate
+	if peak <= 0 || peak > 1000 {
+		t.Fatalf("expected a peak of up to 1000 B/s got %v", peak)
+	}
+
+	// 2. The final report's short interval doesn't, however fast it looks:
+	c.lastTime = time.Now().Add(-10 * time.Millisecond)
+	c.bytesReceived += 1000
+	c.reportBandwidth()
+	if c.Stats().PeakRate != peak {
+		t.Fatalf("expected the peak to stay %v got %v", peak, c.Stats().PeakRate)
+	}
+}
+
+func TestClient_StatsCountsPackets(t *testing.T) {
+	hashId := bytes.Repeat([]byte{1}, HashSize)
+	c := &Client{hashId: hashId}
+
+	// 1. Data before the metadata is ignored:
+	if err := c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("abcd"))}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().IgnoredPackets != 1 {
+		t.Fatalf("expected 1 ignored packet got %v", c.Stats().IgnoredPackets)
+	}
+
+	// 2. Data for another transfer is ignored, data already received is a duplicate:
+	c.tb = &VirtualTarballWriter{}
+	c.nakRegions = NewNakRegions(8)
+	c.nakRegions.Ack(0, 4)
+	if err := c.processData(UDPMessage{Data: dataMessage(bytes.Repeat([]byte{2}, HashSize), 0, []byte("abcd"))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processData(UDPMessage{Data: dataMessage(hashId, 0, []byte("abcd"))}); err != nil {
+		t.Fatal(err)
+	}
+	s := c.Stats()
+	if s.IgnoredPackets != 2 || s.DuplicatePackets != 1 {
+		t.Fatalf("expected 2 ignored and 1 duplicate got %v and %v", s.IgnoredPackets, s.DuplicatePackets)
+	}
+}
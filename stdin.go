@@ -0,0 +1,61 @@
+// stdin.go
+package lancaster
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Argument naming standard input as the payload, optionally renamed with "-::name":
+const StdinArg = "-"
+
+// Served filename for standard input when none is given:
+const DefaultStdinName = "stdin"
+
+var ErrStdinTwice = errors.New("standard input can only be served once")
+
+// Copies `r` to a temporary file since offsets into the stream must be known up front, hashing it
+// along the way. The file is marked to be removed by RemoveSpooled.
+func spoolStdin(r io.Reader, name string) (*TarballFile, error) {
+	f, err := ioutil.TempFile("", "lancaster-stdin")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	if name == "" {
+		name = DefaultStdinName
+	}
+	return &TarballFile{
+		Path:      name,
+		LocalPath: f.Name(),
+		Size:      size,
+		Mode:      0644,
+		ModTime:   time.Now(),
+		Hash:      h.Sum(nil),
+		spooled:   true,
+	}, nil
+}
+
+// Removes temporary files holding standard input or a decompressed archive:
+func RemoveSpooled(files []*TarballFile) {
+	for _, tf := range files {
+		if tf.spooled {
+			os.Remove(tf.LocalPath)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package lancaster
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSpoolStdin(t *testing.T) {
+	contents := []byte("piped contents\n")
+	tf, err := spoolStdin(bytes.NewReader(contents), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveSpooled([]*TarballFile{tf})
+
+	if tf.Path != DefaultStdinName || tf.Size != int64(len(contents)) {
+		t.Fatalf("unexpected entry '%s' of %d bytes", tf.Path, tf.Size)
+	}
+	h := sha256.Sum256(contents)
+	if !bytes.Equal(tf.Hash, h[:]) {
+		t.Fatal("unexpected hash")
+	}
+	b, err := ioutil.ReadFile(tf.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, contents) {
+		t.Fatalf("unexpected spooled contents %q", b)
+	}
+
+	// The spooled copy serves like any other file:
+	tb, err := NewVirtualTarballReader([]*TarballFile{tf}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, tb.size)
+	if _, err = tb.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	tb.Close()
+	if !bytes.Equal(buf[:len(contents)], contents) {
+		t.Fatalf("unexpected stream %q", buf)
+	}
+
+	RemoveSpooled([]*TarballFile{tf})
+	if _, err = os.Stat(tf.LocalPath); !os.IsNotExist(err) {
+		t.Fatal("expected spooled copy to be removed")
+	}
+}
+
+func TestBuildTarball_Stdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	go func() {
+		w.Write([]byte("from a pipe\n"))
+		w.Close()
+	}()
+
+	files, err := BuildTarball([]string{"-::piped.txt"}, nil, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveSpooled(files)
+	if len(files) != 1 || files[0].Path != "piped.txt" || files[0].Size != 12 {
+		t.Fatalf("unexpected files %v", tarballPaths(files))
+	}
+
+	if _, err = BuildTarball([]string{"-", "-::again"}, nil, false, false, 0, IncludeHidden); err != ErrStdinTwice {
+		t.Fatalf("expected %v got %v", ErrStdinTwice, err)
+	}
+}
@@ -0,0 +1,213 @@
+// tar.go
+package lancaster
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var ErrUnsupportedTarEntry = errors.New("unsupported tar entry")
+
+const tarBlockSize = 512
+
+// Lists the entries of a tar archive as files served straight out of the archive. Only regular files,
+// hard links, directories and symlinks are supported; compat mode only allows regular files and hard links.
+// A gzipped archive is decompressed to a temporary file first, since its entries can't be read at an
+// offset, and is marked to be removed by RemoveSpooled.
+func tarArchiveFiles(archivePath string, compat bool) ([]*TarballFile, error) {
+	gzipped, err := isGzipped(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if !gzipped {
+		return tarEntries(archivePath, compat)
+	}
+
+	spoolPath, err := spoolGunzip(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := tarEntries(spoolPath, compat)
+	if err != nil || len(files) == 0 {
+		os.Remove(spoolPath)
+		return nil, err
+	}
+	for _, tf := range files {
+		tf.spooled = true
+	}
+	return files, nil
+}
+
+// Whether `archivePath` is gzipped, going by a .tgz or .tar.gz extension or else its leading magic bytes:
+func isGzipped(archivePath string) (bool, error) {
+	lower := strings.ToLower(archivePath)
+	if strings.HasSuffix(lower, ".tgz") || strings.HasSuffix(lower, ".tar.gz") {
+		return true, nil
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err = io.ReadFull(f, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// Decompresses a gzipped archive into a temporary file and returns its path:
+func spoolGunzip(archivePath string) (string, error) {
+	in, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(in))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", archivePath, err)
+	}
+	defer zr.Close()
+
+	f, err := ioutil.TempFile("", "lancaster-tar")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, zr)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("%s: %w", archivePath, err)
+	}
+	return f.Name(), nil
+}
+
+func tarEntries(archivePath string, compat bool) ([]*TarballFile, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files := []*TarballFile(nil)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "./")
+		if name == "." {
+			// The archive's root directory:
+			continue
+		}
+		tf := &TarballFile{
+			Path:      name,
+			LocalPath: archivePath,
+			Mode:      hdr.FileInfo().Mode(),
+			ModTime:   hdr.ModTime,
+			Uid:       hdr.Uid,
+			Gid:       hdr.Gid,
+			HasOwner:  true,
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			// The reader consumes nothing past the header so this is where the contents start:
+			tf.LocalOffset, err = f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			tf.Size = hdr.Size
+		case tar.TypeDir:
+			if compat {
+				return nil, fmt.Errorf("%w: '%s'", ErrCompatViolation, hdr.Name)
+			}
+		case tar.TypeSymlink:
+			if compat {
+				return nil, fmt.Errorf("%w: '%s'", ErrCompatViolation, hdr.Name)
+			}
+			tf.SymlinkDestination = hdr.Linkname
+		case tar.TypeLink:
+			tf.LinkTarget = strings.TrimPrefix(path.Clean(hdr.Linkname), "./")
+		default:
+			return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedTarEntry, hdr.Name)
+		}
+		files = append(files, tf)
+	}
+	return files, nil
+}
+
+func tarHeader(tf *TarballFile) *tar.Header {
+	hdr := &tar.Header{
+		Name:    tf.Path,
+		Mode:    int64(tf.Mode.Perm()),
+		ModTime: tf.ModTime,
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = time.Unix(0, 0)
+	}
+	if tf.HasOwner {
+		hdr.Uid, hdr.Gid = tf.Uid, tf.Gid
+	}
+
+	switch {
+	case tf.Mode&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = tf.SymlinkDestination
+	case tf.Mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case tf.LinkTarget != "":
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = tf.LinkTarget
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = tf.Size
+	}
+	return hdr
+}
+
+// Writes every entry's header into `archive` and records where each file's contents go, leaving the
+// contents themselves to be filled in as regions arrive. Padding and the end-of-archive marker are zeros.
+func layoutTarArchive(archive *os.File, files []*TarballFile) error {
+	pos := int64(0)
+	for _, tf := range files {
+		buf := &bytes.Buffer{}
+		if err := tar.NewWriter(buf).WriteHeader(tarHeader(tf)); err != nil {
+			return err
+		}
+		if _, err := archive.WriteAt(buf.Bytes(), pos); err != nil {
+			return err
+		}
+		pos += int64(buf.Len())
+
+		tf.archiveOffset = pos
+		if tf.Mode&os.ModeType == 0 {
+			pos += (tf.Size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+		}
+	}
+
+	// Two zero blocks end the archive:
+	return archive.Truncate(pos + 2*tarBlockSize)
+}
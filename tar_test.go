@@ -0,0 +1,340 @@
+package lancaster
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTarModTime = time.Date(2003, 4, 5, 6, 7, 8, 0, time.UTC)
+
+// Writes an archive of a directory holding a file and a symlink to it plus a larger top-level file:
+func writeTestTar(t *testing.T, path string, extra ...*tar.Header) map[string]string {
+	contents := map[string]string{
+		"d/a.txt": "hello tar\n",
+		"b.bin":   strings.Repeat("0123456789", 1000),
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	headers := []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: testTarModTime},
+		{Name: "./d/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: testTarModTime},
+		{Name: "./d/a.txt", Typeflag: tar.TypeReg, Mode: 0640, Size: int64(len(contents["d/a.txt"])), ModTime: testTarModTime},
+		{Name: "./d/link", Typeflag: tar.TypeSymlink, Linkname: "a.txt", Mode: 0777, ModTime: testTarModTime},
+		{Name: "./b.bin", Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(contents["b.bin"])), ModTime: testTarModTime},
+	}
+	for _, hdr := range append(headers, extra...) {
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if c, ok := contents[strings.TrimPrefix(hdr.Name, "./")]; ok {
+			if _, err = tw.Write([]byte(c)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func readAllTarball(t *testing.T, tb *VirtualTarballReader) []byte {
+	buf := make([]byte, tb.size)
+	n, err := tb.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestTarArchiveFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "in.tar")
+	contents := writeTestTar(t, archive)
+
+	files, err := tarArchiveFiles(archive, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("expected 4 entries got %d", len(files))
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	if err = tb.HashFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tf := range tb.files {
+		if !tf.ModTime.Equal(testTarModTime) {
+			t.Fatalf("'%s' expected modification time %v got %v", tf.Path, testTarModTime, tf.ModTime)
+		}
+		switch tf.Path {
+		case "d":
+			if !tf.Mode.IsDir() || tf.Mode.Perm() != 0750 {
+				t.Fatalf("unexpected directory mode %v", tf.Mode)
+			}
+		case "d/link":
+			if tf.Mode&os.ModeSymlink == 0 || tf.SymlinkDestination != "a.txt" {
+				t.Fatalf("unexpected symlink %v -> '%s'", tf.Mode, tf.SymlinkDestination)
+			}
+		default:
+			c := contents[tf.Path]
+			b := make([]byte, tf.Size)
+			if _, err = tb.ReadAt(b, tf.offset); err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != c {
+				t.Fatalf("'%s' read back wrong contents", tf.Path)
+			}
+			h := sha256.Sum256([]byte(c))
+			if !bytes.Equal(tf.Hash, h[:]) {
+				t.Fatalf("'%s' hashed the wrong bytes", tf.Path)
+			}
+		}
+	}
+
+	// Compat mode only allows regular files:
+	if _, err = tarArchiveFiles(archive, true); !errors.Is(err, ErrCompatViolation) {
+		t.Fatalf("expected compat violation got %v", err)
+	}
+}
+
+func TestTarArchiveFiles_Gzipped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plain := filepath.Join(dir, "in.tar")
+	writeTestTar(t, plain)
+	raw, err := ioutil.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := &bytes.Buffer{}
+	zw := gzip.NewWriter(gz)
+	zw.Write(raw)
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tb := newTarArchiveReader(t, plain)
+	expected, expectedId := readAllTarball(t, tb), tb.HashId()
+	tb.Close()
+	// Known by extension, or sniffed without one:
+	for _, name := range []string{"in.tar.gz", "in.TGZ", "in"} {
+		archive := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(archive, gz.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tb := newTarArchiveReader(t, archive)
+		contents := readAllTarball(t, tb)
+		tb.Close()
+		if !bytes.Equal(contents, expected) {
+			t.Fatalf("%s: read back different contents than the plain archive", name)
+		}
+		if !bytes.Equal(tb.HashId(), expectedId) {
+			t.Fatalf("%s: expected the same ID as the plain archive", name)
+		}
+
+		// The decompressed copy is temporary:
+		spool := tb.files[0].LocalPath
+		if spool == archive {
+			t.Fatalf("%s: expected entries served out of a decompressed copy", name)
+		}
+		RemoveSpooled(tb.files)
+		if _, err = os.Stat(spool); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected the decompressed copy removed got %v", name, err)
+		}
+	}
+
+	// Damaged archives fail up front:
+	broken := filepath.Join(dir, "broken.tgz")
+	if err = ioutil.WriteFile(broken, gz.Bytes()[:gz.Len()/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tarArchiveFiles(broken, false); err == nil {
+		t.Fatal("expected a truncated archive to fail")
+	}
+}
+
+func newTarArchiveReader(t *testing.T, archive string) *VirtualTarballReader {
+	files, err := tarArchiveFiles(archive, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tb
+}
+
+func TestTarArchiveFiles_Unsupported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "in.tar")
+	writeTestTar(t, archive, &tar.Header{Name: "fifo", Typeflag: tar.TypeFifo})
+	if _, err = tarArchiveFiles(archive, false); !errors.Is(err, ErrUnsupportedTarEntry) {
+		t.Fatalf("expected unsupported entry got %v", err)
+	}
+}
+
+func TestTarArchiveFiles_HardLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "in.tar")
+	writeTestTar(t, archive, &tar.Header{Name: "./hard", Typeflag: tar.TypeLink, Linkname: "./b.bin", Mode: 0600})
+	files, err := tarArchiveFiles(archive, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	for _, f := range tb.files {
+		if f.Path != "hard" {
+			continue
+		}
+		if f.LinkTarget != "b.bin" || f.Size != 0 {
+			t.Fatalf("expected a link to b.bin got %q of %d bytes", f.LinkTarget, f.Size)
+		}
+		if hdr := tarHeader(f); hdr.Typeflag != tar.TypeLink || hdr.Linkname != "b.bin" {
+			t.Fatalf("expected a hard link header got %v", hdr)
+		}
+		return
+	}
+	t.Fatal("hard link not listed")
+}
+
+func TestVirtualTarballWriter_TarPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.tar")
+	contents := writeTestTar(t, in)
+	files, err := tarArchiveFiles(in, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	if err = tb.HashFiles(); err != nil {
+		t.Fatal(err)
+	}
+	data := readAllTarball(t, tb)
+
+	// Received entries as a client would see them:
+	received := make([]*TarballFile, 0, len(tb.files))
+	for _, tf := range tb.files {
+		received = append(received, &TarballFile{Path: tf.Path, Size: tf.Size, Mode: tf.Mode, SymlinkDestination: tf.SymlinkDestination, ModTime: tf.ModTime, Hash: tf.Hash})
+	}
+	out := filepath.Join(dir, "out.tar")
+	options := getOptions()
+	options.TarPath = out
+	w, err := NewVirtualTarballWriter(received, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	w.markComplete()
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is created besides the archive:
+	if _, err = os.Lstat("d"); !os.IsNotExist(err) {
+		t.Fatal("expected no loose files")
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	seen := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen++
+		if !hdr.ModTime.Equal(testTarModTime) {
+			t.Fatalf("'%s' expected modification time %v got %v", hdr.Name, testTarModTime, hdr.ModTime)
+		}
+		switch hdr.Name {
+		case "d/":
+			if hdr.Typeflag != tar.TypeDir || hdr.Mode != 0750 {
+				t.Fatalf("unexpected directory header %v", hdr)
+			}
+		case "d/link":
+			if hdr.Typeflag != tar.TypeSymlink || hdr.Linkname != "a.txt" {
+				t.Fatalf("unexpected symlink header %v", hdr)
+			}
+		default:
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != contents[hdr.Name] {
+				t.Fatalf("'%s' has wrong contents", hdr.Name)
+			}
+		}
+	}
+	if seen != 4 {
+		t.Fatalf("expected 4 entries got %d", seen)
+	}
+
+	// Both ends agree on the transfer ID:
+	if !bytes.Equal(tarballHashId(w.files, HashSHA256), tb.HashId()) {
+		t.Fatal("expected matching transfer IDs")
+	}
+}
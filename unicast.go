@@ -0,0 +1,47 @@
+// unicast.go
+package lancaster
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var ErrNoUnicastClients = errors.New("unicast serving requires at least one --client address")
+
+// Plain UDP for networks where multicast doesn't route. Ports keep the multicast layout: the server
+// receives control on port+0 and each client receives control on port+1 and data on port+2, so
+// `serverAddr` is where clients send to and where the server listens. Servers send a copy of every
+// message to each of `clients`, given by their base port; clients pass none.
+func NewUnicast(serverAddr *net.UDPAddr, clients []*net.UDPAddr) *Multicast {
+	if serverAddr.Port == 0 {
+		serverAddr.Port = 1360
+	}
+
+	m := &Multicast{
+		datagramSize:        DefaultDatagramSize,
+		sendControlCount:    2,
+		recvControlCount:    32,
+		sendDataCount:       64,
+		recvDataCount:       64,
+		unicast:             true,
+		controlToServerAddr: serverAddr,
+		// Clients receive on every local address:
+		controlToClientAddr: &net.UDPAddr{Port: serverAddr.Port + 1},
+		dataAddr:            &net.UDPAddr{Port: serverAddr.Port + 2},
+	}
+	for _, c := range clients {
+		m.clientControlAddrs = append(m.clientControlAddrs, &net.UDPAddr{IP: c.IP, Port: c.Port + 1, Zone: c.Zone})
+		m.clientDataAddrs = append(m.clientDataAddrs, &net.UDPAddr{IP: c.IP, Port: c.Port + 2, Zone: c.Zone})
+	}
+	return m
+}
+
+// Resolves "host:port", "host" or ":port"; a missing port is `defaultPort`:
+func ResolveUnicastAddr(s string, defaultPort int) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), strconv.Itoa(defaultPort))
+	}
+	return net.ResolveUDPAddr("udp", s)
+}
@@ -0,0 +1,54 @@
+package lancaster
+
+import (
+	"net"
+	"testing"
+)
+
+func TestResolveUnicastAddr(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		expected string
+	}{
+		{"127.0.0.1:2000", "127.0.0.1:2000"},
+		{"127.0.0.1", "127.0.0.1:1360"},
+		{":2000", ":2000"},
+		{"::1", "[::1]:1360"},
+		{"[::1]", "[::1]:1360"},
+		{"[::1]:2000", "[::1]:2000"},
+	} {
+		addr, err := ResolveUnicastAddr(c.s, 1360)
+		if err != nil {
+			t.Fatalf("%s: %s", c.s, err)
+		}
+		if addr.String() != c.expected {
+			t.Fatalf("%s: expected %s got %s", c.s, c.expected, addr)
+		}
+	}
+}
+
+func TestNewUnicast_Ports(t *testing.T) {
+	m := NewUnicast(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1)}, []*net.UDPAddr{
+		{IP: net.IPv4(10, 0, 0, 2), Port: 1360},
+		{IP: net.IPv4(10, 0, 0, 3), Port: 2000},
+	})
+	if m.controlToServerAddr.Port != 1360 {
+		t.Fatalf("expected default port 1360 got %d", m.controlToServerAddr.Port)
+	}
+	if m.controlToClientAddr.Port != 1361 || m.dataAddr.Port != 1362 {
+		t.Fatalf("expected clients to listen on 1361 and 1362 got %d and %d", m.controlToClientAddr.Port, m.dataAddr.Port)
+	}
+
+	expected := []string{"10.0.0.2:1361", "10.0.0.3:2001"}
+	for i, addr := range m.clientControlAddrs {
+		if addr.String() != expected[i] {
+			t.Fatalf("expected %s got %s", expected[i], addr)
+		}
+	}
+	expected = []string{"10.0.0.2:1362", "10.0.0.3:2002"}
+	for i, addr := range m.clientDataAddrs {
+		if addr.String() != expected[i] {
+			t.Fatalf("expected %s got %s", expected[i], addr)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// verify.go
+package lancaster
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files are compared against a live transfer by hashes of blocks of this many bytes of their contents:
+const VerifyBlockSize = 1 << 20
+
+// Leading bytes of each block's SHA-256 that are compared:
+const blockHashSize = 16
+
+// Block hashes in each reply, keeping replies small and each request quick to serve:
+const blockHashesPerMessage = 16
+
+// File index and first block that lead block hash requests and replies:
+const blockHashesMsgSize = 4 + 8
+
+type VerifyResult struct {
+	File *TarballFile
+	Err  error
+	// Parts of a regular file's contents that differ, when compared block by block:
+	Differs []ByteRange
+}
+
+// Bytes [Start, End) of a file's contents:
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Checks the files under `dir` against the given tarball file list without transferring anything.
+// `blockHashes`, by index into `files` as Client.BlockHashes returns them, also find which blocks of
+// each regular file's contents differ; nil when there are none to compare with.
+func VerifyTree(dir string, files []*TarballFile, blockHashes [][]byte, options VirtualTarballOptions) []VerifyResult {
+	results := make([]VerifyResult, 0, len(files))
+	for i, f := range files {
+		hashes := []byte(nil)
+		if i < len(blockHashes) {
+			hashes = blockHashes[i]
+		}
+		differs, err := verifyLocalFile(dir, f, hashes, options)
+		results = append(results, VerifyResult{File: f, Err: err, Differs: differs})
+	}
+	return results
+}
+
+func verifyLocalFile(dir string, f *TarballFile, blockHashes []byte, options VirtualTarballOptions) ([]ByteRange, error) {
+	localPath := filepath.Join(dir, filepath.FromSlash(f.Path))
+	stat, err := os.Lstat(localPath)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("missing")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Mode&os.ModeSymlink == os.ModeSymlink {
+		if stat.Mode()&os.ModeSymlink == 0 {
+			return nil, fmt.Errorf("expected symlink")
+		}
+		dest, err := os.Readlink(localPath)
+		if err != nil {
+			return nil, err
+		}
+		if dest != f.SymlinkDestination {
+			return nil, fmt.Errorf("symlink destination mismatch; '%s' != '%s'", dest, f.SymlinkDestination)
+		}
+		return nil, nil
+	}
+
+	if f.Mode.IsDir() {
+		if !stat.IsDir() {
+			return nil, fmt.Errorf("expected directory")
+		}
+		if !options.CompatMode && stat.Mode().Perm() != localMode(f.Mode).Perm() {
+			return nil, fmt.Errorf("mode mismatch; %v != %v", stat.Mode(), f.Mode)
+		}
+		return nil, nil
+	}
+
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("expected regular file")
+	}
+	differs := []ByteRange(nil)
+	if blockHashes != nil {
+		if differs, err = diffBlocks(localPath, f.Size, blockHashes); err != nil {
+			return nil, err
+		}
+	}
+	if stat.Size() != f.Size {
+		return differs, fmt.Errorf("size mismatch; %d != %d", stat.Size(), f.Size)
+	}
+	if !options.CompatMode && stat.Mode() != localMode(f.Mode) {
+		return differs, fmt.Errorf("mode mismatch; %v != %v", stat.Mode(), f.Mode)
+	}
+	if len(differs) > 0 {
+		n := int64(0)
+		for _, r := range differs {
+			n += r.End - r.Start
+		}
+		return differs, fmt.Errorf("%d bytes of contents differ", n)
+	}
+	if f.Hash != nil {
+		h, err := hashFile(localPath, f.hashAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(h, f.Hash) {
+			return nil, fmt.Errorf("content hash mismatch")
+		}
+	}
+	return nil, nil
+}
+
+// Compares the blocks of the file at `path` with the transfer's hashes of them, merging neighbouring
+// blocks that differ. Blocks the file is too short to fill differ.
+func diffBlocks(path string, size int64, blockHashes []byte) ([]ByteRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	differs := []ByteRange(nil)
+	buf := make([]byte, VerifyBlockSize)
+	for block := int64(0); block < blockCount(size); block++ {
+		h, err := hashBlock(file, 0, size, block, buf)
+		if err == io.ErrUnexpectedEOF {
+			h = nil
+		} else if err != nil {
+			return nil, err
+		}
+		i := block * blockHashSize
+		if i+blockHashSize <= int64(len(blockHashes)) && bytes.Equal(h, blockHashes[i:i+blockHashSize]) {
+			continue
+		}
+
+		start, end := block*VerifyBlockSize, (block+1)*VerifyBlockSize
+		if end > size {
+			end = size
+		}
+		if n := len(differs); n > 0 && differs[n-1].End == start {
+			differs[n-1].End = end
+		} else {
+			differs = append(differs, ByteRange{Start: start, End: end})
+		}
+	}
+	return differs, nil
+}
+
+// Blocks of VerifyBlockSize that `size` bytes of contents span:
+func blockCount(size int64) int64 {
+	return (size + VerifyBlockSize - 1) / VerifyBlockSize
+}
+
+// Hashes up to `count` blocks of the `size` bytes of contents starting at `offset` in `r`, from block
+// `first` on:
+func hashBlocks(r io.ReaderAt, offset int64, size int64, first int64, count int) ([]byte, error) {
+	hashes := []byte(nil)
+	buf := make([]byte, VerifyBlockSize)
+	for block := first; block < blockCount(size) && count > 0; block, count = block+1, count-1 {
+		h, err := hashBlock(r, offset, size, block, buf)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h...)
+	}
+	return hashes, nil
+}
+
+// Fails with io.ErrUnexpectedEOF when `r` ends before the block does:
+func hashBlock(r io.ReaderAt, offset int64, size int64, block int64, buf []byte) ([]byte, error) {
+	n := size - block*VerifyBlockSize
+	if n > VerifyBlockSize {
+		n = VerifyBlockSize
+	}
+	read, err := r.ReadAt(buf[:n], offset+block*VerifyBlockSize)
+	if int64(read) < n {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	h := sha256.Sum256(buf[:n])
+	return h[:blockHashSize], nil
+}
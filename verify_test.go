@@ -0,0 +1,144 @@
+package lancaster
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVerifyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "good.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "short.txt"), []byte("hel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []*TarballFile{
+		&TarballFile{Path: "good.txt", Size: 5, Mode: 0644},
+		&TarballFile{Path: "short.txt", Size: 5, Mode: 0644},
+		&TarballFile{Path: "sub/missing.txt", Size: 5, Mode: 0644},
+	}
+
+	results := VerifyTree(dir, files, nil, getOptions())
+	if len(results) != len(files) {
+		t.Fatalf("expected %d results got %d", len(files), len(results))
+	}
+	if results[0].Err != nil {
+		t.Fatalf("expected good.txt to pass; got %v", results[0].Err)
+	}
+	if results[1].Err == nil {
+		t.Fatal("expected short.txt to fail")
+	}
+	if results[2].Err == nil {
+		t.Fatal("expected sub/missing.txt to fail")
+	}
+}
+
+func TestVerifyTree_BlockHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), (3*VerifyBlockSize+100)/16)
+	hashes, err := hashBlocks(bytes.NewReader(contents), 0, int64(len(contents)), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 4*blockHashSize {
+		t.Fatalf("expected 4 block hashes got %d bytes", len(hashes))
+	}
+
+	// Differences in neighbouring blocks are reported as one range:
+	changed := append([]byte(nil), contents...)
+	changed[VerifyBlockSize+5]++
+	changed[2*VerifyBlockSize]++
+	if err = ioutil.WriteFile(filepath.Join(dir, "changed.bin"), changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "short.bin"), contents[:VerifyBlockSize+1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []*TarballFile{
+		&TarballFile{Path: "changed.bin", Size: int64(len(contents)), Mode: 0644},
+		&TarballFile{Path: "short.bin", Size: int64(len(contents)), Mode: 0644},
+	}
+
+	results := VerifyTree(dir, files, [][]byte{hashes, hashes}, getOptions())
+	size := int64(len(contents))
+	expected := [][]ByteRange{
+		{{Start: VerifyBlockSize, End: 3 * VerifyBlockSize}},
+		{{Start: VerifyBlockSize, End: size}},
+	}
+	for i, r := range results {
+		if r.Err == nil || !reflect.DeepEqual(r.Differs, expected[i]) {
+			t.Fatalf("expected '%s' to differ in %v got %v %v", r.File.Path, expected[i], r.Differs, r.Err)
+		}
+	}
+}
+
+func TestVerifyTree_AgainstServer(t *testing.T) {
+	sm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13940)
+	cm := newLoopbackMulticast(t, net.IPv4(239, 0, 0, 100), 13940)
+	src, err := ioutil.TempDir("", "lancaster-verify-src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), (2*VerifyBlockSize+100)/16)
+	files := []*TarballFile(nil)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if err = ioutil.WriteFile(filepath.Join(src, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, &TarballFile{Path: name, LocalPath: filepath.Join(src, name), Size: int64(len(contents)), Mode: 0644})
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+	s := NewServer(sm, tb, ServerOptions{Quiet: true})
+	go s.Run()
+	defer s.Stop()
+
+	c := NewClient(cm, ClientOptions{HashId: tb.HashId(), TarballOptions: getOptions(), MetadataOnly: true, BlockHashes: true, Quiet: true})
+	done := make(chan error, 1)
+	go func() { done <- c.Run() }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("client did not return with block hashes")
+	}
+
+	// Block 2 of b.bin changed since:
+	changed := append([]byte(nil), contents...)
+	changed[len(changed)-1]++
+	if err = ioutil.WriteFile(filepath.Join(src, "b.bin"), changed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	results := VerifyTree(src, c.Files(), c.BlockHashes(), getOptions())
+	if results[0].Err != nil || results[0].Differs != nil {
+		t.Fatalf("expected a.bin to pass got %v %v", results[0].Differs, results[0].Err)
+	}
+	if expected := []ByteRange{{Start: 2 * VerifyBlockSize, End: int64(len(contents))}}; !reflect.DeepEqual(results[1].Differs, expected) {
+		t.Fatalf("expected b.bin to differ in %v got %v %v", expected, results[1].Differs, results[1].Err)
+	}
+}
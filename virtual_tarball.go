@@ -1,12 +1,15 @@
 // tarball
-package main
+package lancaster
 
 import (
-	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 var (
@@ -15,11 +18,46 @@ var (
 	ErrBadPath          = errors.New("bad path")
 	ErrDuplicatePaths   = errors.New("not all paths are unique")
 	ErrMissingLocalPath = errors.New("missing LocalPath")
-	ErrFilesOnly        = errors.New("LocalPaths may only reference files not directories")
+	ErrFilesOnly        = errors.New("LocalPaths may only reference files not directories in compat mode")
 	ErrBadPaddingByte   = errors.New("expected 0 padding byte")
 	ErrCompatViolation  = errors.New("compat mode violation")
+	ErrDeviceSingleFile = errors.New("device target requires a tarball of exactly one regular file")
+	ErrNotDevice        = errors.New("device target is not a block device")
+	ErrDeviceTooSmall   = errors.New("device is too small for payload")
+	ErrBadSymlink       = errors.New("symlink destination escapes download directory")
+	ErrHashMismatch     = errors.New("downloaded files do not match their hashes")
+	ErrTarAndDevice     = errors.New("cannot write to both a tar archive and a device")
+	ErrSourceChanged    = errors.New("source file changed while serving")
 )
 
+// Checks a path received in metadata and returns it with '/' separators. Absolute paths, drive letters
+// and anything that could step outside the download directory are rejected rather than clamped.
+func sanitizePath(p string) (string, error) {
+	reason := ""
+	n := strings.ReplaceAll(p, "\\", "/")
+	switch {
+	case n == "":
+		reason = "is empty"
+	case strings.IndexByte(n, 0) >= 0:
+		reason = "contains a NUL byte"
+	case path.IsAbs(n) || filepath.IsAbs(n) || filepath.VolumeName(n) != "" || (len(n) >= 2 && n[1] == ':'):
+		reason = "is absolute"
+	case path.Clean(n) == ".." || strings.HasPrefix(path.Clean(n), "../"):
+		reason = "escapes the download directory"
+	default:
+		for _, s := range strings.Split(n, "/") {
+			if s == "." || s == ".." || s == "" {
+				reason = "is not in canonical form"
+				break
+			}
+		}
+	}
+	if reason != "" {
+		return "", fmt.Errorf("%w: '%s' %s", ErrBadPath, p, reason)
+	}
+	return n, nil
+}
+
 type ReaderAtCloser interface {
 	io.ReaderAt
 	io.Closer
@@ -36,49 +74,110 @@ type TarballFile struct {
 	Size               int64
 	Mode               os.FileMode
 	SymlinkDestination string
+	// Applied to the downloaded file when non-zero:
+	ModTime time.Time
+	// Hash of a regular file's contents checked after download when present:
+	Hash []byte
+	// Where the contents start within LocalPath, for files served out of an archive:
+	LocalOffset int64
+	// Ownership restored by downloads running as root when HasOwner; -1 leaves either unchanged:
+	Uid      int
+	Gid      int
+	HasOwner bool
+	// Runs of zeros within the contents, which are neither sent nor written so they stay holes:
+	Sparse []Region
+	// Path of the regular file this one is a hard link to; links carry no contents of their own:
+	LinkTarget string
 
 	offset int64
+	// Where the contents go within the archive written by VirtualTarballOptions.TarPath:
+	archiveOffset int64
+	// LocalPath's size and modification time when the reader was created:
+	localSize    int64
+	localModTime time.Time
+	// LocalPath is a temporary copy of standard input or a decompressed archive:
+	spooled bool
+	// The entry LinkTarget names once resolved:
+	linkTo *TarballFile
+	// How Hash was computed:
+	hashAlgorithm HashAlgorithm
 }
 
 type VirtualTarballOptions struct {
 	// Enables compatibility mode to be lowest common denominator of filesystem support, i.e. no chmod or symlinks
 	CompatMode bool
+	// Writes the contents of a single-file tarball directly to this block device instead of creating a file
+	DevicePath string
+	// Writes all entries into a tar archive at this path instead of creating files
+	TarPath string
+	// Base directory received files are created under instead of the current directory
+	OutputDir string
+	// Leaves received files owned by the downloading user even when running as root
+	NoOwner bool
+	// Content hashes served files are given for clients to verify against
+	HashAlgorithm HashAlgorithm
+	// Reads served files through memory mappings, falling back to ReadAt where mapping fails
+	Mmap bool
+	// Served files kept open between reads, closing the least recently read beyond it; DefaultMaxOpenFiles
+	// when 0
+	MaxOpenFiles int
+	// Starts writing without checking the target filesystem has room for everything, e.g. for ones that
+	// compress or deduplicate
+	SkipSpaceCheck bool
+}
+
+// Modification times travel as Unix nanoseconds with 0 meaning unknown:
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNanos(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
 }
 
 type tarballFileList []*TarballFile
 
 func (l tarballFileList) Len() int           { return len(l) }
-func (l tarballFileList) Less(i, j int) bool { return strings.Compare(l[i].Path, l[j].Path) == 0 }
+func (l tarballFileList) Less(i, j int) bool { return strings.Compare(l[i].Path, l[j].Path) < 0 }
 func (l tarballFileList) Swap(i, j int) {
 	tmpi := l[i]
 	l[i] = l[j]
 	l[j] = tmpi
 }
 
-var zeroHash [32]byte = [32]byte{0}
+// Hash of a file's contents:
+func hashFile(path string, algorithm HashAlgorithm) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := algorithm.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
 
-func hashFile(path string) ([]byte, error) {
+	return h.Sum(nil), nil
+}
+
+// Hash of `size` bytes at `offset` within a file, e.g. an entry inside an archive:
+func hashFileSection(path string, offset int64, size int64, algorithm HashAlgorithm) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
 
-	h := sha256.New()
-	const bufSize = 4096
-	buf := make([]byte, bufSize)
-	tn := 0
-	for {
-		n, err := f.Read(buf)
-		if err == io.EOF && n == 0 && tn == 0 {
-			return zeroHash[:], nil
-		}
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-		n, err = h.Write(buf[:n])
-		// So long as tn != 0 this is sufficient to detect empty hash case.
-		tn = n
+	h := algorithm.New()
+	if _, err = io.Copy(h, io.NewSectionReader(f, offset, size)); err != nil {
+		return nil, err
 	}
 
 	return h.Sum(nil), nil
@@ -1,16 +1,25 @@
 // tarball
-package main
+package lancaster
 
 import (
+	"container/list"
 	"encoding/binary"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
+// How often an open file is re-checked for changes while being read:
+const sourceCheckInterval = time.Second
+
 type VirtualTarballReader struct {
 	files  tarballFileList
 	size   int64
@@ -18,20 +27,44 @@ type VirtualTarballReader struct {
 
 	options VirtualTarballOptions
 
-	// Currently open file for reading:
-	openFileInfo *TarballFile
-	openFile     *os.File
+	// Files recently read from kept open, most recently read first, so servicing NAKs spanning many
+	// small files doesn't reopen them each time:
+	lock   sync.Mutex
+	opened map[*TarballFile]*openSource
+	recent *list.List
+}
+
+// Files kept open at once when VirtualTarballOptions.MaxOpenFiles is 0:
+const DefaultMaxOpenFiles = 64
+
+// A served file kept open between reads:
+type openSource struct {
+	tf   *TarballFile
+	file *os.File
+	// Mapping with the Mmap option; nil when reading with ReadAt:
+	mapped mappedFile
+	// When last checked against its recorded size and modification time:
+	checkedAt time.Time
+	// Held while reading so the file isn't closed from under the reader:
+	lock sync.Mutex
+	elem *list.Element
 }
 
 func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions) (*VirtualTarballReader, error) {
 	t := &VirtualTarballReader{
 		files:   tarballFileList(make([]*TarballFile, 0, len(files))),
 		options: options,
+		opened:  make(map[*TarballFile]*openSource),
+		recent:  list.New(),
 	}
 
 	uniquePaths := make(map[string]string)
 	t.size = int64(0)
-	for _, f := range files {
+
+	// Lay files out by path so the stream and its ID don't depend on argument or directory walk order:
+	sorted := tarballFileList(append([]*TarballFile(nil), files...))
+	sort.Sort(sorted)
+	for _, f := range sorted {
 		// Validate paths:
 		if filepath.IsAbs(f.Path) {
 			return nil, ErrBadPath
@@ -52,9 +85,13 @@ func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions
 		if err != nil {
 			return nil, err
 		}
-		// TODO: remove this limitation and allow directory entries to have their own permission bits
+		f.localSize, f.localModTime = stat.Size(), stat.ModTime()
+		// Directory entries only carry their permission bits:
 		if stat.IsDir() {
-			return nil, ErrFilesOnly
+			if t.options.CompatMode {
+				return nil, ErrFilesOnly
+			}
+			f.Size = 0
 		}
 		if t.options.CompatMode {
 			if stat.Mode()&os.ModeType != 0 {
@@ -77,11 +114,12 @@ func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions
 			}
 		}
 
-		// Validate all paths are unique:
-		if _, ok := uniquePaths[f.Path]; ok {
-			return nil, ErrDuplicatePaths
+		// Validate all paths are unique as clients will write them, naming both sources otherwise:
+		key := path.Clean(f.Path)
+		if other, ok := uniquePaths[key]; ok {
+			return nil, fmt.Errorf("%w: '%s' from both '%s' and '%s'", ErrDuplicatePaths, key, other, f.LocalPath)
 		}
-		uniquePaths[f.Path] = f.Path
+		uniquePaths[key] = f.LocalPath
 
 		// Keep track of the file internally:
 		f.offset = t.size
@@ -91,60 +129,296 @@ func NewVirtualTarballReader(files []*TarballFile, options VirtualTarballOptions
 		t.size += f.Size + 1
 	}
 
-	// Sort files for consistency:
-	sort.Sort(t.files)
+	if err := resolveLinks(t.files); err != nil {
+		return nil, err
+	}
+
+	t.hashId = tarballHashId(t.files, t.options.HashAlgorithm)
 
-	// Generate a 64-bit hash for identification purposes:
+	return t, nil
+}
+
+// Generate a 64-bit hash of the sorted file list for identification purposes. Hashing contents with
+// anything but the default algorithm makes for a different transfer:
+func tarballHashId(files tarballFileList, algorithm HashAlgorithm) []byte {
 	all := fnv.New64a()
-	for _, f := range t.files {
+	if algorithm != HashSHA256 {
+		all.Write([]byte(algorithm.String()))
+	}
+	for _, f := range files {
 		// Write unique data about file into collection hash:
 		all.Write([]byte(f.Path))
 		binary.Write(all, byteOrder, f.Size)
 		binary.Write(all, byteOrder, f.Mode)
 		all.Write([]byte(f.SymlinkDestination))
+		all.Write([]byte(f.LinkTarget))
 	}
 
 	// Sum the 64-bit hash:
-	t.hashId = make([]byte, 8)
-	byteOrder.PutUint64(t.hashId, all.Sum64())
-
-	return t, nil
+	hashId := make([]byte, 8)
+	byteOrder.PutUint64(hashId, all.Sum64())
+	return hashId
 }
 
 func (t *VirtualTarballReader) HashId() []byte {
 	return t.hashId
 }
 
-func (t *VirtualTarballReader) closeFile() error {
-	if t.openFileInfo == nil {
-		t.openFile = nil
-		return nil
+// Files served, sorted by path:
+func (t *VirtualTarballReader) Files() []*TarballFile {
+	return t.files
+}
+
+// Bytes in the stream sent to clients; each file's contents are followed by a NUL:
+func (t *VirtualTarballReader) Size() int64 {
+	return t.size
+}
+
+// Hashes every regular file not already carrying a hash by the chosen algorithm so clients can verify
+// downloads. The same pass finds the runs of zeros that needn't be sent.
+func (t *VirtualTarballReader) HashFiles() error {
+	return t.hashFiles(runtime.NumCPU())
+}
+
+// Hashes files from `workers` goroutines since startup is otherwise dominated by reading many small
+// files one at a time. Each file's results are stored on it so ordering is unaffected:
+func (t *VirtualTarballReader) hashFiles(workers int) error {
+	if workers < 1 {
+		workers = 1
 	}
-	if t.openFile == nil {
-		t.openFileInfo = nil
-		return nil
+
+	pending := make(chan int)
+	errs := make([]error, len(t.files))
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				tf := t.files[i]
+				h, sparse, err := scanFileSection(tf.LocalPath, tf.LocalOffset, tf.Size, t.options.HashAlgorithm)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				tf.Hash, tf.Sparse, tf.hashAlgorithm = h, sparse, t.options.HashAlgorithm
+			}
+		}()
+	}
+	for i, tf := range t.files {
+		if tf.Mode&os.ModeType != 0 || tf.LinkTarget != "" {
+			continue
+		}
+		if tf.Hash != nil && tf.hashAlgorithm == t.options.HashAlgorithm {
+			continue
+		}
+		pending <- i
+	}
+	close(pending)
+	wg.Wait()
+
+	// The first failing file in order, as if hashed one at a time:
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bytes of zeros in sparse extents across all files:
+func (t *VirtualTarballReader) SparseSize() int64 {
+	total := int64(0)
+	for _, tf := range t.files {
+		for _, e := range tf.Sparse {
+			total += e.endEx - e.start
+		}
+	}
+	return total
+}
+
+func (t *VirtualTarballReader) maxOpenFiles() int {
+	if t.options.MaxOpenFiles > 0 {
+		return t.options.MaxOpenFiles
+	}
+	return DefaultMaxOpenFiles
+}
+
+// Closes and finalizes a file once nobody is reading it; the caller holds t.lock:
+func (t *VirtualTarballReader) closeSource(o *openSource) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	t.recent.Remove(o.elem)
+	delete(t.opened, o.tf)
+
+	if o.mapped != nil {
+		if err := munmapFile(o.mapped); err != nil {
+			o.file.Close()
+			return err
+		}
+		o.mapped = nil
 	}
 
 	if !t.options.CompatMode {
-		err := t.openFile.Chmod(t.openFileInfo.Mode)
+		err := o.file.Chmod(localMode(o.tf.Mode))
 		if err != nil {
+			o.file.Close()
 			return err
 		}
 	}
 
-	err := t.openFile.Close()
+	return o.file.Close()
+}
+
+// Opens the file if not already open, closing the least recently read ones beyond MaxOpenFiles. The
+// file stays locked for the caller until released:
+func (t *VirtualTarballReader) acquire(tf *TarballFile) (*openSource, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if o, ok := t.opened[tf]; ok {
+		t.recent.MoveToFront(o.elem)
+		o.lock.Lock()
+		return o, nil
+	}
+
+	for t.recent.Len() >= t.maxOpenFiles() {
+		if err := t.closeSource(t.recent.Back().Value.(*openSource)); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.OpenFile(tf.LocalPath, os.O_RDONLY, 0)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	o := &openSource{tf: tf, file: f}
+	if err = o.checkUnchanged(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if t.options.Mmap && tf.localSize > 0 {
+		// Left reading with ReadAt if the file can't be mapped:
+		o.mapped, _ = mmapFile(f, tf.localSize)
 	}
+	o.elem = t.recent.PushFront(o)
+	t.opened[tf] = o
+	o.lock.Lock()
+	return o, nil
+}
+
+func (o *openSource) release() {
+	o.lock.Unlock()
+}
 
-	t.openFile = nil
-	t.openFileInfo = nil
+// Compares the open file with how it was when the reader was created; clients would otherwise
+// receive a mix of old and new contents:
+func (o *openSource) checkUnchanged() error {
+	tf := o.tf
+	stat, err := o.file.Stat()
+	if err != nil {
+		return err
+	}
+	o.checkedAt = time.Now()
+	if stat.Size() != tf.localSize || !stat.ModTime().Equal(tf.localModTime) {
+		return fmt.Errorf("%w: '%s'", ErrSourceChanged, tf.LocalPath)
+	}
 	return nil
 }
 
-// io.Closer:
+// Re-checks the open file now and then rather than on every read:
+func (o *openSource) checkUnchangedPeriodically() error {
+	if time.Since(o.checkedAt) < sourceCheckInterval {
+		return nil
+	}
+	return o.checkUnchanged()
+}
+
+// Finds the open file backing the virtual tarball at `offset` and how many of up to `maxLen` bytes can
+// be read from it contiguously. Returns nil when `offset` is not inside a regular file's contents.
+// Otherwise the file is held open for the caller until `release` is called.
+func (t *VirtualTarballReader) FileRegion(offset int64, maxLen int) (f *os.File, localOffset int64, n int, release func(), err error) {
+	for _, tf := range t.files {
+		if offset < tf.offset || offset >= tf.offset+tf.Size {
+			continue
+		}
+		if tf.Mode&os.ModeType != 0 {
+			return nil, 0, 0, nil, nil
+		}
+
+		o, err := t.acquire(tf)
+		if err != nil {
+			return nil, 0, 0, nil, err
+		}
+		if err = o.checkUnchangedPeriodically(); err != nil {
+			o.release()
+			return nil, 0, 0, nil, err
+		}
+		f = o.file
+
+		localOffset = offset - tf.offset
+		n = maxLen
+		if localOffset+int64(n) > tf.Size {
+			n = int(tf.Size - localOffset)
+		}
+		return f, tf.LocalOffset + localOffset, n, o.release, nil
+	}
+
+	return nil, 0, 0, nil, nil
+}
+
+// Copies contents at `offset` straight out of the open file's mapping into `p`, stopping at the end
+// of the file. Returns false when `offset` isn't within a mapped file's contents; regions spanning
+// files are left to ReadAt.
+func (t *VirtualTarballReader) ReadMapped(p []byte, offset int64) (n int, mapped bool, err error) {
+	if !t.options.Mmap {
+		return 0, false, nil
+	}
+	for _, tf := range t.files {
+		if offset < tf.offset || offset >= tf.offset+tf.Size {
+			continue
+		}
+		if tf.Mode&os.ModeType != 0 {
+			return 0, false, nil
+		}
+
+		o, err := t.acquire(tf)
+		if err != nil {
+			return 0, false, err
+		}
+		defer o.release()
+		if o.mapped == nil {
+			return 0, false, nil
+		}
+		if err = o.checkUnchangedPeriodically(); err != nil {
+			return 0, false, err
+		}
+
+		localOffset := offset - tf.offset
+		if localOffset+int64(len(p)) > tf.Size {
+			p = p[:tf.Size-localOffset]
+		}
+		n, err = o.mapped.copyAt(p, tf.LocalOffset+localOffset, tf.LocalPath)
+		return n, err == nil, err
+	}
+
+	return 0, false, nil
+}
+
+// io.Closer; releases every open file:
 func (t *VirtualTarballReader) Close() error {
-	return t.closeFile()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	firstErr := error(nil)
+	for t.recent.Len() > 0 {
+		if err := t.closeSource(t.recent.Front().Value.(*openSource)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // io.ReaderAt:
@@ -165,25 +439,22 @@ func (t *VirtualTarballReader) ReadAt(buf []byte, offset int64) (n int, err erro
 		}
 
 		readerAt := io.ReaderAt(nil)
+		o := (*openSource)(nil)
 		// Only open normal, non-empty files:
 		if tf.Mode&os.ModeType == 0 {
-			// Open file if not already:
-			if t.openFileInfo != tf {
-				// Close and finalize last open file:
-				if t.openFileInfo != nil {
-					t.closeFile()
-				}
-
-				f, err := os.OpenFile(tf.LocalPath, os.O_RDONLY, 0)
-				if err != nil {
-					return 0, err
-				}
-
-				t.openFile = f
-				t.openFileInfo = tf
+			o, err = t.acquire(tf)
+			if err != nil {
+				return 0, err
+			}
+			if err = o.checkUnchangedPeriodically(); err != nil {
+				o.release()
+				return 0, err
 			}
 
-			readerAt = t.openFile
+			readerAt = o.file
+			if o.mapped != nil {
+				readerAt = mappedReaderAt{o.mapped, tf.LocalPath}
+			}
 		}
 
 		localOffset := offset - tf.offset
@@ -195,8 +466,15 @@ func (t *VirtualTarballReader) ReadAt(buf []byte, offset int64) (n int, err erro
 			}
 			if len(p) > 0 {
 				// NOTE: we allow len(p) == 0 as a side effect in case that's useful.
-				n, err := readerAt.ReadAt(p, localOffset)
+				n, err := readerAt.ReadAt(p, tf.LocalOffset+localOffset)
+				if err == io.EOF {
+					// Truncated since the reader was created:
+					if cerr := o.checkUnchanged(); cerr != nil {
+						err = cerr
+					}
+				}
 				if err != nil {
+					o.release()
 					return 0, err
 				}
 
@@ -207,6 +485,10 @@ func (t *VirtualTarballReader) ReadAt(buf []byte, offset int64) (n int, err erro
 			}
 		}
 
+		if o != nil {
+			o.release()
+		}
+
 		// Fill in trailing NUL padding byte:
 		if offset == tf.offset+tf.Size && len(remainder) > 0 {
 			remainder[0] = 0
@@ -1,11 +1,18 @@
-package main
+package lancaster
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func getOptions() VirtualTarballOptions {
@@ -59,6 +66,41 @@ func TestTarball_BadPath1(t *testing.T) {
 	}
 }
 
+func TestTarball_DuplicatePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-dup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	for _, p := range []string{a, b} {
+		if err = ioutil.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both renamed onto the same destination:
+	files, err := BuildTarball([]string{a + "::same.txt", b + "::same.txt"}, nil, false, false, 0, IncludeHidden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewVirtualTarballReader(files, getOptions())
+	if !errors.Is(err, ErrDuplicatePaths) {
+		t.Fatalf("expected ErrDuplicatePaths got %v", err)
+	}
+	for _, s := range []string{"'same.txt'", a, b} {
+		if !strings.Contains(err.Error(), s) {
+			t.Fatalf("expected %q to name %s", err, s)
+		}
+	}
+
+	// Paths the client would clean to the same file collide too:
+	files = []*TarballFile{{Path: "sub/x.txt", LocalPath: a, Size: int64(len(a)), Mode: 0644}, {Path: "sub//x.txt", LocalPath: b, Size: int64(len(b)), Mode: 0644}}
+	if _, err = NewVirtualTarballReader(files, getOptions()); !errors.Is(err, ErrDuplicatePaths) {
+		t.Fatalf("expected ErrDuplicatePaths got %v", err)
+	}
+}
+
 func TestReadAt_OneFile(t *testing.T) {
 	testMessage := []byte("hello, world!\n")
 	const fname = "test.txt"
@@ -176,3 +218,561 @@ func TestReadAt_SpanningFiles(t *testing.T) {
 		t.Fatalf("expected message != read message")
 	}
 }
+
+func TestFileRegion(t *testing.T) {
+	testMessage := []byte("hello, world!\n")
+	const fname1 = "test1.txt"
+	const fname2 = "test2.txt"
+
+	testFile1, err := createTestFile(fname1, testMessage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testFile2, err := createTestFile(fname2, testMessage)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	files := []*TarballFile{
+		&TarballFile{
+			Path:      fname1,
+			LocalPath: fname1,
+			Size:      testFile1.Size(),
+			Mode:      testFile1.Mode(),
+		},
+		&TarballFile{
+			Path:      fname2,
+			LocalPath: fname2,
+			Size:      testFile2.Size(),
+			Mode:      testFile2.Mode(),
+		},
+	}
+
+	tb := newTarballReader(t, files)
+	defer closeTarballReader(t, tb)
+
+	// Region is clamped to the end of the first file:
+	f, localOffset, n, release, err := tb.FileRegion(2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f == nil || localOffset != 2 || n != len(testMessage)-2 {
+		t.Fatalf("unexpected region; f = %v localOffset = %d n = %d", f, localOffset, n)
+	}
+	release()
+
+	// NUL padding byte is not backed by a file:
+	f, _, _, _, err = tb.FileRegion(int64(len(testMessage)), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Fatal("expected no file for padding byte")
+	}
+
+	// Second file starts after the padding byte:
+	f, localOffset, n, release, err = tb.FileRegion(int64(len(testMessage))+1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f == nil || localOffset != 0 || n != 4 {
+		t.Fatalf("unexpected region; f = %v localOffset = %d n = %d", f, localOffset, n)
+	}
+	release()
+}
+
+func TestFileRegion_HeldOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-region")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newManyFilesReader(t, dir, 2)
+	defer r.Close()
+	r.options.MaxOpenFiles = 1
+
+	f, localOffset, n, release, err := r.FileRegion(r.files[0].offset, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f == nil || localOffset != 0 || n != 1 {
+		t.Fatalf("unexpected region; f = %v localOffset = %d n = %d", f, localOffset, n)
+	}
+
+	// Reading another file has to wait for the region to be released before closing it:
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.ReadAt(make([]byte, 1), r.files[1].offset)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("expected the read to wait for the release, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	buf := make([]byte, 1)
+	if _, err = f.ReadAt(buf, localOffset); err != nil {
+		t.Fatalf("expected the file to stay open: %v", err)
+	}
+
+	release()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAt_DirectoryEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-direntry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []*TarballFile{
+		&TarballFile{Path: "dir", LocalPath: dir, Size: 4096, Mode: os.ModeDir | 0750},
+	}
+	tb, err := NewVirtualTarballReader(files, getOptions())
+	if getOptions().CompatMode {
+		if err != ErrFilesOnly {
+			t.Fatalf("expected %v got %v", ErrFilesOnly, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	// Directories carry no contents; only the padding byte:
+	if tb.size != 1 {
+		t.Fatalf("expected size 1 got %d", tb.size)
+	}
+	buf := []byte{0xff}
+	n, err := tb.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || buf[0] != 0 {
+		t.Fatalf("expected padding byte got %d %v", n, buf)
+	}
+}
+
+func TestHashId_OrderIndependent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Enough files that sorting doesn't fall back to insertion sort:
+	files := []*TarballFile(nil)
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		localPath := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(localPath, bytes.Repeat([]byte{byte(i)}, i), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, &TarballFile{Path: name, LocalPath: localPath, Size: int64(i), Mode: 0644})
+	}
+
+	read := func(files []*TarballFile) ([]byte, []byte) {
+		tb, err := NewVirtualTarballReader(files, getOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tb.Close()
+		buf := make([]byte, tb.size)
+		if _, err = tb.ReadAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+		return tb.HashId(), buf
+	}
+
+	copyFiles := func() []*TarballFile {
+		l := make([]*TarballFile, 0, len(files))
+		for _, f := range files {
+			c := *f
+			l = append(l, &c)
+		}
+		return l
+	}
+
+	expectedId, expectedStream := read(copyFiles())
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		shuffled := copyFiles()
+		r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		id, stream := read(shuffled)
+		if !bytes.Equal(id, expectedId) {
+			t.Fatalf("expected ID %x got %x", expectedId, id)
+		}
+		if !bytes.Equal(stream, expectedStream) {
+			t.Fatal("expected the same stream layout")
+		}
+	}
+}
+
+func TestReadAt_SourceChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, change := range []string{"modified", "truncated"} {
+		localPath := filepath.Join(dir, change)
+		if err = ioutil.WriteFile(localPath, []byte("hello world\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tb, err := NewVirtualTarballReader([]*TarballFile{{Path: change, LocalPath: localPath, Size: 12, Mode: 0644}}, getOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Change the file after its metadata was taken:
+		contents := []byte("HELLO WORLD\n")
+		if change == "truncated" {
+			contents = contents[:4]
+		}
+		if err = ioutil.WriteFile(localPath, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Hour)
+		if err = os.Chtimes(localPath, later, later); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 13)
+		if _, err = tb.ReadAt(buf, 0); !errors.Is(err, ErrSourceChanged) {
+			t.Fatalf("%s: expected %v got %v", change, ErrSourceChanged, err)
+		}
+		tb.Close()
+	}
+}
+
+func TestReadAt_SourceChangedWhileOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	localPath := filepath.Join(dir, "growing")
+	if err = ioutil.WriteFile(localPath, []byte("hello world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tb, err := NewVirtualTarballReader([]*TarballFile{{Path: "growing", LocalPath: localPath, Size: 12, Mode: 0644}}, getOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tb.Close()
+
+	buf := make([]byte, 4)
+	if _, err = tb.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Appended to after it was opened; noticed at the next periodic check:
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("more\n"))
+	f.Close()
+	for _, o := range tb.opened {
+		o.checkedAt = time.Time{}
+	}
+
+	if _, err = tb.ReadAt(buf, 4); !errors.Is(err, ErrSourceChanged) {
+		t.Fatalf("expected %v got %v", ErrSourceChanged, err)
+	}
+}
+
+// Builds a reader over `n` small files:
+func newManyFilesReader(tb testing.TB, dir string, n int) *VirtualTarballReader {
+	files := []*TarballFile(nil)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%04d", i)
+		localPath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(localPath, bytes.Repeat([]byte{byte(i)}, 1+i%4096), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		files = append(files, &TarballFile{Path: name, LocalPath: localPath, Size: int64(1 + i%4096), Mode: 0644})
+	}
+	r, err := NewVirtualTarballReader(files, getOptions())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return r
+}
+
+func TestReadAt_OpenFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newManyFilesReader(t, dir, 20)
+	r.options.MaxOpenFiles = 4
+	expected := make([]byte, r.Size())
+	for _, f := range r.files {
+		b, err := ioutil.ReadFile(f.LocalPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[f.offset:], b)
+	}
+
+	// Reading everything leaves the last few files open:
+	buf := make([]byte, r.Size())
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatal("unexpected contents")
+	}
+	if len(r.opened) != 4 || r.recent.Len() != 4 {
+		t.Fatalf("expected 4 open files got %d", len(r.opened))
+	}
+	last := r.files[len(r.files)-1]
+	kept, ok := r.opened[last]
+	if !ok {
+		t.Fatal("expected the most recently read file to be open")
+	}
+
+	// Rereading it uses the same descriptor while the least recently read is closed for another:
+	if _, err = r.ReadAt(buf[:1], last.offset); err != nil {
+		t.Fatal(err)
+	}
+	if r.opened[last] != kept {
+		t.Fatal("expected the open file to be reused")
+	}
+	if _, err = r.ReadAt(buf[:1], r.files[0].offset); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.opened) != 4 || r.opened[r.files[len(r.files)-4]] != nil || r.opened[last] == nil {
+		t.Fatal("expected the least recently read file to be closed")
+	}
+
+	// Concurrent reads all see the right contents:
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			p := make([]byte, 100)
+			for i := 0; i < 200; i++ {
+				offset := int64((g*7919 + i*104729) % int(r.Size()-int64(len(p))))
+				n, err := r.ReadAt(p, offset)
+				if err == nil && !bytes.Equal(p[:n], expected[offset:offset+int64(n)]) {
+					err = fmt.Errorf("unexpected contents at %d", offset)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Closing releases every descriptor:
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.opened) != 0 || r.recent.Len() != 0 {
+		t.Fatalf("expected no open files got %d", len(r.opened))
+	}
+	if _, err = kept.file.Stat(); err == nil {
+		t.Fatal("expected the file to be closed")
+	}
+}
+
+func TestHashFiles_ParallelMatchesSerial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serial := newManyFilesReader(t, dir, 200)
+	defer serial.Close()
+	if err = serial.hashFiles(1); err != nil {
+		t.Fatal(err)
+	}
+	parallel := newManyFilesReader(t, dir, 200)
+	defer parallel.Close()
+	if err = parallel.hashFiles(8); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, f := range serial.files {
+		p := parallel.files[i]
+		if f.Path != p.Path || !bytes.Equal(f.Hash, p.Hash) {
+			t.Fatalf("%s: expected hash %x got %s %x", f.Path, f.Hash, p.Path, p.Hash)
+		}
+	}
+
+	// The first failure in file order is reported:
+	failing := newManyFilesReader(t, dir, 200)
+	defer failing.Close()
+	failing.files[10].LocalPath = filepath.Join(dir, "missing10")
+	failing.files[150].LocalPath = filepath.Join(dir, "missing150")
+	if err = failing.hashFiles(8); err == nil || !strings.Contains(err.Error(), "missing10") {
+		t.Fatalf("expected the first missing file to be reported; got %v", err)
+	}
+}
+
+func benchmarkHashFiles(b *testing.B, workers int) {
+	dir, err := ioutil.TempDir("", "lancaster-hash")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newManyFilesReader(b, dir, 2000)
+	defer r.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, f := range r.files {
+			f.Hash = nil
+		}
+		if err = r.hashFiles(workers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Rereads regions spanning dozens of small files, as NAKs for the same holes from several clients do:
+func benchmarkReadSmallFiles(b *testing.B, maxOpenFiles int) {
+	dir, err := ioutil.TempDir("", "lancaster-open")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newManyFilesReader(b, dir, 2000)
+	r.options.MaxOpenFiles = maxOpenFiles
+	defer r.Close()
+	offsets := []int64{r.files[100].offset, r.files[900].offset, r.files[1700].offset}
+	buf := make([]byte, 4*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, offset := range offsets {
+			if _, err = r.ReadAt(buf, offset); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReadSmallFiles_Reopen(b *testing.B) {
+	benchmarkReadSmallFiles(b, 1)
+}
+
+func BenchmarkReadSmallFiles_Cached(b *testing.B) {
+	benchmarkReadSmallFiles(b, DefaultMaxOpenFiles)
+}
+
+func BenchmarkHashFiles_Serial(b *testing.B) {
+	benchmarkHashFiles(b, 1)
+}
+
+func BenchmarkHashFiles_Parallel(b *testing.B) {
+	benchmarkHashFiles(b, runtime.NumCPU())
+}
+
+// Offsets past 4GiB; files are sparse so this stays cheap where the filesystem allows:
+const (
+	largeFileA = 3<<30 + 5
+	largeFileB = 2 << 30
+	// Stream offsets of the second and third files after the NUL padding bytes:
+	largeOffsetB = largeFileA + 1
+	largeOffsetC = largeOffsetB + largeFileB + 1
+)
+
+// Creates a sparse file of `size` bytes with `markers` written at their offsets:
+func writeSparseFile(t *testing.T, path string, size int64, markers map[int64]string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("files are not created sparse")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		t.Skipf("cannot create a %d byte file: %s", size, err)
+	}
+	for offset, s := range markers {
+		if _, err = f.WriteAt([]byte(s), offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadAt_Beyond4GiB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 4GiB lies within the second file:
+	writeSparseFile(t, filepath.Join(dir, "a"), largeFileA, map[int64]string{largeFileA - 5: "A-END"})
+	writeSparseFile(t, filepath.Join(dir, "b"), largeFileB, map[int64]string{0: "B-START", 4<<30 - largeOffsetB - 3: "4GiB!!", largeFileB - 5: "B-END"})
+	writeSparseFile(t, filepath.Join(dir, "c"), 5, map[int64]string{0: "hello"})
+	files := []*TarballFile{
+		{Path: "a", LocalPath: filepath.Join(dir, "a"), Size: largeFileA, Mode: 0644},
+		{Path: "b", LocalPath: filepath.Join(dir, "b"), Size: largeFileB, Mode: 0644},
+		{Path: "c", LocalPath: filepath.Join(dir, "c"), Size: 5, Mode: 0644},
+	}
+
+	for _, mmap := range []bool{false, true} {
+		options := getOptions()
+		options.Mmap = mmap
+		tb, err := NewVirtualTarballReader(files, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tb.size != largeOffsetC+5+1 {
+			t.Fatalf("expected size %d got %d", int64(largeOffsetC+5+1), tb.size)
+		}
+
+		for _, c := range []struct {
+			offset   int64
+			expected string
+		}{
+			{largeFileA - 5, "A-END\x00B-START"},
+			{4<<30 - 3, "4GiB!!"},
+			{largeOffsetC - 6, "B-END\x00hello\x00"},
+		} {
+			buf := make([]byte, len(c.expected))
+			n, err := tb.ReadAt(buf, c.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(buf) || string(buf) != c.expected {
+				t.Fatalf("mmap %v: at %d expected %q got %q", mmap, c.offset, c.expected, buf[:n])
+			}
+		}
+
+		// Regions within the second file map onto offsets past 2GiB into it:
+		f, localOffset, n, release, err := tb.FileRegion(largeOffsetC-6, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f == nil || localOffset != largeFileB-5 || n != 5 {
+			t.Fatalf("unexpected region; f = %v localOffset = %d n = %d", f, localOffset, n)
+		}
+		release()
+		tb.Close()
+	}
+}
@@ -1,11 +1,16 @@
 // tarball
-package main
+package lancaster
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 )
 
 type VirtualTarballWriter struct {
@@ -14,9 +19,23 @@ type VirtualTarballWriter struct {
 
 	options VirtualTarballOptions
 
+	// WriteAt may be called from several goroutines; the open file is shared between them:
+	lock sync.Mutex
+
 	// Which file is currently open for writing:
 	openFileInfo *TarballFile
 	openFile     *os.File
+
+	// Directory entries created so far; their modes are applied on Close:
+	dirs map[string]*TarballFile
+
+	// Set once every region has been written so Close may restore modification times:
+	complete bool
+	// Set by Close when ownership could not be restored for lack of privilege:
+	ownersSkipped bool
+
+	// Single archive receiving all entries when TarPath is set:
+	archive *os.File
 }
 
 func NewVirtualTarballWriter(files []*TarballFile, options VirtualTarballOptions) (*VirtualTarballWriter, error) {
@@ -24,25 +43,43 @@ func NewVirtualTarballWriter(files []*TarballFile, options VirtualTarballOptions
 		files:   tarballFileList(make([]*TarballFile, 0, len(files))),
 		options: options,
 		size:    0,
+		dirs:    make(map[string]*TarballFile),
+	}
+
+	outputDir := options.OutputDir
+	if outputDir == "" {
+		outputDir = "."
 	}
 
 	uniquePaths := make(map[string]string)
 	t.size = int64(0)
 	for _, f := range files {
 		// Validate paths:
-		if filepath.IsAbs(f.Path) {
-			return nil, ErrBadPath
+		p, err := sanitizePath(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		f.Path = p
+
+		// Where the entry lands on disk, which must stay within the output directory:
+		f.LocalPath = filepath.Join(outputDir, filepath.FromSlash(f.Path))
+		if !isWithinDir(outputDir, f.LocalPath) {
+			return nil, fmt.Errorf("%w: '%s' escapes the download directory", ErrBadPath, f.Path)
+		}
+
+		// Don't let a server plant links pointing outside the download directory:
+		if f.Mode&os.ModeSymlink == os.ModeSymlink && !isContainedSymlink(f.Path, f.SymlinkDestination) {
+			return nil, ErrBadSymlink
 		}
-		s := strings.Split(f.Path, string(filepath.Separator))
-		for _, p := range s {
-			if p == "." || p == ".." {
-				return nil, ErrBadPath
+		if f.LinkTarget != "" {
+			if f.LinkTarget, err = sanitizePath(f.LinkTarget); err != nil {
+				return nil, err
 			}
 		}
 
 		// Validate all paths are unique:
 		if _, ok := uniquePaths[f.Path]; ok {
-			return nil, ErrDuplicatePaths
+			return nil, fmt.Errorf("%w: '%s'", ErrDuplicatePaths, f.Path)
 		}
 		uniquePaths[f.Path] = f.Path
 
@@ -53,13 +90,94 @@ func NewVirtualTarballWriter(files []*TarballFile, options VirtualTarballOptions
 		t.size += f.Size + 1
 	}
 
-	// Sort files for consistency:
-	sort.Sort(t.files)
+	// Files stay in the server's order since that is how the stream is laid out.
+
+	if err := resolveLinks(t.files); err != nil {
+		return nil, err
+	}
+
+	// Devices were sized up front; anything else should fail now rather than part way through:
+	if t.options.DevicePath == "" && !t.options.SkipSpaceCheck {
+		if err := t.checkFreeSpace(); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.options.TarPath != "" {
+		if t.options.DevicePath != "" {
+			return nil, ErrTarAndDevice
+		}
+
+		f, err := os.OpenFile(t.options.TarPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = layoutTarArchive(f, t.files); err != nil {
+			f.Close()
+			return nil, err
+		}
+		t.archive = f
+	}
+
+	if t.options.OutputDir != "" && t.options.DevicePath == "" && t.options.TarPath == "" {
+		if err := os.MkdirAll(t.options.OutputDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.options.DevicePath != "" {
+		if len(t.files) != 1 || t.files[0].Mode&os.ModeType != 0 {
+			return nil, ErrDeviceSingleFile
+		}
+		// Devices hold whatever was there before so every byte has to be written:
+		t.files[0].Sparse = nil
+
+		// Open the device up front so a bad target fails before any data is transferred:
+		f, err := t.openDevice(t.files[0])
+		if err != nil {
+			return nil, err
+		}
+		t.openFile = f
+		t.openFileInfo = t.files[0]
+	}
 
 	return t, nil
 }
 
-func (t *VirtualTarballWriter) closeFile() error {
+func (t *VirtualTarballWriter) openDevice(tf *TarballFile) (*os.File, error) {
+	stat, err := os.Stat(t.options.DevicePath)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Mode()&os.ModeDevice == 0 || stat.Mode()&os.ModeCharDevice != 0 {
+		return nil, ErrNotDevice
+	}
+
+	// Devices are written in place so never create or truncate. Writes go through the
+	// kernel's buffered block layer (no O_DIRECT) which takes care of sector alignment
+	// for our arbitrarily sized and positioned regions:
+	f, err := os.OpenFile(t.options.DevicePath, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Block devices report a zero size via stat; seek to the end to find their capacity:
+	capacity, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if capacity < tf.Size {
+		f.Close()
+		return nil, ErrDeviceTooSmall
+	}
+
+	return f, nil
+}
+
+// Closes the file being written, first making sure it is on disk when `sync`. Only the final close
+// syncs; retransmits alternating between files would otherwise wait on the disk for every region:
+func (t *VirtualTarballWriter) closeFile(sync bool) error {
 	if t.openFileInfo == nil {
 		t.openFile = nil
 		return nil
@@ -69,8 +187,14 @@ func (t *VirtualTarballWriter) closeFile() error {
 		return nil
 	}
 
-	if !t.options.CompatMode {
-		err := t.openFile.Chmod(t.openFileInfo.Mode)
+	// Make sure everything is on disk before reporting success:
+	if sync {
+		if err := t.openFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if t.options.DevicePath == "" && !t.options.CompatMode {
+		err := t.openFile.Chmod(localMode(t.openFileInfo.Mode))
 		if err != nil {
 			return err
 		}
@@ -88,50 +212,242 @@ func (t *VirtualTarballWriter) closeFile() error {
 
 // io.Closer:
 func (t *VirtualTarballWriter) Close() error {
-	return t.closeFile()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	err := t.closeFile(true)
+	if err != nil {
+		return err
+	}
+	err = t.applyLinks()
+	if err != nil {
+		return err
+	}
+	err = t.applyDirModes()
+	if err != nil {
+		return err
+	}
+	err = t.closeArchive()
+	if err != nil {
+		return err
+	}
+	err = t.verifyHashes()
+	if err != nil {
+		return err
+	}
+	err = t.applyOwners()
+	if err != nil {
+		return err
+	}
+	return t.applyModTimes()
 }
 
-func (t *VirtualTarballWriter) makeSymlink(tf *TarballFile) error {
-	_, err := os.Lstat(tf.Path)
-	// Dont bother recreating if exists:
+func (t *VirtualTarballWriter) closeArchive() error {
+	if t.archive == nil {
+		return nil
+	}
+	err := t.archive.Sync()
 	if err != nil {
-		if !os.IsNotExist(err) {
+		return err
+	}
+	err = t.archive.Close()
+	t.archive = nil
+	return err
+}
+
+// Re-reads each completed file with a known hash and reports any whose contents don't match:
+func (t *VirtualTarballWriter) verifyHashes() error {
+	if !t.complete || t.options.DevicePath != "" {
+		return nil
+	}
+
+	mismatched := []string(nil)
+	for _, tf := range t.files {
+		if tf.Hash == nil || tf.Mode&os.ModeType != 0 {
+			continue
+		}
+		h, err := []byte(nil), error(nil)
+		if t.options.TarPath != "" {
+			h, err = hashFileSection(t.options.TarPath, tf.archiveOffset, tf.Size, tf.hashAlgorithm)
+		} else {
+			h, err = hashFile(tf.LocalPath, tf.hashAlgorithm)
+		}
+		if err != nil {
 			return err
 		}
+		if !bytes.Equal(h, tf.Hash) {
+			mismatched = append(mismatched, tf.Path)
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("%w: %s", ErrHashMismatch, strings.Join(mismatched, ", "))
 	}
+	return nil
+}
 
-	// Get current working directory:
-	wd := ""
-	wd, err = os.Getwd()
-	if err != nil {
-		return err
+// Marks all regions as written; partial downloads keep current times so they never look up to date.
+func (t *VirtualTarballWriter) markComplete() {
+	t.complete = true
+}
+
+// Creates hard links once the files they link to are complete. Archived links are entries in their own
+// right so only files need them.
+func (t *VirtualTarballWriter) applyLinks() error {
+	if !t.complete || t.options.DevicePath != "" || t.options.TarPath != "" {
+		return nil
+	}
+
+	for _, tf := range t.files {
+		if tf.linkTo == nil {
+			continue
+		}
+		if err := makeHardlink(tf, t.options.CompatMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restores modification times once nothing more will be written. Symlinks are skipped since
+// Chtimes would follow them.
+func (t *VirtualTarballWriter) applyModTimes() error {
+	// Archived entries carry their times in their headers:
+	if !t.complete || t.options.DevicePath != "" || t.options.TarPath != "" {
+		return nil
+	}
+
+	for _, tf := range t.files {
+		if tf.ModTime.IsZero() || tf.Mode&os.ModeSymlink != 0 {
+			continue
+		}
+		err := os.Chtimes(tf.LocalPath, tf.ModTime, tf.ModTime)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restores recorded owners, which only root may do; anyone else keeps ownership of what they
+// downloaded and OwnersSkipped reports it. Symlinks are changed themselves rather than their targets.
+func (t *VirtualTarballWriter) applyOwners() error {
+	if !t.complete || t.options.NoOwner || t.options.CompatMode || t.options.DevicePath != "" || t.options.TarPath != "" {
+		return nil
+	}
+
+	for _, tf := range t.files {
+		if !tf.HasOwner {
+			continue
+		}
+		if os.Geteuid() != 0 {
+			t.ownersSkipped = true
+			return nil
+		}
+
+		err := os.Lchown(tf.LocalPath, tf.Uid, tf.Gid)
+		if os.IsPermission(err) {
+			// e.g. root within a user namespace:
+			t.ownersSkipped = true
+			return nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		// Changing owner clears set-user-ID and set-group-ID bits:
+		if tf.Mode.IsRegular() && tf.Mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+			if err = os.Chmod(tf.LocalPath, tf.Mode); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	dir, fileName := filepath.Split(tf.Path)
-	err = os.MkdirAll(dir, tf.Mode|0700)
+// Whether Close left files with the downloading user's ownership rather than their recorded owners:
+func (t *VirtualTarballWriter) OwnersSkipped() bool {
+	return t.ownersSkipped
+}
+
+func (t *VirtualTarballWriter) makeDir(tf *TarballFile) error {
+	// Stay writable by owner until Close so children can still be created inside:
+	err := os.MkdirAll(tf.LocalPath, tf.Mode.Perm()|0700)
 	if err != nil {
 		return err
 	}
+	t.dirs[tf.Path] = tf
+	return nil
+}
+
+// Chmods directory entries to their recorded modes, including those first created implicitly to hold
+// a child file. Deepest directories go first so a read-only parent doesn't block chmod of its children.
+func (t *VirtualTarballWriter) applyDirModes() error {
+	if t.options.CompatMode {
+		return nil
+	}
+
+	dirs := make([]*TarballFile, 0, len(t.dirs))
+	for _, tf := range t.dirs {
+		dirs = append(dirs, tf)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := strings.Count(dirs[i].Path, "/"), strings.Count(dirs[j].Path, "/")
+		if di != dj {
+			return di > dj
+		}
+		return dirs[i].Path < dirs[j].Path
+	})
+
+	for _, tf := range dirs {
+		err := os.Chmod(tf.LocalPath, localMode(tf.Mode).Perm())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	err = os.Chdir(dir)
+// Reports whether a relative symlink at `linkPath` resolves within the tree it lives in:
+func isContainedSymlink(linkPath string, dest string) bool {
+	if dest == "" || path.IsAbs(dest) || filepath.IsAbs(dest) || filepath.VolumeName(dest) != "" {
+		return false
+	}
+	resolved := path.Join(path.Dir(linkPath), filepath.ToSlash(dest))
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// Reports whether `p` is `dir` itself or lies beneath it once both are cleaned:
+func isWithinDir(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
 	if err != nil {
-		return err
+		return false
 	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
 
-	// Change directory back to what it was before exiting:
-	defer func() {
-		err = os.Chdir(wd)
-	}()
+func (t *VirtualTarballWriter) makeSymlink(tf *TarballFile) error {
+	// Dont bother recreating if it already points where it should:
+	if dest, err := os.Readlink(tf.LocalPath); err == nil && dest == tf.SymlinkDestination {
+		return nil
+	}
 
-	// Create symlink from directory:
-	err = os.Symlink(tf.SymlinkDestination, fileName)
+	dir, _ := filepath.Split(tf.LocalPath)
+	if dir != "" {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Return the last error (possibly from defer):
-	return err
+	// Relative destinations resolve against the link's own directory:
+	return os.Symlink(tf.SymlinkDestination, tf.LocalPath)
 }
 
 // io.WriterAt:
 func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	if buf == nil {
 		return 0, ErrNilBuffer
 	}
@@ -147,24 +463,36 @@ func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 			continue
 		}
 
-		if tf.Mode&os.ModeSymlink == os.ModeSymlink {
+		if t.archive != nil {
+			// Entries were laid out up front; only contents remain to be written.
+		} else if tf.Mode&os.ModeSymlink == os.ModeSymlink {
 			// Create symlink if not exists:
 			err := t.makeSymlink(tf)
 			if err != nil {
 				return 0, err
 			}
+		} else if tf.linkTo != nil {
+			// Linked on Close once the file it links to is complete.
+		} else if tf.Mode.IsDir() {
+			// Create directory if not exists:
+			err := t.makeDir(tf)
+			if err != nil {
+				return 0, err
+			}
 		} else {
 			// Create file if not already:
 			if t.openFileInfo != tf {
 				// Close and finalize last open file:
 				if t.openFileInfo != nil {
-					t.closeFile()
+					if err := t.closeFile(false); err != nil {
+						return 0, err
+					}
 				}
 
 				// Try to mkdir all paths involved:
-				dir, _ := filepath.Split(tf.Path)
+				dir, _ := filepath.Split(tf.LocalPath)
 				if dir != "" {
-					// TODO: record directory entries for their modes.
+					// Directories listed as entries get their recorded mode on Close.
 					// Make sure directories are at least rwx by owner:
 					err := os.MkdirAll(dir, tf.Mode|0700)
 					if err != nil {
@@ -172,16 +500,25 @@ func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 					}
 				}
 
-				f, err := os.OpenFile(tf.Path, os.O_WRONLY|os.O_CREATE, tf.Mode|0700)
+				// Sparse extents of a file that already exists have to be read to be cleared:
+				flags, existed := os.O_WRONLY|os.O_CREATE, false
+				if len(tf.Sparse) > 0 {
+					flags = os.O_RDWR | os.O_CREATE
+					if stat, err := os.Lstat(tf.LocalPath); err == nil && stat.Size() > 0 {
+						existed = true
+					}
+				}
+
+				f, err := os.OpenFile(tf.LocalPath, flags, tf.Mode|0700)
 				if err != nil {
 					if !t.options.CompatMode && os.IsPermission(err) {
 						// chmod existing file to be able to write:
-						err = os.Chmod(tf.Path, tf.Mode|0700)
+						err = os.Chmod(tf.LocalPath, tf.Mode|0700)
 						if err != nil {
 							return 0, err
 						}
 						// Try to reopen for writing:
-						f, err = os.OpenFile(tf.Path, os.O_WRONLY|os.O_CREATE, tf.Mode|0700)
+						f, err = os.OpenFile(tf.LocalPath, flags, tf.Mode|0700)
 					}
 					if err != nil {
 						return 0, err
@@ -193,6 +530,13 @@ func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 				if err != nil {
 					return 0, err
 				}
+				// New files are all holes until written:
+				if existed {
+					if err = clearSparse(f, tf.Sparse); err != nil {
+						f.Close()
+						return 0, err
+					}
+				}
 
 				t.openFile = f
 				t.openFileInfo = tf
@@ -208,7 +552,11 @@ func (t *VirtualTarballWriter) WriteAt(buf []byte, offset int64) (int, error) {
 			}
 			if len(p) > 0 {
 				// NOTE: we allow len(p) == 0 to create file as a side effect in case that's useful.
-				n, err := t.openFile.WriteAt(p, localOffset)
+				w, base := io.WriterAt(t.openFile), int64(0)
+				if t.archive != nil {
+					w, base = t.archive, tf.archiveOffset
+				}
+				n, err := writeAroundSparse(w, p, base, localOffset, tf.Sparse)
 				if err != nil {
 					return 0, err
 				}
@@ -1,8 +1,16 @@
-package main
+package lancaster
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func newTarballWriter(t *testing.T, files []*TarballFile) *VirtualTarballWriter {
@@ -31,7 +39,7 @@ func verifyFile(t *testing.T, f *TarballFile, tb *VirtualTarballWriter) {
 	if err != nil {
 		t.Fatalf("%s", err)
 	}
-	if stat.Size() != f.Size {
+	if !f.Mode.IsDir() && stat.Size() != f.Size {
 		t.Fatalf("%s: size mistmatch; %d != %d", f.Path, stat.Size(), f.Size)
 	}
 	if !tb.options.CompatMode {
@@ -188,3 +196,654 @@ func TestWriteAt_ZeroFileMultiple2(t *testing.T) {
 		t.Fatalf("n != %d; n = %v", expectedLen, n)
 	}
 }
+
+func TestDevice_MultipleFiles(t *testing.T) {
+	files := []*TarballFile{
+		&TarballFile{
+			Path: "hello.txt",
+			Size: 7,
+			Mode: 0644,
+		},
+		&TarballFile{
+			Path: "world.txt",
+			Size: 7,
+			Mode: 0644,
+		},
+	}
+
+	options := getOptions()
+	options.DevicePath = os.DevNull
+	_, err := NewVirtualTarballWriter(files, options)
+	if err != ErrDeviceSingleFile {
+		t.Fatalf("Expected ErrDeviceSingleFile; got %v", err)
+	}
+}
+
+func TestDevice_NotDevice(t *testing.T) {
+	const fname = "notadevice.img"
+	if _, err := createTestFile(fname, []byte("hello, world!\n")); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fname)
+
+	files := []*TarballFile{
+		&TarballFile{
+			Path: "disk.img",
+			Size: 7,
+			Mode: 0644,
+		},
+	}
+
+	options := getOptions()
+	options.DevicePath = fname
+	_, err := NewVirtualTarballWriter(files, options)
+	if err != ErrNotDevice {
+		t.Fatalf("Expected ErrNotDevice; got %v", err)
+	}
+}
+
+func TestWriteAt_ShortTailRegion(t *testing.T) {
+	const regionSize = 64
+	const srcName = "tail_src.bin"
+	const dstName = "tail.bin"
+
+	// Payload size deliberately not a multiple of the region size:
+	payload := make([]byte, 3*regionSize+17)
+	for i := range payload {
+		payload[i] = byte(i*7 + 1)
+	}
+	src, err := createTestFile(srcName, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(srcName)
+
+	rd := newTarballReader(t, []*TarballFile{
+		&TarballFile{
+			Path:      dstName,
+			LocalPath: srcName,
+			Size:      src.Size(),
+			Mode:      src.Mode(),
+		},
+	})
+	defer rd.Close()
+
+	files := []*TarballFile{
+		&TarballFile{
+			Path: dstName,
+			Size: src.Size(),
+			Mode: src.Mode(),
+		},
+	}
+	tb := newTarballWriter(t, files)
+
+	naks := NewNakRegions(tb.size)
+	for offset := int64(0); offset < rd.size; {
+		buf := make([]byte, regionSize)
+		n, err := rd.ReadAt(buf, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only the final region is short, and by exactly the remainder:
+		if offset+regionSize < rd.size && n != regionSize {
+			t.Fatalf("short read %d at offset %d", n, offset)
+		}
+		if offset+regionSize >= rd.size && int64(n) != rd.size-offset {
+			t.Fatalf("tail read %d at offset %d; expected %d", n, offset, rd.size-offset)
+		}
+
+		m, err := tb.WriteAt(buf[:n], offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != n {
+			t.Fatalf("wrote %d of %d", m, n)
+		}
+
+		if naks.IsAllAcked() {
+			t.Fatalf("all acked before tail at offset %d", offset)
+		}
+		naks.Ack(offset, offset+int64(n))
+		offset += int64(n)
+	}
+	if !naks.IsAllAcked() {
+		t.Fatalf("expected all acked; naks = %v", naks.Naks())
+	}
+
+	closeTarballWriterKeep(t, tb)
+	defer os.Remove(dstName)
+
+	written, err := ioutil.ReadFile(dstName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, payload) {
+		t.Fatalf("downloaded file differs; len %d vs %d", len(written), len(payload))
+	}
+}
+
+func closeTarballWriterKeep(t *testing.T, tb *VirtualTarballWriter) {
+	err := tb.Close()
+	if err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	for _, f := range tb.files {
+		verifyFile(t, f, tb)
+	}
+}
+
+func TestWriteAt_DirectoryModes(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("directory modes are not applied in compat mode")
+	}
+
+	dir, err := ioutil.TempDir("", "lancaster-dirmodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// Files come before their directory entries so each directory is first created implicitly:
+	files := []*TarballFile{
+		&TarballFile{Path: "top/mid/leaf.txt", Size: 3, Mode: 0644},
+		&TarballFile{Path: "top/other/empty.txt", Size: 0, Mode: 0600},
+		&TarballFile{Path: "top/mid", Mode: os.ModeDir | 0750},
+		&TarballFile{Path: "top/other", Mode: os.ModeDir | 0500},
+		&TarballFile{Path: "top/empty", Mode: os.ModeDir | 0711},
+		&TarballFile{Path: "top", Mode: os.ModeDir | 0705},
+	}
+	tb := newTarballWriter(t, files)
+
+	n, err := tb.WriteAt([]byte("hi\n\x00\x00\x00\x00\x00\x00"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 9 {
+		t.Fatalf("expected 9 bytes written got %d", n)
+	}
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Let cleanup remove read-only directories:
+	defer filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+
+	for _, f := range files {
+		verifyFile(t, f, tb)
+	}
+}
+
+func TestIsContainedSymlink(t *testing.T) {
+	cases := []struct {
+		path     string
+		dest     string
+		expected bool
+	}{
+		{"link", "target", true},
+		{"a/b/link", "../c", true},
+		{"a/link", "../target", true},
+		{"link", "../target", false},
+		{"a/link", "../../target", false},
+		{"a/link", "b/../../../target", false},
+		{"link", "/etc/passwd", false},
+		{"link", "", false},
+	}
+	for _, c := range cases {
+		if actual := isContainedSymlink(c.path, c.dest); actual != c.expected {
+			t.Fatalf("%s -> %s: expected %v got %v", c.path, c.dest, c.expected, actual)
+		}
+	}
+}
+
+func TestWriteAt_Symlink(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("symlinks are not supported in compat mode")
+	}
+
+	dir, err := ioutil.TempDir("", "lancaster-symlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	files := []*TarballFile{
+		&TarballFile{Path: "link", Mode: os.ModeSymlink | 0777, SymlinkDestination: "sub/target"},
+		&TarballFile{Path: "sub/up", Mode: os.ModeSymlink | 0777, SymlinkDestination: "../link"},
+	}
+	tb := newTarballWriter(t, files)
+	if _, err = tb.WriteAt([]byte{0, 0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Writing again leaves existing links alone:
+	if _, err = tb.WriteAt([]byte{0, 0}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		dest, err := os.Readlink(f.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dest != f.SymlinkDestination {
+			t.Fatalf("%s: expected destination %s got %s", f.Path, f.SymlinkDestination, dest)
+		}
+	}
+}
+
+func TestWriter_RejectsEscapingSymlink(t *testing.T) {
+	for _, dest := range []string{"/etc/passwd", "../outside", "a/../../outside"} {
+		files := []*TarballFile{
+			&TarballFile{Path: "link", Mode: os.ModeSymlink | 0777, SymlinkDestination: dest},
+		}
+		if _, err := NewVirtualTarballWriter(files, getOptions()); err != ErrBadSymlink {
+			t.Fatalf("%s: expected %v got %v", dest, ErrBadSymlink, err)
+		}
+	}
+}
+
+func TestWriteAt_OutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []*TarballFile{
+		&TarballFile{Path: "a/b/c/nested.txt", Size: 3, Mode: 0644},
+		&TarballFile{Path: "top.txt", Size: 2, Mode: 0644},
+	}
+	options := getOptions()
+	options.OutputDir = filepath.Join(dir, "out")
+	tb, err := NewVirtualTarballWriter(files, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tb.WriteAt([]byte("hi\n\x00ok\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tb.markComplete()
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{"a/b/c/nested.txt": "hi\n", "top.txt": "ok"} {
+		b, err := ioutil.ReadFile(filepath.Join(options.OutputDir, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != expected {
+			t.Fatalf("%s: expected %q got %q", path, expected, b)
+		}
+	}
+}
+
+func TestWriter_RejectsEscapingOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options := getOptions()
+	options.OutputDir = filepath.Join(dir, "out")
+	files := []*TarballFile{
+		&TarballFile{Path: "ok.txt", Size: 1, Mode: 0644},
+		&TarballFile{Path: "../../etc/passwd", Size: 1, Mode: 0644},
+	}
+	if _, err = NewVirtualTarballWriter(files, options); !errors.Is(err, ErrBadPath) {
+		t.Fatalf("expected %v got %v", ErrBadPath, err)
+	}
+	if _, err = os.Stat(options.OutputDir); !os.IsNotExist(err) {
+		t.Fatal("expected nothing created for a rejected transfer")
+	}
+}
+
+func TestSanitizePath(t *testing.T) {
+	dangerous := []string{
+		"",
+		"/etc/passwd",
+		"\\etc\\passwd",
+		"C:/Windows/system.ini",
+		"c:evil",
+		"..",
+		"../x",
+		"../../etc/passwd",
+		"a/../../x",
+		"a\\..\\..\\x",
+		"a/./b",
+		"a//b",
+		"a/",
+		"./a",
+		"a/..",
+		"a\x00b",
+	}
+	for _, p := range dangerous {
+		if _, err := sanitizePath(p); !errors.Is(err, ErrBadPath) {
+			t.Fatalf("%q: expected %v got %v", p, ErrBadPath, err)
+		}
+	}
+
+	safe := map[string]string{
+		"a":           "a",
+		"a/b/c.txt":   "a/b/c.txt",
+		"a\\b\\c.txt": "a/b/c.txt",
+		"..hidden":    "..hidden",
+		"a/..b/c":     "a/..b/c",
+	}
+	for p, expected := range safe {
+		actual, err := sanitizePath(p)
+		if err != nil {
+			t.Fatalf("%q: %v", p, err)
+		}
+		if actual != expected {
+			t.Fatalf("%q: expected %q got %q", p, expected, actual)
+		}
+	}
+}
+
+func TestWriter_RejectsUnsafePaths(t *testing.T) {
+	for _, p := range []string{"/etc/passwd", "../outside", "a/../../outside"} {
+		files := []*TarballFile{&TarballFile{Path: p, Size: 1, Mode: 0644}}
+		_, err := NewVirtualTarballWriter(files, getOptions())
+		if !errors.Is(err, ErrBadPath) || !strings.Contains(err.Error(), p) {
+			t.Fatalf("%s: expected %v naming the path got %v", p, ErrBadPath, err)
+		}
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	cases := []struct {
+		dir      string
+		path     string
+		expected bool
+	}{
+		{".", "a", true},
+		{".", ".", true},
+		{"out", "out/a/b", true},
+		{"out", "out/../a", false},
+		{"out", "out2/a", false},
+		{".", "..", false},
+		{"/srv/out", "/srv/out/..x", true},
+		{"/srv/out", "/srv/outside", false},
+	}
+	for _, c := range cases {
+		if actual := isWithinDir(filepath.FromSlash(c.dir), filepath.FromSlash(c.path)); actual != c.expected {
+			t.Fatalf("%s in %s: expected %v got %v", c.path, c.dir, c.expected, actual)
+		}
+	}
+}
+
+func TestWriteAt_ModTime(t *testing.T) {
+	modTime := time.Date(2010, 6, 7, 8, 9, 10, 0, time.UTC)
+	for _, complete := range []bool{true, false} {
+		files := []*TarballFile{
+			&TarballFile{Path: "jim-mtime.txt", Size: 3, Mode: 0644, ModTime: modTime},
+		}
+		tb := newTarballWriter(t, files)
+		if _, err := tb.WriteAt([]byte("hi\n\x00"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if complete {
+			tb.markComplete()
+		}
+		if err := tb.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := os.Stat("jim-mtime.txt")
+		os.Remove("jim-mtime.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Partial downloads must not look up to date:
+		if stat.ModTime().Equal(modTime) != complete {
+			t.Fatalf("complete=%v: unexpected modification time %v", complete, stat.ModTime())
+		}
+	}
+}
+
+func TestClose_HashMismatch(t *testing.T) {
+	good := sha256.Sum256([]byte("hi\n"))
+	files := []*TarballFile{
+		&TarballFile{Path: "jim-hash-ok.txt", Size: 3, Mode: 0644, Hash: good[:]},
+		&TarballFile{Path: "jim-hash-bad.txt", Size: 3, Mode: 0644, Hash: good[:]},
+	}
+	defer os.Remove("jim-hash-ok.txt")
+	defer os.Remove("jim-hash-bad.txt")
+
+	tb := newTarballWriter(t, files)
+	// Second file has one corrupted byte:
+	if _, err := tb.WriteAt([]byte("hi\n\x00hI\n\x00"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tb.markComplete()
+
+	err := tb.Close()
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected %v got %v", ErrHashMismatch, err)
+	}
+	if !strings.Contains(err.Error(), "jim-hash-bad.txt") || strings.Contains(err.Error(), "jim-hash-ok.txt") {
+		t.Fatalf("expected only the corrupted file reported got %v", err)
+	}
+}
+
+func TestClose_Owners(t *testing.T) {
+	if getOptions().CompatMode {
+		t.Skip("ownership is not restored in compat mode")
+	}
+
+	for _, noOwner := range []bool{false, true} {
+		files := []*TarballFile{
+			&TarballFile{Path: "jim-owner.txt", Size: 3, Mode: 0644, Uid: 4242, Gid: 4343, HasOwner: true},
+		}
+		options := getOptions()
+		options.NoOwner = noOwner
+		tb, err := NewVirtualTarballWriter(files, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tb.WriteAt([]byte("hi\n\x00"), 0); err != nil {
+			t.Fatal(err)
+		}
+		tb.markComplete()
+		if err = tb.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := os.Lstat("jim-owner.txt")
+		os.Remove("jim-owner.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		uid, gid, ok := fileOwner(stat)
+		if !ok {
+			t.Skip("file ownership unavailable on this platform")
+		}
+		restored := uid == 4242 && gid == 4343
+		switch {
+		case noOwner:
+			if restored || tb.OwnersSkipped() {
+				t.Fatalf("expected ownership left alone with NoOwner; got %d:%d", uid, gid)
+			}
+		case tb.OwnersSkipped():
+			if restored {
+				t.Fatal("expected ownership unchanged when skipped")
+			}
+		case !restored:
+			t.Fatalf("expected owner 4242:4343 got %d:%d", uid, gid)
+		}
+		if !noOwner && os.Geteuid() != 0 && !tb.OwnersSkipped() {
+			t.Fatal("expected unprivileged downloads to report skipped ownership")
+		}
+	}
+}
+
+func TestWriteAt_Beyond4GiB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if runtime.GOOS == "windows" {
+		t.Skip("files are not created sparse")
+	}
+
+	options := getOptions()
+	options.OutputDir = dir
+	// Only a few bytes are written; the rest stays holes:
+	options.SkipSpaceCheck = true
+	tb, err := NewVirtualTarballWriter([]*TarballFile{
+		{Path: "a", Size: largeFileA, Mode: 0644},
+		{Path: "b", Size: largeFileB, Mode: 0644},
+		{Path: "c", Size: 5, Mode: 0644},
+	}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes spanning files on either side of 4GiB:
+	for offset, s := range map[int64]string{
+		largeFileA - 5:   "A-END\x00B-START",
+		4<<30 - 3:        "4GiB!!",
+		largeOffsetC - 6: "B-END\x00hello\x00",
+	} {
+		if n, err := tb.WriteAt([]byte(s), offset); err != nil || n != len(s) {
+			t.Fatalf("at %d: wrote %d of %d: %v", offset, n, len(s), err)
+		}
+	}
+	if err = tb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path     string
+		offset   int64
+		expected string
+	}{
+		{"a", largeFileA - 5, "A-END"},
+		{"b", 0, "B-START"},
+		{"b", 4<<30 - largeOffsetB - 3, "4GiB!!"},
+		{"b", largeFileB - 5, "B-END"},
+		{"c", 0, "hello"},
+	} {
+		f, err := os.Open(filepath.Join(dir, c.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(c.expected))
+		_, err = f.ReadAt(buf, c.offset)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != c.expected {
+			t.Fatalf("%s at %d: expected %q got %q", c.path, c.offset, c.expected, buf)
+		}
+	}
+}
+
+// Makes the target filesystem report `free` bytes available until the returned function is called:
+func mockDiskFree(free uint64, ok bool) func() {
+	saved := diskFree
+	diskFree = func(path string) (uint64, bool, error) {
+		return free, ok, nil
+	}
+	return func() { diskFree = saved }
+}
+
+func TestWriter_ChecksFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Left by an earlier run:
+	if err = ioutil.WriteFile(filepath.Join(dir, "partial"), make([]byte, 30<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	newFiles := func() []*TarballFile {
+		return []*TarballFile{
+			{Path: "big", Size: 100 << 20, Mode: 0644},
+			// Mostly holes:
+			{Path: "sparse", Size: 100 << 20, Mode: 0644, Sparse: []Region{{0, 90 << 20}}},
+			{Path: "partial", Size: 40 << 20, Mode: 0644},
+			{Path: "linked", Mode: 0644, LinkTarget: "big"},
+		}
+	}
+	// 100MiB, 10MiB of sparse and 10MiB more of partial with 1% and 16MiB on top:
+	const needed = 120<<20 + (120<<20)/100 + freeSpaceMargin
+
+	cases := []struct {
+		free     uint64
+		ok       bool
+		skip     bool
+		tarPath  string
+		expected error
+	}{
+		{needed, true, false, "", nil},
+		{needed - 1, true, false, "", ErrInsufficientSpace},
+		{needed - 1, true, true, "", nil},
+		// Can't tell so don't stand in the way:
+		{0, false, false, "", nil},
+		// Archives hold every byte whatever is already in the directory:
+		{needed, true, false, filepath.Join(dir, "out.tar"), ErrInsufficientSpace},
+	}
+	for i, c := range cases {
+		restore := mockDiskFree(c.free, c.ok)
+		options := getOptions()
+		options.OutputDir = dir
+		options.SkipSpaceCheck = c.skip
+		options.TarPath = c.tarPath
+		tb, err := NewVirtualTarballWriter(newFiles(), options)
+		restore()
+		if !errors.Is(err, c.expected) {
+			t.Fatalf("%d: expected %v got %v", i, c.expected, err)
+		}
+		if tb != nil {
+			tb.Close()
+		}
+	}
+}
+
+func TestExistingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lancaster-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for in, expected := range map[string]string{
+		dir:                                     dir,
+		filepath.Join(dir, "not", "yet"):        dir,
+		"":                                      ".",
+		filepath.Join("not", "there", "at all"): ".",
+	} {
+		if actual := existingDir(in); actual != expected {
+			t.Fatalf("%q: expected %q got %q", in, expected, actual)
+		}
+	}
+}
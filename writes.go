@@ -0,0 +1,124 @@
+// writes.go
+package lancaster
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Download failing because received data couldn't be written:
+var ErrWriteFailed = errors.New("writing received data failed")
+
+// Queued data regions per writer goroutine when no queue depth is configured:
+const defaultWriteQueuePerWorker = 64
+
+type writeRequest struct {
+	w      io.WriterAt
+	region int64
+	data   []byte
+	// Called once data has been written, or dropped; may be nil:
+	release func()
+}
+
+// Writes received regions from a pool of goroutines so a slow disk doesn't hold up receiving. The
+// queue is bounded so receiving still slows down rather than buffering without limit once the disk
+// falls far enough behind. Regions are only ACKed in `durable` once written; that is what progress
+// is saved from so a resumed download never trusts bytes that didn't reach the disk.
+type writePool struct {
+	requests chan writeRequest
+	wg       sync.WaitGroup
+	stopped  sync.Once
+
+	lock    sync.Mutex
+	durable *NakRegions
+	err     error
+}
+
+func newWritePool(workers int, depth int, durable *NakRegions) *writePool {
+	if workers < 1 {
+		workers = 1
+	}
+	if depth < 1 {
+		depth = workers * defaultWriteQueuePerWorker
+	}
+
+	p := &writePool{
+		requests: make(chan writeRequest, depth),
+		durable:  durable,
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *writePool) worker() {
+	defer p.wg.Done()
+
+	for req := range p.requests {
+		if p.failed() != nil {
+			// Drain without writing; the download is being abandoned:
+			req.done()
+			continue
+		}
+
+		n, err := req.w.WriteAt(req.data, req.region)
+		if err == nil && n < len(req.data) {
+			err = io.ErrShortWrite
+		}
+		req.done()
+
+		p.lock.Lock()
+		if err != nil {
+			if p.err == nil {
+				p.err = err
+			}
+		} else {
+			err = p.durable.Ack(req.region, req.region+int64(len(req.data)))
+			if err != nil && p.err == nil {
+				p.err = err
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (req writeRequest) done() {
+	if req.release != nil {
+		req.release()
+	}
+}
+
+func (p *writePool) failed() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// Queues a region to be written at its offset, blocking while the queue is full. Writes complete in
+// any order. Returns the first error any earlier write ran into.
+func (p *writePool) write(w io.WriterAt, region int64, data []byte, release func()) error {
+	if err := p.failed(); err != nil {
+		return err
+	}
+	p.requests <- writeRequest{w: w, region: region, data: data, release: release}
+	return nil
+}
+
+// Waits for every queued write to finish and stops the pool; safe to call more than once:
+func (p *writePool) wait() error {
+	p.stopped.Do(func() {
+		close(p.requests)
+	})
+	p.wg.Wait()
+	return p.failed()
+}
+
+// Copy of what has been written so far, for saving progress while writes are still going on:
+func (p *writePool) progress() *NakRegions {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.durable.clone()
+}
@@ -0,0 +1,93 @@
+package lancaster
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// In-memory io.WriterAt safe for concurrent use:
+type memWriterAt struct {
+	lock sync.Mutex
+	buf  []byte
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return copy(m.buf[off:], p), nil
+}
+
+type failingWriterAt struct{}
+
+func (failingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestWritePool_OutOfOrder(t *testing.T) {
+	const regionSize = 100
+	const regions = 500
+	expected := make([]byte, regionSize*regions)
+	rand.New(rand.NewSource(1)).Read(expected)
+
+	w := &memWriterAt{buf: make([]byte, len(expected))}
+	p := newWritePool(4, 8, NewNakRegions(int64(len(expected))))
+	for _, i := range rand.New(rand.NewSource(2)).Perm(regions) {
+		region := int64(i * regionSize)
+		if err := p.write(w, region, expected[region:region+regionSize], nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.buf, expected) {
+		t.Fatal("unexpected contents")
+	}
+	if !p.progress().IsAllAcked() {
+		t.Fatalf("expected everything written got naks %v", p.progress().Naks())
+	}
+
+	// Waiting again is harmless:
+	if err := p.wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWritePool_FailedWriteNotAcked(t *testing.T) {
+	w := &memWriterAt{buf: make([]byte, 20)}
+	p := newWritePool(1, 1, NewNakRegions(20))
+	if err := p.write(w, 0, make([]byte, 10), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.write(failingWriterAt{}, 10, make([]byte, 10), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.wait(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected %v got %v", io.ErrUnexpectedEOF, err)
+	}
+	cmp(t, p.progress().Naks(), []Region{{10, 20}})
+}
+
+func TestWritePool_ReleasesAfterWriting(t *testing.T) {
+	w := &memWriterAt{buf: make([]byte, 30)}
+	p := newWritePool(2, 4, NewNakRegions(30))
+	released := int32(0)
+	release := func() { atomic.AddInt32(&released, 1) }
+	if err := p.write(w, 0, make([]byte, 10), release); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.write(failingWriterAt{}, 10, make([]byte, 10), release); err != nil {
+		t.Fatal(err)
+	}
+	// Dropped once a write has failed but still released:
+	p.write(w, 20, make([]byte, 10), release)
+	p.wait()
+	if released != 3 {
+		t.Fatalf("expected every buffer released got %d", released)
+	}
+}